@@ -1,12 +1,14 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/dagger/container-use/mcpserver"
+	"github.com/dagger/container-use/rules"
 	"github.com/spf13/cobra"
 )
 
@@ -86,6 +88,32 @@ func selectAgent(agentKey string) (ConfigurableAgent, error) {
 	return nil, fmt.Errorf("unknown agent: %s", agentKey)
 }
 
+// SaveRules writes the container-use rules for the given agent in the current directory.
+// Without an agent, the rules are written to AGENT.md.
+func SaveRules(agentKey string) error {
+	if agentKey == "" {
+		return saveRulesFile("AGENT.md", rules.AgentRules)
+	}
+	agent, err := selectAgent(agentKey)
+	if err != nil {
+		return err
+	}
+	return agent.editRules()
+}
+
+// MCPServerSnippet returns the mcpServers JSON that registers the container-use MCP server.
+func MCPServerSnippet() ([]byte, error) {
+	config := MCPServersConfig{
+		MCPServers: map[string]MCPServer{
+			"container-use": {
+				Command: ContainerUseBinary,
+				Args:    []string{"stdio"},
+			},
+		},
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
 func configureAgent(agent ConfigurableAgent) error {
 	fmt.Printf("Configuring %s...\n", agent.name())
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -9,7 +10,9 @@ import (
 )
 
 var (
-	applyDelete bool
+	applyDelete       bool
+	applyDryRun       bool
+	applyTargetBranch string
 )
 
 var applyCmd = &cobra.Command{
@@ -21,6 +24,11 @@ for you to commit manually, discarding the original commit sequence. This lets y
 review and customize the final commit before making the agent's work permanent.
 Your working directory will be automatically stashed and restored.
 
+Use --target-branch (or --into) to apply the changes to another branch without switching
+to it. Since they can't be left staged on a branch that isn't checked out, they are committed
+there as a single commit. If the branch is checked out in another worktree, they are staged
+there instead.
+
 If no environment is specified, automatically selects from environments 
 that are descendants of the current HEAD.`,
 	Args:              cobra.MaximumNArgs(1),
@@ -28,6 +36,12 @@ that are descendants of the current HEAD.`,
 	Example: `# Apply agent's work as staged changes to current branch
 cu apply backend-api
 
+# Preview the changes that would be applied, without applying them
+cu apply --dry-run backend-api
+
+# Apply to another branch as a single commit, without switching to it
+cu apply --target-branch release backend-api
+
 # Apply and delete the environment after successful application
 cu apply -d backend-api
 cu apply --delete backend-api
@@ -52,7 +66,15 @@ cu apply`,
 			return err
 		}
 
-		if err := repo.Apply(ctx, envID, os.Stdout); err != nil {
+		opts := repository.MergeOptions{TargetBranch: applyTargetBranch}
+		if applyDryRun {
+			return previewMerge(ctx, repo, envID, opts)
+		}
+
+		if err := repo.Apply(ctx, envID, os.Stdout, opts); err != nil {
+			if errors.Is(err, repository.ErrMergeConflict) && opts.TargetBranch == "" {
+				return fmt.Errorf("%w\nResolve the conflicts and commit the result, or run `git reset --merge` to cancel", err)
+			}
 			return fmt.Errorf("failed to apply environment: %w", err)
 		}
 
@@ -62,6 +84,9 @@ cu apply`,
 
 func init() {
 	applyCmd.Flags().BoolVarP(&applyDelete, "delete", "d", false, "Delete the environment after successful application")
+	applyCmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "Show the changes that would be applied without applying them")
+	applyCmd.Flags().StringVar(&applyTargetBranch, "target-branch", "", "Apply to this branch instead of the current one, without switching to it (the changes are committed as a single commit)")
+	applyCmd.Flags().StringVar(&applyTargetBranch, "into", "", "Same as --target-branch")
 
 	rootCmd.AddCommand(applyCmd)
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var attachCmd = &cobra.Command{
+	Use:   "attach <env> <file>...",
+	Short: "Attach files to an environment without committing them",
+	Long: `Attach files such as design docs or screenshots to an environment to give agents more context.
+Attachments are stored alongside the environment rather than in its worktree, so they are never committed.
+Attaching a file with the same name as an existing attachment replaces it.`,
+	Args: cobra.MinimumNArgs(2),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return suggestEnvironments(cmd, args, toComplete)
+		}
+		// Complete the files to attach
+		return nil, cobra.ShellCompDirectiveDefault
+	},
+	Example: `# Attach a design doc to an environment
+container-use attach fancy-mallard ./docs/design.md
+
+# Attach several files at once
+container-use attach fancy-mallard mockup.png notes.txt`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID := args[0]
+		for _, file := range args[1:] {
+			name, err := repo.Attach(ctx, envID, file)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Attached '%s' to environment '%s'\n", name, envID)
+		}
+		return nil
+	},
+}
+
+var attachmentsCmd = &cobra.Command{
+	Use:               "attachments [<env>]",
+	Short:             "List the files attached to an environment",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		attachments, err := repo.Attachments(ctx, envID)
+		if err != nil {
+			return err
+		}
+		if len(attachments) == 0 {
+			fmt.Printf("No attachments for environment '%s'\n", envID)
+			return nil
+		}
+		for _, name := range attachments {
+			fmt.Println(name)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(attachCmd)
+	rootCmd.AddCommand(attachmentsCmd)
+}
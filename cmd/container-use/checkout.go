@@ -25,7 +25,16 @@ container-use checkout fancy-mallard
 container-use checkout fancy-mallard -b my-review-branch
 
 # Auto-select environment
-container-use checkout`,
+container-use checkout
+
+# Print the path of the environment's worktree, without switching branches
+code "$(container-use checkout fancy-mallard --print-path)"
+
+# Review the environment in a new worktree next to your repository, without switching branches
+container-use checkout fancy-mallard --worktree ../fancy-mallard-review
+
+# Remove that worktree once done
+container-use checkout --remove-worktree ../fancy-mallard-review`,
 	RunE: func(app *cobra.Command, args []string) error {
 		ctx := app.Context()
 
@@ -35,6 +44,17 @@ container-use checkout`,
 			return err
 		}
 
+		if removeWorktree, _ := app.Flags().GetString("remove-worktree"); removeWorktree != "" {
+			if len(args) > 0 || app.Flags().Changed("worktree") {
+				return fmt.Errorf("--remove-worktree doesn't take an environment, it can't be used with --worktree")
+			}
+			if err := repo.RemoveCheckoutWorktree(ctx, removeWorktree); err != nil {
+				return err
+			}
+			fmt.Printf("Removed worktree '%s'\n", removeWorktree)
+			return nil
+		}
+
 		envID, err := resolveEnvironmentID(ctx, repo, args)
 		if err != nil {
 			return err
@@ -45,6 +65,35 @@ container-use checkout`,
 			return err
 		}
 
+		worktreeDir, err := app.Flags().GetString("worktree")
+		if err != nil {
+			return err
+		}
+
+		if printPath, _ := app.Flags().GetBool("print-path"); printPath {
+			if worktreeDir != "" {
+				return fmt.Errorf("--print-path doesn't check out the environment, it can't be used with --worktree")
+			}
+			if branchName != "" {
+				return fmt.Errorf("--print-path doesn't switch branches, it can't be used with --branch")
+			}
+			worktree, err := repo.EnsureWorktree(ctx, envID)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(app.OutOrStdout(), worktree)
+			return nil
+		}
+
+		if worktreeDir != "" {
+			dir, err := repo.CheckoutWorktree(ctx, envID, worktreeDir, branchName)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Checked out environment '%s' in worktree '%s'\n", envID, dir)
+			return nil
+		}
+
 		branch, err := repo.Checkout(ctx, envID, branchName)
 		if err != nil {
 			return err
@@ -57,5 +106,8 @@ container-use checkout`,
 
 func init() {
 	checkoutCmd.Flags().StringP("branch", "b", "", "Local branch name to use")
+	checkoutCmd.Flags().Bool("print-path", false, "Print the path of the environment's worktree instead of switching to its branch, e.g. to open it in an editor")
+	checkoutCmd.Flags().String("worktree", "", "Check the environment out in a new worktree at this path instead of switching branches")
+	checkoutCmd.Flags().String("remove-worktree", "", "Remove a worktree created with --worktree")
 	rootCmd.AddCommand(checkoutCmd)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var commentCmd = &cobra.Command{
+	Use:   "comment <env> <text>",
+	Short: "Add a comment to an environment",
+	Long: `Append a comment to the thread of an environment, to record decisions or TODOs
+for the other people and agents working on it. Comments are signed with your git
+user name, unless --author is set, and listed with "container-use comments".`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Leave a note for whoever picks up the environment next
+container-use comment fancy-mallard "Keep the v1 API until the mobile app migrates"`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		author, _ := app.Flags().GetString("author")
+		if author == "" {
+			name, err := repository.RunGitCommand(ctx, repo.SourcePath(), "config", "user.name")
+			if err != nil {
+				return fmt.Errorf("unable to get your git user name, set --author: %w", err)
+			}
+			author = strings.TrimSpace(name)
+		}
+
+		if err := repo.AddComment(ctx, args[0], author, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Comment added to environment '%s'\n", args[0])
+		return nil
+	},
+}
+
+var commentsCmd = &cobra.Command{
+	Use:               "comments <env>",
+	Short:             "List the comments of an environment",
+	Long:              `Display the comments left on an environment by users and agents, from the oldest to the most recent.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Catch up on the decisions made in an environment
+container-use comments fancy-mallard`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.OpenReadOnly(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		comments, err := repo.Comments(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if len(comments) == 0 {
+			fmt.Printf("No comments on environment '%s'\n", args[0])
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer tw.Flush()
+		for _, comment := range comments {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", humanize.Time(comment.Timestamp), comment.Author, comment.Text)
+		}
+		return nil
+	},
+}
+
+func init() {
+	commentCmd.Flags().String("author", "", "Name the comment is signed with (default: your git user name)")
+	rootCmd.AddCommand(commentCmd)
+	rootCmd.AddCommand(commentsCmd)
+}
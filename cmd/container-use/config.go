@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/charmbracelet/huh"
 	"github.com/dagger/container-use/cmd/container-use/agent"
 	"github.com/dagger/container-use/environment"
 	"github.com/dagger/container-use/repository"
@@ -14,14 +25,14 @@ import (
 
 // Helper function for read-only config operations
 func withConfig(cmd *cobra.Command, fn func(*environment.EnvironmentConfig) error) error {
-	ctx := cmd.Context()
-	repo, err := repository.Open(ctx, ".")
+	// Reading the configuration doesn't need container-use to set up the repository
+	source, err := repository.SourceRoot(cmd.Context(), ".")
 	if err != nil {
 		return fmt.Errorf("failed to open repository: %w", err)
 	}
 
 	config := environment.DefaultConfig()
-	if err := config.Load(repo.SourcePath()); err != nil {
+	if err := config.Load(source); err != nil {
 		return fmt.Errorf("failed to load configuration: %w", err)
 	}
 
@@ -61,6 +72,7 @@ These settings are stored in .container-use/environment.json and apply to all ne
 
 func init() {
 	configShowCmd.Flags().Bool("json", false, "Dump the configuration in JSON")
+	configShowCmd.Flags().Bool("effective", false, "Compare the configuration of the environment to the repository configuration")
 }
 
 var configShowCmd = &cobra.Command{
@@ -68,180 +80,1311 @@ var configShowCmd = &cobra.Command{
 	Short: "Show environment configuration",
 	Long: `Display environment configuration including base image and setup commands.
 Without an environment argument, shows the default configuration used for new environments.
-With an environment argument, shows the configuration for that specific environment.`,
+With an environment argument, shows the configuration for that specific environment.
+With --effective, also shows how the configuration the environment actually runs with
+differs from the repository's .container-use/environment.json.`,
 	Example: `# Show the default environment configuration
 container-use config show
 
 # Show the configuration for a specific environment
 container-use config show my-env
+
+# Show what an environment runs with, compared to the repository configuration
+container-use config show --effective my-env
 `,
 	Args:              cobra.MaximumNArgs(1),
 	ValidArgsFunction: suggestEnvironments,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
+		effective, _ := cmd.Flags().GetBool("effective")
+		if effective && len(args) == 0 {
+			return errors.New("--effective requires an environment")
+		}
+
+		source, err := repository.SourceRoot(ctx, ".")
+		if err != nil {
+			return fmt.Errorf("failed to open repository: %w", err)
+		}
+		repoConfig := environment.DefaultConfig()
+		if err := repoConfig.Load(source); err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+
+		// If no environment is specified, use the default configuration
+		config := repoConfig
+		if len(args) > 0 {
+			repo, err := repository.OpenReadOnly(ctx, ".")
+			if err != nil {
+				return fmt.Errorf("failed to open repository: %w", err)
+			}
+			env, err := repo.Info(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			config = env.State.Config
+		}
+
+		var changes *environment.ConfigChanges
+		if effective {
+			changes = environment.DiffConfig(repoConfig, config)
+		}
+
+		if ok, _ := cmd.Flags().GetBool("json"); ok {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if effective {
+				return enc.Encode(map[string]any{"config": config, "repository_changes": changes})
+			}
+			return enc.Encode(config)
+		}
+
+		if effective {
+			fmt.Printf("Configuration environment %s runs with:\n\n", args[0])
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		printConfig(tw, source, config)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		if effective {
+			fmt.Printf("\nDifferences from the repository configuration (%s):\n", environment.ConfigPath(""))
+			if changes.Empty() {
+				fmt.Println("  (none)")
+				return nil
+			}
+			printConfigChanges(os.Stdout, changes)
+		}
+		return nil
+	},
+}
+
+// printConfig writes the settings of config, one per row. source is the root of the repository the
+// configuration belongs to, inherited configuration files are shown relative to it.
+func printConfig(tw *tabwriter.Writer, source string, config *environment.EnvironmentConfig) {
+	if inheritance := config.Inheritance(); len(inheritance) > 0 {
+		for i, file := range inheritance {
+			if rel, err := filepath.Rel(source, file); err == nil {
+				inheritance[i] = rel
+			}
+		}
+		fmt.Fprintf(tw, "Extends:\t%s\n", strings.Join(inheritance, " → "))
+	} else if config.Extends != "" {
+		fmt.Fprintf(tw, "Extends:\t%s\n", config.Extends)
+	}
+	if len(config.Override) > 0 {
+		fmt.Fprintf(tw, "Overrides:\t%s\n", strings.Join(config.Override, ", "))
+	}
+
+	fmt.Fprintf(tw, "Base Image:\t%s\n", config.BaseImage)
+	fmt.Fprintf(tw, "Workdir:\t%s\n", config.Workdir)
+
+	if len(config.SetupCommands) > 0 {
+		fmt.Fprintf(tw, "Setup Commands:\t\n")
+		for i, cmd := range config.SetupCommands {
+			fmt.Fprintf(tw, "  %d.\t%s\n", i+1, cmd)
+		}
+	} else {
+		fmt.Fprintf(tw, "Setup Commands:\t(none)\n")
+	}
+
+	if len(config.InstallCommands) > 0 {
+		fmt.Fprintf(tw, "Install Commands:\t\n")
+		for i, cmd := range config.InstallCommands {
+			fmt.Fprintf(tw, "  %d.\t%s\n", i+1, cmd)
+		}
+	} else {
+		fmt.Fprintf(tw, "Install Commands:\t(none)\n")
+	}
+
+	envKeys := config.Env.Keys()
+	if len(envKeys) > 0 {
+		fmt.Fprintf(tw, "Environment Variables:\t\n")
+		for i, key := range envKeys {
+			value := config.Env.Get(key)
+			fmt.Fprintf(tw, "  %d.\t%s=%s\n", i+1, key, value)
+		}
+	} else {
+		fmt.Fprintf(tw, "Environment Variables:\t(none)\n")
+	}
+
+	secretKeys := config.Secrets.Keys()
+	if len(secretKeys) > 0 {
+		fmt.Fprintf(tw, "Secrets:\t\n")
+		for i, key := range secretKeys {
+			value := config.Secrets.Get(key)
+			if slices.Contains(config.RefreshSecrets, key) {
+				value += " (refreshed for every command)"
+			}
+			fmt.Fprintf(tw, "  %d.\t%s=%s\n", i+1, key, value)
+		}
+	} else {
+		fmt.Fprintf(tw, "Secrets:\t(none)\n")
+	}
+
+	if len(config.Services) > 0 {
+		fmt.Fprintf(tw, "Services:\t\n")
+		for i, service := range config.Services {
+			fmt.Fprintf(tw, "  %d.\t%s\n", i+1, formatService(service))
+		}
+	}
+
+	if config.ServiceIdleTimeout != "" {
+		fmt.Fprintf(tw, "Service Idle Timeout:\t%s\n", config.ServiceIdleTimeout)
+	}
+
+	if config.VerifyCommand != "" {
+		fmt.Fprintf(tw, "Verify Command:\t%s\n", config.VerifyCommand)
+	}
+
+	if !config.CommandPolicy.Empty() {
+		fmt.Fprintf(tw, "Command Policy:\t\n")
+		for _, pattern := range config.CommandPolicy.Allow {
+			fmt.Fprintf(tw, "  allow\t%s\n", pattern)
+		}
+		for _, pattern := range config.CommandPolicy.Deny {
+			fmt.Fprintf(tw, "  deny\t%s\n", pattern)
+		}
+	}
+
+	if config.Privileged {
+		fmt.Fprintf(tw, "Privileged:\ton\n")
+	}
+
+	if len(config.Capabilities) > 0 {
+		fmt.Fprintf(tw, "Capabilities:\t%s\n", strings.Join(config.Capabilities, ", "))
+	}
+
+	if config.ReadOnly {
+		fmt.Fprintf(tw, "Read Only:\ton\n")
+	}
+
+	if len(config.Entrypoint) > 0 {
+		fmt.Fprintf(tw, "Entrypoint:\t%s\n", strings.Join(config.Entrypoint, " "))
+	}
+
+	if config.RunAsUser != "" {
+		fmt.Fprintf(tw, "Run As User:\t%s\n", config.RunAsUser)
+	}
+
+	if config.GitCheckout {
+		fmt.Fprintf(tw, "Git Checkout:\ton\n")
+	}
+
+	if config.CommitGranularity != "" {
+		fmt.Fprintf(tw, "Commit Granularity:\t%s\n", config.CommitGranularity)
+	}
+
+	if config.NotesPropagationWindow != "" {
+		fmt.Fprintf(tw, "Notes Propagation Window:\t%s\n", config.NotesPropagationWindow)
+	}
+
+	if config.ID != nil {
+		format := config.ID.Format
+		if format == "" {
+			format = environment.IDFormatPetname
+		}
+		if format == environment.IDFormatPetname && config.ID.Words != 0 {
+			format = fmt.Sprintf("%s (%d words)", format, config.ID.Words)
+		}
+		fmt.Fprintf(tw, "ID Format:\t%s\n", format)
+		if config.ID.Prefix != "" {
+			fmt.Fprintf(tw, "ID Prefix:\t%s\n", config.ID.Prefix)
+		}
+	}
+
+	if len(config.BuildArgs) > 0 {
+		fmt.Fprintf(tw, "Build Args:\t\n")
+		for i, name := range slices.Sorted(maps.Keys(config.BuildArgs)) {
+			fmt.Fprintf(tw, "  %d.\t%s=%s\n", i+1, name, config.BuildArgs[name])
+		}
+	}
+}
+
+var configSuggestCmd = &cobra.Command{
+	Use:   "suggest",
+	Short: "Suggest a configuration for the project type",
+	Long: `Detect the kinds of projects in the repository, from files such as package.json,
+pyproject.toml, go.mod or Cargo.toml and their lockfiles, and print the base image and
+commands they need, with the commands applying them. Nothing is changed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		root, err := repository.SourceRoot(cmd.Context(), ".")
+		if err != nil {
+			return err
+		}
+		printSuggestions(cmd.OutOrStdout(), repository.DetectProjects(root))
+		return nil
+	},
+}
+
+// printSuggestions prints the setup of the detected projects, and the commands applying it.
+func printSuggestions(w io.Writer, projects []repository.Project) {
+	if len(projects) == 0 {
+		fmt.Fprintf(w, "No known project type detected, the default configuration (base image %s) applies.\n", environment.DefaultConfig().BaseImage)
+		return
+	}
+
+	for i, project := range projects {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Detected a %s project (%s):\n", project.Name, project.Marker)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "  Base Image:\t%s\n", project.BaseImage)
+		for _, command := range project.SetupCommands {
+			fmt.Fprintf(tw, "  Setup Command:\t%s\n", command)
+		}
+		for _, command := range project.InstallCommands {
+			fmt.Fprintf(tw, "  Install Command:\t%s\n", command)
+		}
+		tw.Flush()
+
+		fmt.Fprintln(w, "To apply it:")
+		fmt.Fprintf(w, "  container-use config base-image set %s\n", project.BaseImage)
+		for _, command := range project.SetupCommands {
+			fmt.Fprintf(w, "  container-use config setup-command add %q\n", command)
+		}
+		for _, command := range project.InstallCommands {
+			fmt.Fprintf(w, "  container-use config install-command add %q\n", command)
+		}
+	}
+	if len(projects) > 1 {
+		fmt.Fprintln(w, "\nEnvironments have a single base image: pick the main project, and add the tools of the others with setup commands.")
+	}
+}
+
+var configImportCmd = &cobra.Command{
+	Use:   "import <env>",
+	Short: "Import configuration from an environment",
+	Long: `Import configuration from an existing environment and set it as the default.
+This copies the environment's base image, setup commands, environment variables,
+and secrets to be used as defaults for new environments.`,
+	Example: `# Import configuration from an environment
+container-use config import my-env
+
+# View the configuration before importing
+container-use config show my-env
+container-use config import my-env`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return fmt.Errorf("failed to open repository: %w", err)
+		}
+
+		envID := args[0]
+		env, err := repo.Info(ctx, envID)
+		if err != nil {
+			return err
+		}
+		if err := env.State.Config.Save(repo.SourcePath()); err != nil {
+			return fmt.Errorf("failed to save configuration: %w", err)
+		}
+
+		fmt.Printf("Configuration imported from environment '%s'\n", envID)
+		return nil
+	},
+}
+
+var configAuditCmd = &cobra.Command{
+	Use:   "audit --baseline <file>",
+	Short: "List environments deviating from an approved configuration",
+	Long: `Compare the configuration of every environment of the repository to a baseline,
+and list the environments that deviate from it, e.g. with a different base image
+or extra setup commands. The baseline is a configuration file in the format of
+.container-use/environment.json. Only the settings it sets are audited.
+Exits with an error if any environment deviates.`,
+	Example: `# Check that every environment uses the approved base image and setup
+container-use config audit --baseline approved.json`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		baselineFile, _ := cmd.Flags().GetString("baseline")
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return fmt.Errorf("failed to open repository: %w", err)
+		}
+		baseline, err := environment.LoadBaseline(baselineFile)
+		if err != nil {
+			return fmt.Errorf("failed to load baseline: %w", err)
+		}
+
+		deviations, err := repo.Audit(ctx, baseline)
+		if err != nil {
+			return err
+		}
+		if len(deviations) == 0 {
+			fmt.Printf("All environments conform to %s\n", baselineFile)
+			return nil
+		}
+		for _, deviation := range deviations {
+			fmt.Printf("%s (%s)\n", deviation.ID, deviation.State.Title)
+			printConfigChanges(os.Stdout, deviation.Changes)
+		}
+		return fmt.Errorf("%d environments deviate from %s", len(deviations), baselineFile)
+	},
+}
+
+// printConfigChanges writes one line per value changed, or entry added or removed, by setting.
+func printConfigChanges(w io.Writer, changes *environment.ConfigChanges) {
+	printValue := func(name string, change *environment.ValueChange) {
+		if change != nil {
+			fmt.Fprintf(w, "  %s: %q → %q\n", name, change.From, change.To)
+		}
+	}
+	printList := func(name string, change *environment.ListChange) {
+		if change == nil {
+			return
+		}
+		for _, entry := range change.Added {
+			fmt.Fprintf(w, "  %s: + %s\n", name, entry)
+		}
+		for _, entry := range change.Removed {
+			fmt.Fprintf(w, "  %s: - %s\n", name, entry)
+		}
+	}
+
+	printValue("base_image", changes.BaseImage)
+	printValue("workdir", changes.Workdir)
+	printList("setup_commands", changes.SetupCommands)
+	printList("install_commands", changes.InstallCommands)
+	printList("pre_source_files", changes.PreSourceFiles)
+	printList("envs", changes.Env)
+	printList("secrets", changes.Secrets)
+	printList("build_args", changes.BuildArgs)
+	printList("services", changes.Services)
+	printList("cache_dirs", changes.CacheDirs)
+	printList("command_policy", changes.CommandPolicy)
+	printValue("privileged", changes.Privileged)
+	printList("capabilities", changes.Capabilities)
+	printValue("read_only", changes.ReadOnly)
+	printValue("run_as_user", changes.RunAsUser)
+	printValue("verify_command", changes.VerifyCommand)
+}
+
+var configResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Reset the whole configuration to defaults",
+	Long: `Reset .container-use/environment.json to the default configuration, discarding
+the base image, commands, environment variables, secrets and every other setting.
+Use --keep-secrets to preserve the configured secrets.`,
+	Example: `# Start over from the default configuration
+container-use config reset
+
+# Reset everything but secrets, without confirmation
+container-use config reset --keep-secrets --yes`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		yes, _ := cmd.Flags().GetBool("yes")
+		keepSecrets, _ := cmd.Flags().GetBool("keep-secrets")
+
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			defaultConfig := environment.DefaultConfig()
+			if keepSecrets {
+				defaultConfig.Secrets = config.Secrets
+			}
+
+			settings, err := changedSettings(config, defaultConfig)
+			if err != nil {
+				return err
+			}
+			if len(settings) == 0 {
+				fmt.Println("Configuration already matches the defaults")
+				return nil
+			}
+
+			if !yes {
+				confirmed := false
+				prompt := huh.NewConfirm().
+					Title("Reset the configuration to defaults?").
+					Description("The following settings will be reset: " + strings.Join(settings, ", ")).
+					Value(&confirmed)
+				if err := prompt.Run(); err != nil {
+					return err
+				}
+				if !confirmed {
+					return errors.New("reset cancelled")
+				}
+			}
+
+			*config = *defaultConfig
+			fmt.Println("Configuration reset to defaults:")
+			for _, setting := range settings {
+				fmt.Printf("  - %s\n", setting)
+			}
+			return nil
+		})
+	},
+}
+
+// changedSettings returns the names of the settings that differ between two configurations,
+// as they appear in environment.json.
+func changedSettings(a, b *environment.EnvironmentConfig) ([]string, error) {
+	toMap := func(config *environment.EnvironmentConfig) (map[string]json.RawMessage, error) {
+		data, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		settings := map[string]json.RawMessage{}
+		return settings, json.Unmarshal(data, &settings)
+	}
+	aSettings, err := toMap(a)
+	if err != nil {
+		return nil, err
+	}
+	bSettings, err := toMap(b)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	for name, value := range aSettings {
+		if !bytes.Equal(value, bSettings[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range bSettings {
+		if _, ok := aSettings[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return changed, nil
+}
+
+// Base image object commands
+var configBaseImageCmd = &cobra.Command{
+	Use:   "base-image",
+	Short: "Manage base container image",
+	Long:  `Manage the base container image for new environments.`,
+}
+
+var configBaseImageSetCmd = &cobra.Command{
+	Use:   "set <image>",
+	Short: "Set the base container image",
+	Long:  `Set the base container image for new environments (e.g., python:3.11, node:18, ubuntu:22.04).`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		baseImage := args[0]
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.BaseImage = baseImage
+			fmt.Printf("Base image set to: %s\n", baseImage)
+			return nil
+		})
+	},
+}
+
+var configBaseImageGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Get the current base container image",
+	Long:  `Display the current base container image.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			fmt.Println(config.BaseImage)
+			return nil
+		})
+	},
+}
+
+var configBaseImageResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Reset base image to default",
+	Long:  `Reset the base container image to the default (ubuntu:24.04).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			defaultConfig := environment.DefaultConfig()
+			config.BaseImage = defaultConfig.BaseImage
+			fmt.Printf("Base image reset to default: %s\n", defaultConfig.BaseImage)
+			return nil
+		})
+	},
+}
+
+var configBaseImageFromCheckpointCmd = &cobra.Command{
+	Use:   "from-checkpoint <env>",
+	Short: "Base new environments on the checkpoint of an environment",
+	Long: `Set the base image to the content-addressed image an environment was last checkpointed to,
+so new environments start with everything installed in it and only get the code mounted.
+Setup commands are cleared, as their results are part of the checkpoint.
+
+With --publish, the environment is checkpointed to the given destination first.
+Otherwise, it must have been checkpointed already, e.g. by the agent with environment_checkpoint.`,
+	Example: `# Base new environments on the last checkpoint of an environment
+container-use config base-image from-checkpoint fancy-mallard
+
+# Checkpoint the environment now, and base new environments on it
+container-use config base-image from-checkpoint fancy-mallard --publish registry.example.com/team/toolchain:latest`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		envID := args[0]
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return fmt.Errorf("failed to open repository: %w", err)
+		}
+
+		var checkpoint string
+		if destination, _ := cmd.Flags().GetString("publish"); destination != "" {
+			dag, err := connectDagger(ctx)
+			if err != nil {
+				return err
+			}
+			defer dag.Close()
+
+			env, err := repo.Get(ctx, dag, envID)
+			if err != nil {
+				return err
+			}
+			if checkpoint, err = env.Checkpoint(ctx, destination); err != nil {
+				return fmt.Errorf("failed to checkpoint environment: %w", err)
+			}
+			if err := repo.Update(ctx, env, "Checkpoint to "+destination); err != nil {
+				return fmt.Errorf("failed to save environment: %w", err)
+			}
+		} else {
+			envInfo, err := repo.Info(ctx, envID)
+			if err != nil {
+				return err
+			}
+			checkpoint = envInfo.State.Checkpoint
+			if checkpoint == "" {
+				return fmt.Errorf("environment %s was never checkpointed: checkpoint it with --publish <destination>", envID)
+			}
+		}
+
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.BaseImage = checkpoint
+			fmt.Printf("Base image set to: %s\n", checkpoint)
+			if len(config.SetupCommands) > 0 {
+				config.SetupCommands = nil
+				fmt.Println("Setup commands cleared, their results are part of the checkpoint")
+			}
+			return nil
+		})
+	},
+}
+
+var configBaseImageHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show how the base image changed over time",
+	Long: `List the commits of the current branch that changed the base image in
+.container-use/environment.json, most recent first, with the image before and after.
+Only committed changes are listed: commit the configuration to record them.`,
+	Example: `# See when the base image was changed, by whom and why
+container-use config base-image history`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return fmt.Errorf("failed to open repository: %w", err)
+		}
+		changes, err := repo.BaseImageHistory(ctx)
+		if err != nil {
+			return err
+		}
+
+		if ok, _ := cmd.Flags().GetBool("json"); ok {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(changes)
+		}
+		if len(changes) == 0 {
+			fmt.Println("The base image was never changed in a commit")
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer tw.Flush()
+		fmt.Fprintln(tw, "DATE\tCOMMIT\tAUTHOR\tBASE IMAGE\tSUBJECT")
+		for _, change := range changes {
+			baseImage := change.To
+			if change.From != "" {
+				baseImage = change.From + " → " + change.To
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", change.Timestamp.Format(time.DateOnly), change.Hash[:7], change.Author, baseImage, change.Subject)
+		}
+		return nil
+	},
+}
+
+// Entrypoint object commands
+var configEntrypointCmd = &cobra.Command{
+	Use:   "entrypoint",
+	Short: "Manage the container entrypoint",
+	Long: `Manage the entrypoint of new environments, overriding the one of the base image.
+Commands agents run with use_entrypoint are prefixed with it.`,
+}
+
+var configEntrypointSetCmd = &cobra.Command{
+	Use:   "set <command> [<arg>...]",
+	Short: "Set the container entrypoint",
+	Long:  `Set the entrypoint of new environments. Use -- before the entrypoint if it has arguments starting with a dash.`,
+	Example: `# Run commands through tini
+container-use config entrypoint set -- /usr/bin/tini --`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.Entrypoint = args
+			fmt.Printf("Entrypoint set to: %s\n", strings.Join(args, " "))
+			return nil
+		})
+	},
+}
+
+var configEntrypointGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Get the container entrypoint",
+	Long:  `Display the current entrypoint.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if len(config.Entrypoint) == 0 {
+				fmt.Println("No entrypoint configured, the base image's entrypoint is used")
+				return nil
+			}
+			fmt.Println(strings.Join(config.Entrypoint, " "))
+			return nil
+		})
+	},
+}
+
+var configEntrypointUnsetCmd = &cobra.Command{
+	Use:   "unset",
+	Short: "Remove the container entrypoint",
+	Long:  `Use the entrypoint of the base image again.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.Entrypoint = nil
+			fmt.Println("Entrypoint removed, the base image's entrypoint will be used")
+			return nil
+		})
+	},
+}
+
+// Verify command object commands
+var configVerifyCommandCmd = &cobra.Command{
+	Use:   "verify-command",
+	Short: "Manage the verify command",
+	Long: `Manage the optional command run after each change an agent makes to an environment (e.g., "go build ./...").
+Its result is reported to the agent so it immediately knows when it broke something.`,
+}
+
+var configVerifyCommandSetCmd = &cobra.Command{
+	Use:   "set <command>",
+	Short: "Set the verify command",
+	Long:  `Set the command run after each change an agent makes to an environment (e.g., "go build ./...").`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		command := args[0]
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.VerifyCommand = command
+			fmt.Printf("Verify command set to: %s\n", command)
+			return nil
+		})
+	},
+}
+
+var configVerifyCommandGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Get the verify command",
+	Long:  `Display the current verify command.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if config.VerifyCommand == "" {
+				fmt.Println("No verify command configured")
+				return nil
+			}
+			fmt.Println(config.VerifyCommand)
+			return nil
+		})
+	},
+}
+
+var configVerifyCommandUnsetCmd = &cobra.Command{
+	Use:   "unset",
+	Short: "Remove the verify command",
+	Long:  `Stop verifying the changes agents make to environments.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.VerifyCommand = ""
+			fmt.Println("Verify command removed")
+			return nil
+		})
+	},
+}
+
+var configRunAsUserCmd = &cobra.Command{
+	Use:   "run-as-user [<user>]",
+	Short: "Run commands as a non-root user",
+	Long: `Run setup commands, install commands and agent commands as the given user
+(name, uid, name:group or uid:gid) instead of root. The user must exist in the base image.
+Use "root" to go back to running as root. Without a user, shows the current setting.`,
+	Example: `# Run as the node user of the node base image
+container-use config run-as-user node
+
+# Run as root again
+container-use config run-as-user root`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.RunAsUser == "" {
+					fmt.Println("root")
+					return nil
+				}
+				fmt.Println(config.RunAsUser)
+				return nil
+			})
+		}
+
+		user := args[0]
+		if user == "root" {
+			user = ""
+		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.RunAsUser = user
+			fmt.Printf("Commands will run as: %s\n", args[0])
+			return nil
+		})
+	},
+}
+
+var configGitCheckoutCmd = &cobra.Command{
+	Use:   "git-checkout [on|off]",
+	Short: "Let agents make their own git commits",
+	Long: `Make the workdir of new environments a git checkout of their branch.
+Commits made by agents inside the environment are then kept as-is, instead of
+container-use committing all changes after each operation. Changes left uncommitted
+by the agent are still committed automatically. Without an argument, shows the current setting.`,
+	Example: `# Keep the commits agents make inside environments
+container-use config git-checkout on`,
+	Args:      cobra.MaximumNArgs(1),
+	ValidArgs: []string{"on", "off"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.GitCheckout {
+					fmt.Println("on")
+				} else {
+					fmt.Println("off")
+				}
+				return nil
+			})
+		}
+
+		var enabled bool
+		switch args[0] {
+		case "on":
+			enabled = true
+		case "off":
+			enabled = false
+		default:
+			return fmt.Errorf("invalid value %q: use on or off", args[0])
+		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.GitCheckout = enabled
+			if enabled {
+				fmt.Println("New environments will be git checkouts, commits made inside them will be kept")
+			} else {
+				fmt.Println("Changes made in new environments will be committed automatically")
+			}
+			return nil
+		})
+	},
+}
+
+var configCommitGranularityCmd = &cobra.Command{
+	Use:   "commit-granularity [per-operation|per-session]",
+	Short: "Set how often changes made in environments are committed",
+	Long: `Set how often container-use commits the changes made in new environments.
+With per-operation (the default), every file write and command gets its own commit, for a detailed audit trail.
+With per-session, changes accumulate in the environment's worktree and are committed together
+when the agent's session ends, or earlier with "container-use flush". Without an argument, shows the current setting.`,
+	Example: `# Commit the work of each agent session as a whole
+container-use config commit-granularity per-session`,
+	Args:      cobra.MaximumNArgs(1),
+	ValidArgs: []string{environment.CommitPerOperation, environment.CommitPerSession},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.CommitGranularity == "" {
+					fmt.Println(environment.CommitPerOperation)
+				} else {
+					fmt.Println(config.CommitGranularity)
+				}
+				return nil
+			})
+		}
+
+		granularity := args[0]
+		switch granularity {
+		case environment.CommitPerOperation, environment.CommitPerSession:
+		default:
+			return fmt.Errorf("invalid value %q: use %s or %s", granularity, environment.CommitPerOperation, environment.CommitPerSession)
+		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if granularity == environment.CommitPerOperation {
+				// Default
+				config.CommitGranularity = ""
+				fmt.Println("Changes made in new environments will be committed after each operation")
+			} else {
+				config.CommitGranularity = granularity
+				fmt.Println("Changes made in new environments will be committed once per session")
+			}
+			return nil
+		})
+	},
+}
+
+var configSecretScanCmd = &cobra.Command{
+	Use:   "secret-scan [on|warn|off]",
+	Short: "Set how files that look like they contain secrets are committed",
+	Long: `Set what happens when a file written in new environments looks like it contains a secret,
+such as an API key, an access token or a private key. Once committed, secrets stay in the git history.
+With warn (the default), the file is committed with a warning. With on, it's left out of the commit
+until the secret is removed. With off, files aren't scanned. Without an argument, shows the current setting.`,
+	Example: `# Never commit files that look like they contain secrets
+container-use config secret-scan on`,
+	Args:      cobra.MaximumNArgs(1),
+	ValidArgs: []string{environment.SecretScanOn, environment.SecretScanWarn, environment.SecretScanOff},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.SecretScan == "" {
+					fmt.Println(environment.SecretScanWarn)
+				} else {
+					fmt.Println(config.SecretScan)
+				}
+				return nil
+			})
+		}
+
+		mode := args[0]
+		switch mode {
+		case environment.SecretScanOn, environment.SecretScanWarn, environment.SecretScanOff:
+		default:
+			return fmt.Errorf("invalid value %q: use %s, %s or %s", mode, environment.SecretScanOn, environment.SecretScanWarn, environment.SecretScanOff)
+		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			switch mode {
+			case environment.SecretScanWarn:
+				// Default
+				config.SecretScan = ""
+				fmt.Println("Files that look like they contain secrets will be committed with a warning")
+			case environment.SecretScanOn:
+				config.SecretScan = mode
+				fmt.Println("Files that look like they contain secrets will not be committed")
+			default:
+				config.SecretScan = mode
+				fmt.Println("Files will be committed without scanning them for secrets")
+			}
+			return nil
+		})
+	},
+}
 
-		repo, err := repository.Open(ctx, ".")
-		if err != nil {
-			return fmt.Errorf("failed to open repository: %w", err)
+var configServiceIdleTimeoutCmd = &cobra.Command{
+	Use:   "service-idle-timeout [<duration>]",
+	Short: "Stop services of idle environments",
+	Long: `Stop the services and background commands of an environment once no command has been run in it
+for the given duration (e.g., 30m, 1h). Stopped services are restarted on demand.
+Use "off" to keep services running until the environment is deleted. Without a duration, shows the current setting.`,
+	Example: `# Stop services after 30 minutes of inactivity
+container-use config service-idle-timeout 30m
+
+# Never stop services
+container-use config service-idle-timeout off`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.ServiceIdleTimeout == "" {
+					fmt.Println("off")
+					return nil
+				}
+				fmt.Println(config.ServiceIdleTimeout)
+				return nil
+			})
 		}
 
-		var config *environment.EnvironmentConfig
+		value := args[0]
+		if value == "off" || value == "0" {
+			value = ""
+		} else if timeout, err := time.ParseDuration(value); err != nil || timeout < 0 {
+			return fmt.Errorf("invalid duration %q: use a value like 30m or 1h, or off", value)
+		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.ServiceIdleTimeout = value
+			if value == "" {
+				fmt.Println("Services of idle environments will keep running")
+			} else {
+				fmt.Printf("Services will be stopped after %s of inactivity\n", value)
+			}
+			return nil
+		})
+	},
+}
 
-		// If no environment is specified, use the default configuration
+var configNotesPropagationWindowCmd = &cobra.Command{
+	Use:   "notes-propagation-window [<duration>]",
+	Short: "Coalesce the propagation of git notes",
+	Long: `Copy the history and state git notes of environments to your repository at most once per window
+(e.g., 10s, 1m) instead of after every operation, saving git round-trips during bursts of agent activity.
+Pending notes are always copied when the agent's session ends and by "container-use flush".
+Use "off" to copy them right away. Without a duration, shows the current setting.`,
+	Example: `# Copy notes at most every 10 seconds
+container-use config notes-propagation-window 10s
+
+# Copy notes after every operation
+container-use config notes-propagation-window off`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
-			config = environment.DefaultConfig()
-			if err := config.Load(repo.SourcePath()); err != nil {
-				return fmt.Errorf("failed to load configuration: %w", err)
-			}
-		} else {
-			envID := args[0]
-			env, err := repo.Info(ctx, envID)
-			if err != nil {
-				return err
-			}
-			config = env.State.Config
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.NotesPropagationWindow == "" {
+					fmt.Println("off")
+					return nil
+				}
+				fmt.Println(config.NotesPropagationWindow)
+				return nil
+			})
 		}
 
-		if ok, _ := cmd.Flags().GetBool("json"); ok {
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetIndent("", "  ")
-			return enc.Encode(config)
+		value := args[0]
+		if value == "off" || value == "0" {
+			value = ""
+		} else if window, err := time.ParseDuration(value); err != nil || window < 0 {
+			return fmt.Errorf("invalid duration %q: use a value like 10s or 1m, or off", value)
 		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.NotesPropagationWindow = value
+			if value == "" {
+				fmt.Println("Git notes will be propagated after every operation")
+			} else {
+				fmt.Printf("Git notes will be propagated at most every %s\n", value)
+			}
+			return nil
+		})
+	},
+}
 
-		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		defer tw.Flush()
+// insertCommand inserts command at the given 1-based position, or appends it if at is 0.
+func insertCommand(commands []string, command string, at int) ([]string, error) {
+	if at == 0 {
+		return append(commands, command), nil
+	}
+	if at < 1 || at > len(commands)+1 {
+		return nil, fmt.Errorf("invalid position %d: must be between 1 and %d", at, len(commands)+1)
+	}
+	return slices.Insert(commands, at-1, command), nil
+}
 
-		fmt.Fprintf(tw, "Base Image:\t%s\n", config.BaseImage)
-		fmt.Fprintf(tw, "Workdir:\t%s\n", config.Workdir)
+func printCommands(commands []string) {
+	for i, command := range commands {
+		fmt.Printf("%d. %s\n", i+1, command)
+	}
+}
 
-		if len(config.SetupCommands) > 0 {
-			fmt.Fprintf(tw, "Setup Commands:\t\n")
-			for i, cmd := range config.SetupCommands {
-				fmt.Fprintf(tw, "  %d.\t%s\n", i+1, cmd)
-			}
-		} else {
-			fmt.Fprintf(tw, "Setup Commands:\t(none)\n")
+// Command policy object commands
+var configPrivilegedCmd = &cobra.Command{
+	Use:   "privileged [on|off]",
+	Short: "Run commands with all root capabilities",
+	Long: `Run the commands of new environments with all root capabilities, like docker run --privileged,
+e.g. for Docker-in-Docker. Without an argument, shows the current setting.
+
+This gives the commands, and so agents, full access to the host running the Dagger engine:
+only enable it for trusted agents and workloads. Off by default.`,
+	Example: `# Let agents run Docker inside their environments
+container-use config privileged on`,
+	Args:      cobra.MaximumNArgs(1),
+	ValidArgs: []string{"on", "off"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.Privileged {
+					fmt.Println("on")
+				} else {
+					fmt.Println("off")
+				}
+				return nil
+			})
 		}
 
-		if len(config.InstallCommands) > 0 {
-			fmt.Fprintf(tw, "Install Commands:\t\n")
-			for i, cmd := range config.InstallCommands {
-				fmt.Fprintf(tw, "  %d.\t%s\n", i+1, cmd)
-			}
-		} else {
-			fmt.Fprintf(tw, "Install Commands:\t(none)\n")
+		var enabled bool
+		switch args[0] {
+		case "on":
+			enabled = true
+		case "off":
+			enabled = false
+		default:
+			return fmt.Errorf("invalid value %q: use on or off", args[0])
 		}
-
-		envKeys := config.Env.Keys()
-		if len(envKeys) > 0 {
-			fmt.Fprintf(tw, "Environment Variables:\t\n")
-			for i, key := range envKeys {
-				value := config.Env.Get(key)
-				fmt.Fprintf(tw, "  %d.\t%s=%s\n", i+1, key, value)
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.Privileged = enabled
+			if enabled {
+				fmt.Println("Commands of new environments will run with all root capabilities, with full access to the Dagger engine's host")
+			} else {
+				fmt.Println("Commands of new environments will run with the default capabilities")
 			}
-		} else {
-			fmt.Fprintf(tw, "Environment Variables:\t(none)\n")
-		}
+			return nil
+		})
+	},
+}
 
-		secretKeys := config.Secrets.Keys()
-		if len(secretKeys) > 0 {
-			fmt.Fprintf(tw, "Secrets:\t\n")
-			for i, key := range secretKeys {
-				value := config.Secrets.Get(key)
-				fmt.Fprintf(tw, "  %d.\t%s=%s\n", i+1, key, value)
-			}
-		} else {
-			fmt.Fprintf(tw, "Secrets:\t(none)\n")
+var configReadOnlyCmd = &cobra.Command{
+	Use:   "readonly [on|off]",
+	Short: "Keep agents from changing environments",
+	Long: `Make new environments read-only, for "look but don't touch" sessions such as code reviews
+or exploring a checkpoint. Agents can read and list files, and run commands, but the changes
+commands make are discarded, and writing or deleting files, running commands in the background,
+adding services and changing the configuration are refused. Without an argument, shows the
+current setting.
+
+To make every environment read-only for a single agent session instead, start the MCP server
+with "container-use stdio --read-only". Off by default.`,
+	Example: `# Let a review agent investigate without changing anything
+container-use config readonly on`,
+	Args:      cobra.MaximumNArgs(1),
+	ValidArgs: []string{"on", "off"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+				if config.ReadOnly {
+					fmt.Println("on")
+				} else {
+					fmt.Println("off")
+				}
+				return nil
+			})
 		}
 
-		return nil
+		var enabled bool
+		switch args[0] {
+		case "on":
+			enabled = true
+		case "off":
+			enabled = false
+		default:
+			return fmt.Errorf("invalid value %q: use on or off", args[0])
+		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.ReadOnly = enabled
+			if enabled {
+				fmt.Println("New environments will be read-only: agents can't change them")
+			} else {
+				fmt.Println("Agents can change new environments")
+			}
+			return nil
+		})
 	},
 }
 
-var configImportCmd = &cobra.Command{
-	Use:   "import <env>",
-	Short: "Import configuration from an environment",
-	Long: `Import configuration from an existing environment and set it as the default.
-This copies the environment's base image, setup commands, environment variables,
-and secrets to be used as defaults for new environments.`,
-	Example: `# Import configuration from an environment
-container-use config import my-env
+var configCapabilitiesCmd = &cobra.Command{
+	Use:   "capabilities",
+	Short: "Manage the Linux capabilities commands need",
+	Long: `Manage the Linux capabilities the commands of new environments need beyond the default ones,
+e.g. SYS_PTRACE to run debuggers.
 
-# View the configuration before importing
-container-use config show my-env
-container-use config import my-env`,
-	Args:              cobra.ExactArgs(1),
-	ValidArgsFunction: suggestEnvironments,
-	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx := cmd.Context()
+Dagger can't grant capabilities one by one: if any is configured, commands run with all root
+capabilities, as with "container-use config privileged on", which gives them full access to the
+host running the Dagger engine. Listing the capabilities still documents what environments need.`,
+}
 
-		repo, err := repository.Open(ctx, ".")
+var configCapabilitiesAddCmd = &cobra.Command{
+	Use:     "add <capability>",
+	Short:   "Add a capability",
+	Long:    `Add a Linux capability commands need, with or without its CAP_ prefix.`,
+	Example: `container-use config capabilities add SYS_PTRACE`,
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		capability, err := environment.NormalizeCapability(args[0])
 		if err != nil {
-			return fmt.Errorf("failed to open repository: %w", err)
+			return err
 		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if slices.Contains(config.Capabilities, capability) {
+				return fmt.Errorf("capability already added: %s", capability)
+			}
+			config.Capabilities = append(config.Capabilities, capability)
+			fmt.Printf("Capability added: %s (commands now run with all root capabilities)\n", capability)
+			return nil
+		})
+	},
+}
 
-		envID := args[0]
-		env, err := repo.Info(ctx, envID)
+var configCapabilitiesRemoveCmd = &cobra.Command{
+	Use:   "remove <capability>",
+	Short: "Remove a capability",
+	Long:  `Remove a Linux capability from the environment configuration.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		capability, err := environment.NormalizeCapability(args[0])
 		if err != nil {
 			return err
 		}
-		if err := env.State.Config.Save(repo.SourcePath()); err != nil {
-			return fmt.Errorf("failed to save configuration: %w", err)
-		}
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			i := slices.Index(config.Capabilities, capability)
+			if i < 0 {
+				return fmt.Errorf("capability not found: %s", capability)
+			}
+			config.Capabilities = slices.Delete(config.Capabilities, i, i+1)
+			fmt.Printf("Capability removed: %s\n", capability)
+			return nil
+		})
+	},
+}
 
-		fmt.Printf("Configuration imported from environment '%s'\n", envID)
-		return nil
+var configCapabilitiesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all capabilities",
+	Long:  `List the Linux capabilities commands need.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if len(config.Capabilities) == 0 {
+				fmt.Println("No capabilities configured")
+				return nil
+			}
+			for _, capability := range config.Capabilities {
+				fmt.Println(capability)
+			}
+			return nil
+		})
 	},
 }
 
-// Base image object commands
-var configBaseImageCmd = &cobra.Command{
-	Use:   "base-image",
-	Short: "Manage base container image",
-	Long:  `Manage the base container image for new environments.`,
+var configCapabilitiesClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Clear all capabilities",
+	Long:  `Remove all capabilities from the environment configuration.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			config.Capabilities = nil
+			fmt.Println("All capabilities cleared")
+			return nil
+		})
+	},
 }
 
-var configBaseImageSetCmd = &cobra.Command{
-	Use:   "set <image>",
-	Short: "Set the base container image",
-	Long:  `Set the base container image for new environments (e.g., python:3.11, node:18, ubuntu:22.04).`,
+var configCommandPolicyCmd = &cobra.Command{
+	Use:   "command-policy",
+	Short: "Restrict the commands agents can run",
+	Long: `Restrict the commands agents can run in new environments with regular expressions, matched anywhere
+in the command. Commands matching a denied pattern are refused. If there are allowed patterns, commands
+must also match one of them. Every command is allowed by default.
+
+The policy is a guardrail against mistakes of semi-trusted agents, not a sandbox: a determined agent can
+get around patterns, e.g. by writing a script and running it.`,
+}
+
+var configCommandPolicyDenyCmd = &cobra.Command{
+	Use:   "deny <pattern>",
+	Short: "Refuse the commands matching a pattern",
+	Example: `# Forbid piping downloads into a shell
+container-use config command-policy deny 'curl.*\|\s*(ba)?sh'
+
+# Forbid wiping the filesystem
+container-use config command-policy deny 'rm\s+-rf\s+/(\s|$)'`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return addCommandPolicyPattern(cmd, args[0], func(policy *environment.CommandPolicy) *[]string { return &policy.Deny })
+	},
+}
+
+var configCommandPolicyAllowCmd = &cobra.Command{
+	Use:   "allow <pattern>",
+	Short: "Only allow the commands matching allowed patterns",
+	Example: `# Only allow go and git commands
+container-use config command-policy allow '^go '
+container-use config command-policy allow '^git '`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return addCommandPolicyPattern(cmd, args[0], func(policy *environment.CommandPolicy) *[]string { return &policy.Allow })
+	},
+}
+
+var configCommandPolicyRemoveCmd = &cobra.Command{
+	Use:   "remove <pattern>",
+	Short: "Remove an allowed or denied pattern",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		baseImage := args[0]
+		pattern := args[0]
 		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
-			config.BaseImage = baseImage
-			fmt.Printf("Base image set to: %s\n", baseImage)
+			policy := config.CommandPolicy
+			if policy == nil || (!slices.Contains(policy.Allow, pattern) && !slices.Contains(policy.Deny, pattern)) {
+				return fmt.Errorf("pattern not found: %s", pattern)
+			}
+			policy.Allow = slices.DeleteFunc(policy.Allow, func(p string) bool { return p == pattern })
+			policy.Deny = slices.DeleteFunc(policy.Deny, func(p string) bool { return p == pattern })
+			if policy.Empty() {
+				config.CommandPolicy = nil
+			}
+			fmt.Printf("Pattern removed: %s\n", pattern)
 			return nil
 		})
 	},
 }
 
-var configBaseImageGetCmd = &cobra.Command{
-	Use:   "get",
-	Short: "Get the current base container image",
-	Long:  `Display the current base container image.`,
+var configCommandPolicyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the allowed and denied patterns",
+	Args:  cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
-			fmt.Println(config.BaseImage)
+			if config.CommandPolicy.Empty() {
+				fmt.Println("No command policy configured, every command is allowed")
+				return nil
+			}
+			for _, pattern := range config.CommandPolicy.Allow {
+				fmt.Printf("allow %s\n", pattern)
+			}
+			for _, pattern := range config.CommandPolicy.Deny {
+				fmt.Printf("deny  %s\n", pattern)
+			}
 			return nil
 		})
 	},
 }
 
-var configBaseImageResetCmd = &cobra.Command{
-	Use:   "reset",
-	Short: "Reset base image to default",
-	Long:  `Reset the base container image to the default (ubuntu:24.04).`,
+var configCommandPolicyClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Allow every command again",
+	Args:  cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
-			defaultConfig := environment.DefaultConfig()
-			config.BaseImage = defaultConfig.BaseImage
-			fmt.Printf("Base image reset to default: %s\n", defaultConfig.BaseImage)
+			config.CommandPolicy = nil
+			fmt.Println("Command policy cleared, every command is allowed")
 			return nil
 		})
 	},
 }
 
+// addCommandPolicyPattern adds pattern to the list of the command policy returned by list.
+func addCommandPolicyPattern(cmd *cobra.Command, pattern string, list func(*environment.CommandPolicy) *[]string) error {
+	if err := (&environment.CommandPolicy{Deny: []string{pattern}}).Validate(); err != nil {
+		return err
+	}
+	return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+		if config.CommandPolicy == nil {
+			config.CommandPolicy = &environment.CommandPolicy{}
+		}
+		patterns := list(config.CommandPolicy)
+		if slices.Contains(*patterns, pattern) {
+			return fmt.Errorf("pattern already configured: %s", pattern)
+		}
+		*patterns = append(*patterns, pattern)
+		fmt.Printf("Pattern added: %s\n", pattern)
+		return nil
+	})
+}
+
 // Setup command object commands
 var configSetupCommandCmd = &cobra.Command{
 	Use:   "setup-command",
@@ -256,9 +1399,17 @@ var configSetupCommandAddCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		command := args[0]
+		at, _ := cmd.Flags().GetInt("at")
 		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
-			config.SetupCommands = append(config.SetupCommands, command)
+			commands, err := insertCommand(config.SetupCommands, command, at)
+			if err != nil {
+				return err
+			}
+			config.SetupCommands = commands
 			fmt.Printf("Setup command added: %s\n", command)
+			if at > 0 {
+				printCommands(config.SetupCommands)
+			}
 			return nil
 		})
 	},
@@ -304,9 +1455,7 @@ var configSetupCommandListCmd = &cobra.Command{
 				return nil
 			}
 
-			for i, command := range config.SetupCommands {
-				fmt.Printf("%d. %s\n", i+1, command)
-			}
+			printCommands(config.SetupCommands)
 			return nil
 		})
 	},
@@ -339,9 +1488,17 @@ var configInstallCommandAddCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		command := args[0]
+		at, _ := cmd.Flags().GetInt("at")
 		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
-			config.InstallCommands = append(config.InstallCommands, command)
+			commands, err := insertCommand(config.InstallCommands, command, at)
+			if err != nil {
+				return err
+			}
+			config.InstallCommands = commands
 			fmt.Printf("Install command added: %s\n", command)
+			if at > 0 {
+				printCommands(config.InstallCommands)
+			}
 			return nil
 		})
 	},
@@ -387,9 +1544,7 @@ var configInstallCommandListCmd = &cobra.Command{
 				return nil
 			}
 
-			for i, command := range config.InstallCommands {
-				fmt.Printf("%d. %s\n", i+1, command)
-			}
+			printCommands(config.InstallCommands)
 			return nil
 		})
 	},
@@ -408,6 +1563,104 @@ var configInstallCommandClearCmd = &cobra.Command{
 	},
 }
 
+// Service object commands
+var configServiceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manage services",
+	Long: `Manage the services started alongside environments, such as databases or caches.
+Services are started whenever an environment is loaded, and can be reached by name from its commands.`,
+}
+
+var configServiceAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "Add a service",
+	Long:  `Add a service, started from an image, to be run alongside environments.`,
+	Example: `# A PostgreSQL database, reachable at postgres:5432
+container-use config service add postgres --image postgres:16 --port 5432 --env POSTGRES_PASSWORD=postgres
+
+# A service running a custom command
+container-use config service add cache --image redis:7 --command 'redis-server --save ""' --port 6379`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		image, _ := cmd.Flags().GetString("image")
+		command, _ := cmd.Flags().GetString("command")
+		ports, _ := cmd.Flags().GetIntSlice("port")
+		envs, _ := cmd.Flags().GetStringArray("env")
+		secrets, _ := cmd.Flags().GetStringArray("secret")
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if config.Services.Get(name) != nil {
+				return fmt.Errorf("service already exists: %s", name)
+			}
+			config.Services = append(config.Services, &environment.ServiceConfig{
+				Name:         name,
+				Image:        image,
+				Command:      command,
+				ExposedPorts: ports,
+				Env:          envs,
+				Secrets:      secrets,
+			})
+			fmt.Printf("Service added: %s (%s)\n", name, image)
+			return nil
+		})
+	},
+}
+
+var configServiceRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a service",
+	Long:  `Remove a service from the environment configuration.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if config.Services.Get(name) == nil {
+				return fmt.Errorf("service not found: %s", name)
+			}
+			config.Services = slices.DeleteFunc(config.Services, func(service *environment.ServiceConfig) bool {
+				return service.Name == name
+			})
+			fmt.Printf("Service removed: %s\n", name)
+			return nil
+		})
+	},
+}
+
+var configServiceListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all services",
+	Long:  `List all services started alongside environments.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			if len(config.Services) == 0 {
+				fmt.Println("No services configured")
+				return nil
+			}
+
+			for i, service := range config.Services {
+				fmt.Printf("%d. %s\n", i+1, formatService(service))
+			}
+			return nil
+		})
+	},
+}
+
+// formatService describes a service on a single line, e.g. "postgres (postgres:16, ports 5432)".
+func formatService(service *environment.ServiceConfig) string {
+	details := []string{service.Image}
+	if len(service.ExposedPorts) > 0 {
+		ports := make([]string, 0, len(service.ExposedPorts))
+		for _, port := range service.ExposedPorts {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		details = append(details, "ports "+strings.Join(ports, ", "))
+	}
+	if service.Command != "" {
+		details = append(details, "command "+service.Command)
+	}
+	return fmt.Sprintf("%s (%s)", service.Name, strings.Join(details, ", "))
+}
+
 // Environment variable object commands
 var configEnvCmd = &cobra.Command{
 	Use:   "env",
@@ -418,11 +1671,34 @@ var configEnvCmd = &cobra.Command{
 var configEnvSetCmd = &cobra.Command{
 	Use:   "set <key> <value>",
 	Short: "Set an environment variable",
-	Long:  `Set an environment variable to be used when creating new environments (e.g., "PATH" "/usr/local/bin:$PATH").`,
-	Args:  cobra.ExactArgs(2),
+	Long: `Set an environment variable to be used when creating new environments (e.g., "PATH" "/usr/local/bin:$PATH").
+
+Values are evaluated at two different times:
+  - With --eval, the value is a shell command run on the host now, when setting the variable:
+    its output is stored as the value, and doesn't change afterwards.
+  - References to host environment variables as {{host.NAME}} are stored as is, and resolved
+    each time an environment is built, from the host environment at that time.`,
+	Example: `# Set a static value
+container-use config env set NODE_ENV development
+
+# Store the current timestamp, evaluated once
+container-use config env set --eval BUILD_ID 'date +%s'
+
+# Resolve the host's user and name whenever an environment is built
+container-use config env set BUILD_HOST '{{host.USER}}@{{host.HOSTNAME}}'`,
+	Args: cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		key := args[0]
 		value := args[1]
+		if eval, _ := cmd.Flags().GetBool("eval"); eval {
+			command := exec.CommandContext(cmd.Context(), "sh", "-c", value)
+			command.Stderr = os.Stderr
+			output, err := command.Output()
+			if err != nil {
+				return fmt.Errorf("failed to evaluate %q: %w", value, err)
+			}
+			value = strings.TrimRight(string(output), "\n")
+		}
 		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
 			config.Env.Set(key, value)
 			fmt.Printf("Environment variable set: %s=%s\n", key, value)
@@ -492,13 +1768,28 @@ var configSecretCmd = &cobra.Command{
 var configSecretSetCmd = &cobra.Command{
 	Use:   "set <key> <value>",
 	Short: "Set a secret",
-	Long:  `Set a secret to be used when creating new environments (e.g., "API_KEY" "op://vault/item/field").`,
-	Args:  cobra.ExactArgs(2),
+	Long: `Set a secret to be used when creating new environments (e.g., "API_KEY" "op://vault/item/field").
+With --refresh, the secret is resolved again for every command instead of once when the environment
+is built, so rotating credentials such as short-lived tokens stay fresh. Only env:// and op://
+secrets can be refreshed.`,
+	Example: `# Resolved once, when the environment is built
+container-use config secret set API_KEY op://vault/api/key
+
+# Resolved for every command, as the token is short-lived
+container-use config secret set GITHUB_TOKEN op://vault/github/token --refresh`,
+	Args: cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		key := args[0]
 		value := args[1]
+		refresh, _ := cmd.Flags().GetBool("refresh")
 		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
 			config.Secrets.Set(key, value)
+			config.RefreshSecrets = slices.DeleteFunc(config.RefreshSecrets, func(name string) bool { return name == key })
+			if refresh {
+				config.RefreshSecrets = append(config.RefreshSecrets, key)
+				fmt.Printf("Secret set, refreshed for every command: %s=%s\n", key, value)
+				return nil
+			}
 			fmt.Printf("Secret set: %s=%s\n", key, value)
 			return nil
 		})
@@ -516,6 +1807,7 @@ var configSecretUnsetCmd = &cobra.Command{
 			if !config.Secrets.Unset(key) {
 				return fmt.Errorf("secret not found: %s", key)
 			}
+			config.RefreshSecrets = slices.DeleteFunc(config.RefreshSecrets, func(name string) bool { return name == key })
 			fmt.Printf("Secret unset: %s\n", key)
 			return nil
 		})
@@ -536,6 +1828,10 @@ var configSecretListCmd = &cobra.Command{
 
 			for i, key := range keys {
 				value := config.Secrets.Get(key)
+				if slices.Contains(config.RefreshSecrets, key) {
+					fmt.Printf("%d. %s=%s (refreshed for every command)\n", i+1, key, value)
+					continue
+				}
 				fmt.Printf("%d. %s=%s\n", i+1, key, value)
 			}
 			return nil
@@ -543,6 +1839,44 @@ var configSecretListCmd = &cobra.Command{
 	},
 }
 
+var configSecretCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check that all secrets resolve",
+	Long: `Resolve every configured secret reference the way environments do, and report
+the ones that fail, e.g. a rotated 1Password item or a missing environment variable.
+Secret values are never printed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withConfig(cmd, func(config *environment.EnvironmentConfig) error {
+			keys := config.Secrets.Keys()
+			if len(keys) == 0 {
+				fmt.Println("No secrets configured")
+				return nil
+			}
+
+			ctx := cmd.Context()
+			dag, err := connectDagger(ctx)
+			if err != nil {
+				return err
+			}
+			defer dag.Close()
+
+			failed := config.CheckSecrets(ctx, dag)
+			for _, key := range keys {
+				value := config.Secrets.Get(key)
+				if err, ok := failed[key]; ok {
+					fmt.Printf("✗ %s=%s: %v\n", key, value, err)
+				} else {
+					fmt.Printf("✓ %s=%s\n", key, value)
+				}
+			}
+			if len(failed) > 0 {
+				return fmt.Errorf("%d of %d secrets failed to resolve", len(failed), len(keys))
+			}
+			return nil
+		})
+	},
+}
+
 var configSecretClearCmd = &cobra.Command{
 	Use:   "clear",
 	Short: "Clear all secrets",
@@ -550,6 +1884,7 @@ var configSecretClearCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return updateConfig(cmd, func(config *environment.EnvironmentConfig) error {
 			config.Secrets.Clear()
+			config.RefreshSecrets = nil
 			fmt.Println("All secrets cleared")
 			return nil
 		})
@@ -561,20 +1896,62 @@ func init() {
 	configBaseImageCmd.AddCommand(configBaseImageSetCmd)
 	configBaseImageCmd.AddCommand(configBaseImageGetCmd)
 	configBaseImageCmd.AddCommand(configBaseImageResetCmd)
+	configBaseImageCmd.AddCommand(configBaseImageHistoryCmd)
+	configBaseImageCmd.AddCommand(configBaseImageFromCheckpointCmd)
+	configBaseImageFromCheckpointCmd.Flags().String("publish", "", "Checkpoint the environment to this image destination first (e.g. registry.example.com/team/toolchain:latest)")
+	configSecretSetCmd.Flags().Bool("refresh", false, "Resolve the secret again for every command instead of once at build time")
+	configBaseImageHistoryCmd.Flags().Bool("json", false, "Output the history in JSON")
+
+	// Add entrypoint commands
+	configEntrypointCmd.AddCommand(configEntrypointSetCmd)
+	configEntrypointCmd.AddCommand(configEntrypointGetCmd)
+	configEntrypointCmd.AddCommand(configEntrypointUnsetCmd)
 
 	// Add setup-command commands
+	configSetupCommandAddCmd.Flags().Int("at", 0, "Insert the command at this position (1-based) instead of appending it")
 	configSetupCommandCmd.AddCommand(configSetupCommandAddCmd)
 	configSetupCommandCmd.AddCommand(configSetupCommandRemoveCmd)
 	configSetupCommandCmd.AddCommand(configSetupCommandListCmd)
 	configSetupCommandCmd.AddCommand(configSetupCommandClearCmd)
 
 	// Add install-command commands
+	configInstallCommandAddCmd.Flags().Int("at", 0, "Insert the command at this position (1-based) instead of appending it")
 	configInstallCommandCmd.AddCommand(configInstallCommandAddCmd)
 	configInstallCommandCmd.AddCommand(configInstallCommandRemoveCmd)
 	configInstallCommandCmd.AddCommand(configInstallCommandListCmd)
 	configInstallCommandCmd.AddCommand(configInstallCommandClearCmd)
 
+	// Add command-policy commands
+	configCommandPolicyCmd.AddCommand(configCommandPolicyDenyCmd)
+	configCommandPolicyCmd.AddCommand(configCommandPolicyAllowCmd)
+	configCommandPolicyCmd.AddCommand(configCommandPolicyRemoveCmd)
+	configCommandPolicyCmd.AddCommand(configCommandPolicyListCmd)
+	configCommandPolicyCmd.AddCommand(configCommandPolicyClearCmd)
+
+	// Add capabilities commands
+	configCapabilitiesCmd.AddCommand(configCapabilitiesAddCmd)
+	configCapabilitiesCmd.AddCommand(configCapabilitiesRemoveCmd)
+	configCapabilitiesCmd.AddCommand(configCapabilitiesListCmd)
+	configCapabilitiesCmd.AddCommand(configCapabilitiesClearCmd)
+
+	// Add service commands
+	configServiceAddCmd.Flags().String("image", "", "Image the service is started from (e.g. postgres:16)")
+	configServiceAddCmd.MarkFlagRequired("image")
+	configServiceAddCmd.Flags().String("command", "", "Command run by the service, instead of the image's default")
+	configServiceAddCmd.Flags().IntSlice("port", nil, "Port exposed by the service (repeatable)")
+	configServiceAddCmd.Flags().StringArray("env", nil, "Environment variable of the service, as KEY=VALUE (repeatable)")
+	configServiceAddCmd.Flags().StringArray("secret", nil, "Secret of the service, as KEY=reference (repeatable)")
+	configServiceCmd.AddCommand(configServiceAddCmd)
+	configServiceCmd.AddCommand(configServiceRemoveCmd)
+	configServiceCmd.AddCommand(configServiceListCmd)
+
+	// Add verify-command commands
+	configVerifyCommandCmd.AddCommand(configVerifyCommandSetCmd)
+	configVerifyCommandCmd.AddCommand(configVerifyCommandGetCmd)
+	configVerifyCommandCmd.AddCommand(configVerifyCommandUnsetCmd)
+
 	// Add env commands
+	configEnvSetCmd.Flags().Bool("eval", false, "Evaluate the value as a shell command on the host, and store its output")
 	configEnvCmd.AddCommand(configEnvSetCmd)
 	configEnvCmd.AddCommand(configEnvUnsetCmd)
 	configEnvCmd.AddCommand(configEnvListCmd)
@@ -585,15 +1962,36 @@ func init() {
 	configSecretCmd.AddCommand(configSecretUnsetCmd)
 	configSecretCmd.AddCommand(configSecretListCmd)
 	configSecretCmd.AddCommand(configSecretClearCmd)
+	configSecretCmd.AddCommand(configSecretCheckCmd)
 
 	// Add object commands to config
 	configCmd.AddCommand(configBaseImageCmd)
+	configCmd.AddCommand(configEntrypointCmd)
 	configCmd.AddCommand(configSetupCommandCmd)
 	configCmd.AddCommand(configInstallCommandCmd)
+	configCmd.AddCommand(configVerifyCommandCmd)
+	configCmd.AddCommand(configServiceCmd)
+	configCmd.AddCommand(configServiceIdleTimeoutCmd)
+	configCmd.AddCommand(configNotesPropagationWindowCmd)
+	configCmd.AddCommand(configGitCheckoutCmd)
+	configCmd.AddCommand(configCommitGranularityCmd)
+	configCmd.AddCommand(configSecretScanCmd)
+	configCmd.AddCommand(configCommandPolicyCmd)
+	configCmd.AddCommand(configPrivilegedCmd)
+	configCmd.AddCommand(configCapabilitiesCmd)
+	configCmd.AddCommand(configReadOnlyCmd)
+	configCmd.AddCommand(configRunAsUserCmd)
 	configCmd.AddCommand(configEnvCmd)
 	configCmd.AddCommand(configSecretCmd)
 	configCmd.AddCommand(configShowCmd)
 	configCmd.AddCommand(configImportCmd)
+	configCmd.AddCommand(configSuggestCmd)
+	configAuditCmd.Flags().String("baseline", "", "Configuration file environments must conform to")
+	configAuditCmd.MarkFlagRequired("baseline")
+	configCmd.AddCommand(configAuditCmd)
+	configResetCmd.Flags().BoolP("yes", "y", false, "Reset without asking for confirmation")
+	configResetCmd.Flags().Bool("keep-secrets", false, "Preserve the configured secrets")
+	configCmd.AddCommand(configResetCmd)
 
 	// Add agent command
 	configCmd.AddCommand(agent.AgentCmd)
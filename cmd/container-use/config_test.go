@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertCommand(t *testing.T) {
+	commands := []string{"apt update", "apt install -y git"}
+
+	got, err := insertCommand(commands, "echo last", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"apt update", "apt install -y git", "echo last"}, got)
+
+	got, err = insertCommand([]string{"apt update", "apt install -y git"}, "echo first", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"echo first", "apt update", "apt install -y git"}, got)
+
+	got, err = insertCommand([]string{"apt update", "apt install -y git"}, "echo end", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"apt update", "apt install -y git", "echo end"}, got)
+
+	_, err = insertCommand(commands, "echo", 4)
+	assert.Error(t, err)
+	_, err = insertCommand(commands, "echo", -1)
+	assert.Error(t, err)
+}
+
+func TestChangedSettings(t *testing.T) {
+	config := environment.DefaultConfig()
+	settings, err := changedSettings(config, environment.DefaultConfig())
+	require.NoError(t, err)
+	assert.Empty(t, settings)
+
+	config.BaseImage = "golang:1.24"
+	config.SetupCommands = []string{"go mod download"}
+	config.Secrets.Set("API_KEY", "env://API_KEY")
+	config.Workdir = ""
+	settings, err = changedSettings(config, environment.DefaultConfig())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"base_image", "secrets", "setup_commands", "workdir"}, settings)
+}
+
+func TestPrintConfigChanges(t *testing.T) {
+	repoConfig := environment.DefaultConfig()
+	repoConfig.BaseImage = "python:3.11"
+	config := repoConfig.Copy()
+	config.BaseImage = "python:3.12"
+	config.SetupCommands = []string{"apt-get install -y postgresql-client"}
+
+	var out strings.Builder
+	printConfigChanges(&out, environment.DiffConfig(repoConfig, config))
+	assert.Equal(t, `  base_image: "python:3.11" → "python:3.12"
+  setup_commands: + apt-get install -y postgresql-client
+`, out.String())
+}
+
+// Every setting of ConfigChanges is printed
+func TestPrintConfigChangesCoversEverySetting(t *testing.T) {
+	var changes environment.ConfigChanges
+	v := reflect.ValueOf(&changes).Elem()
+	for i := range v.NumField() {
+		switch field := v.Field(i); field.Interface().(type) {
+		case *environment.ValueChange:
+			field.Set(reflect.ValueOf(&environment.ValueChange{From: "a", To: "b"}))
+		case *environment.ListChange:
+			field.Set(reflect.ValueOf(&environment.ListChange{Added: []string{"a"}}))
+		default:
+			t.Fatalf("unexpected type of ConfigChanges.%s", v.Type().Field(i).Name)
+		}
+	}
+
+	var out strings.Builder
+	printConfigChanges(&out, &changes)
+	assert.Len(t, strings.Split(strings.TrimSpace(out.String()), "\n"), v.NumField())
+}
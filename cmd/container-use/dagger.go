@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"dagger.io/dagger"
+)
+
+// connectDagger connects to the Dagger engine. Only the commands running containers call it, so the commands only
+// using git work without an engine running.
+var connectDagger = func(ctx context.Context) (*dagger.Client, error) {
+	dag, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
+	if err != nil {
+		handleRuntimeError(err)
+		return nil, fmt.Errorf("failed to connect to dagger: %w", err)
+	}
+	return dag, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGitCommandsWithoutDagger checks the commands only reading the git history work without a Dagger engine.
+func TestGitCommandsWithoutDagger(t *testing.T) {
+	ctx := context.Background()
+
+	connected := false
+	connect := connectDagger
+	connectDagger = func(context.Context) (*dagger.Client, error) {
+		connected = true
+		return nil, errors.New("no dagger engine in tests")
+	}
+	t.Cleanup(func() { connectDagger = connect })
+
+	// Keep the forks of the test out of the actual home directory
+	t.Setenv("HOME", t.TempDir())
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	git := func(args ...string) {
+		_, err := repository.RunGitCommand(ctx, dir, args...)
+		require.NoError(t, err)
+	}
+	git("init")
+	git("config", "user.email", "test@example.com")
+	git("config", "user.name", "Test User")
+	git("config", "commit.gpgsign", "false")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("# Test\n"), 0644))
+	git("add", "README.md")
+	git("commit", "-m", "Initial commit")
+
+	_, err := repository.Open(ctx, dir)
+	require.NoError(t, err)
+
+	// Make an environment by hand, as creating one needs a container
+	state, err := (&environment.State{Title: "Test environment"}).Marshal()
+	require.NoError(t, err)
+	git("checkout", "-b", "test-env")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644))
+	git("add", "main.go")
+	git("commit", "-m", "Add main.go")
+	git("notes", "--ref", "cu/state", "add", "-m", string(state))
+	git("push", "container-use", "test-env", "refs/notes/cu/state")
+	git("fetch", "container-use")
+	git("checkout", "-")
+
+	for _, args := range [][]string{
+		{"log", "test-env"},
+		{"diff", "test-env"},
+		{"list"},
+	} {
+		rootCmd.SetArgs(args)
+		assert.NoError(t, rootCmd.ExecuteContext(ctx), args)
+	}
+	assert.False(t, connected, "git commands must not connect to dagger")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var debugSetupCmd = &cobra.Command{
+	Use:   "debug-setup [<env>]",
+	Short: "Open a terminal right before a failing setup command",
+	Long: `Rebuild an environment and, if a setup or install command fails, open an interactive
+terminal in the container as it was right before that command ran, to run it by hand and see why it fails.
+
+The environment is rebuilt from its current source with its own configuration, or with the
+repository's configuration (.container-use/environment.json) with --default-config.
+The environment itself is left unchanged.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Debug the setup of an environment
+container-use debug-setup fancy-mallard
+
+# Debug the setup commands you just added to the repository's configuration
+container-use config setup-command add "make deps"
+container-use debug-setup fancy-mallard --default-config`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		if err := ensureDaggerRun(); err != nil {
+			return err
+		}
+
+		dag, err := connectDagger(ctx)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		env, err := repo.Get(ctx, dag, envID)
+		if err != nil {
+			return err
+		}
+
+		config := env.State.Config
+		if useDefault, _ := app.Flags().GetBool("default-config"); useDefault {
+			config = environment.DefaultConfig()
+			if err := config.Load(repo.SourcePath()); err != nil {
+				return fmt.Errorf("failed to load configuration: %w", err)
+			}
+		}
+
+		failure, err := env.DebugBuild(environment.WithBuildLog(ctx, os.Stderr), config)
+		if err != nil {
+			return err
+		}
+		if failure == nil {
+			fmt.Printf("All setup and install commands of %s succeed\n", envID)
+			return nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Command failed with exit code %d: %s\nOpening a terminal right before it ran\n", failure.ExitCode, failure.Command)
+		return failure.Terminal(ctx)
+	},
+}
+
+func init() {
+	debugSetupCmd.Flags().Bool("default-config", false, "Use the repository's configuration instead of the environment's")
+	rootCmd.AddCommand(debugSetupCmd)
+}
@@ -46,7 +46,7 @@ container-use delete --all`,
 		var envIDs []string
 		if all {
 			// Get all environment IDs
-			envs, err := repo.List(ctx)
+			envs, err := repo.List(ctx, repository.ListOptions{})
 			if err != nil {
 				return fmt.Errorf("failed to list environments: %w", err)
 			}
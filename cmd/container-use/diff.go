@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/dagger/container-use/repository"
@@ -23,13 +24,16 @@ container-use diff fancy-mallard
 # Quick assessment before merging
 container-use diff backend-api
 
+# Only list the files the agent changed
+container-use diff backend-api --name-only
+
 # Auto-select environment
 container-use diff`,
 	RunE: func(app *cobra.Command, args []string) error {
 		ctx := app.Context()
 
 		// Ensure we're in a git repository
-		repo, err := repository.Open(ctx, ".")
+		repo, err := repository.OpenReadOnly(ctx, ".")
 		if err != nil {
 			return err
 		}
@@ -39,10 +43,22 @@ container-use diff`,
 			return err
 		}
 
+		if nameOnly, _ := app.Flags().GetBool("name-only"); nameOnly {
+			files, err := repo.ChangedFiles(ctx, envID)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				fmt.Println(file)
+			}
+			return nil
+		}
+
 		return repo.Diff(ctx, envID, os.Stdout)
 	},
 }
 
 func init() {
+	diffCmd.Flags().Bool("name-only", false, "Only list the names of the changed files")
 	rootCmd.AddCommand(diffCmd)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"strings"
 )
 
@@ -18,8 +19,67 @@ func isDockerDaemonError(err error) bool {
 		strings.Contains(errStr, "docker.sock")
 }
 
-// handleDockerDaemonError prints a helpful error message for Docker daemon issues
-func handleDockerDaemonError() {
-	fmt.Fprintf(os.Stderr, "\nError: Docker daemon is not running.\n")
-	fmt.Fprintf(os.Stderr, "Please start Docker and try again.\n\n")
+// isSocketPermissionError checks if the container runtime socket exists but the user can't access it
+func isSocketPermissionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	errStr := strings.ToLower(err.Error())
+	return strings.Contains(errStr, "permission denied") &&
+		(strings.Contains(errStr, "docker.sock") || strings.Contains(errStr, "podman.sock") || strings.Contains(errStr, "daemon socket"))
+}
+
+// isPodmanError checks if the error comes from a podman installation that Dagger can't use
+func isPodmanError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	errStr := strings.ToLower(err.Error())
+	return strings.Contains(errStr, "cannot connect to podman") ||
+		strings.Contains(errStr, "podman.sock") ||
+		strings.Contains(errStr, "podman machine")
+}
+
+// isMissingRuntimeError checks if no container runtime could be found at all
+func isMissingRuntimeError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	errStr := strings.ToLower(err.Error())
+	return strings.Contains(errStr, "no container runtime") ||
+		(strings.Contains(errStr, "docker") && strings.Contains(errStr, "executable file not found"))
+}
+
+// runtimeErrorHint translates common container runtime failures into an actionable message.
+// It returns an empty string if the error isn't recognized.
+func runtimeErrorHint(err error) string {
+	switch {
+	case isSocketPermissionError(err):
+		return "Permission denied while connecting to the container runtime socket.\n" +
+			"Add your user to the docker group (sudo usermod -aG docker $USER), then log out and back in and retry."
+	case isPodmanError(err):
+		return "Podman doesn't appear to be running.\n" +
+			"Start it with `podman machine start` (macOS/Windows) or `systemctl --user start podman.socket` (Linux) and retry."
+	case isMissingRuntimeError(err):
+		if _, lookErr := exec.LookPath("podman"); lookErr == nil {
+			return "Podman is installed but Docker compatibility isn't enabled.\n" +
+				"Install podman-docker (or link `docker` to `podman`) so Dagger can find a container runtime, then retry."
+		}
+		return "No container runtime found.\n" +
+			"Install Docker (https://docs.docker.com/get-docker/) or Podman and retry."
+	case isDockerDaemonError(err):
+		return "Docker doesn't appear to be running.\n" +
+			"Start Docker Desktop (or the docker service) and retry."
+	}
+	return ""
+}
+
+// handleRuntimeError prints a helpful error message for container runtime issues
+func handleRuntimeError(err error) {
+	if hint := runtimeErrorHint(err); hint != "" {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n\n", hint)
+	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -36,3 +37,54 @@ func TestIsDockerDaemonError(t *testing.T) {
 		})
 	}
 }
+
+func TestRuntimeErrorHint(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "nil error",
+			err:      nil,
+			expected: "",
+		},
+		{
+			name:     "docker not running",
+			err:      errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?"),
+			expected: "Docker doesn't appear to be running",
+		},
+		{
+			name:     "socket permission denied",
+			err:      errors.New("permission denied while trying to connect to the Docker daemon socket at unix:///var/run/docker.sock"),
+			expected: "Permission denied",
+		},
+		{
+			name:     "podman not running",
+			err:      errors.New("Cannot connect to Podman. Please verify your connection to the Linux system using `podman system connection list`"),
+			expected: "Podman doesn't appear to be running",
+		},
+		{
+			name:     "no runtime",
+			err:      errors.New(`exec: "docker": executable file not found in $PATH`),
+			expected: "Podman",
+		},
+		{
+			name:     "other error",
+			err:      errors.New("some other error"),
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runtimeErrorHint(tt.err)
+			if tt.expected == "" && got != "" {
+				t.Errorf("runtimeErrorHint() = %q, want no hint", got)
+			}
+			if !strings.Contains(got, tt.expected) {
+				t.Errorf("runtimeErrorHint() = %q, want it to contain %q", got, tt.expected)
+			}
+		})
+	}
+}
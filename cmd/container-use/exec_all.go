@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var execAllCmd = &cobra.Command{
+	Use:   "exec-all [flags] -- <command> [<args>...]",
+	Short: "Run a command in several environments",
+	Long: `Run a command in every environment, or those matching --filter and --since, one after
+the other, e.g. to test the same fix in environments with different base images. The output
+and exit code of the command in each environment are reported, and the command fails if it
+failed in any of them.
+
+A single argument is run as a shell script, so it can use pipes, redirections and &&.
+Several arguments are run as a command and its arguments, quoted for the shell as given.
+
+As for the commands agents run, the changes the command makes are committed to the environments.`,
+	Args: cobra.MinimumNArgs(1),
+	Example: `# Run the tests in every environment with "node" in its title
+container-use exec-all --filter node -- npm test
+
+# Run a shell script, quoted as a single argument
+container-use exec-all -- 'npm ci && npm test 2>&1 | tail -20'
+
+# Collect the results as JSON
+container-use exec-all --json -- go version`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+		opts, err := listOptionsFromFlags(app)
+		if err != nil {
+			return err
+		}
+		shell, _ := app.Flags().GetString("shell")
+		command := shellCommand(args)
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		dag, err := connectDagger(ctx)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		results, err := repo.ExecAll(ctx, dag, opts, command, shell)
+		if err != nil {
+			return err
+		}
+
+		if ok, _ := app.Flags().GetBool("json"); ok {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(results); err != nil {
+				return err
+			}
+		} else {
+			if len(results) == 0 {
+				fmt.Println("No matching environments")
+				return nil
+			}
+			for _, result := range results {
+				if result.Error != "" {
+					fmt.Printf("=== %s (error: %s)\n", result.EnvironmentID, result.Error)
+				} else {
+					fmt.Printf("=== %s (exit code %d)\n", result.EnvironmentID, result.ExitCode)
+				}
+				if result.Output != "" {
+					fmt.Println(strings.TrimRight(result.Output, "\n"))
+				}
+			}
+		}
+
+		failed := 0
+		for _, result := range results {
+			if result.Failed() {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("command failed in %d of %d environments", failed, len(results))
+		}
+		return nil
+	},
+}
+
+// shellCommand returns the shell command running args: a single argument is a script, run as is, several are
+// a command and its arguments, each quoted so the shell passes them on unchanged.
+func shellCommand(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = environment.ShellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func init() {
+	execAllCmd.Flags().String("filter", "", "Only run the command in environments whose title contains this text")
+	execAllCmd.Flags().String("since", "", "Only run the command in environments updated since this time (e.g. 24h, 2025-01-31)")
+	execAllCmd.Flags().Int("limit", 0, "Maximum number of environments to run the command in, the most recently updated first (0 for no limit)")
+	execAllCmd.Flags().Int("offset", 0, "Number of environments to skip")
+	execAllCmd.Flags().String("shell", "sh", "Shell running the command in the environments")
+	execAllCmd.Flags().Bool("json", false, "Output the results in JSON")
+	rootCmd.AddCommand(execAllCmd)
+}
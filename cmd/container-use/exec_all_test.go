@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellCommand(t *testing.T) {
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("sh", "-c", shellCommand(args)).Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	// A single argument is a script
+	assert.Equal(t, "a\nb\n", run("echo a && echo b"))
+	// Several arguments are passed on as given
+	assert.Equal(t, "two words|it's|$HOME|a && b|", run("printf", "%s|", "two words", "it's", "$HOME", "a && b"))
+}
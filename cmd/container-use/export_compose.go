@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var exportComposeCmd = &cobra.Command{
+	Use:   "export-compose [<env>]",
+	Short: "Export an environment and its services as a Docker Compose file",
+	Long: `Write a docker-compose.yml running an environment and its services with Docker Compose,
+to keep working on an agent-built stack with your usual tooling, without container-use.
+
+The environment runs from its base image with the directory of the compose file mounted
+as its workdir, so run it from a checkout of the environment ("container-use checkout").
+Setup and install commands aren't run then: use --checkpoint to push the environment's
+current container state to a registry and run that image instead.
+
+Secrets are never resolved into the file. They are emitted as placeholders reading the
+variable of the same name, which must be set when running the compose file.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Print the compose file of an environment
+container-use export-compose fancy-mallard
+
+# Write it next to the checked out code
+container-use checkout fancy-mallard
+container-use export-compose fancy-mallard -o docker-compose.yml
+
+# Run the environment's container state, pushed to a registry
+container-use export-compose fancy-mallard --checkpoint registry.example.com/team/app:fancy-mallard`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+		output, _ := app.Flags().GetString("output")
+		checkpoint, _ := app.Flags().GetString("checkpoint")
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		envInfo, err := repo.Info(ctx, envID)
+		if err != nil {
+			return err
+		}
+
+		image := ""
+		if checkpoint != "" {
+			dag, err := connectDagger(ctx)
+			if err != nil {
+				return err
+			}
+			defer dag.Close()
+
+			env, err := repo.Get(ctx, dag, envID)
+			if err != nil {
+				return err
+			}
+			image, err = env.Checkpoint(ctx, checkpoint)
+			if err != nil {
+				return fmt.Errorf("failed to checkpoint environment: %w", err)
+			}
+		}
+
+		compose, err := envInfo.Compose(image)
+		if err != nil {
+			return err
+		}
+
+		if output == "" {
+			_, err := app.OutOrStdout().Write(compose)
+			return err
+		}
+		if err := os.WriteFile(output, compose, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(app.OutOrStdout(), "Wrote %s. Run it with: docker compose -f %s up -d\n", output, output)
+		return nil
+	},
+}
+
+func init() {
+	exportComposeCmd.Flags().StringP("output", "o", "", "Write the compose file to this path instead of stdout")
+	exportComposeCmd.Flags().String("checkpoint", "", "Push the environment's container state to this image reference and run it instead of the base image")
+	rootCmd.AddCommand(exportComposeCmd)
+}
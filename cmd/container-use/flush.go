@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var flushCmd = &cobra.Command{
+	Use:   "flush [<env>]",
+	Short: "Commit the changes an environment has left uncommitted",
+	Long: `Commit the changes accumulated in an environment configured with the per-session
+commit granularity (see "container-use config commit-granularity"), without waiting for
+the agent's session to end. Also copies the git notes whose propagation is pending to your
+repository (see "container-use config notes-propagation-window").
+Does nothing if there are no uncommitted changes or pending notes.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Commit the work in progress before reviewing it
+container-use flush fancy-mallard
+container-use diff fancy-mallard`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		if err := repo.Flush(ctx, envID); err != nil {
+			return fmt.Errorf("failed to commit environment changes: %w", err)
+		}
+
+		fmt.Printf("Changes of environment '%s' committed.\n", envID)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(flushCmd)
+}
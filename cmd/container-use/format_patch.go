@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var formatPatchCmd = &cobra.Command{
+	Use:   "format-patch [<env>]",
+	Short: "Export an environment's commits as patch files",
+	Long: `Write the commits an agent made in an environment as a series of patch files,
+one per commit, as git format-patch does. Authorship and commit messages are
+preserved, so the patches can be sent upstream or applied with git am.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Export the commits of an environment to patches/
+container-use format-patch fancy-mallard -o patches/
+
+# Apply them on another branch
+git am patches/*.patch`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.OpenReadOnly(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		outDir, _ := app.Flags().GetString("output-directory")
+		patches, err := repo.FormatPatch(ctx, envID, outDir)
+		if err != nil {
+			return err
+		}
+		if len(patches) == 0 {
+			fmt.Fprintf(app.ErrOrStderr(), "Environment '%s' has no commits to export\n", envID)
+			return nil
+		}
+		for _, patch := range patches {
+			fmt.Fprintln(app.OutOrStdout(), patch)
+		}
+		return nil
+	},
+}
+
+func init() {
+	formatPatchCmd.Flags().StringP("output-directory", "o", ".", "Directory to write the patches to")
+	rootCmd.AddCommand(formatPatchCmd)
+}
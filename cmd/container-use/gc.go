@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Clean up what deleted environments left behind",
+	Long: `Remove the git worktree records and remote-tracking branches left behind by deleted environments.
+
+With --dagger, also prune the Dagger engine cache of the container states no environment
+references anymore: those of deleted environments and the earlier states of existing ones.
+The environments of every repository are kept, since they share the engine. The container
+state of each environment is loaded first, which may take a while if it has to be rebuilt.
+Note that the engine cache is also shared with anything else using Dagger on this machine.`,
+	Args: cobra.NoArgs,
+	Example: `# Clean up after deleted environments
+container-use gc
+
+# Show how much space pruning the Dagger engine cache would reclaim
+container-use gc --dagger --dry-run
+
+# Also prune the Dagger engine cache
+container-use gc --dagger`,
+	RunE: func(app *cobra.Command, _ []string) error {
+		ctx := app.Context()
+		pruneDagger, _ := app.Flags().GetBool("dagger")
+		dryRun, _ := app.Flags().GetBool("dry-run")
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		if !dryRun {
+			if err := repo.Prune(ctx); err != nil {
+				return err
+			}
+		}
+		if !pruneDagger {
+			return nil
+		}
+
+		dag, err := connectDagger(ctx)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		report, err := repo.PruneDagger(ctx, dag, dryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dagger engine cache: %s used, %s reclaimable (kept the state of %d environments)\n",
+			humanize.IBytes(uint64(report.UsedBytes)), humanize.IBytes(uint64(report.ReclaimableBytes)), report.Environments)
+		if dryRun {
+			fmt.Println("Nothing was pruned (dry run). Run again without --dry-run to reclaim it.")
+		} else {
+			fmt.Printf("Reclaimed %s\n", humanize.IBytes(uint64(report.ReclaimedBytes)))
+		}
+		return nil
+	},
+}
+
+func init() {
+	gcCmd.Flags().Bool("dagger", false, "Also prune the Dagger engine cache of container states no environment references")
+	gcCmd.Flags().Bool("dry-run", false, "Report what would be pruned without pruning anything")
+	rootCmd.AddCommand(gcCmd)
+}
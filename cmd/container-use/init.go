@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dagger/container-use/cmd/container-use/agent"
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+// mcpConfigLocations lists where agents that use the mcpServers JSON format expect it.
+var mcpConfigLocations = map[string]string{
+	"claude":  ".mcp.json",
+	"cursor":  ".cursor/mcp.json",
+	"amazonq": ".amazonq/mcp.json",
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Set up container-use in the current repository",
+	Long: `Scaffold container-use for the current repository.
+This creates .container-use/environment.json, writes the container-use rules for
+your agent, and prints the MCP server configuration to register container-use with it.
+
+The environment configuration is tailored to the project type, detected from files
+such as package.json, pyproject.toml, go.mod or Cargo.toml and their lockfiles: a matching
+base image and the commands installing its dependencies. Use --minimal for the default
+settings, and "container-use config suggest" to see the suggestions without applying them.
+An existing environment configuration is left untouched.`,
+	Example: `# Set up container-use with generic agent rules (AGENT.md)
+container-use init
+
+# Set up container-use for Claude Code
+container-use init --agent claude
+
+# Use the default environment configuration, whatever the project type
+container-use init --minimal`,
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		ctx := app.Context()
+		agentKey, _ := app.Flags().GetString("agent")
+		minimal, _ := app.Flags().GetBool("minimal")
+
+		out, err := repository.RunGitCommand(ctx, ".", "rev-parse", "--show-toplevel")
+		if err != nil {
+			return errors.New("you must be in a git repository to use container-use")
+		}
+		// Agent rules are written relative to the working directory, so run from the repository root.
+		if err := os.Chdir(strings.TrimSpace(out)); err != nil {
+			return err
+		}
+
+		return initRepository(agentKey, minimal, app.OutOrStdout())
+	},
+}
+
+// suggestedConfig returns the environment configuration suggested for the project in dir. If the repository holds
+// several kinds of projects, the first detected one is set up, see repository.DetectProjects.
+func suggestedConfig(dir string, w io.Writer) *environment.EnvironmentConfig {
+	config := environment.DefaultConfig()
+	projects := repository.DetectProjects(dir)
+	if len(projects) == 0 {
+		return config
+	}
+	project := projects[0]
+	fmt.Fprintf(w, "✓ Detected a %s project (%s)\n", project.Name, project.Marker)
+	for _, other := range projects[1:] {
+		fmt.Fprintf(w, "! Also detected a %s project (%s), not set up: see `container-use config suggest`\n", other.Name, other.Marker)
+	}
+	config.BaseImage = project.BaseImage
+	config.SetupCommands = project.SetupCommands
+	config.InstallCommands = project.InstallCommands
+	return config
+}
+
+// initRepository scaffolds container-use in the repository rooted at the current directory.
+// Unless minimal is set, the environment configuration is tailored to the detected project type.
+func initRepository(agentKey string, minimal bool, w io.Writer) error {
+	configPath := environment.ConfigPath(".")
+	if _, err := os.Stat(configPath); err == nil {
+		fmt.Fprintf(w, "✓ Keeping existing %s\n", configPath)
+	} else if os.IsNotExist(err) {
+		config := environment.DefaultConfig()
+		if !minimal {
+			config = suggestedConfig(".", w)
+		}
+		if err := config.Save("."); err != nil {
+			return fmt.Errorf("failed to save configuration: %w", err)
+		}
+		fmt.Fprintf(w, "✓ Created %s (base image %s)\n", configPath, config.BaseImage)
+	} else {
+		return err
+	}
+
+	if err := agent.SaveRules(agentKey); err != nil {
+		return fmt.Errorf("failed to save agent rules: %w", err)
+	}
+	if agentKey == "" {
+		fmt.Fprintln(w, "✓ Saved container-use rules to AGENT.md")
+	} else {
+		fmt.Fprintf(w, "✓ Saved %s container-use rules\n", agentKey)
+	}
+
+	snippet, err := agent.MCPServerSnippet()
+	if err != nil {
+		return err
+	}
+	if location, ok := mcpConfigLocations[agentKey]; ok {
+		fmt.Fprintf(w, "\nAdd the container-use MCP server to %s:\n\n", location)
+	} else if agentKey != "" {
+		fmt.Fprintf(w, "\nRun `container-use config agent %s` to register the MCP server, or add it manually:\n\n", agentKey)
+	} else {
+		fmt.Fprintf(w, "\nAdd the container-use MCP server to your agent's MCP configuration:\n\n")
+	}
+	fmt.Fprintln(w, string(snippet))
+
+	return nil
+}
+
+func init() {
+	initCmd.Flags().String("agent", "", "Agent to write rules for (claude, goose, cursor, codex, amazonq)")
+	initCmd.Flags().Bool("minimal", false, "Write the default environment configuration instead of one tailored to the project type")
+	rootCmd.AddCommand(initCmd)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/cmd/container-use/agent"
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitRepository(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	var out bytes.Buffer
+	require.NoError(t, initRepository("claude", false, &out))
+
+	assert.FileExists(t, filepath.Join(dir, ".container-use", "environment.json"))
+	assert.FileExists(t, filepath.Join(dir, "CLAUDE.md"))
+
+	config := &environment.EnvironmentConfig{}
+	require.NoError(t, config.Load(dir))
+	assert.Equal(t, environment.DefaultConfig(), config)
+
+	// The printed snippet must be valid mcpServers JSON
+	output := out.String()
+	snippet := output[strings.Index(output, "{") : strings.LastIndex(output, "}")+1]
+	var mcpConfig agent.MCPServersConfig
+	require.NoError(t, json.Unmarshal([]byte(snippet), &mcpConfig))
+	require.Contains(t, mcpConfig.MCPServers, "container-use")
+	assert.Equal(t, []string{"stdio"}, mcpConfig.MCPServers["container-use"].Args)
+
+	t.Run("KeepsExistingConfig", func(t *testing.T) {
+		configPath := filepath.Join(dir, ".container-use", "environment.json")
+		require.NoError(t, os.WriteFile(configPath, []byte(`{"base_image": "golang:1.24"}`), 0644))
+
+		out.Reset()
+		require.NoError(t, initRepository("", false, &out))
+
+		data, err := os.ReadFile(configPath)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"base_image": "golang:1.24"}`, string(data))
+		assert.FileExists(t, filepath.Join(dir, "AGENT.md"))
+	})
+}
+
+func TestInitRepositoryDetectsProjectType(t *testing.T) {
+	for _, tc := range []struct {
+		marker          string
+		baseImage       string
+		installCommands []string
+	}{
+		{"package.json", "node:22", []string{"npm install"}},
+		{"requirements.txt", "python:3.12", []string{"pip install -r requirements.txt"}},
+		{"go.mod", "golang:1.24", []string{"go mod download"}},
+		{"Cargo.toml", "rust:1", []string{"cargo fetch"}},
+	} {
+		t.Run(tc.marker, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Chdir(dir)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, tc.marker), nil, 0644))
+
+			var out bytes.Buffer
+			require.NoError(t, initRepository("", false, &out))
+			assert.Contains(t, out.String(), tc.marker)
+
+			config := environment.DefaultConfig()
+			require.NoError(t, config.Load(dir))
+			assert.Equal(t, tc.baseImage, config.BaseImage)
+			assert.Equal(t, tc.installCommands, config.InstallCommands)
+		})
+	}
+
+	t.Run("minimal", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Chdir(dir)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), nil, 0644))
+
+		var out bytes.Buffer
+		require.NoError(t, initRepository("", true, &out))
+
+		config := &environment.EnvironmentConfig{}
+		require.NoError(t, config.Load(dir))
+		assert.Equal(t, environment.DefaultConfig(), config)
+	})
+}
@@ -17,7 +17,7 @@ var inspectCmd = &cobra.Command{
 	ValidArgsFunction: suggestEnvironments,
 	RunE: func(app *cobra.Command, args []string) error {
 		ctx := app.Context()
-		repo, err := repository.Open(ctx, ".")
+		repo, err := repository.OpenReadOnly(ctx, ".")
 		if err != nil {
 			return err
 		}
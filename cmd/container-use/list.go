@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
 
+	"github.com/dagger/container-use/environment"
 	"github.com/dagger/container-use/repository"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
@@ -14,16 +17,30 @@ var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all environments",
 	Long: `Display all active environments with their IDs, titles, and timestamps.
-Use -q for environment IDs only, useful for scripting.`,
+Use -q for environment IDs only, useful for scripting.
+Use --filter, --since and --limit to narrow down the list.`,
+	Example: `# Environments updated during the last day
+container-use list --since 24h
+
+# The 10 most recently updated environments with "api" in their title
+container-use list --filter api --limit 10`,
 	RunE: func(app *cobra.Command, _ []string) error {
 		ctx := app.Context()
-		repo, err := repository.Open(ctx, ".")
+		opts, err := listOptionsFromFlags(app)
 		if err != nil {
 			return err
 		}
-		envInfos, err := repo.List(ctx)
-		if err != nil {
+		var envInfos []*environment.EnvironmentInfo
+		repo, err := repository.OpenReadOnly(ctx, ".")
+		switch {
+		case errors.Is(err, repository.ErrNotInitialized):
+			// No environment was ever created in this repository
+		case err != nil:
 			return err
+		default:
+			if envInfos, err = repo.List(ctx, opts); err != nil {
+				return err
+			}
 		}
 		if quiet, _ := app.Flags().GetBool("quiet"); quiet {
 			for _, envInfo := range envInfos {
@@ -33,16 +50,44 @@ Use -q for environment IDs only, useful for scripting.`,
 		}
 
 		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(tw, "ID\tTITLE\tCREATED\tUPDATED")
+		fmt.Fprintln(tw, "ID\tTITLE\tCREATED\tUPDATED\tLATEST COMMENT")
 
 		defer tw.Flush()
 		for _, envInfo := range envInfos {
-			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", envInfo.ID, truncate(app, envInfo.State.Title, 40), humanize.Time(envInfo.State.CreatedAt), humanize.Time(envInfo.State.UpdatedAt))
+			comments, err := repo.Comments(ctx, envInfo.ID)
+			if err != nil {
+				return err
+			}
+			latestComment := ""
+			if len(comments) > 0 {
+				latest := comments[len(comments)-1]
+				latestComment = latest.Author + ": " + strings.Join(strings.Fields(latest.Text), " ")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", envInfo.ID, truncate(app, envInfo.State.Title, 40), humanize.Time(envInfo.State.CreatedAt), humanize.Time(envInfo.State.UpdatedAt), truncate(app, latestComment, 40))
 		}
 		return nil
 	},
 }
 
+func listOptionsFromFlags(app *cobra.Command) (repository.ListOptions, error) {
+	limit, _ := app.Flags().GetInt("limit")
+	offset, _ := app.Flags().GetInt("offset")
+	filter, _ := app.Flags().GetString("filter")
+	opts := repository.ListOptions{
+		Limit:         limit,
+		Offset:        offset,
+		TitleContains: filter,
+	}
+	if since, _ := app.Flags().GetString("since"); since != "" {
+		updatedSince, err := repository.ParseUpdatedSince(since)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --since: %w", err)
+		}
+		opts.UpdatedSince = updatedSince
+	}
+	return opts, nil
+}
+
 func truncate(app *cobra.Command, s string, max int) string {
 	if noTrunc, _ := app.Flags().GetBool("no-trunc"); noTrunc {
 		return s
@@ -56,5 +101,9 @@ func truncate(app *cobra.Command, s string, max int) string {
 func init() {
 	listCmd.Flags().BoolP("quiet", "q", false, "Display only environment IDs")
 	listCmd.Flags().BoolP("no-trunc", "", false, "Don't truncate output")
+	listCmd.Flags().Int("limit", 0, "Maximum number of environments to display (0 for no limit)")
+	listCmd.Flags().Int("offset", 0, "Number of environments to skip")
+	listCmd.Flags().String("filter", "", "Only display environments whose title contains this text")
+	listCmd.Flags().String("since", "", "Only display environments updated since this time (e.g. 24h, 2025-01-31)")
 	rootCmd.AddCommand(listCmd)
 }
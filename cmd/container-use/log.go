@@ -30,7 +30,7 @@ container-use log`,
 		ctx := app.Context()
 
 		// Ensure we're in a git repository
-		repo, err := repository.Open(ctx, ".")
+		repo, err := repository.OpenReadOnly(ctx, ".")
 		if err != nil {
 			return err
 		}
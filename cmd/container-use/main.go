@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/signal"
 	"runtime"
@@ -21,9 +22,18 @@ var (
 		Short: "Containerized environments for coding agents",
 		Long: `Container Use creates isolated development environments for AI agents.
 Each environment runs in its own container with dedicated git branches.`,
+		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+			if trace, _ := cmd.Flags().GetBool("trace-git"); trace {
+				repository.SetGitTrace(os.Stderr)
+			}
+		},
 	}
 )
 
+func init() {
+	rootCmd.PersistentFlags().Bool("trace-git", false, "Print every git command run, and its exit status, to stderr (or set CONTAINER_USE_TRACE_GIT=1)")
+}
+
 func main() {
 	ctx := context.Background()
 	sigusrCh := make(chan os.Signal, 1)
@@ -45,13 +55,18 @@ func main() {
 		return
 	}
 
-	if err := fang.Execute(
+	err := fang.Execute(
 		ctx,
 		rootCmd,
 		fang.WithVersion(version),
 		fang.WithCommit(commit),
 		fang.WithNotifySignal(os.Interrupt, os.Kill, syscall.SIGTERM),
-	); err != nil {
+	)
+	// Commands may have deferred the propagation of git notes
+	if err := repository.FlushNotes(ctx); err != nil {
+		slog.Error("Failed to propagate git notes", "err", err)
+	}
+	if err != nil {
 		os.Exit(1)
 	}
 }
@@ -73,12 +88,12 @@ func dumpStacks() {
 func suggestEnvironments(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	ctx := cmd.Context()
 
-	repo, err := repository.Open(ctx, ".")
+	repo, err := repository.OpenReadOnly(ctx, ".")
 	if err != nil {
 		return nil, cobra.ShellCompDirectiveError
 	}
 
-	envs, err := repo.List(ctx)
+	envs, err := repo.List(ctx, repository.ListOptions{})
 	if err != nil {
 		return nil, cobra.ShellCompDirectiveError
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 
@@ -10,7 +11,9 @@ import (
 )
 
 var (
-	mergeDelete bool
+	mergeDelete       bool
+	mergeDryRun       bool
+	mergeTargetBranch string
 )
 
 var mergeCmd = &cobra.Command{
@@ -20,6 +23,11 @@ var mergeCmd = &cobra.Command{
 This makes the agent's work permanent in your repository.
 Your working directory will be automatically stashed and restored.
 
+Use --target-branch (or --into) to merge into another branch without switching to it.
+If the merge conflicts, it's abandoned and the branch is left as it was. If the branch
+is checked out in another worktree, the merge happens there instead, like in the
+current one: its work in progress is stashed and restored, and conflicts are left to resolve.
+
 If no environment is specified, automatically selects from environments 
 that are descendants of the current HEAD.`,
 	Args:              cobra.MaximumNArgs(1),
@@ -27,6 +35,12 @@ that are descendants of the current HEAD.`,
 	Example: `# Accept agent's work into current branch
 container-use merge backend-api
 
+# Preview the changes the merge would bring, without merging
+container-use merge --dry-run backend-api
+
+# Merge into another branch, without switching to it
+container-use merge --into release backend-api
+
 # Merge and delete the environment after successful merge
 container-use merge -d backend-api
 container-use merge --delete backend-api
@@ -47,7 +61,15 @@ container-use merge`,
 			return err
 		}
 
-		if err := repo.Merge(ctx, envID, os.Stdout); err != nil {
+		opts := repository.MergeOptions{TargetBranch: mergeTargetBranch}
+		if mergeDryRun {
+			return previewMerge(ctx, repo, envID, opts)
+		}
+
+		if err := repo.Merge(ctx, envID, os.Stdout, opts); err != nil {
+			if errors.Is(err, repository.ErrMergeConflict) && opts.TargetBranch == "" {
+				return fmt.Errorf("%w\nResolve the conflicts and commit the result, or run `git merge --abort` to cancel", err)
+			}
 			return fmt.Errorf("failed to merge environment: %w", err)
 		}
 
@@ -55,6 +77,18 @@ container-use merge`,
 	},
 }
 
+// previewMerge shows what merging or applying the environment would change, without changing anything.
+func previewMerge(ctx context.Context, repo *repository.Repository, envID string, opts repository.MergeOptions) error {
+	if err := repo.PreviewMerge(ctx, envID, os.Stdout, opts); err != nil {
+		if errors.Is(err, repository.ErrMergeConflict) {
+			return fmt.Errorf("%w\nNo changes were made (dry run)", err)
+		}
+		return fmt.Errorf("failed to preview environment changes: %w", err)
+	}
+	fmt.Printf("No changes were made (dry run). Run again without --dry-run to bring the changes of '%s' to your branch.\n", envID)
+	return nil
+}
+
 func deleteAfterMerge(ctx context.Context, repo *repository.Repository, env string, delete bool, verb string) error {
 	if !delete {
 		fmt.Printf("Environment '%s' %s successfully.\n", env, verb)
@@ -69,6 +103,9 @@ func deleteAfterMerge(ctx context.Context, repo *repository.Repository, env stri
 
 func init() {
 	mergeCmd.Flags().BoolVarP(&mergeDelete, "delete", "d", false, "Delete the environment after successful merge")
+	mergeCmd.Flags().BoolVar(&mergeDryRun, "dry-run", false, "Show the changes the merge would bring without merging")
+	mergeCmd.Flags().StringVar(&mergeTargetBranch, "target-branch", "", "Merge into this branch instead of the current one, without switching to it")
+	mergeCmd.Flags().StringVar(&mergeTargetBranch, "into", "", "Same as --target-branch")
 
 	rootCmd.AddCommand(mergeCmd)
 }
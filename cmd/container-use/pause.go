@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var pauseCmd = &cobra.Command{
+	Use:     "pause [<env>]",
+	Aliases: []string{"freeze"},
+	Short:   "Set an environment aside and stop its services to free resources",
+	Long: `Pause an environment: commands can't be run in it until it is resumed.
+Its services and tunnels run in the MCP server of the agent that started them,
+which stops them once it notices the environment is paused, within a minute.
+The environment's container state is preserved: use "container-use resume" to
+keep working where the agent left off.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Pause an environment that is no longer being worked on
+container-use pause fancy-mallard
+
+# Auto-select environment
+container-use pause`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		if err := repo.Pause(ctx, envID); err != nil {
+			return err
+		}
+
+		fmt.Printf("Environment '%s' paused. Run 'container-use resume %s' to resume it.\n", envID, envID)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pauseCmd)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [<env>]",
+	Short: "Re-run an environment's commands to check they are reproducible",
+	Long: `Replay the commands an environment ran, in order, in a fresh environment built
+from the same configuration, and report any command whose exit code or output
+differs from the original run. This validates that an environment's work is
+reproducible and catches non-determinism.
+
+The replay environment is discarded afterwards: the original environment is not modified.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Check that an environment's work is reproducible
+container-use replay fancy-mallard`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		dag, err := connectDagger(ctx)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		return repo.Replay(ctx, dag, envID, os.Stdout)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+}
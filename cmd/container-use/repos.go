@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var reposCmd = &cobra.Command{
+	Use:   "repos",
+	Short: "List the repositories container-use manages on this machine",
+	Long: `List the forks container-use keeps for every repository it was used in, with the
+source repositories using them, their number of environments and their disk size.
+Sources which no longer exist are marked as missing: their forks can be deleted to
+reclaim the space, along with their worktrees.`,
+	Args: cobra.NoArgs,
+	Example: `# Find the forks of projects that were deleted or moved
+container-use repos`,
+	RunE: func(app *cobra.Command, _ []string) error {
+		repos, err := repository.ManagedRepos(app.Context())
+		if err != nil {
+			return err
+		}
+		if quiet, _ := app.Flags().GetBool("quiet"); quiet {
+			for _, repo := range repos {
+				fmt.Fprintln(app.OutOrStdout(), repo.ForkPath)
+			}
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(app.OutOrStdout(), 0, 0, 2, ' ', 0)
+		defer tw.Flush()
+		fmt.Fprintln(tw, "NAME\tSOURCE\tENVIRONMENTS\tSIZE")
+		for _, repo := range repos {
+			sources := make([]string, 0, len(repo.SourcePaths))
+			for _, source := range repo.SourcePaths {
+				if _, err := os.Stat(source); os.IsNotExist(err) {
+					source += " (missing)"
+				}
+				sources = append(sources, source)
+			}
+			if len(sources) == 0 {
+				sources = append(sources, "-")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", repo.Name, strings.Join(sources, ", "), repo.Environments, humanize.IBytes(uint64(repo.SizeBytes)))
+		}
+		return nil
+	},
+}
+
+func init() {
+	reposCmd.Flags().BoolP("quiet", "q", false, "Display only the paths of the forks")
+	rootCmd.AddCommand(reposCmd)
+}
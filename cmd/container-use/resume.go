@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var resumeCmd = &cobra.Command{
+	Use:     "resume [<env>]",
+	Aliases: []string{"thaw"},
+	Short:   "Resume a paused environment",
+	Long: `Resume an environment paused with "container-use pause".
+Commands can be run in it again, its services are restarted by the next one.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Resume a paused environment
+container-use resume fancy-mallard
+
+# Auto-select environment
+container-use resume`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		if err := repo.Resume(ctx, envID); err != nil {
+			return err
+		}
+
+		fmt.Printf("Environment '%s' resumed.\n", envID)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resumeCmd)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var savepointCmd = &cobra.Command{
+	Use:   "savepoint",
+	Short: "Save and restore named states of environments",
+	Long: `Record the state of an environment under a name, e.g. "before refactor", to bring it back
+to that state later. Restoring a savepoint reverts the files and the container of the
+environment with a new commit, so the work done since stays in its history.
+
+Unlike checkpoints, savepoints aren't published as images: they live in the Dagger engine.`,
+}
+
+var savepointCreateCmd = &cobra.Command{
+	Use:   "create <env> <name>",
+	Short: "Save the current state of an environment",
+	Args:  cobra.ExactArgs(2),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return suggestEnvironments(cmd, args, toComplete)
+		}
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	},
+	Example: `# Save the state of the environment before a risky change
+container-use savepoint create fancy-mallard "before refactor"`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		dag, err := connectDagger(ctx)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		if err := repo.Savepoint(ctx, dag, args[0], args[1]); err != nil {
+			return err
+		}
+
+		fmt.Printf("Savepoint '%s' created. Run 'container-use savepoint restore %s %q' to come back to it.\n", args[1], args[0], args[1])
+		return nil
+	},
+}
+
+var savepointListCmd = &cobra.Command{
+	Use:               "list [<env>]",
+	Short:             "List the savepoints of an environment",
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.OpenReadOnly(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		savepoints, err := repo.Savepoints(ctx, envID)
+		if err != nil {
+			return err
+		}
+		if len(savepoints) == 0 {
+			fmt.Printf("No savepoints in environment '%s'\n", envID)
+			return nil
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer tw.Flush()
+		fmt.Fprintln(tw, "NAME\tCREATED")
+		for _, savepoint := range savepoints {
+			fmt.Fprintf(tw, "%s\t%s\n", savepoint.Name, humanize.Time(savepoint.CreatedAt))
+		}
+		return nil
+	},
+}
+
+var savepointRestoreCmd = &cobra.Command{
+	Use:   "restore <env> <name>",
+	Short: "Bring an environment back to a savepoint",
+	Args:  cobra.ExactArgs(2),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return suggestEnvironments(cmd, args, toComplete)
+		}
+		// Complete the savepoints of the environment
+		repo, err := repository.OpenReadOnly(cmd.Context(), ".")
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		savepoints, err := repo.Savepoints(cmd.Context(), args[0])
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		names := []string{}
+		for _, savepoint := range savepoints {
+			names = append(names, savepoint.Name)
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	},
+	Example: `# Undo everything done since the savepoint
+container-use savepoint restore fancy-mallard "before refactor"`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		dag, err := connectDagger(ctx)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+
+		if err := repo.RestoreTag(ctx, dag, args[0], args[1]); err != nil {
+			return err
+		}
+
+		fmt.Printf("Environment '%s' restored to savepoint '%s'\n", args[0], args[1])
+		return nil
+	},
+}
+
+func init() {
+	savepointCmd.AddCommand(savepointCreateCmd)
+	savepointCmd.AddCommand(savepointListCmd)
+	savepointCmd.AddCommand(savepointRestoreCmd)
+	rootCmd.AddCommand(savepointCmd)
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
-	"os"
 
 	"dagger.io/dagger"
 	"github.com/dagger/container-use/mcpserver"
@@ -16,24 +17,54 @@ var stdioCmd = &cobra.Command{
 	RunE: func(app *cobra.Command, _ []string) error {
 		ctx := app.Context()
 
-		slog.Info("connecting to dagger")
+		maxConcurrentBuilds, err := app.Flags().GetInt("max-concurrent-builds")
+		if err != nil {
+			return err
+		}
 
-		dag, err := dagger.Connect(ctx, dagger.WithLogOutput(logWriter))
+		idleTimeout, err := app.Flags().GetDuration("idle-timeout")
 		if err != nil {
-			slog.Error("Error starting dagger", "error", err)
+			return err
+		}
 
-			if isDockerDaemonError(err) {
-				handleDockerDaemonError()
-			}
+		metricsAddr, err := app.Flags().GetString("metrics-addr")
+		if err != nil {
+			return err
+		}
 
-			os.Exit(1)
+		readOnly, err := app.Flags().GetBool("read-only")
+		if err != nil {
+			return err
+		}
+
+		// Connecting to dagger is deferred to the first tool needing a container, so the tools only using git
+		// keep working without a container runtime.
+		connect := func(ctx context.Context) (*dagger.Client, error) {
+			slog.Info("connecting to dagger")
+			dag, err := dagger.Connect(ctx, dagger.WithLogOutput(logWriter))
+			if err != nil {
+				slog.Error("Error starting dagger", "error", err)
+				if hint := runtimeErrorHint(err); hint != "" {
+					return nil, fmt.Errorf("failed to connect to dagger: %s: %w", hint, err)
+				}
+				return nil, fmt.Errorf("failed to connect to dagger: %w", err)
+			}
+			return dag, nil
 		}
-		defer dag.Close()
 
-		return mcpserver.RunStdioServer(ctx, dag)
+		return mcpserver.RunStdioServer(ctx, connect, mcpserver.ServerOptions{
+			MaxConcurrentBuilds: maxConcurrentBuilds,
+			IdleTimeout:         idleTimeout,
+			MetricsAddr:         metricsAddr,
+			ReadOnly:            readOnly,
+		})
 	},
 }
 
 func init() {
+	stdioCmd.Flags().Int("max-concurrent-builds", 0, "Maximum number of environment builds running at once per repository (0 for unlimited)")
+	stdioCmd.Flags().Duration("idle-timeout", 0, "Shut the server down when no tool is called for this long, e.g. 2h (0 to never shut down)")
+	stdioCmd.Flags().String("metrics-addr", "", "Serve Prometheus metrics of tool calls and operations at /metrics on this address, e.g. localhost:9090")
+	stdioCmd.Flags().Bool("read-only", false, "Keep agents from changing environments: files can be read and commands run, but their changes are discarded")
 	rootCmd.AddCommand(stdioCmd)
 }
@@ -7,7 +7,6 @@ import (
 	"os/exec"
 	"syscall"
 
-	"dagger.io/dagger"
 	"github.com/dagger/container-use/repository"
 	"github.com/spf13/cobra"
 )
@@ -37,25 +36,13 @@ container-use terminal`,
 			return err
 		}
 
-		// FIXME(aluzzardi): This is a hack to make sure we're wrapped in `dagger run` since `Terminal()` only works with the CLI.
-		// If not, it will auto-wrap this command in a `dagger run`.
-		if _, ok := os.LookupEnv("DAGGER_SESSION_TOKEN"); !ok {
-			daggerBin, err := exec.LookPath("dagger")
-			if err != nil {
-				if errors.Is(err, exec.ErrNotFound) {
-					return fmt.Errorf("dagger is not installed. Please install it from https://docs.dagger.io/install/")
-				}
-				return fmt.Errorf("failed to look up dagger binary: %w", err)
-			}
-			return syscall.Exec(daggerBin, append([]string{"dagger", "run"}, os.Args...), os.Environ())
+		if err := ensureDaggerRun(); err != nil {
+			return err
 		}
 
-		dag, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
+		dag, err := connectDagger(ctx)
 		if err != nil {
-			if isDockerDaemonError(err) {
-				handleDockerDaemonError()
-			}
-			return fmt.Errorf("failed to connect to dagger: %w", err)
+			return err
 		}
 		defer dag.Close()
 
@@ -73,6 +60,22 @@ container-use terminal`,
 	},
 }
 
+// ensureDaggerRun re-executes the command wrapped in `dagger run` unless it already is.
+// FIXME(aluzzardi): This is a hack to make sure we're wrapped in `dagger run` since `Terminal()` only works with the CLI.
+func ensureDaggerRun() error {
+	if _, ok := os.LookupEnv("DAGGER_SESSION_TOKEN"); ok {
+		return nil
+	}
+	daggerBin, err := exec.LookPath("dagger")
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("dagger is not installed. Please install it from https://docs.dagger.io/install/")
+		}
+		return fmt.Errorf("failed to look up dagger binary: %w", err)
+	}
+	return syscall.Exec(daggerBin, append([]string{"dagger", "run"}, os.Args...), os.Environ())
+}
+
 func init() {
 	rootCmd.AddCommand(terminalCmd)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/spf13/cobra"
+)
+
+var tidyCmd = &cobra.Command{
+	Use:   "tidy [<env>]",
+	Short: "Clean up the commit history of an environment",
+	Long: `Clean up the commits of an environment before merging it, e.g. squashing the commit of
+every file write of the agent into a few meaningful ones, with an interactive rebase
+("git rebase -i") in your editor. The rebase covers the commits of the environment that
+aren't on your current branch. The environment's branch then has the cleaned up history,
+ready to merge.
+
+Aborting the rebase, e.g. by emptying the todo list, leaves the history of the
+environment unchanged. A rebase that stops before the end, e.g. at an "edit",
+is yours to finish with "git rebase --continue" in the environment's worktree;
+run tidy again afterwards to save the environment's new history.
+
+If no environment is specified, automatically selects from environments
+that are descendants of the current HEAD.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: suggestEnvironments,
+	Example: `# Squash and reword the agent's commits, then merge them
+container-use tidy fancy-mallard
+container-use merge fancy-mallard`,
+	RunE: func(app *cobra.Command, args []string) error {
+		ctx := app.Context()
+
+		repo, err := repository.Open(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		envID, err := resolveEnvironmentID(ctx, repo, args)
+		if err != nil {
+			return err
+		}
+
+		if err := repo.Tidy(ctx, envID, os.Stdout); err != nil {
+			if errors.Is(err, repository.ErrNothingToTidy) {
+				fmt.Printf("Environment '%s' has no commits to tidy.\n", envID)
+				return nil
+			}
+			return err
+		}
+
+		fmt.Printf("History of environment '%s' tidied.\n", envID)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tidyCmd)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/dustin/go-humanize/english"
+	"github.com/spf13/cobra"
+)
+
+var treeCmd = &cobra.Command{
+	Use:   "tree",
+	Short: "Show where environments branched off your current branch",
+	Long: `Display environments grouped by the commit of your current branch they branched off,
+from the most recent commit to the oldest. Each environment shows how many commits it has
+that aren't in your branch yet, or whether it's already merged.`,
+	Example: `# See which environments are outstanding on the current branch
+container-use tree`,
+	Args: cobra.NoArgs,
+	RunE: func(app *cobra.Command, _ []string) error {
+		ctx := app.Context()
+		repo, err := repository.OpenReadOnly(ctx, ".")
+		if err != nil {
+			return err
+		}
+
+		tree, err := repo.Tree(ctx)
+		if err != nil {
+			return err
+		}
+		printTree(os.Stdout, tree)
+		return nil
+	},
+}
+
+func printTree(w io.Writer, tree *repository.EnvironmentTree) {
+	fmt.Fprintln(w, tree.Branch)
+	hasUnrelated := len(tree.Unrelated) > 0
+	for i, base := range tree.Bases {
+		last := i == len(tree.Bases)-1 && !hasUnrelated
+		commit := base.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		position := "HEAD"
+		if base.Behind > 0 {
+			position = english.Plural(base.Behind, "commit", "") + " behind"
+		}
+		fmt.Fprintf(w, "%s%s %s (%s)\n", treeBranch(last), commit, base.Subject, position)
+		printTreeEnvironments(w, treeIndent(last), base.Environments)
+	}
+	if hasUnrelated {
+		fmt.Fprintf(w, "%s(no common history)\n", treeBranch(true))
+		printTreeEnvironments(w, treeIndent(true), tree.Unrelated)
+	}
+}
+
+func printTreeEnvironments(w io.Writer, indent string, envs []*repository.EnvironmentBranch) {
+	for i, env := range envs {
+		status := "merged"
+		if !env.Merged() {
+			status = english.Plural(env.Ahead, "commit", "") + " ahead"
+		}
+		fmt.Fprintf(w, "%s%s%s  %s  [%s]\n", indent, treeBranch(i == len(envs)-1), env.ID, env.State.Title, status)
+	}
+}
+
+func treeBranch(last bool) string {
+	if last {
+		return "└── "
+	}
+	return "├── "
+}
+
+func treeIndent(last bool) string {
+	if last {
+		return "    "
+	}
+	return "│   "
+}
+
+func init() {
+	rootCmd.AddCommand(treeCmd)
+}
@@ -0,0 +1,55 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type buildLogKey struct{}
+
+// WithBuildLog returns a context in which environment builds log their setup and install commands to w:
+// each command as it starts, then its output once it exits. This is not a live stream: Dagger only hands
+// over the output of a command when it's done, so a long command logs nothing until it exits.
+func WithBuildLog(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, buildLogKey{}, w)
+}
+
+// buildLog returns where the build of the environment logs its commands, with secrets masked
+// as the log may be shown to agents.
+func (env *Environment) buildLog(ctx context.Context) io.Writer {
+	w, ok := ctx.Value(buildLogKey{}).(io.Writer)
+	if !ok {
+		return io.Discard
+	}
+	return &maskingWriter{w: w, masker: env.secretMasker(ctx, RunOpts{})}
+}
+
+// writeCommandOutput writes the output of a setup or install command that exited to w, stderr after stdout,
+// each ending with a newline.
+func writeCommandOutput(w io.Writer, stdout, stderr string) {
+	for _, output := range []string{stdout, stderr} {
+		if output == "" {
+			continue
+		}
+		if !strings.HasSuffix(output, "\n") {
+			output += "\n"
+		}
+		fmt.Fprint(w, output)
+	}
+}
+
+// maskingWriter masks secrets in what's written to w.
+// Writes are expected to be whole outputs, so secrets aren't split across them.
+type maskingWriter struct {
+	w      io.Writer
+	masker *strings.Replacer
+}
+
+func (m *maskingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(m.w, m.masker.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,81 @@
+package environment
+
+import (
+	"strings"
+	"sync"
+)
+
+// commandOutputs caches the output of read-only commands run with RunOpts.Cache, so running them again on the same
+// container state returns the same output without executing them. Like idleServices, it's global because
+// environments are loaded again for every operation.
+var commandOutputs = &outputCache{envs: map[string]*cachedOutputs{}}
+
+type outputCache struct {
+	mu   sync.Mutex
+	envs map[string]*cachedOutputs
+}
+
+// cachedOutputs are the outputs cached for the current container state of an environment.
+type cachedOutputs struct {
+	container string
+	outputs   map[commandKey]string
+}
+
+// commandKey identifies a command run in a given container state.
+type commandKey struct {
+	command       string
+	shell         string
+	user          string
+	useEntrypoint bool
+	// captureFiles are the files captured along with the output, NUL-separated
+	captureFiles string
+}
+
+func newCommandKey(command, shell string, opts RunOpts) commandKey {
+	return commandKey{
+		command:       command,
+		shell:         shell,
+		user:          opts.User,
+		useEntrypoint: opts.UseEntrypoint,
+		captureFiles:  strings.Join(opts.CaptureFiles, "\x00"),
+	}
+}
+
+// get returns the output of the command cached for the environment's container state.
+func (c *outputCache) get(id, container string, key commandKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.envs[id]
+	if !ok || cached.container != container {
+		return "", false
+	}
+	output, ok := cached.outputs[key]
+	return output, ok
+}
+
+// set caches the output of the command for the environment's container state.
+// Outputs cached for previous container states are dropped, they can't be used anymore.
+func (c *outputCache) set(id, container string, key commandKey, output string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.envs[id]
+	if !ok || cached.container != container {
+		cached = &cachedOutputs{container: container, outputs: map[commandKey]string{}}
+		c.envs[id] = cached
+	}
+	cached.outputs[key] = output
+}
+
+// CachedOutput returns the output of an identical command run earlier with RunOpts.Cache on the current
+// container state of the environment, if any.
+func (env *Environment) CachedOutput(command, shell string, opts RunOpts) (string, bool) {
+	if !opts.Cache || len(opts.InheritHostEnv) > 0 {
+		return "", false
+	}
+	env.mu.RLock()
+	container := env.State.Container
+	env.mu.RUnlock()
+	return commandOutputs.get(env.ID, container, newCommandKey(command, shell, opts))
+}
@@ -0,0 +1,36 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputCache(t *testing.T) {
+	cache := &outputCache{envs: map[string]*cachedOutputs{}}
+	ls := newCommandKey("ls", "sh", RunOpts{})
+	lsAsNobody := newCommandKey("ls", "sh", RunOpts{User: "nobody"})
+
+	cache.set("env", "container-1", ls, "a.txt")
+	output, ok := cache.get("env", "container-1", ls)
+	assert.True(t, ok)
+	assert.Equal(t, "a.txt", output)
+
+	// Outputs are specific to the command, the environment and its container state
+	_, ok = cache.get("env", "container-1", lsAsNobody)
+	assert.False(t, ok)
+	_, ok = cache.get("other-env", "container-1", ls)
+	assert.False(t, ok)
+	_, ok = cache.get("env", "container-2", ls)
+	assert.False(t, ok)
+
+	// Caching for a new container state drops the outputs of the previous one
+	cache.set("env", "container-2", lsAsNobody, "b.txt")
+	_, ok = cache.get("env", "container-2", ls)
+	assert.False(t, ok)
+	_, ok = cache.get("env", "container-1", ls)
+	assert.False(t, ok)
+	output, ok = cache.get("env", "container-2", lsAsNobody)
+	assert.True(t, ok)
+	assert.Equal(t, "b.txt", output)
+}
@@ -0,0 +1,65 @@
+package environment
+
+import (
+	"fmt"
+	"path"
+
+	"dagger.io/dagger"
+)
+
+// SharedDir is mounted in every command of an environment, foreground and background, as the same volume: it's
+// the only way for a foreground command to inspect files written by a running background command, e.g. a
+// server's logs. Its contents are never committed, and don't survive the engine's cache.
+const SharedDir = "/cu/shared"
+
+// cacheDirs returns the absolute paths of the cache directories of the environment.
+func (env *Environment) cacheDirs() ([]string, error) {
+	dirs := make([]string, 0, len(env.State.Config.CacheDirs))
+	for _, dir := range env.State.Config.CacheDirs {
+		resolved, err := resolvePath(env.State.Config.Workdir, dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache_dirs: %w", err)
+		}
+		// The source isn't a cache: it must be committed
+		if resolved == path.Clean(env.State.Config.Workdir) {
+			return nil, fmt.Errorf("invalid cache_dirs: %s is the workdir", dir)
+		}
+		dirs = append(dirs, resolved)
+	}
+	return dirs, nil
+}
+
+// withCacheDirs mounts the cache directories of the environment on container. Volumes are keyed by environment,
+// so environments don't step on each other's caches.
+func (env *Environment) withCacheDirs(container *dagger.Container) (*dagger.Container, error) {
+	dirs, err := env.cacheDirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		container = container.WithMountedCache(dir, env.dag.CacheVolume(fmt.Sprintf("container-use-%s-%s", env.ID, dir)), dagger.ContainerWithMountedCacheOpts{
+			Owner: env.State.Config.RunAsUser,
+		})
+	}
+	return container, nil
+}
+
+// withSharedDir mounts the environment's SharedDir volume on container.
+func (env *Environment) withSharedDir(container *dagger.Container) *dagger.Container {
+	return container.WithMountedCache(SharedDir, env.dag.CacheVolume(fmt.Sprintf("container-use-%s-shared", env.ID)), dagger.ContainerWithMountedCacheOpts{
+		Owner: env.State.Config.RunAsUser,
+	})
+}
+
+// withoutCacheDirs unmounts the cache directories and the SharedDir of the environment from container, so their contents
+// don't make it into its state, and from there into the worktree.
+func (env *Environment) withoutCacheDirs(container *dagger.Container) (*dagger.Container, error) {
+	dirs, err := env.cacheDirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		container = container.WithoutMount(dir)
+	}
+	return container.WithoutMount(SharedDir), nil
+}
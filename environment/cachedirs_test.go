@@ -0,0 +1,24 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheDirs(t *testing.T) {
+	env := &Environment{EnvironmentInfo: &EnvironmentInfo{State: &State{Config: &EnvironmentConfig{
+		Workdir:   "/workdir",
+		CacheDirs: []string{"/root/.cache/go-build", ".gradle/caches"},
+	}}}}
+	dirs, err := env.cacheDirs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/root/.cache/go-build", "/workdir/.gradle/caches"}, dirs)
+
+	for _, dir := range []string{"../outside", ".", "/workdir/", ""} {
+		env.State.Config.CacheDirs = []string{dir}
+		_, err := env.cacheDirs()
+		assert.ErrorContains(t, err, "invalid cache_dirs", dir)
+	}
+}
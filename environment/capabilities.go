@@ -0,0 +1,43 @@
+package environment
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// linuxCapabilities are the names of the Linux capabilities, without their CAP_ prefix.
+var linuxCapabilities = []string{
+	"AUDIT_CONTROL", "AUDIT_READ", "AUDIT_WRITE", "BLOCK_SUSPEND", "BPF", "CHECKPOINT_RESTORE", "CHOWN",
+	"DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER", "FSETID", "IPC_LOCK", "IPC_OWNER", "KILL", "LEASE",
+	"LINUX_IMMUTABLE", "MAC_ADMIN", "MAC_OVERRIDE", "MKNOD", "NET_ADMIN", "NET_BIND_SERVICE", "NET_BROADCAST",
+	"NET_RAW", "PERFMON", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYSLOG", "SYS_ADMIN", "SYS_BOOT",
+	"SYS_CHROOT", "SYS_MODULE", "SYS_NICE", "SYS_PACCT", "SYS_PTRACE", "SYS_RAWIO", "SYS_RESOURCE",
+	"SYS_TIME", "SYS_TTY_CONFIG", "WAKE_ALARM",
+}
+
+// NormalizeCapability returns the name of a Linux capability as stored in the configuration: in upper case and
+// without its CAP_ prefix, e.g. SYS_PTRACE for cap_sys_ptrace.
+func NormalizeCapability(name string) (string, error) {
+	capability := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "CAP_")
+	if !slices.Contains(linuxCapabilities, capability) {
+		return "", fmt.Errorf("unknown capability %q", name)
+	}
+	return capability, nil
+}
+
+// validateCapabilities makes sure the capabilities of the configuration are known Linux capabilities.
+func (config *EnvironmentConfig) validateCapabilities() error {
+	for _, capability := range config.Capabilities {
+		if normalized, err := NormalizeCapability(capability); err != nil || normalized != capability {
+			return fmt.Errorf("invalid capabilities: %q must be a Linux capability, e.g. SYS_PTRACE", capability)
+		}
+	}
+	return nil
+}
+
+// insecureRootCapabilities reports whether commands run with all root capabilities. Dagger can't grant capabilities
+// one by one, so requesting any of them grants them all.
+func (config *EnvironmentConfig) insecureRootCapabilities() bool {
+	return config.Privileged || len(config.Capabilities) > 0
+}
@@ -0,0 +1,38 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeCapability(t *testing.T) {
+	for _, name := range []string{"SYS_PTRACE", "sys_ptrace", "CAP_SYS_PTRACE", " cap_sys_ptrace "} {
+		capability, err := NormalizeCapability(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, "SYS_PTRACE", capability, name)
+	}
+	_, err := NormalizeCapability("SYS_EVERYTHING")
+	assert.ErrorContains(t, err, `unknown capability "SYS_EVERYTHING"`)
+}
+
+func TestCapabilities(t *testing.T) {
+	config := &EnvironmentConfig{}
+	assert.False(t, config.insecureRootCapabilities())
+	assert.NoError(t, config.validateCapabilities())
+
+	// Dagger grants all root capabilities or none
+	config.Capabilities = []string{"SYS_PTRACE"}
+	assert.True(t, config.insecureRootCapabilities())
+	assert.NoError(t, config.validateCapabilities())
+	assert.True(t, (&EnvironmentConfig{Privileged: true}).insecureRootCapabilities())
+
+	// Capabilities edited by hand must be normalized
+	config.Capabilities = []string{"cap_sys_ptrace"}
+	assert.ErrorContains(t, config.validateCapabilities(), "invalid capabilities")
+
+	changes := DiffConfig(&EnvironmentConfig{}, &EnvironmentConfig{Privileged: true, Capabilities: []string{"SYS_PTRACE"}})
+	assert.Equal(t, &ValueChange{From: "false", To: "true"}, changes.Privileged)
+	assert.Equal(t, &ListChange{Added: []string{"SYS_PTRACE"}}, changes.Capabilities)
+}
@@ -0,0 +1,58 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// resolveCaptureFiles resolves the paths of RunOpts.CaptureFiles, so invalid ones are reported before the command runs.
+func (env *Environment) resolveCaptureFiles(paths []string) ([]string, error) {
+	resolved := make([]string, 0, len(paths))
+	for _, p := range paths {
+		r, err := resolvePath(env.State.Config.Workdir, p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file to capture: %w", err)
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved, nil
+}
+
+// captureFiles reads the files from the container a command ran in, and returns them formatted to be appended
+// to its output. Files that can't be captured are reported in place of their contents rather than failing
+// the command, which already ran.
+func (env *Environment) captureFiles(ctx context.Context, container *dagger.Container, paths []string, masker *strings.Replacer) string {
+	limit := int(env.State.Config.MaxFileReadSize)
+	if limit == 0 {
+		limit = defaultMaxFileReadSize
+	}
+	var out strings.Builder
+	for _, p := range paths {
+		contents, err := container.File(p).Contents(ctx)
+		out.WriteString(formatCapturedFile(p, masker.Replace(contents), err, limit))
+	}
+	return out.String()
+}
+
+// formatCapturedFile formats a captured file: its contents if it's a text file, truncated to limit bytes.
+func formatCapturedFile(path, contents string, err error, limit int) string {
+	header := fmt.Sprintf("\n\n--- captured file %s ---\n", path)
+	switch {
+	case err != nil:
+		return header + "[not captured: the file doesn't exist or isn't a regular file]\n"
+	case isBinary(contents):
+		return header + fmt.Sprintf("[not captured: binary file of %d bytes]\n", len(contents))
+	}
+	captured, truncated := truncateContents(contents, limit)
+	marker := ""
+	if truncated {
+		marker = fmt.Sprintf("[file truncated at %d bytes of %d; read the rest with environment_file_read]\n", len(captured), len(contents))
+	}
+	if captured != "" && !strings.HasSuffix(captured, "\n") {
+		captured += "\n"
+	}
+	return header + captured + marker
+}
@@ -0,0 +1,24 @@
+package environment
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatCapturedFile(t *testing.T) {
+	assert.Equal(t, "\n\n--- captured file /workdir/report.txt ---\nok\n",
+		formatCapturedFile("/workdir/report.txt", "ok", nil, 100))
+	assert.Equal(t, "\n\n--- captured file /workdir/empty.txt ---\n",
+		formatCapturedFile("/workdir/empty.txt", "", nil, 100))
+	assert.Equal(t, "\n\n--- captured file /workdir/missing.txt ---\n[not captured: the file doesn't exist or isn't a regular file]\n",
+		formatCapturedFile("/workdir/missing.txt", "", errors.New("no such file"), 100))
+	assert.Equal(t, "\n\n--- captured file /workdir/app ---\n[not captured: binary file of 4 bytes]\n",
+		formatCapturedFile("/workdir/app", "EL\x00F", nil, 100))
+
+	large := strings.Repeat("line\n", 10)
+	assert.Equal(t, "\n\n--- captured file /workdir/coverage.txt ---\nline\nline\n[file truncated at 10 bytes of 50; read the rest with environment_file_read]\n",
+		formatCapturedFile("/workdir/coverage.txt", large, nil, 12))
+}
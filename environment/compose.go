@@ -0,0 +1,112 @@
+package environment
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// composeFile is the subset of the Docker Compose file format used to export environments.
+type composeFile struct {
+	Services map[string]*composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Image       string            `yaml:"image"`
+	User        string            `yaml:"user,omitempty"`
+	Entrypoint  []string          `yaml:"entrypoint,omitempty"`
+	Command     []string          `yaml:"command,omitempty"`
+	WorkingDir  string            `yaml:"working_dir,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	Volumes     []string          `yaml:"volumes,omitempty"`
+	DependsOn   []string          `yaml:"depends_on,omitempty"`
+}
+
+// Compose returns a Docker Compose file running the environment and its services.
+//
+// The environment runs from image if set, typically a checkpoint of the environment, or else from its base image
+// with the directory of the compose file mounted as workdir. Setup and install commands aren't run in the latter case.
+// Secrets are never resolved: they are emitted as variables that must be set when running the compose file.
+func (env *EnvironmentInfo) Compose(image string) ([]byte, error) {
+	config := env.State.Config
+
+	main := &composeService{
+		Image:       image,
+		User:        config.RunAsUser,
+		Entrypoint:  config.Entrypoint,
+		WorkingDir:  config.Workdir,
+		Environment: composeEnvironment(config.Env, config.Secrets),
+		// Keep the container running so commands can be run in it with `docker compose exec`
+		Command: []string{"sleep", "infinity"},
+	}
+	if image == "" {
+		main.Image = config.BaseImage
+		main.Volumes = []string{".:" + config.Workdir}
+	}
+	if len(config.Entrypoint) > 0 {
+		// The command is passed to the entrypoint, which may not run it
+		main.Command = nil
+	}
+
+	compose := &composeFile{Services: map[string]*composeService{env.ID: main}}
+	for _, svc := range config.Services {
+		if _, ok := compose.Services[svc.Name]; ok {
+			return nil, fmt.Errorf("service %q has the same name as the environment", svc.Name)
+		}
+		service := &composeService{
+			Image:       svc.Image,
+			Environment: composeEnvironment(svc.Env, svc.Secrets),
+		}
+		if svc.Command != "" {
+			service.Command = []string{"sh", "-c", escapeCompose(svc.Command)}
+		}
+		for _, port := range svc.ExposedPorts {
+			// Published on a random host port, like container-use does
+			service.Ports = append(service.Ports, fmt.Sprint(port))
+		}
+		compose.Services[svc.Name] = service
+		main.DependsOn = append(main.DependsOn, svc.Name)
+	}
+
+	data, err := yaml.Marshal(compose)
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("# Exported from container-use environment %s (%s)\n", env.ID, env.State.Title)
+	if image == "" {
+		header += "# Run from a checkout of the environment: container-use checkout " + env.ID + "\n"
+	}
+	hasSecrets := len(config.Secrets) > 0
+	for _, svc := range config.Services {
+		hasSecrets = hasSecrets || len(svc.Secrets) > 0
+	}
+	if hasSecrets {
+		header += "# Secrets are not included: set the variables they are read from before running it.\n"
+	}
+	return append([]byte(header), data...), nil
+}
+
+// composeEnvironment returns the variables of a compose service. Secrets are emitted as placeholders
+// interpolated from the variable of the same name, failing with the reference of the secret if it's not set.
+func composeEnvironment(envs KVList, secrets KVList) map[string]string {
+	if len(envs) == 0 && len(secrets) == 0 {
+		return nil
+	}
+	environment := map[string]string{}
+	for _, item := range envs {
+		key, value := envs.parseKeyValue(item)
+		environment[key] = escapeCompose(value)
+	}
+	for _, item := range secrets {
+		key, ref := secrets.parseKeyValue(item)
+		environment[key] = fmt.Sprintf("${%s:?secret %s}", key, escapeCompose(ref))
+	}
+	return environment
+}
+
+// escapeCompose escapes value from Compose variable interpolation.
+func escapeCompose(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
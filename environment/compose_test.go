@@ -0,0 +1,71 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCompose(t *testing.T) {
+	config := DefaultConfig()
+	config.Env = KVList{"GREETING=hello $USER"}
+	config.Secrets = KVList{"API_KEY=op://vault/item/field"}
+	config.Services = ServiceConfigs{{
+		Name:         "db",
+		Image:        "postgres:16",
+		Command:      "postgres -c log_statement=all",
+		ExposedPorts: []int{5432},
+		Env:          []string{"POSTGRES_PASSWORD=secret"},
+	}}
+	env := &EnvironmentInfo{ID: "fancy-mallard", State: &State{Title: "App", Config: config}}
+
+	t.Run("base_image", func(t *testing.T) {
+		data, err := env.Compose("")
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "container-use checkout fancy-mallard")
+		assert.Contains(t, string(data), "Secrets are not included")
+
+		var compose composeFile
+		require.NoError(t, yaml.Unmarshal(data, &compose))
+		require.Len(t, compose.Services, 2)
+
+		main := compose.Services["fancy-mallard"]
+		assert.Equal(t, "ubuntu:24.04", main.Image)
+		assert.Equal(t, "/workdir", main.WorkingDir)
+		assert.Equal(t, []string{".:/workdir"}, main.Volumes)
+		assert.Equal(t, []string{"db"}, main.DependsOn)
+		assert.Equal(t, map[string]string{
+			// Values are escaped from interpolation, secrets are placeholders
+			"GREETING": "hello $$USER",
+			"API_KEY":  "${API_KEY:?secret op://vault/item/field}",
+		}, main.Environment)
+
+		db := compose.Services["db"]
+		assert.Equal(t, "postgres:16", db.Image)
+		assert.Equal(t, []string{"sh", "-c", "postgres -c log_statement=all"}, db.Command)
+		assert.Equal(t, []string{"5432"}, db.Ports)
+		assert.Equal(t, map[string]string{"POSTGRES_PASSWORD": "secret"}, db.Environment)
+	})
+
+	t.Run("checkpoint", func(t *testing.T) {
+		data, err := env.Compose("registry.example.com/app@sha256:1234")
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "container-use checkout")
+
+		var compose composeFile
+		require.NoError(t, yaml.Unmarshal(data, &compose))
+		main := compose.Services["fancy-mallard"]
+		assert.Equal(t, "registry.example.com/app@sha256:1234", main.Image)
+		// The code is part of the image
+		assert.Empty(t, main.Volumes)
+	})
+
+	t.Run("name_conflict", func(t *testing.T) {
+		conflicting := *env
+		conflicting.ID = "db"
+		_, err := conflicting.Compose("")
+		assert.ErrorContains(t, err, "same name")
+	})
+}
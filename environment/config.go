@@ -3,9 +3,13 @@ package environment
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 )
 
 const (
@@ -23,6 +27,13 @@ func DefaultConfig() *EnvironmentConfig {
 }
 
 type EnvironmentConfig struct {
+	// Extends is the path, absolute or relative to the directory of this configuration file, of a configuration it's based on.
+	// Settings defined here take precedence over the parent's, except setup and install commands which are appended
+	// to the parent's, and environment variables, secrets, services and build args which are merged with the parent's
+	// by name. Fields listed in Override replace the parent's instead.
+	Extends  string   `json:"extends,omitempty"`
+	Override []string `json:"override,omitempty"`
+
 	Workdir         string         `json:"workdir,omitempty"`
 	BaseImage       string         `json:"base_image,omitempty"`
 	SetupCommands   []string       `json:"setup_commands,omitempty"`
@@ -30,6 +41,117 @@ type EnvironmentConfig struct {
 	Env             KVList         `json:"env,omitempty"`
 	Secrets         KVList         `json:"secrets,omitempty"`
 	Services        ServiceConfigs `json:"services,omitempty"`
+
+	// RefreshSecrets are the names of secrets resolved again for every command run in the environment, rather than
+	// once when it's built, so rotating credentials such as short-lived tokens stay fresh. They must be env:// or op://
+	// secrets. Setup and install commands still get the values resolved at build time.
+	RefreshSecrets []string `json:"refresh_secrets,omitempty"`
+
+	// PreSourceFiles are files of the repository, relative to its root, copied to the workdir before the setup commands
+	// run, for those that need them (e.g. a .npmrc with the registry to install from). Changing them invalidates the setup.
+	PreSourceFiles []string `json:"pre_source_files,omitempty"`
+
+	// BuildArgs are build-time variables substituted into setup and install commands as ${NAME}.
+	// Unlike Env, they are not set in the environment at runtime.
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+
+	// Entrypoint overrides the entrypoint of the base image. It's prepended to commands run with UseEntrypoint.
+	Entrypoint []string `json:"entrypoint,omitempty"`
+
+	// RunAsUser is the user (name, uid, name:group or uid:gid) setup commands, install commands and
+	// commands run in the environment execute as, instead of the base image's default user.
+	// It must exist in the base image.
+	RunAsUser string `json:"run_as_user,omitempty"`
+
+	// GitCheckout makes the workdir a git checkout of the environment's branch. Commits made inside
+	// the environment are then kept as-is instead of being squashed into an automatic commit.
+	GitCheckout bool `json:"git_checkout,omitempty"`
+
+	// CommitGranularity is either CommitPerOperation (default), committing the changes of each operation as it's made,
+	// or CommitPerSession, leaving them uncommitted until they are flushed or the agent's session ends.
+	CommitGranularity string `json:"commit_granularity,omitempty"`
+
+	// SecretScan is what happens to files written in the environment that look like they contain secrets, such as
+	// API keys or private keys: SecretScanWarn (default) commits them with a warning, SecretScanOn leaves them out
+	// of the commit, SecretScanOff doesn't scan them.
+	SecretScan string `json:"secret_scan,omitempty"`
+
+	// NotesPropagationWindow coalesces the propagation of git notes (history and state) to the source repository,
+	// copying them at most once per window (e.g. "10s") instead of after every operation. They're propagated right away if empty.
+	NotesPropagationWindow string `json:"notes_propagation_window,omitempty"`
+
+	// VerifyCommand is an optional sanity check (e.g. `go build ./...`) run after each command that changes the environment.
+	VerifyCommand string `json:"verify_command,omitempty"`
+
+	// ServiceIdleTimeout is how long services keep running once no command touches the environment (e.g. "30m").
+	// Stopped services are restarted on demand. Services are never stopped if empty.
+	ServiceIdleTimeout string `json:"service_idle_timeout,omitempty"`
+
+	// Privileged runs the commands of the environment with all root capabilities, like docker run --privileged,
+	// e.g. for Docker-in-Docker. It gives them full access to the host running the Dagger engine.
+	Privileged bool `json:"privileged,omitempty"`
+
+	// Capabilities are the Linux capabilities commands need beyond the default ones, e.g. SYS_PTRACE for debuggers.
+	// Dagger can't grant them one by one: setting any of them runs commands with all root capabilities, as Privileged does.
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// ReadOnly keeps agents from changing the environment: they can read and list files, and run commands,
+	// but the changes of the commands are discarded, and writing files or changing the configuration is refused.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// CommandPolicy restricts the commands agents can run in the environment. Every command is allowed if nil.
+	CommandPolicy *CommandPolicy `json:"command_policy,omitempty"`
+
+	// ID configures how the IDs of new environments are generated.
+	ID *IDConfig `json:"id,omitempty"`
+
+	// LargeFileWarningSize is the size in bytes above which committed text files are reported (defaults to 1MB).
+	LargeFileWarningSize int64 `json:"large_file_warning_size,omitempty"`
+	// MaxFileSize is the size in bytes above which text files are not committed (0 for no limit).
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// IgnorePatterns are gitignore-style patterns of files written in the environment that are never committed,
+	// in addition to those the repository ignores, e.g. dependencies the repository's .gitignore doesn't cover.
+	IgnorePatterns []string `json:"ignore_patterns,omitempty"`
+	// CacheDirs are directories of the container, absolute or relative to the workdir, mounted as cache volumes while
+	// commands run (e.g. /root/.cache/go-build, /usr/local/cargo/registry): their contents persist from one command to the
+	// next, but aren't part of the environment's state, so they're never committed nor checkpointed.
+	CacheDirs []string `json:"cache_dirs,omitempty"`
+	// MaxFileReadSize is the size in bytes at which files read entirely are truncated (defaults to 256KB).
+	MaxFileReadSize int64 `json:"max_file_read_size,omitempty"`
+
+	// parent is the configuration this one extends, as loaded from parentFile.
+	parent     *EnvironmentConfig
+	parentFile string
+}
+
+// Commit granularities supported by EnvironmentConfig.
+const (
+	CommitPerOperation = "per-operation"
+	CommitPerSession   = "per-session"
+)
+
+// Secret scanning modes supported by EnvironmentConfig.
+const (
+	SecretScanOn   = "on"
+	SecretScanWarn = "warn"
+	SecretScanOff  = "off"
+)
+
+// ID formats supported by IDConfig.
+const (
+	IDFormatPetname = "petname"
+	IDFormatHex     = "hex"
+)
+
+// IDConfig configures the generation of environment IDs.
+// The zero value generates two-word petnames such as quiet-mongoose.
+type IDConfig struct {
+	// Format is either IDFormatPetname (default) or IDFormatHex for short random hex strings.
+	Format string `json:"format,omitempty"`
+	// Words is the number of words of petnames (defaults to 2).
+	Words int `json:"words,omitempty"`
+	// Prefix is prepended to generated IDs, separated by a dash.
+	Prefix string `json:"prefix,omitempty"`
 }
 
 type ServiceConfig struct {
@@ -52,6 +174,16 @@ func (sc ServiceConfigs) Get(name string) *ServiceConfig {
 	return nil
 }
 
+// Equal reports whether both services are configured the same way, so a service started from one can be used for the other.
+func (cfg *ServiceConfig) Equal(other *ServiceConfig) bool {
+	return cfg.Name == other.Name &&
+		cfg.Image == other.Image &&
+		cfg.Command == other.Command &&
+		slices.Equal(cfg.ExposedPorts, other.ExposedPorts) &&
+		slices.Equal(cfg.Env, other.Env) &&
+		slices.Equal(cfg.Secrets, other.Secrets)
+}
+
 // KVList represents a list of key-value pairs in the format KEY=VALUE
 type KVList []string
 
@@ -110,8 +242,36 @@ func (kv KVList) Get(key string) string {
 	return ""
 }
 
+// Normalized returns the list sorted by key, with duplicate keys removed. The last value of a key wins.
+func (kv KVList) Normalized() KVList {
+	if kv == nil {
+		return nil
+	}
+	items := map[string]string{}
+	for _, item := range kv {
+		key, _ := kv.parseKeyValue(item)
+		items[key] = item
+	}
+	normalized := make(KVList, 0, len(items))
+	for _, key := range slices.Sorted(maps.Keys(items)) {
+		normalized = append(normalized, items[key])
+	}
+	return normalized
+}
+
 func (config *EnvironmentConfig) Copy() *EnvironmentConfig {
 	copy := *config
+	copy.BuildArgs = maps.Clone(config.BuildArgs)
+	if config.ID != nil {
+		id := *config.ID
+		copy.ID = &id
+	}
+	if config.CommandPolicy != nil {
+		copy.CommandPolicy = &CommandPolicy{
+			Allow: slices.Clone(config.CommandPolicy.Allow),
+			Deny:  slices.Clone(config.CommandPolicy.Deny),
+		}
+	}
 	copy.Services = make(ServiceConfigs, len(config.Services))
 	for i, svc := range config.Services {
 		svcCopy := *svc
@@ -120,15 +280,105 @@ func (config *EnvironmentConfig) Copy() *EnvironmentConfig {
 	return &copy
 }
 
+// IdleTimeout returns the parsed ServiceIdleTimeout, or 0 if services should never be stopped.
+func (config *EnvironmentConfig) IdleTimeout() time.Duration {
+	if config.ServiceIdleTimeout == "" {
+		return 0
+	}
+	timeout, err := time.ParseDuration(config.ServiceIdleTimeout)
+	if err != nil {
+		return 0
+	}
+	return timeout
+}
+
+// NotesWindow returns the parsed NotesPropagationWindow, or 0 if notes should be propagated right away.
+func (config *EnvironmentConfig) NotesWindow() time.Duration {
+	if config.NotesPropagationWindow == "" {
+		return 0
+	}
+	window, err := time.ParseDuration(config.NotesPropagationWindow)
+	if err != nil {
+		return 0
+	}
+	return window
+}
+
+var buildArgRegExp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandBuildArgs substitutes the build args referenced as ${NAME} in command.
+// References to anything else, such as shell variables, are left untouched.
+func (config *EnvironmentConfig) ExpandBuildArgs(command string) string {
+	if len(config.BuildArgs) == 0 {
+		return command
+	}
+	return buildArgRegExp.ReplaceAllStringFunc(command, func(ref string) string {
+		if value, ok := config.BuildArgs[ref[2:len(ref)-1]]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+var hostTemplateRegExp = regexp.MustCompile(`\{\{\s*host\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// ExpandHostTemplates substitutes the host environment variables referenced as {{host.NAME}} in value,
+// when the environment is built. {{host.HOSTNAME}} is the name of the host, even if HOSTNAME isn't exported.
+// It fails if a referenced variable isn't set, rather than silently setting an empty value.
+func ExpandHostTemplates(value string) (string, error) {
+	var err error
+	expanded := hostTemplateRegExp.ReplaceAllStringFunc(value, func(ref string) string {
+		name := hostTemplateRegExp.FindStringSubmatch(ref)[1]
+		if hostValue, ok := os.LookupEnv(name); ok {
+			return hostValue
+		}
+		if name == "HOSTNAME" {
+			hostname, hostnameErr := os.Hostname()
+			if hostnameErr == nil {
+				return hostname
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("host environment variable %s referenced by %s is not set", name, ref)
+		}
+		return ref
+	})
+	return expanded, err
+}
+
+// ConfigPath returns the path of the environment configuration stored in baseDir.
+func ConfigPath(baseDir string) string {
+	return path.Join(baseDir, configDir, environmentFile)
+}
+
 func (config *EnvironmentConfig) Save(baseDir string) error {
 	configPath := path.Join(baseDir, configDir)
 	if err := os.MkdirAll(configPath, 0755); err != nil {
 		return err
 	}
 
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
+	// Keep the committed file stable so it produces minimal diffs
+	normalized := *config
+	normalized.Env = config.Env.Normalized()
+	normalized.Secrets = config.Secrets.Normalized()
+
+	var data []byte
+	var err error
+	if config.parent != nil {
+		// Only save what differs from the parent
+		local, err := normalized.localFields(config.parent)
+		if err != nil {
+			return err
+		}
+		data, err = json.MarshalIndent(local, "", "  ")
+		if err != nil {
+			return err
+		}
+	} else {
+		data, err = json.MarshalIndent(&normalized, "", "  ")
+		if err != nil {
+			return err
+		}
 	}
 
 	if err := os.WriteFile(path.Join(configPath, environmentFile), data, 0644); err != nil {
@@ -141,12 +391,13 @@ func (config *EnvironmentConfig) Save(baseDir string) error {
 func (config *EnvironmentConfig) Load(baseDir string) error {
 	configPath := path.Join(baseDir, configDir)
 
-	data, err := os.ReadFile(path.Join(configPath, environmentFile))
+	file := path.Join(configPath, environmentFile)
+	data, err := os.ReadFile(file)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	if err == nil {
-		if err := json.Unmarshal(data, config); err != nil {
+		if err := config.loadFile(file, data, nil); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,221 @@
+package environment
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// ValueChange describes a setting whose value changed.
+type ValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ListChange describes the entries added to and removed from a list setting.
+type ListChange struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+func (c *ListChange) empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+// ConfigChanges summarizes the differences between two environment configurations.
+// Unchanged settings are omitted.
+type ConfigChanges struct {
+	BaseImage       *ValueChange `json:"base_image,omitempty"`
+	Workdir         *ValueChange `json:"workdir,omitempty"`
+	SetupCommands   *ListChange  `json:"setup_commands,omitempty"`
+	InstallCommands *ListChange  `json:"install_commands,omitempty"`
+	PreSourceFiles  *ListChange  `json:"pre_source_files,omitempty"`
+	Env             *ListChange  `json:"envs,omitempty"`
+	Secrets         *ListChange  `json:"secrets,omitempty"`
+	BuildArgs       *ListChange  `json:"build_args,omitempty"`
+	Services        *ListChange  `json:"services,omitempty"`
+	CacheDirs       *ListChange  `json:"cache_dirs,omitempty"`
+	CommandPolicy   *ListChange  `json:"command_policy,omitempty"`
+	Privileged      *ValueChange `json:"privileged,omitempty"`
+	Capabilities    *ListChange  `json:"capabilities,omitempty"`
+	ReadOnly        *ValueChange `json:"read_only,omitempty"`
+	RunAsUser       *ValueChange `json:"run_as_user,omitempty"`
+	VerifyCommand   *ValueChange `json:"verify_command,omitempty"`
+}
+
+// Empty reports whether the configurations were identical.
+func (c *ConfigChanges) Empty() bool {
+	return *c == ConfigChanges{}
+}
+
+// DiffConfig compares two configurations and returns what changed from old to new.
+// Environment variables, secrets and build args are compared as KEY=VALUE entries, so
+// changing a value is reported as removing the old entry and adding the new one.
+// Services are compared by name.
+func DiffConfig(old, new *EnvironmentConfig) *ConfigChanges {
+	return &ConfigChanges{
+		BaseImage:       diffValue(old.BaseImage, new.BaseImage),
+		Workdir:         diffValue(old.Workdir, new.Workdir),
+		SetupCommands:   diffList(old.SetupCommands, new.SetupCommands),
+		InstallCommands: diffList(old.InstallCommands, new.InstallCommands),
+		PreSourceFiles:  diffList(old.PreSourceFiles, new.PreSourceFiles),
+		Env:             diffList(old.Env, new.Env),
+		Secrets:         diffList(old.Secrets, new.Secrets),
+		BuildArgs:       diffList(buildArgEntries(old.BuildArgs), buildArgEntries(new.BuildArgs)),
+		Services:        diffList(serviceNames(old.Services), serviceNames(new.Services)),
+		CacheDirs:       diffList(old.CacheDirs, new.CacheDirs),
+		CommandPolicy:   diffList(commandPolicyEntries(old.CommandPolicy), commandPolicyEntries(new.CommandPolicy)),
+		Privileged:      diffValue(strconv.FormatBool(old.Privileged), strconv.FormatBool(new.Privileged)),
+		Capabilities:    diffList(old.Capabilities, new.Capabilities),
+		ReadOnly:        diffValue(strconv.FormatBool(old.ReadOnly), strconv.FormatBool(new.ReadOnly)),
+		RunAsUser:       diffValue(old.RunAsUser, new.RunAsUser),
+		VerifyCommand:   diffValue(old.VerifyCommand, new.VerifyCommand),
+	}
+}
+
+func diffValue(old, new string) *ValueChange {
+	if old == new {
+		return nil
+	}
+	return &ValueChange{From: old, To: new}
+}
+
+// diffList returns the entries only present in new as added and those only present in old as removed.
+// Duplicate entries are matched one for one.
+func diffList(old, new []string) *ListChange {
+	change := &ListChange{}
+	remaining := slices.Clone(old)
+	for _, entry := range new {
+		if i := slices.Index(remaining, entry); i >= 0 {
+			remaining = slices.Delete(remaining, i, i+1)
+			continue
+		}
+		change.Added = append(change.Added, entry)
+	}
+	change.Removed = remaining
+	if change.empty() {
+		return nil
+	}
+	return change
+}
+
+func buildArgEntries(buildArgs map[string]string) []string {
+	entries := make([]string, 0, len(buildArgs))
+	for name, value := range buildArgs {
+		entries = append(entries, fmt.Sprintf("%s=%s", name, value))
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// commandPolicyEntries returns the patterns of the policy as "allow PATTERN" and "deny PATTERN" entries.
+func commandPolicyEntries(policy *CommandPolicy) []string {
+	if policy == nil {
+		return nil
+	}
+	entries := make([]string, 0, len(policy.Allow)+len(policy.Deny))
+	for _, pattern := range policy.Allow {
+		entries = append(entries, "allow "+pattern)
+	}
+	for _, pattern := range policy.Deny {
+		entries = append(entries, "deny "+pattern)
+	}
+	return entries
+}
+
+func serviceNames(services ServiceConfigs) []string {
+	names := make([]string, 0, len(services))
+	for _, svc := range services {
+		names = append(names, svc.Name)
+	}
+	return names
+}
+
+// Baseline is an approved configuration environments are audited against.
+type Baseline struct {
+	config *EnvironmentConfig
+	// settings are the settings the baseline sets, the only ones audited.
+	settings []string
+}
+
+// LoadBaseline loads a baseline from a configuration file, which may extend other configurations.
+func LoadBaseline(file string) (*Baseline, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// Loaded over an empty configuration, so only the settings it sets are serialized
+	config := &EnvironmentConfig{}
+	if err := config.loadFile(file, data, nil); err != nil {
+		return nil, err
+	}
+	fields, err := configFields(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Baseline{config: config, settings: slices.Sorted(maps.Keys(fields))}, nil
+}
+
+// Audit returns how config deviates from the baseline, or nil if it conforms.
+// Only the settings the baseline sets are audited: those it leaves out aren't constrained.
+func (b *Baseline) Audit(config *EnvironmentConfig) *ConfigChanges {
+	changes := DiffConfig(b.config, config)
+	audited := func(setting string) bool {
+		return slices.Contains(b.settings, setting)
+	}
+	if !audited("base_image") {
+		changes.BaseImage = nil
+	}
+	if !audited("workdir") {
+		changes.Workdir = nil
+	}
+	if !audited("setup_commands") {
+		changes.SetupCommands = nil
+	}
+	if !audited("install_commands") {
+		changes.InstallCommands = nil
+	}
+	if !audited("pre_source_files") {
+		changes.PreSourceFiles = nil
+	}
+	if !audited("env") {
+		changes.Env = nil
+	}
+	if !audited("secrets") {
+		changes.Secrets = nil
+	}
+	if !audited("build_args") {
+		changes.BuildArgs = nil
+	}
+	if !audited("services") {
+		changes.Services = nil
+	}
+	if !audited("cache_dirs") {
+		changes.CacheDirs = nil
+	}
+	if !audited("command_policy") {
+		changes.CommandPolicy = nil
+	}
+	if !audited("privileged") {
+		changes.Privileged = nil
+	}
+	if !audited("capabilities") {
+		changes.Capabilities = nil
+	}
+	if !audited("read_only") {
+		changes.ReadOnly = nil
+	}
+	if !audited("run_as_user") {
+		changes.RunAsUser = nil
+	}
+	if !audited("verify_command") {
+		changes.VerifyCommand = nil
+	}
+	if changes.Empty() {
+		return nil
+	}
+	return changes
+}
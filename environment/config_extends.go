@@ -0,0 +1,333 @@
+package environment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+)
+
+// Fields of the configuration that extend the parent's instead of replacing it, unless listed in Override.
+var (
+	// appendedFields are lists appended to the parent's.
+	appendedFields = []string{"setup_commands", "install_commands", "pre_source_files", "ignore_patterns", "refresh_secrets", "cache_dirs", "capabilities"}
+	// keyedFields are lists or maps whose entries replace the parent's entries with the same key,
+	// or are added to them.
+	keyedFields = []string{"env", "secrets", "services", "build_args"}
+)
+
+// loadFile loads the configuration in data, read from file, into config, merged with the configurations it extends.
+// visited lists the files already loaded while resolving the inheritance, to detect cycles.
+func (config *EnvironmentConfig) loadFile(file string, data []byte, visited []string) error {
+	var header struct {
+		Extends string `json:"extends"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("invalid configuration %s: %w", file, err)
+	}
+	if header.Extends == "" {
+		return json.Unmarshal(data, config)
+	}
+
+	visited = append(visited, file)
+	parentFile := header.Extends
+	if !path.IsAbs(parentFile) {
+		parentFile = path.Join(path.Dir(file), parentFile)
+	}
+	if slices.Contains(visited, parentFile) {
+		return fmt.Errorf("configuration %s extends %s, which extends it back", file, header.Extends)
+	}
+	parentData, err := os.ReadFile(parentFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("configuration %s extends %s, which doesn't exist", file, header.Extends)
+		}
+		return err
+	}
+	// The parent is loaded over the same defaults
+	parent := config.Copy()
+	if err := parent.loadFile(parentFile, parentData, visited); err != nil {
+		return err
+	}
+
+	parentFields, err := configFields(parent)
+	if err != nil {
+		return err
+	}
+	var localFields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &localFields); err != nil {
+		return err
+	}
+	var override []string
+	if raw, ok := localFields["override"]; ok {
+		if err := json.Unmarshal(raw, &override); err != nil {
+			return fmt.Errorf("invalid override in %s: %w", file, err)
+		}
+	}
+
+	merged := maps.Clone(parentFields)
+	// How the parent was itself loaded doesn't carry over
+	delete(merged, "extends")
+	delete(merged, "override")
+	for key, raw := range localFields {
+		switch {
+		case slices.Contains(override, key) || parentFields[key] == nil:
+			merged[key] = raw
+		case slices.Contains(appendedFields, key):
+			if merged[key], err = appendLists(parentFields[key], raw); err != nil {
+				return fmt.Errorf("invalid %s in %s: %w", key, file, err)
+			}
+		case slices.Contains(keyedFields, key):
+			if merged[key], err = mergeEntries(key, parentFields[key], raw); err != nil {
+				return fmt.Errorf("invalid %s in %s: %w", key, file, err)
+			}
+		default:
+			merged[key] = raw
+		}
+	}
+	mergedData, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(mergedData, config); err != nil {
+		return err
+	}
+	config.parent = parent
+	config.parentFile = parentFile
+	return nil
+}
+
+// Inheritance returns the files of the configurations this configuration extends, from its parent to the root one.
+func (config *EnvironmentConfig) Inheritance() []string {
+	var files []string
+	for c := config; c.parent != nil; c = c.parent {
+		files = append(files, c.parentFile)
+	}
+	return files
+}
+
+// localFields returns the fields to save for a configuration extending parent: those that differ from the parent,
+// only with the entries added to the parent's for the fields extending it. Fields that can't extend the parent's,
+// because entries were removed, are added to the override list.
+func (config *EnvironmentConfig) localFields(parent *EnvironmentConfig) (map[string]json.RawMessage, error) {
+	fields, err := configFields(config)
+	if err != nil {
+		return nil, err
+	}
+	parentFields, err := configFields(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	override := slices.Clone(config.Override)
+	local := map[string]json.RawMessage{}
+	for key, raw := range fields {
+		parentRaw := parentFields[key]
+		switch {
+		case key == "extends" || key == "override":
+			local[key] = raw
+		case bytes.Equal(raw, parentRaw) && !slices.Contains(override, key):
+			// Inherited as is
+		case parentRaw == nil || slices.Contains(override, key):
+			local[key] = raw
+		case slices.Contains(appendedFields, key) || slices.Contains(keyedFields, key):
+			added, ok, err := addedEntries(key, parentRaw, raw)
+			if err != nil {
+				return nil, err
+			}
+			local[key] = added
+			if !ok {
+				local[key] = raw
+				override = append(override, key)
+			}
+		default:
+			local[key] = raw
+		}
+	}
+	// Fields set by the parent but cleared here must be cleared explicitly
+	for key, parentRaw := range parentFields {
+		if _, ok := fields[key]; ok || key == "extends" || key == "override" {
+			continue
+		}
+		local[key] = zeroJSON(parentRaw)
+		if slices.Contains(appendedFields, key) || slices.Contains(keyedFields, key) {
+			override = append(override, key)
+		}
+	}
+
+	local["override"], err = json.Marshal(slices.Compact(slices.Sorted(slices.Values(override))))
+	if err != nil {
+		return nil, err
+	}
+	if len(override) == 0 {
+		delete(local, "override")
+	}
+	return local, nil
+}
+
+// configFields returns the fields of the configuration as they are serialized.
+func configFields(config *EnvironmentConfig) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func appendLists(parentRaw, raw json.RawMessage) (json.RawMessage, error) {
+	var parent, local []string
+	if err := json.Unmarshal(parentRaw, &parent); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &local); err != nil {
+		return nil, err
+	}
+	return json.Marshal(append(parent, local...))
+}
+
+// entry is an entry of a keyed field, along with its key.
+type entry struct {
+	key   string
+	value json.RawMessage
+}
+
+// keyedEntries returns the entries of a keyed field, in order.
+func keyedEntries(field string, raw json.RawMessage) ([]entry, error) {
+	var entries []entry
+	switch field {
+	case "build_args":
+		var args map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, err
+		}
+		for _, key := range slices.Sorted(maps.Keys(args)) {
+			entries = append(entries, entry{key: key, value: args[key]})
+		}
+	case "services":
+		var services []json.RawMessage
+		if err := json.Unmarshal(raw, &services); err != nil {
+			return nil, err
+		}
+		for _, service := range services {
+			var svc ServiceConfig
+			if err := json.Unmarshal(service, &svc); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{key: svc.Name, value: service})
+		}
+	default:
+		var items KVList
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			key, _ := items.parseKeyValue(item)
+			value, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{key: key, value: value})
+		}
+	}
+	return entries, nil
+}
+
+func marshalEntries(field string, entries []entry) (json.RawMessage, error) {
+	if field == "build_args" {
+		args := map[string]json.RawMessage{}
+		for _, e := range entries {
+			args[e.key] = e.value
+		}
+		return json.Marshal(args)
+	}
+	values := make([]json.RawMessage, 0, len(entries))
+	for _, e := range entries {
+		values = append(values, e.value)
+	}
+	return json.Marshal(values)
+}
+
+func mergeEntries(field string, parentRaw, raw json.RawMessage) (json.RawMessage, error) {
+	merged, err := keyedEntries(field, parentRaw)
+	if err != nil {
+		return nil, err
+	}
+	local, err := keyedEntries(field, raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range local {
+		if i := slices.IndexFunc(merged, func(m entry) bool { return m.key == e.key }); i >= 0 {
+			merged[i] = e
+		} else {
+			merged = append(merged, e)
+		}
+	}
+	return marshalEntries(field, merged)
+}
+
+// addedEntries returns the entries of raw added to, or replacing those of, parentRaw. It returns false if raw
+// can't be expressed as an extension of parentRaw, because entries of the parent were removed (or reordered, for lists).
+func addedEntries(field string, parentRaw, raw json.RawMessage) (json.RawMessage, bool, error) {
+	if slices.Contains(appendedFields, field) {
+		var parent, current []string
+		if err := json.Unmarshal(parentRaw, &parent); err != nil {
+			return nil, false, err
+		}
+		if err := json.Unmarshal(raw, &current); err != nil {
+			return nil, false, err
+		}
+		if len(current) < len(parent) || !slices.Equal(current[:len(parent)], parent) {
+			return nil, false, nil
+		}
+		added, err := json.Marshal(current[len(parent):])
+		return added, true, err
+	}
+
+	parent, err := keyedEntries(field, parentRaw)
+	if err != nil {
+		return nil, false, err
+	}
+	current, err := keyedEntries(field, raw)
+	if err != nil {
+		return nil, false, err
+	}
+	// The order of entries doesn't matter
+	var added []entry
+	for _, e := range current {
+		j := slices.IndexFunc(parent, func(p entry) bool { return p.key == e.key })
+		if j < 0 || !bytes.Equal(parent[j].value, e.value) {
+			added = append(added, e)
+		}
+	}
+	for _, p := range parent {
+		if !slices.ContainsFunc(current, func(e entry) bool { return e.key == p.key }) {
+			return nil, false, nil
+		}
+	}
+	data, err := marshalEntries(field, added)
+	return data, true, err
+}
+
+// zeroJSON returns the zero value of the type of raw, to clear a field explicitly.
+func zeroJSON(raw json.RawMessage) json.RawMessage {
+	switch raw[0] {
+	case '"':
+		return json.RawMessage(`""`)
+	case '[':
+		return json.RawMessage(`[]`)
+	case '{':
+		return json.RawMessage(`{}`)
+	case 't', 'f':
+		return json.RawMessage(`false`)
+	default:
+		return json.RawMessage(`0`)
+	}
+}
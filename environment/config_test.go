@@ -105,6 +105,48 @@ func TestEnvironmentConfig_Load(t *testing.T) {
 	}
 }
 
+func TestEnvironmentConfig_SaveIsDeterministic(t *testing.T) {
+	// The same logical configuration, built in different orders and with overridden keys
+	first := DefaultConfig()
+	first.Env = KVList{"FOO=old", "BAR=2", "FOO=bar"}
+	first.Secrets = KVList{"TOKEN=env://TOKEN", "API_KEY=op://vault/item/field"}
+
+	second := DefaultConfig()
+	second.Env.Set("BAR", "2")
+	second.Env.Set("FOO", "bar")
+	second.Secrets = KVList{"API_KEY=op://vault/item/field", "TOKEN=env://TOKEN"}
+
+	firstDir, secondDir := t.TempDir(), t.TempDir()
+	require.NoError(t, first.Save(firstDir))
+	require.NoError(t, second.Save(secondDir))
+
+	firstData, err := os.ReadFile(ConfigPath(firstDir))
+	require.NoError(t, err)
+	secondData, err := os.ReadFile(ConfigPath(secondDir))
+	require.NoError(t, err)
+	assert.Equal(t, string(firstData), string(secondData))
+
+	loaded := DefaultConfig()
+	require.NoError(t, loaded.Load(firstDir))
+	assert.Equal(t, KVList{"BAR=2", "FOO=bar"}, loaded.Env)
+	assert.Equal(t, KVList{"API_KEY=op://vault/item/field", "TOKEN=env://TOKEN"}, loaded.Secrets)
+
+	// Saving doesn't modify the configuration itself
+	assert.Equal(t, KVList{"FOO=old", "BAR=2", "FOO=bar"}, first.Env)
+}
+
+func TestEnvironmentConfig_ExpandBuildArgs(t *testing.T) {
+	config := &EnvironmentConfig{
+		BuildArgs: map[string]string{"NODE_VERSION": "20", "EMPTY": ""},
+	}
+
+	assert.Equal(t, "nvm install 20", config.ExpandBuildArgs("nvm install ${NODE_VERSION}"))
+	assert.Equal(t, "echo []", config.ExpandBuildArgs("echo [${EMPTY}]"))
+	// Anything that isn't a build arg is left for the shell
+	assert.Equal(t, "echo $HOME ${HOME} ${NODE_VERSION:-18} $NODE_VERSION", config.ExpandBuildArgs("echo $HOME ${HOME} ${NODE_VERSION:-18} $NODE_VERSION"))
+	assert.Equal(t, "echo ${NODE_VERSION}", (&EnvironmentConfig{}).ExpandBuildArgs("echo ${NODE_VERSION}"))
+}
+
 // Test helper functions
 func createInstructionsFile(t *testing.T, dir, content string) {
 	t.Helper()
@@ -122,3 +164,163 @@ func createConfigFile(t *testing.T, dir string, config *EnvironmentConfig) {
 	require.NoError(t, err)
 	require.NoError(t, os.WriteFile(filepath.Join(configDir, "environment.json"), data, 0644))
 }
+
+func TestDiffConfig(t *testing.T) {
+	old := &EnvironmentConfig{
+		BaseImage:     "ubuntu:24.04",
+		Workdir:       "/workdir",
+		SetupCommands: []string{"apt-get update", "apt-get install -y git"},
+		Env:           KVList{"FOO=bar", "DEBUG=1"},
+		BuildArgs:     map[string]string{"NODE_VERSION": "18"},
+	}
+
+	t.Run("identical", func(t *testing.T) {
+		changes := DiffConfig(old, old.Copy())
+		assert.True(t, changes.Empty())
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		new := old.Copy()
+		new.BaseImage = "golang:1.24"
+		new.SetupCommands = []string{"apt-get update", "apt-get install -y curl"}
+		new.Env = KVList{"FOO=baz"}
+		new.BuildArgs = map[string]string{"NODE_VERSION": "20", "GO_VERSION": "1.24"}
+		new.RunAsUser = "node"
+
+		changes := DiffConfig(old, new)
+		assert.False(t, changes.Empty())
+		assert.Equal(t, &ValueChange{From: "ubuntu:24.04", To: "golang:1.24"}, changes.BaseImage)
+		assert.Nil(t, changes.Workdir)
+		assert.Equal(t, &ListChange{Added: []string{"apt-get install -y curl"}, Removed: []string{"apt-get install -y git"}}, changes.SetupCommands)
+		assert.Equal(t, &ListChange{Added: []string{"FOO=baz"}, Removed: []string{"FOO=bar", "DEBUG=1"}}, changes.Env)
+		assert.Equal(t, &ListChange{Added: []string{"GO_VERSION=1.24", "NODE_VERSION=20"}, Removed: []string{"NODE_VERSION=18"}}, changes.BuildArgs)
+		assert.Nil(t, changes.Secrets)
+		assert.Equal(t, &ValueChange{From: "", To: "node"}, changes.RunAsUser)
+	})
+}
+
+func TestServiceConfig_Equal(t *testing.T) {
+	service := &ServiceConfig{Name: "db", Image: "postgres:16", ExposedPorts: []int{5432}, Env: []string{"POSTGRES_PASSWORD=postgres"}}
+
+	same := *service
+	same.ExposedPorts = []int{5432}
+	assert.True(t, service.Equal(&same))
+
+	changed := *service
+	changed.Env = []string{"POSTGRES_PASSWORD=secret"}
+	assert.False(t, service.Equal(&changed))
+
+	changed = *service
+	changed.Image = "postgres:17"
+	assert.False(t, service.Equal(&changed))
+}
+
+func TestEnvironmentConfig_Extends(t *testing.T) {
+	root := t.TempDir()
+	api := filepath.Join(root, "packages", "api")
+	createConfigFile(t, root, &EnvironmentConfig{
+		BaseImage:       "golang:1.24",
+		Workdir:         "/workdir",
+		SetupCommands:   []string{"apt-get update"},
+		InstallCommands: []string{"go mod download"},
+		Env:             KVList{"CGO_ENABLED=0", "LOG_LEVEL=info"},
+		VerifyCommand:   "go build ./...",
+	})
+	writeConfig := func(t *testing.T, dir, config string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, ".container-use"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ".container-use", "environment.json"), []byte(config), 0644))
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		writeConfig(t, api, `{
+  "extends": "../../../.container-use/environment.json",
+  "base_image": "golang:1.25",
+  "setup_commands": ["apt-get install -y protobuf-compiler"],
+  "install_commands": ["make generate"],
+  "env": ["LOG_LEVEL=debug", "SERVICE=api"],
+  "override": ["install_commands"]
+}`)
+		config := DefaultConfig()
+		require.NoError(t, config.Load(api))
+
+		// Local scalars win, command lists are appended unless overridden, variables are merged by name
+		assert.Equal(t, "golang:1.25", config.BaseImage)
+		assert.Equal(t, "go build ./...", config.VerifyCommand)
+		assert.Equal(t, []string{"apt-get update", "apt-get install -y protobuf-compiler"}, config.SetupCommands)
+		assert.Equal(t, []string{"make generate"}, config.InstallCommands)
+		assert.Equal(t, KVList{"CGO_ENABLED=0", "LOG_LEVEL=debug", "SERVICE=api"}, config.Env)
+		assert.Equal(t, []string{filepath.Join(root, ".container-use", "environment.json")}, config.Inheritance())
+
+		// Saving only writes what the package changes
+		config.SetupCommands = append(config.SetupCommands, "apt-get install -y jq")
+		config.Env.Unset("CGO_ENABLED")
+		require.NoError(t, config.Save(api))
+		data, err := os.ReadFile(ConfigPath(api))
+		require.NoError(t, err)
+		var saved map[string]any
+		require.NoError(t, json.Unmarshal(data, &saved))
+		assert.Equal(t, map[string]any{
+			"extends":          "../../../.container-use/environment.json",
+			"base_image":       "golang:1.25",
+			"setup_commands":   []any{"apt-get install -y protobuf-compiler", "apt-get install -y jq"},
+			"install_commands": []any{"make generate"},
+			// Removing an inherited variable requires overriding them all
+			"env":      []any{"LOG_LEVEL=debug", "SERVICE=api"},
+			"override": []any{"env", "install_commands"},
+		}, saved)
+
+		reloaded := DefaultConfig()
+		require.NoError(t, reloaded.Load(api))
+		assert.Equal(t, config.SetupCommands, reloaded.SetupCommands)
+		assert.Equal(t, KVList{"LOG_LEVEL=debug", "SERVICE=api"}, reloaded.Env)
+		assert.Equal(t, "go build ./...", reloaded.VerifyCommand)
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		writeConfig(t, api, `{"extends": "../../../.container-use/environment.json", "verify_command": "go vet ./..."}`)
+		handler := filepath.Join(api, "handler")
+		writeConfig(t, handler, `{"extends": "../../.container-use/environment.json", "setup_commands": ["echo handler"]}`)
+
+		config := DefaultConfig()
+		require.NoError(t, config.Load(handler))
+		assert.Equal(t, "go vet ./...", config.VerifyCommand)
+		assert.Equal(t, []string{"apt-get update", "echo handler"}, config.SetupCommands)
+		assert.Equal(t, []string{
+			filepath.Join(api, ".container-use", "environment.json"),
+			filepath.Join(root, ".container-use", "environment.json"),
+		}, config.Inheritance())
+	})
+
+	t.Run("missing_parent", func(t *testing.T) {
+		dir := t.TempDir()
+		writeConfig(t, dir, `{"extends": "../missing/environment.json"}`)
+		assert.ErrorContains(t, DefaultConfig().Load(dir), "doesn't exist")
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		a, b := t.TempDir(), t.TempDir()
+		writeConfig(t, a, `{"extends": "`+filepath.Join(b, ".container-use", "environment.json")+`"}`)
+		writeConfig(t, b, `{"extends": "`+filepath.Join(a, ".container-use", "environment.json")+`"}`)
+		assert.ErrorContains(t, DefaultConfig().Load(a), "extends it back")
+	})
+}
+
+func TestExpandHostTemplates(t *testing.T) {
+	t.Setenv("CU_TEST_USER", "alice")
+	t.Setenv("HOSTNAME", "")
+	os.Unsetenv("HOSTNAME")
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	expanded, err := ExpandHostTemplates("{{host.CU_TEST_USER}}@{{ host.HOSTNAME }}")
+	require.NoError(t, err)
+	assert.Equal(t, "alice@"+hostname, expanded)
+
+	// Values without templates, and other braces, are left untouched
+	expanded, err = ExpandHostTemplates("${HOME}/{{not.a.template}}")
+	require.NoError(t, err)
+	assert.Equal(t, "${HOME}/{{not.a.template}}", expanded)
+
+	_, err = ExpandHostTemplates("{{host.CU_TEST_UNSET}}")
+	assert.ErrorContains(t, err, "CU_TEST_UNSET")
+}
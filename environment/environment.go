@@ -5,11 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"dagger.io/dagger"
+	"github.com/dagger/container-use/metrics"
 )
 
 // EnvironmentInfo contains basic metadata about an environment
@@ -32,7 +38,21 @@ type Environment struct {
 }
 
 func New(ctx context.Context, dag *dagger.Client, id, title string, config *EnvironmentConfig, initialSourceDir *dagger.Directory) (*Environment, error) {
-	env := &Environment{
+	env := newEnvironment(dag, id, title, config)
+	return env.create(ctx, initialSourceDir)
+}
+
+// NewFromImage creates an environment using image as its container, e.g. a checkpoint of another environment,
+// instead of building it from the base image and the source: its workdir is taken as the source of the environment.
+// Setup and install commands aren't run, their results are expected to be part of the image.
+func NewFromImage(ctx context.Context, dag *dagger.Client, id, title string, config *EnvironmentConfig, image string) (*Environment, error) {
+	env := newEnvironment(dag, id, title, config)
+	env.State.FromImage = image
+	return env.create(ctx, nil)
+}
+
+func newEnvironment(dag *dagger.Client, id, title string, config *EnvironmentConfig) *Environment {
+	return &Environment{
 		EnvironmentInfo: &EnvironmentInfo{
 			ID: id,
 			State: &State{
@@ -44,13 +64,15 @@ func New(ctx context.Context, dag *dagger.Client, id, title string, config *Envi
 		},
 		dag: dag,
 	}
+}
 
+func (env *Environment) create(ctx context.Context, initialSourceDir *dagger.Directory) (*Environment, error) {
 	container, err := env.buildBase(ctx, initialSourceDir)
 	if err != nil {
 		return nil, err
 	}
 
-	slog.Info("Creating environment", "id", env.ID, "workdir", env.State.Config.Workdir)
+	slog.Info("Creating environment", "id", env.ID, "workdir", env.State.Config.Workdir, "from_image", env.State.FromImage)
 
 	if err := env.apply(ctx, container); err != nil {
 		return nil, err
@@ -78,7 +100,6 @@ func Load(ctx context.Context, dag *dagger.Client, id string, state []byte, work
 	env := &Environment{
 		EnvironmentInfo: envInfo,
 		dag:             dag,
-		// Services: ?
 	}
 
 	return env, nil
@@ -111,11 +132,12 @@ func LoadInfo(ctx context.Context, id string, state []byte, worktree string) (*E
 
 func (env *Environment) apply(ctx context.Context, newState *dagger.Container) error {
 	// TODO(braa): is this sync redundant with newState.ID?
-	if _, err := newState.Sync(ctx); err != nil {
-		return err
-	}
-
-	containerID, err := newState.ID(ctx)
+	containerID, err := retryTransient(ctx, func() (dagger.ContainerID, error) {
+		if _, err := newState.Sync(ctx); err != nil {
+			return "", err
+		}
+		return newState.ID(ctx)
+	})
 	if err != nil {
 		return err
 	}
@@ -137,6 +159,10 @@ func containerWithEnvAndSecrets(dag *dagger.Client, container *dagger.Container,
 		if !found {
 			return nil, fmt.Errorf("invalid environment variable: %s", env)
 		}
+		v, err := ExpandHostTemplates(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment variable %s: %w", k, err)
+		}
 		container = container.WithEnvVariable(k, v)
 	}
 
@@ -151,29 +177,106 @@ func containerWithEnvAndSecrets(dag *dagger.Client, container *dagger.Container,
 	return container, nil
 }
 
-func (env *Environment) buildBase(ctx context.Context, baseSourceDir *dagger.Directory) (*dagger.Container, error) {
+// containerWithHostEnv exposes the current value of host environment variables to the next exec.
+// Values are passed as env:// secret references so they never end up in the persisted container state.
+func containerWithHostEnv(dag *dagger.Client, container *dagger.Container, names []string) (*dagger.Container, error) {
+	for _, name := range names {
+		if _, ok := os.LookupEnv(name); !ok {
+			return nil, fmt.Errorf("host environment variable %s is not set", name)
+		}
+		container = container.WithSecretVariable(name, dag.Secret("env://"+name))
+	}
+	return container, nil
+}
+
+// containerWithoutHostEnv removes variables added by containerWithHostEnv.
+func containerWithoutHostEnv(container *dagger.Container, names []string) *dagger.Container {
+	for _, name := range names {
+		container = container.WithoutSecretVariable(name)
+	}
+	return container
+}
+
+func (env *Environment) buildBase(ctx context.Context, baseSourceDir *dagger.Directory) (_ *dagger.Container, rerr error) {
+	defer metrics.Track("build_base", &rerr)()
+
+	baseImage := env.State.Config.BaseImage
+	preSourceFiles := env.State.Config.PreSourceFiles
+	setupCommands := env.State.Config.SetupCommands
+	installCommands := env.State.Config.InstallCommands
+	if env.State.FromImage != "" {
+		// The image already holds the source and the results of the commands, only the settings are applied on top
+		baseImage = env.State.FromImage
+		preSourceFiles, setupCommands, installCommands = nil, nil, nil
+	}
+	// Agents can change setup and install commands, they're subject to the policy like the commands they run
+	for _, command := range slices.Concat(setupCommands, installCommands) {
+		if err := env.checkCommandPolicy(env.State.Config.ExpandBuildArgs(command)); err != nil {
+			return nil, err
+		}
+	}
+
 	container := env.dag.
 		Container().
-		From(env.State.Config.BaseImage).
+		From(baseImage).
 		WithWorkdir(env.State.Config.Workdir)
 
+	if entrypoint := env.State.Config.Entrypoint; len(entrypoint) > 0 {
+		container = container.WithEntrypoint(entrypoint)
+	}
+
+	if user := env.State.Config.RunAsUser; user != "" {
+		if err := validateUser(ctx, container, user); err != nil {
+			return nil, fmt.Errorf("invalid run_as_user: %w", err)
+		}
+		// Create the workdir up front so the user can write to it, rather than letting the first exec create it as root
+		container = container.
+			WithDirectory(env.State.Config.Workdir, env.dag.Directory(), dagger.ContainerWithDirectoryOpts{Owner: user}).
+			WithUser(user)
+	}
+
 	container, err := containerWithEnvAndSecrets(env.dag, container, env.State.Config.Env, env.State.Config.Secrets)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := env.State.Config.refreshedSecrets(); err != nil {
+		return nil, err
+	}
+	if _, err := env.cacheDirs(); err != nil {
+		return nil, err
+	}
+	if err := env.State.Config.validateCapabilities(); err != nil {
+		return nil, err
+	}
 
+	buildLog := env.buildLog(ctx)
 	runCommands := func(commands []string) error {
 		for _, command := range commands {
 			var err error
 
-			container = container.WithExec([]string{"sh", "-c", command})
+			command = env.State.Config.ExpandBuildArgs(command)
+			fmt.Fprintf(buildLog, "$ %s\n", command)
+			before := container
+			container = container.WithExec([]string{"sh", "-c", command}, dagger.ContainerWithExecOpts{
+				InsecureRootCapabilities: env.State.Config.insecureRootCapabilities(),
+			})
 
-			exitCode, err := container.ExitCode(ctx)
+			exitCode, err := retryTransient(ctx, func() (int, error) {
+				return container.ExitCode(ctx)
+			})
 			if err != nil {
 				var exitErr *dagger.ExecError
 				if errors.As(err, &exitErr) {
+					writeCommandOutput(buildLog, exitErr.Stdout, exitErr.Stderr)
 					env.Notes.AddCommand(command, exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
-					return fmt.Errorf("exit code %d.\nstdout: %s\nstderr: %s\n%w", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr, err)
+					return &BuildCommandError{
+						Command:   command,
+						ExitCode:  exitErr.ExitCode,
+						Container: before,
+
+						insecureRootCapabilities: env.State.Config.insecureRootCapabilities(),
+						err:                      fmt.Errorf("exit code %d.\nstdout: %s\nstderr: %s\n%w", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr, err),
+					}
 				}
 
 				return err
@@ -188,33 +291,93 @@ func (env *Environment) buildBase(ctx context.Context, baseSourceDir *dagger.Dir
 				return fmt.Errorf("failed to get stderr: %w", err)
 			}
 
+			writeCommandOutput(buildLog, stdout, stderr)
 			env.Notes.AddCommand(command, exitCode, stdout, stderr)
 		}
 
 		return nil
 	}
 
+	for _, file := range preSourceFiles {
+		if path.IsAbs(file) {
+			return nil, fmt.Errorf("invalid pre_source_files: %s must be relative to the repository root", file)
+		}
+		target, err := resolvePath(env.State.Config.Workdir, file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pre_source_files: %w", err)
+		}
+		container = container.WithFile(target, baseSourceDir.File(file), dagger.ContainerWithFileOpts{
+			Owner: env.State.Config.RunAsUser,
+		})
+	}
+
 	// Run setup commands without the source directory for caching purposes
-	if err := runCommands(env.State.Config.SetupCommands); err != nil {
+	if err := runCommands(setupCommands); err != nil {
 		return nil, fmt.Errorf("setup command failed: %w", err)
 	}
 
-	env.Services, err = env.startServices(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to start services: %w", err)
-	}
-	for _, service := range env.Services {
-		container = container.WithServiceBinding(service.Config.Name, service.svc)
+	// Services still running from a previous build are reused
+	if err := env.ensureServices(ctx); err != nil {
+		return nil, err
 	}
+	container = env.withServiceBindings(container)
 
-	container = container.WithDirectory(".", baseSourceDir)
+	// Without a source directory, the image's workdir is the source
+	if baseSourceDir != nil {
+		container = container.WithDirectory(".", baseSourceDir, dagger.ContainerWithDirectoryOpts{
+			Owner: env.State.Config.RunAsUser,
+		})
+	}
 
 	// Run the install commands after the source directory is set up
-	if err := runCommands(env.State.Config.InstallCommands); err != nil {
+	if err := runCommands(installCommands); err != nil {
 		return nil, fmt.Errorf("install command failed: %w", err)
 	}
 
-	return container, nil
+	// Secrets refreshed for every command are set again when commands run
+	return env.containerWithoutRefreshedSecrets(container), nil
+}
+
+// BuildCommandError is a setup or install command failing while building an environment.
+type BuildCommandError struct {
+	Command  string
+	ExitCode int
+	// Container is the environment as built up to, but not including, the failing command.
+	Container *dagger.Container
+
+	// insecureRootCapabilities is whether the command ran with all root capabilities, as the terminal then does.
+	insecureRootCapabilities bool
+	err                      error
+}
+
+func (e *BuildCommandError) Error() string {
+	return e.err.Error()
+}
+
+func (e *BuildCommandError) Unwrap() error {
+	return e.err
+}
+
+// Terminal opens an interactive terminal in the environment as it was right before the command failed,
+// to run it again by hand.
+func (e *BuildCommandError) Terminal(ctx context.Context) error {
+	return terminal(ctx, e.Container, fmt.Sprintf("printf '%%s\\n' %s; ", ShellQuote("The failing command was: "+e.Command)), e.insecureRootCapabilities)
+}
+
+// DebugBuild rebuilds the environment from its current source with config, without applying the result,
+// and returns the setup or install command that failed, or nil if they all succeed.
+func (env *Environment) DebugBuild(ctx context.Context, config *EnvironmentConfig) (*BuildCommandError, error) {
+	source := env.Workdir()
+	env.State.Config = config
+	_, err := env.buildBase(ctx, source)
+	if err == nil {
+		return nil, nil
+	}
+	var commandErr *BuildCommandError
+	if errors.As(err, &commandErr) {
+		return commandErr, nil
+	}
+	return nil, err
 }
 
 func (env *Environment) UpdateConfig(ctx context.Context, newConfig *EnvironmentConfig) error {
@@ -229,42 +392,172 @@ func (env *Environment) UpdateConfig(ctx context.Context, newConfig *Environment
 	if err := env.apply(ctx, container); err != nil {
 		return err
 	}
+	env.State.HistoryAtBuild = len(env.State.History)
 
 	return nil
 }
 
-func (env *Environment) Run(ctx context.Context, command, shell string, useEntrypoint bool) (string, error) {
+// RunOpts holds the per-command settings of Run and RunBackground.
+type RunOpts struct {
+	// UseEntrypoint prepends the image entrypoint to the command.
+	UseEntrypoint bool
+	// InheritHostEnv lists host environment variables passed to the command without being persisted.
+	InheritHostEnv []string
+	// User runs the command as this user (name, uid, name:group or uid:gid) instead of the environment's default.
+	// Files created or modified by the command are owned by this user.
+	User string
+	// Cache marks the command as read-only: its changes to the container are discarded, and running it again
+	// on the same container state returns the output of the previous successful run without executing it.
+	// Commands inheriting host environment variables are never cached.
+	Cache bool
+	// CaptureFiles lists files read from the container once the command ran, whose contents are appended to
+	// its output, e.g. a report the command generates.
+	CaptureFiles []string
+}
+
+// containerForCommand returns the container a single command should run in, according to opts.
+func (env *Environment) containerForCommand(ctx context.Context, opts RunOpts) (*dagger.Container, error) {
+	if env.State.Paused {
+		return nil, fmt.Errorf("environment %s is paused, it must be resumed (container-use resume %s) before running commands", env.ID, env.ID)
+	}
+	idleServices.touch(env.ID, env.State.Config.IdleTimeout())
+	if err := env.ensureServices(ctx); err != nil {
+		return nil, err
+	}
+
+	container, err := containerWithHostEnv(env.dag, env.withServiceBindings(env.container()), opts.InheritHostEnv)
+	if err != nil {
+		return nil, err
+	}
+	container, err = env.containerWithRefreshedSecrets(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	container, err = env.withCacheDirs(container)
+	if err != nil {
+		return nil, err
+	}
+	container = env.withSharedDir(container)
+	if opts.User != "" {
+		if err := validateUser(ctx, env.container(), opts.User); err != nil {
+			return nil, err
+		}
+		container = container.WithUser(opts.User)
+	}
+	return container, nil
+}
+
+// withoutCommandSettings reverts the per-command settings of opts once the command has run,
+// so they don't leak into the environment's state.
+func (env *Environment) withoutCommandSettings(ctx context.Context, container *dagger.Container, opts RunOpts) (*dagger.Container, error) {
+	container = containerWithoutHostEnv(container, opts.InheritHostEnv)
+	container = env.containerWithoutRefreshedSecrets(container)
+	container, err := env.withoutCacheDirs(container)
+	if err != nil {
+		return nil, err
+	}
+	if opts.User != "" {
+		user, err := env.container().User(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get default user: %w", err)
+		}
+		container = container.WithUser(user)
+	}
+	return container, nil
+}
+
+// validateUser makes sure user exists in container. Numeric IDs are always accepted.
+func validateUser(ctx context.Context, container *dagger.Container, user string) error {
+	name, _, _ := strings.Cut(user, ":")
+	if _, err := strconv.Atoi(name); err == nil {
+		return nil
+	}
+	passwd, err := container.File("/etc/passwd").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to look up user %s: %w", name, err)
+	}
+	for line := range strings.Lines(passwd) {
+		if strings.HasPrefix(line, name+":") {
+			return nil
+		}
+	}
+	return fmt.Errorf("user %s does not exist in the environment", name)
+}
+
+// ErrCommandInterrupted is returned by Run when its context is canceled while the command runs. The command is
+// killed, and the environment is left as it was before it.
+var ErrCommandInterrupted = errors.New("command interrupted, the environment was left as it was before the command")
+
+func (env *Environment) Run(ctx context.Context, command, shell string, opts RunOpts) (_ string, rerr error) {
+	if err := env.checkCommandPolicy(command); err != nil {
+		return "", err
+	}
+	if output, ok := env.CachedOutput(command, shell, opts); ok {
+		return output, nil
+	}
+	defer metrics.Track("run", &rerr)()
+	// The cached output belongs to the container state the command ran on
+	container := env.State.Container
+
+	captureFiles, err := env.resolveCaptureFiles(opts.CaptureFiles)
+	if err != nil {
+		return "", err
+	}
+
 	args := []string{}
 	if command != "" {
 		args = []string{shell, "-c", command}
 	}
-	newState := env.container().WithExec(args, dagger.ContainerWithExecOpts{
-		UseEntrypoint:                 useEntrypoint,
+	commandContainer, err := env.containerForCommand(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+	newState := commandContainer.WithExec(args, dagger.ContainerWithExecOpts{
+		UseEntrypoint:                 opts.UseEntrypoint,
 		Expect:                        dagger.ReturnTypeAny, // Don't treat non-zero exit as error
 		ExperimentalPrivilegedNesting: true,
+		InsecureRootCapabilities:      env.State.Config.insecureRootCapabilities(),
 	})
 
-	exitCode, err := newState.ExitCode(ctx)
+	// Canceling ctx cancels the queries to the engine, which kills the command
+	exitCode, err := retryTransient(ctx, func() (int, error) {
+		return newState.ExitCode(ctx)
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to get exit code: %w", err)
+		return "", interruptedOr(ctx, fmt.Errorf("failed to get exit code: %w", err))
 	}
 
 	stdout, err := newState.Stdout(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to get stdout: %w", err)
+		return "", interruptedOr(ctx, fmt.Errorf("failed to get stdout: %w", err))
 	}
 
 	stderr, err := newState.Stderr(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to get stderr: %w", err)
+		return "", interruptedOr(ctx, fmt.Errorf("failed to get stderr: %w", err))
+	}
+
+	// Nothing was recorded yet: a command interrupted right as it finished isn't half-applied either
+	if err := ctx.Err(); err != nil {
+		return "", interruptedOr(ctx, err)
 	}
 
+	// Secrets echoed by the command must not be stored in the notes nor returned
+	masker := env.secretMasker(ctx, opts)
+	stdout, stderr = masker.Replace(stdout), masker.Replace(stderr)
+
 	// Log the command execution with all details
 	env.Notes.AddCommand(command, exitCode, stdout, stderr)
 
-	// Always apply the container state (preserving changes even on non-zero exit)
-	if err := env.apply(ctx, newState); err != nil {
-		return stdout, fmt.Errorf("failed to apply container state: %w", err)
+	// Always apply the container state (preserving changes even on non-zero exit), unless the command is read-only
+	if !opts.Cache {
+		newState, err = env.withoutCommandSettings(ctx, newState, opts)
+		if err != nil {
+			return stdout, err
+		}
+		if err := env.apply(ctx, newState); err != nil {
+			return stdout, fmt.Errorf("failed to apply container state: %w", err)
+		}
 	}
 
 	// Return combined output (stdout + stderr if there was stderr)
@@ -275,16 +568,49 @@ func (env *Environment) Run(ctx context.Context, command, shell string, useEntry
 		}
 		combinedOutput += "stderr: " + stderr
 	}
+
+	env.State.History = append(env.State.History, &CommandRecord{
+		Command:        command,
+		Shell:          shell,
+		User:           opts.User,
+		UseEntrypoint:  opts.UseEntrypoint,
+		InheritHostEnv: opts.InheritHostEnv,
+		ExitCode:       exitCode,
+		OutputDigest:   OutputDigest(combinedOutput),
+	})
+
+	if len(captureFiles) > 0 {
+		combinedOutput += env.captureFiles(ctx, newState, captureFiles, masker)
+	}
+
+	if opts.Cache && exitCode == 0 && len(opts.InheritHostEnv) == 0 {
+		commandOutputs.set(env.ID, container, newCommandKey(command, shell, opts), combinedOutput)
+	}
+
 	return combinedOutput, nil
 }
 
-func (env *Environment) RunBackground(ctx context.Context, command, shell string, ports []int, useEntrypoint bool) (EndpointMappings, error) {
+// interruptedOr returns ErrCommandInterrupted if ctx was canceled, err otherwise.
+func interruptedOr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %w", ErrCommandInterrupted, ctxErr)
+	}
+	return err
+}
+
+func (env *Environment) RunBackground(ctx context.Context, command, shell string, ports []int, opts RunOpts) (EndpointMappings, error) {
+	if err := env.checkCommandPolicy(command); err != nil {
+		return nil, err
+	}
 	args := []string{}
 	if command != "" {
 		args = []string{shell, "-c", command}
 	}
 	displayCommand := command + " &"
-	serviceState := env.container()
+	serviceState, err := env.containerForCommand(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	// Expose ports
 	for _, port := range ports {
@@ -298,14 +624,17 @@ func (env *Environment) RunBackground(ctx context.Context, command, shell string
 	startCtx, cancel := context.WithTimeout(ctx, serviceStartTimeout)
 	defer cancel()
 	svc, err := serviceState.AsService(dagger.ContainerAsServiceOpts{
-		Args:          args,
-		UseEntrypoint: useEntrypoint,
+		Args:                     args,
+		UseEntrypoint:            opts.UseEntrypoint,
+		InsecureRootCapabilities: env.State.Config.insecureRootCapabilities(),
 	}).Start(startCtx)
 	if err != nil {
 		var exitErr *dagger.ExecError
 		if errors.As(err, &exitErr) {
-			env.Notes.AddCommand(displayCommand, exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
-			return nil, fmt.Errorf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
+			masker := env.secretMasker(ctx, opts)
+			stdout, stderr := masker.Replace(exitErr.Stdout), masker.Replace(exitErr.Stderr)
+			env.Notes.AddCommand(displayCommand, exitErr.ExitCode, stdout, stderr)
+			return nil, fmt.Errorf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, stdout, stderr)
 		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			err = fmt.Errorf("service failed to start within %s timeout", serviceStartTimeout)
@@ -316,6 +645,7 @@ func (env *Environment) RunBackground(ctx context.Context, command, shell string
 	}
 
 	env.Notes.AddCommand(displayCommand, 0, "", "")
+	idleServices.track(env.ID, env.State.Config.IdleTimeout(), svc)
 
 	endpoints := EndpointMappings{}
 	for _, port := range ports {
@@ -352,12 +682,90 @@ func (env *Environment) RunBackground(ctx context.Context, command, shell string
 		}
 		endpoint.EnvironmentInternal = internalEndpoint
 	}
+	idleServices.trackEndpoints(env.ID, endpoints)
 
 	return endpoints, nil
 }
 
+// VerifyResult is the outcome of running the configured verify command.
+type VerifyResult struct {
+	Command  string
+	ExitCode int
+	Output   string
+}
+
+func (r *VerifyResult) Passed() bool {
+	return r.ExitCode == 0
+}
+
+// Verify runs the configured verify command against the current state of the environment.
+// Changes made by the verify command are discarded. It returns nil if no verify command is configured.
+func (env *Environment) Verify(ctx context.Context) (*VerifyResult, error) {
+	command := env.State.Config.VerifyCommand
+	if command == "" {
+		return nil, nil
+	}
+
+	verified := env.container().WithExec([]string{"sh", "-c", command}, dagger.ContainerWithExecOpts{
+		Expect:                   dagger.ReturnTypeAny,
+		InsecureRootCapabilities: env.State.Config.insecureRootCapabilities(),
+	})
+	exitCode, err := verified.ExitCode(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exit code: %w", err)
+	}
+	stdout, err := verified.Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdout: %w", err)
+	}
+	stderr, err := verified.Stderr(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stderr: %w", err)
+	}
+
+	return &VerifyResult{
+		Command:  command,
+		ExitCode: exitCode,
+		Output:   strings.TrimSpace(stdout + "\n" + stderr),
+	}, nil
+}
+
+// SyncSource overlays dir onto the environment's workdir.
+// Files that don't exist in dir are left in place.
+func (env *Environment) SyncSource(ctx context.Context, dir *dagger.Directory) error {
+	return env.apply(ctx, env.container().WithDirectory(".", dir, dagger.ContainerWithDirectoryOpts{
+		Owner: env.State.Config.RunAsUser,
+	}))
+}
+
+// ReplaceGitDir replaces the git directory of the environment's workdir with the one at hostPath.
+func (env *Environment) ReplaceGitDir(ctx context.Context, hostPath string) error {
+	gitDir := env.dag.Host().Directory(hostPath, dagger.HostDirectoryOpts{NoCache: true})
+	return env.apply(ctx, env.container().WithoutDirectory(".git").WithDirectory(".git", gitDir))
+}
+
 func (env *Environment) Terminal(ctx context.Context) error {
-	container := env.container()
+	if err := env.StartServices(ctx); err != nil {
+		return err
+	}
+	return terminal(ctx, env.withServiceBindings(env.container()), "", env.State.Config.insecureRootCapabilities())
+}
+
+// safeShellWordRegExp matches words the shell doesn't interpret, which don't need quoting.
+var safeShellWordRegExp = regexp.MustCompile(`^[A-Za-z0-9_./:=@%+,^-]+$`)
+
+// ShellQuote quotes s as a single word for POSIX shells: in single quotes, where nothing is expanded, unless the
+// shell doesn't interpret it.
+func ShellQuote(s string) string {
+	if safeShellWordRegExp.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// terminal opens an interactive terminal in container, running rc, if any, when the shell starts.
+// With insecureRootCapabilities, the shell has all root capabilities, like the commands of the environment.
+func terminal(ctx context.Context, container *dagger.Container, rc string, insecureRootCapabilities bool) error {
 	var cmd []string
 	var sourceRC string
 	if shells, err := container.File("/etc/shells").Contents(ctx); err == nil {
@@ -374,7 +782,7 @@ func (env *Environment) Terminal(ctx context.Context) error {
 		}
 	}
 	// Try to show the same pretty PS1 as for the default /bin/sh terminal in dagger
-	container = container.WithNewFile("/cu/rc.sh", sourceRC+`export PS1="\033[33mcu\033[0m \033[02m\$(pwd | sed \"s|^\$HOME|~|\")\033[0m \$ "`+"\n")
+	container = container.WithNewFile("/cu/rc.sh", sourceRC+rc+`export PS1="\033[33mcu\033[0m \033[02m\$(pwd | sed \"s|^\$HOME|~|\")\033[0m \$ "`+"\n")
 	if cmd == nil {
 		// If bash not available, assume POSIX shell
 		container = container.WithEnvVariable("ENV", "/cu/rc.sh")
@@ -382,6 +790,7 @@ func (env *Environment) Terminal(ctx context.Context) error {
 	}
 	if _, err := container.Terminal(dagger.ContainerTerminalOpts{
 		ExperimentalPrivilegedNesting: true,
+		InsecureRootCapabilities:      insecureRootCapabilities,
 		Cmd:                           cmd,
 	}).Sync(ctx); err != nil {
 		return err
@@ -389,6 +798,13 @@ func (env *Environment) Terminal(ctx context.Context) error {
 	return nil
 }
 
+// Checkpoint publishes the environment in its current state as an image to target, and returns its
+// content-addressed reference, also recorded in the state so other environments can be based on it.
 func (env *Environment) Checkpoint(ctx context.Context, target string) (string, error) {
-	return env.container().Publish(ctx, target)
+	ref, err := env.container().Publish(ctx, target)
+	if err != nil {
+		return "", err
+	}
+	env.State.Checkpoint = ref
+	return ref, nil
 }
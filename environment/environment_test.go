@@ -0,0 +1,29 @@
+package environment
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "refs/heads/fancy-mallard", ShellQuote("refs/heads/fancy-mallard"))
+	assert.Equal(t, "--format=%H", ShellQuote("--format=%H"))
+	assert.Equal(t, "'Initial commit'", ShellQuote("Initial commit"))
+	assert.Equal(t, `'it'\''s'`, ShellQuote("it's"))
+	assert.Equal(t, "''", ShellQuote(""))
+
+	for _, s := range []string{
+		"",
+		"apt-get install -y git",
+		`echo "$HOME" && echo $(id -u) ` + "`whoami`",
+		"it's a \\n trap; rm -rf /tmp/x",
+		"line one\nline two",
+	} {
+		out, err := exec.Command("sh", "-c", "printf '%s' "+ShellQuote(s)).Output()
+		require.NoError(t, err)
+		assert.Equal(t, s, string(out))
+	}
+}
@@ -3,16 +3,63 @@ package environment
 import (
 	"context"
 	"fmt"
+	"os"
+	"path"
+	"slices"
 	"strings"
+
+	"dagger.io/dagger"
 )
 
-func (env *Environment) FileRead(ctx context.Context, targetFile string, shouldReadEntireFile bool, startLineOneIndexedInclusive int, endLineOneIndexedInclusive int) (string, error) {
+// resolvePath resolves target, absolute or relative to workdir, to an absolute path in the container.
+// Relative paths must stay within workdir, and absolute paths can't use ".." to disguise where they point.
+func resolvePath(workdir, target string) (string, error) {
+	if target == "" {
+		return "", fmt.Errorf("path must not be empty")
+	}
+	if path.IsAbs(target) {
+		if slices.Contains(strings.Split(target, "/"), "..") {
+			return "", fmt.Errorf("invalid path %q: absolute paths must not contain '..'", target)
+		}
+		return path.Clean(target), nil
+	}
+
+	workdir = path.Clean(workdir)
+	resolved := path.Join(workdir, target)
+	if resolved != workdir && !strings.HasPrefix(resolved, strings.TrimSuffix(workdir, "/")+"/") {
+		return "", fmt.Errorf("invalid path %q: it resolves to %s, outside of the workdir %s", target, resolved, workdir)
+	}
+	return resolved, nil
+}
+
+// FileRead returns the contents of targetFile, or of the given range of lines. With withLineNumbers,
+// each line is prefixed with its line number, under a header telling which lines of the file these are.
+func (env *Environment) FileRead(ctx context.Context, targetFile string, shouldReadEntireFile bool, startLineOneIndexedInclusive int, endLineOneIndexedInclusive int, withLineNumbers bool) (string, error) {
+	targetFile, err := resolvePath(env.State.Config.Workdir, targetFile)
+	if err != nil {
+		return "", err
+	}
 	file, err := env.container().File(targetFile).Contents(ctx)
 	if err != nil {
 		return "", err
 	}
+	if isBinary(file) {
+		return "", fmt.Errorf("%s is a binary file of %d bytes and can't be read as text; inspect it with a command instead, e.g. `file` or `xxd | head`", targetFile, len(file))
+	}
 	if shouldReadEntireFile {
-		return file, err
+		limit := env.State.Config.MaxFileReadSize
+		if limit == 0 {
+			limit = defaultMaxFileReadSize
+		}
+		contents, truncated := truncateContents(file, int(limit))
+		marker := ""
+		if truncated {
+			marker = fmt.Sprintf("\n[file truncated at %d bytes of %d; read the rest with start_line_one_indexed_inclusive and end_line_one_indexed_inclusive]\n", len(contents), len(file))
+		}
+		if withLineNumbers {
+			contents = numberLines(contents, 1, countLines(file))
+		}
+		return contents + marker, nil
 	}
 
 	lines := strings.Split(file, "\n")
@@ -33,20 +80,115 @@ func (env *Environment) FileRead(ctx context.Context, targetFile string, shouldR
 		return "", fmt.Errorf("error reading file: end_line_one_indexed_inclusive (%d) must be greater than start_line_one_indexed_inclusive (%d)", endLineOneIndexedInclusive, startLineOneIndexedInclusive)
 	}
 
-	return strings.Join(lines[start:end], "\n"), nil
+	excerpt := strings.Join(lines[start:end], "\n")
+	if withLineNumbers {
+		return numberLines(excerpt, start+1, countLines(file)), nil
+	}
+	return excerpt, nil
 }
 
-func (env *Environment) FileWrite(ctx context.Context, explanation, targetFile, contents string) error {
-	err := env.apply(ctx, env.container().WithNewFile(targetFile, contents))
-	if err != nil {
+const (
+	// defaultMaxFileReadSize is the size at which files read entirely are truncated,
+	// so reading a huge generated file doesn't flood the agent's context.
+	defaultMaxFileReadSize = 256 * 1024 // 256KB
+	// binaryCheckSize is how much of a file is searched for NUL bytes to tell whether it's binary.
+	binaryCheckSize = 8000
+)
+
+// isBinary reports whether contents look binary, like git does: a NUL byte in its beginning.
+func isBinary(contents string) bool {
+	return strings.IndexByte(contents[:min(len(contents), binaryCheckSize)], 0) >= 0
+}
+
+// truncateContents truncates contents to at most limit bytes, at the end of the last line that fits if any,
+// and reports whether it was truncated.
+func truncateContents(contents string, limit int) (string, bool) {
+	if len(contents) <= limit {
+		return contents, false
+	}
+	truncated := contents[:limit]
+	if i := strings.LastIndexByte(truncated, '\n'); i >= 0 {
+		truncated = truncated[:i+1]
+	}
+	return truncated, true
+}
+
+// countLines returns the number of lines of contents, the last one not necessarily ending with a newline.
+func countLines(contents string) int {
+	count := strings.Count(contents, "\n")
+	if contents != "" && !strings.HasSuffix(contents, "\n") {
+		count++
+	}
+	return count
+}
+
+// numberLines prefixes each line of excerpt with its line number, starting at first,
+// under a header such as "lines 40-60 of 523" locating the excerpt in a file of total lines.
+func numberLines(excerpt string, first, total int) string {
+	if excerpt == "" {
+		return fmt.Sprintf("no lines (file has %d lines)\n", total)
+	}
+	lines := strings.Split(strings.TrimSuffix(excerpt, "\n"), "\n")
+	last := first + len(lines) - 1
+	width := len(fmt.Sprint(last))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "lines %d-%d of %d\n", first, last, total)
+	for i, line := range lines {
+		fmt.Fprintf(&sb, "%*d\t%s\n", width, first+i, line)
+	}
+	return sb.String()
+}
+
+// DefaultFileMode is the mode of files written without an explicit one.
+const DefaultFileMode os.FileMode = 0644
+
+// FileWrite writes contents to targetFile with the given permissions (DefaultFileMode if 0).
+func (env *Environment) FileWrite(ctx context.Context, explanation, targetFile, contents string, mode os.FileMode) error {
+	return env.FilesWrite(ctx, explanation, []File{{Path: targetFile, Contents: contents, Mode: mode}})
+}
+
+// File is a file to write with FilesWrite.
+type File struct {
+	Path     string
+	Contents string
+	// Mode is the permissions of the file (DefaultFileMode if 0).
+	Mode os.FileMode
+}
+
+// FilesWrite writes several files at once, so they end up in the environment as a single change.
+// Nothing is written if any of the paths is invalid.
+func (env *Environment) FilesWrite(ctx context.Context, explanation string, files []File) error {
+	container := env.container()
+	for _, file := range files {
+		resolved, err := resolvePath(env.State.Config.Workdir, file.Path)
+		if err != nil {
+			return err
+		}
+		mode := file.Mode
+		if mode == 0 {
+			mode = DefaultFileMode
+		}
+		container = container.WithNewFile(resolved, file.Contents, dagger.ContainerWithNewFileOpts{
+			Permissions: int(mode.Perm()),
+			Owner:       env.State.Config.RunAsUser,
+		})
+	}
+	if err := env.apply(ctx, container); err != nil {
 		return fmt.Errorf("failed applying file write, skipping git propagation: %w", err)
 	}
-	env.Notes.Add("Write %s", targetFile)
+	for _, file := range files {
+		env.Notes.Add("Write %s", file.Path)
+	}
 	return nil
 }
 
 func (env *Environment) FileDelete(ctx context.Context, explanation, targetFile string) error {
-	err := env.apply(ctx, env.container().WithoutFile(targetFile))
+	resolved, err := resolvePath(env.State.Config.Workdir, targetFile)
+	if err != nil {
+		return err
+	}
+	err = env.apply(ctx, env.container().WithoutFile(resolved))
 	if err != nil {
 		return fmt.Errorf("failed applying file delete, skipping git propagation: %w", err)
 	}
@@ -54,8 +196,12 @@ func (env *Environment) FileDelete(ctx context.Context, explanation, targetFile
 	return nil
 }
 
-func (env *Environment) FileList(ctx context.Context, path string) (string, error) {
-	entries, err := env.container().Directory(path).Entries(ctx)
+func (env *Environment) FileList(ctx context.Context, targetDir string) (string, error) {
+	targetDir, err := resolvePath(env.State.Config.Workdir, targetDir)
+	if err != nil {
+		return "", err
+	}
+	entries, err := env.container().Directory(targetDir).Entries(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,82 @@
+package environment
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePath(t *testing.T) {
+	for _, tc := range []struct {
+		target   string
+		expected string
+	}{
+		{"main.go", "/workdir/main.go"},
+		{"./src/main.go", "/workdir/src/main.go"},
+		{"src/../README.md", "/workdir/README.md"},
+		{".", "/workdir"},
+		{"/workdir/main.go", "/workdir/main.go"},
+		// Absolute paths anywhere in the container are allowed
+		{"/etc/hosts", "/etc/hosts"},
+		{"/tmp//out/", "/tmp/out"},
+	} {
+		resolved, err := resolvePath("/workdir", tc.target)
+		require.NoError(t, err, tc.target)
+		assert.Equal(t, tc.expected, resolved, tc.target)
+	}
+
+	for _, target := range []string{
+		"",
+		"../../etc/passwd",
+		"..",
+		"src/../../other/file",
+		"../workdir-other/file",
+		"/workdir/../etc/passwd",
+	} {
+		_, err := resolvePath("/workdir", target)
+		assert.Error(t, err, target)
+	}
+
+	// A workdir at the root allows any relative path that doesn't climb above it
+	resolved, err := resolvePath("/", "etc/hosts")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/hosts", resolved)
+}
+
+func TestNumberLines(t *testing.T) {
+	assert.Equal(t, 3, countLines("a\nb\nc\n"))
+	assert.Equal(t, 3, countLines("a\nb\nc"))
+	assert.Equal(t, 0, countLines(""))
+
+	assert.Equal(t, "lines 1-3 of 3\n1\ta\n2\tb\n3\tc\n", numberLines("a\nb\nc\n", 1, 3))
+	assert.Equal(t, "lines 9-11 of 523\n 9\ti\n10\tj\n11\tk\n", numberLines("i\nj\nk", 9, 523))
+	// Blank lines are numbered too
+	assert.Equal(t, "lines 4-5 of 5\n4\t\n5\te\n", numberLines("\ne", 4, 5))
+	assert.Equal(t, "no lines (file has 0 lines)\n", numberLines("", 1, 0))
+}
+
+func TestIsBinary(t *testing.T) {
+	assert.False(t, isBinary(""))
+	assert.False(t, isBinary("package main\n\nfunc main() {}\n"))
+	assert.True(t, isBinary("\x7fELF\x02\x01\x01\x00\x00"))
+	// Only the beginning of the file is checked
+	assert.False(t, isBinary(strings.Repeat("a", binaryCheckSize)+"\x00"))
+}
+
+func TestTruncateContents(t *testing.T) {
+	contents, truncated := truncateContents("one\ntwo\n", 16)
+	assert.False(t, truncated)
+	assert.Equal(t, "one\ntwo\n", contents)
+
+	// Truncated at the end of the last line that fits
+	contents, truncated = truncateContents("one\ntwo\nthree\n", 10)
+	assert.True(t, truncated)
+	assert.Equal(t, "one\ntwo\n", contents)
+
+	// Cut mid-line if not even a line fits
+	contents, truncated = truncateContents("a very long line\n", 6)
+	assert.True(t, truncated)
+	assert.Equal(t, "a very", contents)
+}
@@ -0,0 +1,208 @@
+package environment
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// idleServices keeps track of the services started by each environment and of the last time a command touched it,
+// so services of environments left idle can be stopped. Environments are loaded again for every operation,
+// hence the tracking is global rather than per Environment.
+var idleServices = &serviceTracker{envs: map[string]*trackedEnvironment{}}
+
+type serviceTracker struct {
+	mu   sync.Mutex
+	envs map[string]*trackedEnvironment
+}
+
+type trackedEnvironment struct {
+	lastActivity time.Time
+	timeout      time.Duration
+	services     []*dagger.Service
+	// endpoints are the endpoints of the ports exposed by the services, by service and port
+	endpoints map[servicePort]*EndpointMapping
+	// configured are the running services declared by the configuration, by name
+	configured map[string]*Service
+}
+
+// touch records activity on the environment and refreshes its idle timeout.
+func (t *serviceTracker) touch(id string, timeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.envs[id]
+	if !ok {
+		return
+	}
+	tracked.lastActivity = time.Now()
+	tracked.timeout = timeout
+}
+
+// track registers a service started by the environment.
+func (t *serviceTracker) track(id string, timeout time.Duration, svc *dagger.Service) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.envs[id]
+	if !ok {
+		tracked = &trackedEnvironment{}
+		t.envs[id] = tracked
+	}
+	tracked.lastActivity = time.Now()
+	tracked.timeout = timeout
+	tracked.services = append(tracked.services, svc)
+}
+
+// servicePort is a port exposed by a service, identified by the host it's reached at within the environment:
+// services may expose the same port.
+type servicePort struct {
+	host string
+	port int
+}
+
+// trackEndpoints records the endpoints of the ports exposed by a service of the environment.
+func (t *serviceTracker) trackEndpoints(id string, endpoints EndpointMappings) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.envs[id]
+	if !ok {
+		return
+	}
+	if tracked.endpoints == nil {
+		tracked.endpoints = map[servicePort]*EndpointMapping{}
+	}
+	for port, endpoint := range endpoints {
+		host, _, _ := net.SplitHostPort(strings.TrimPrefix(endpoint.EnvironmentInternal, "tcp://"))
+		tracked.endpoints[servicePort{host: host, port: port}] = endpoint
+	}
+}
+
+// trackConfigured records a running service declared by the configuration of the environment, registered with track,
+// so environments loaded again reuse it rather than start it again.
+func (t *serviceTracker) trackConfigured(id string, service *Service) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.envs[id]
+	if !ok {
+		return
+	}
+	if tracked.configured == nil {
+		tracked.configured = map[string]*Service{}
+	}
+	tracked.configured[service.Config.Name] = service
+}
+
+// configured returns the running services declared by the configuration of the environment, by name.
+func (t *serviceTracker) configured(id string) map[string]*Service {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.envs[id]
+	if !ok {
+		return nil
+	}
+	return maps.Clone(tracked.configured)
+}
+
+// untrackConfigured forgets a service declared by the configuration of the environment, once it's stopped.
+func (t *serviceTracker) untrackConfigured(id, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tracked, ok := t.envs[id]; ok {
+		delete(tracked.configured, name)
+	}
+}
+
+// endpoints returns the endpoints of port exposed by the running services of the environment, or only by the service
+// reached at host within the environment if host isn't empty, sorted by their endpoint within the environment.
+func (t *serviceTracker) endpoints(id, host string, port int) []*EndpointMapping {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.envs[id]
+	if !ok {
+		return nil
+	}
+	var endpoints []*EndpointMapping
+	for key, endpoint := range tracked.endpoints {
+		if key.port == port && (host == "" || key.host == host) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	slices.SortFunc(endpoints, func(a, b *EndpointMapping) int {
+		return strings.Compare(a.EnvironmentInternal, b.EnvironmentInternal)
+	})
+	return endpoints
+}
+
+// remove removes and returns the services of the environment.
+func (t *serviceTracker) remove(id string) []*dagger.Service {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.envs[id]
+	if !ok {
+		return nil
+	}
+	delete(t.envs, id)
+	return tracked.services
+}
+
+// ids returns the IDs of the environments with running services.
+func (t *serviceTracker) ids() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.Collect(maps.Keys(t.envs))
+}
+
+// idle removes and returns the services of environments that have been idle for longer than their timeout.
+func (t *serviceTracker) idle(now time.Time) map[string][]*dagger.Service {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idle := map[string][]*dagger.Service{}
+	for id, tracked := range t.envs {
+		if tracked.timeout <= 0 || now.Sub(tracked.lastActivity) < tracked.timeout {
+			continue
+		}
+		idle[id] = tracked.services
+		delete(t.envs, id)
+	}
+	return idle
+}
+
+// ReapIdleServices stops the services of environments that haven't run any command for longer than their
+// configured service idle timeout, checking every interval until ctx is done.
+// Stopped services are started again on demand by the next command that needs them.
+func ReapIdleServices(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for id, services := range idleServices.idle(now) {
+				slog.Info("Stopping services of idle environment", "environment.id", id, "services", len(services))
+				for _, svc := range services {
+					if _, err := svc.Stop(ctx); err != nil {
+						slog.Warn("Failed to stop idle service", "environment.id", id, "err", err)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package environment
+
+import (
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceTrackerIdle(t *testing.T) {
+	tracker := &serviceTracker{envs: map[string]*trackedEnvironment{}}
+	svc := &dagger.Service{}
+
+	tracker.track("busy-env", time.Minute, svc)
+	tracker.track("idle-env", time.Minute, svc)
+	tracker.track("no-timeout-env", 0, svc)
+
+	// Nothing is idle yet
+	assert.Empty(t, tracker.idle(time.Now()))
+
+	later := time.Now().Add(2 * time.Minute)
+	tracker.envs["busy-env"].lastActivity = later.Add(-30 * time.Second)
+
+	idle := tracker.idle(later)
+	assert.Len(t, idle, 1)
+	assert.Equal(t, []*dagger.Service{svc}, idle["idle-env"])
+
+	// Idle environments are only reported once, and activity isn't tracked for environments without services
+	assert.Empty(t, tracker.idle(later))
+	tracker.touch("idle-env", time.Minute)
+	assert.NotContains(t, tracker.envs, "idle-env")
+}
+
+func TestEnvironmentConfig_IdleTimeout(t *testing.T) {
+	assert.Equal(t, time.Duration(0), (&EnvironmentConfig{}).IdleTimeout())
+	assert.Equal(t, 30*time.Minute, (&EnvironmentConfig{ServiceIdleTimeout: "30m"}).IdleTimeout())
+	assert.Equal(t, time.Duration(0), (&EnvironmentConfig{ServiceIdleTimeout: "soon"}).IdleTimeout())
+}
+
+func TestServiceTrackerConfigured(t *testing.T) {
+	tracker := &serviceTracker{envs: map[string]*trackedEnvironment{}}
+	web := &Service{Config: &ServiceConfig{Name: "web"}, svc: &dagger.Service{}}
+
+	// Services of environments without tracked services are dropped, as they're stopped
+	tracker.trackConfigured("test-env", web)
+	assert.Empty(t, tracker.configured("test-env"))
+
+	tracker.track("test-env", time.Minute, web.svc)
+	tracker.trackConfigured("test-env", web)
+	assert.Equal(t, map[string]*Service{"web": web}, tracker.configured("test-env"))
+
+	// Removed services are forgotten with their environment
+	assert.Equal(t, []*dagger.Service{web.svc}, tracker.remove("test-env"))
+	assert.Empty(t, tracker.configured("test-env"))
+	assert.Empty(t, tracker.ids())
+	assert.Empty(t, tracker.remove("test-env"))
+
+	// Idle services are forgotten with their environment
+	tracker.track("test-env", time.Minute, web.svc)
+	tracker.trackConfigured("test-env", web)
+	tracker.idle(time.Now().Add(2 * time.Minute))
+	assert.Empty(t, tracker.configured("test-env"))
+}
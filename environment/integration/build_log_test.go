@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBuildLog verifies the setup commands and their output are logged as the environment is built
+func TestBuildLog(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "build_output", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		config := environment.DefaultConfig()
+		config.BaseImage = "alpine:latest"
+		config.SetupCommands = []string{
+			"echo first line; echo second line; echo warning >&2",
+			"echo done",
+		}
+		require.NoError(t, config.Save(user.repoDir))
+		user.GitCommand("add", ".")
+		user.GitCommand("commit", "-m", "Configure setup")
+
+		var chunks []string
+		ctx := environment.WithBuildLog(context.Background(), writerFunc(func(p []byte) (int, error) {
+			chunks = append(chunks, string(p))
+			return len(p), nil
+		}))
+		_, err := repo.Create(ctx, user.dag, "Build Output", "Testing build output", repository.CreateOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"$ echo first line; echo second line; echo warning >&2\n",
+			"first line\nsecond line\n",
+			"warning\n",
+			"$ echo done\n",
+			"done\n",
+		}, chunks)
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,39 @@
+package integration
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCacheDirs verifies cache directories persist from one command to the next, without being committed
+func TestCacheDirs(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "cache_dirs", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		config := environment.DefaultConfig()
+		config.BaseImage = "alpine:latest"
+		config.CacheDirs = []string{".cache", "/root/.cache/build"}
+		require.NoError(t, config.Save(user.repoDir))
+		user.GitCommand("add", ".")
+		user.GitCommand("commit", "-m", "Configure cache directories")
+
+		env := user.CreateEnvironment("Cache Dirs", "Testing cache directories")
+
+		user.RunCommand(env.ID, "mkdir -p .cache && echo cached > .cache/artifact && echo cached > /root/.cache/build/artifact && echo source > main.txt", "Build")
+		assert.Equal(t, "cached\n", user.RunCommand(env.ID, "cat .cache/artifact", "Read the cache in the workdir"))
+		assert.Equal(t, "cached\n", user.RunCommand(env.ID, "cat /root/.cache/build/artifact", "Read the cache outside the workdir"))
+
+		// Only the source is committed
+		assert.Equal(t, "source\n", user.ReadWorktreeFile(env.ID, "main.txt"))
+		assert.NoFileExists(t, filepath.Join(user.WorktreePath(env.ID), ".cache", "artifact"))
+		assert.NotContains(t, user.GitCommand("log", "--name-only", "--format=", "container-use/"+env.ID), ".cache")
+	})
+}
@@ -0,0 +1,87 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCreateFromCheckpoint verifies an environment can be based on the checkpoint of another one,
+// as `container-use config base-image from-checkpoint` does
+func TestCreateFromCheckpoint(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "from_checkpoint", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		config := environment.DefaultConfig()
+		config.BaseImage = "alpine:latest"
+		require.NoError(t, config.Save(user.repoDir))
+		user.GitCommand("add", ".")
+		user.GitCommand("commit", "-m", "Configure environment")
+
+		toolchain := user.CreateEnvironment("Toolchain", "Set up the toolchain")
+		user.RunCommand(toolchain.ID, "echo v1.2.3 > /opt/toolchain-version", "Install the toolchain")
+
+		// An anonymous, short-lived registry
+		destination := fmt.Sprintf("ttl.sh/container-use-test-%d:1h", time.Now().UnixNano())
+		env := user.GetEnvironment(toolchain.ID)
+		checkpoint, err := env.Checkpoint(ctx, destination)
+		require.NoError(t, err)
+		require.NoError(t, repo.Update(ctx, env, "Checkpoint the toolchain"))
+		assert.Contains(t, checkpoint, "@sha256:")
+
+		envInfo, err := repo.Info(ctx, toolchain.ID)
+		require.NoError(t, err)
+		require.Equal(t, checkpoint, envInfo.State.Checkpoint)
+
+		config.BaseImage = envInfo.State.Checkpoint
+		require.NoError(t, config.Save(user.repoDir))
+		user.GitCommand("add", ".")
+		user.GitCommand("commit", "-m", "Base environments on the toolchain")
+
+		derived := user.CreateEnvironment("Derived", "Start from the toolchain")
+		assert.Equal(t, "v1.2.3\n", user.RunCommand(derived.ID, "cat /opt/toolchain-version", "Check the toolchain"))
+	})
+}
+
+// TestCreateFromImage verifies an environment can continue the work of another one from its checkpoint,
+// with the changes made before the checkpoint tracked by the first commit of the new environment
+func TestCreateFromImage(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "from_image", SetupPythonRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+
+		previous := user.CreateEnvironment("Previous", "Start the work")
+		user.FileWrite(previous.ID, "notes.md", "# Work in progress\n", "Take notes")
+		user.RunCommand(previous.ID, "echo v1.2.3 > /opt/toolchain-version", "Install the toolchain")
+
+		destination := fmt.Sprintf("ttl.sh/container-use-test-%d:1h", time.Now().UnixNano())
+		checkpoint, err := user.GetEnvironment(previous.ID).Checkpoint(ctx, destination)
+		require.NoError(t, err)
+
+		_, err = repo.Create(ctx, user.dag, "Continued", "Continue the work", repository.CreateOptions{
+			FromImage:          checkpoint,
+			IncludeUncommitted: true,
+		})
+		require.Error(t, err, "the source of the environment comes from the image")
+
+		continued, err := repo.Create(ctx, user.dag, "Continued", "Continue the work", repository.CreateOptions{FromImage: checkpoint})
+		require.NoError(t, err)
+		assert.Equal(t, checkpoint, continued.State.FromImage)
+		assert.Equal(t, "v1.2.3\n", user.RunCommand(continued.ID, "cat /opt/toolchain-version", "Check the toolchain"))
+		assert.Equal(t, "# Work in progress\n", user.ReadWorktreeFile(continued.ID, "notes.md"))
+	})
+}
@@ -0,0 +1,48 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDebugBuild verifies a failing setup command is reported with the container right before it ran,
+// the one the debug-setup terminal opens in
+func TestDebugBuild(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "debug_build", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Debug Build", "Testing debugging setup commands")
+
+		config := env.State.Config.Copy()
+		config.SetupCommands = []string{
+			"echo ok > /tmp/before",
+			"echo partial > /tmp/failing && exit 3",
+			"echo never > /tmp/after",
+		}
+		failure, err := user.GetEnvironment(env.ID).DebugBuild(ctx, config)
+		require.NoError(t, err)
+		require.NotNil(t, failure)
+		assert.Equal(t, "echo partial > /tmp/failing && exit 3", failure.Command)
+		assert.Equal(t, 3, failure.ExitCode)
+
+		before, err := failure.Container.File("/tmp/before").Contents(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "ok\n", before)
+		// Nothing of the failing command is in the container
+		_, err = failure.Container.File("/tmp/failing").Contents(ctx)
+		assert.Error(t, err)
+
+		config.SetupCommands = []string{"echo ok > /tmp/before"}
+		failure, err = user.GetEnvironment(env.ID).DebugBuild(ctx, config)
+		require.NoError(t, err)
+		assert.Nil(t, failure)
+	})
+}
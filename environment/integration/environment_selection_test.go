@@ -84,7 +84,7 @@ func TestEnvironmentSelection(t *testing.T) {
 			assert.Len(t, descendantEnvs, 0)
 
 			// Verify that the environment still exists but is not a descendant
-			allEnvs, err := repo.List(ctx)
+			allEnvs, err := repo.List(ctx, repository.ListOptions{})
 			require.NoError(t, err)
 			assert.Len(t, allEnvs, 1)
 			assert.Equal(t, env.ID, allEnvs[0].ID)
@@ -0,0 +1,58 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExecAll verifies a command runs in every matching environment, with the result of each
+func TestExecAll(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "exec_all", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		alpine := user.CreateEnvironment("Fix on alpine", "Testing exec-all")
+		config := alpine.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		user.UpdateEnvironment(alpine.ID, "Fix on alpine", "Use Alpine", config)
+		user.FileWrite(alpine.ID, "fixed.txt", "yes", "Fix")
+
+		busybox := user.CreateEnvironment("Fix on busybox", "Testing exec-all")
+		config = busybox.State.Config.Copy()
+		config.BaseImage = "busybox:latest"
+		user.UpdateEnvironment(busybox.ID, "Fix on busybox", "Use BusyBox", config)
+		user.CreateEnvironment("Unrelated work", "Not matching the filter")
+
+		results, err := repo.ExecAll(ctx, user.dag, repository.ListOptions{TitleContains: "fix on"}, "cat /etc/os-release | head -1; cat fixed.txt", "sh")
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+
+		byID := map[string]*repository.ExecResult{}
+		for _, result := range results {
+			assert.Empty(t, result.Error)
+			byID[result.EnvironmentID] = result
+		}
+		require.Contains(t, byID, alpine.ID)
+		require.Contains(t, byID, busybox.ID)
+
+		assert.Equal(t, 0, byID[alpine.ID].ExitCode)
+		assert.Contains(t, byID[alpine.ID].Output, "Alpine")
+		assert.Contains(t, byID[alpine.ID].Output, "yes")
+		assert.False(t, byID[alpine.ID].Failed())
+
+		// cat fails in the environment without the fix
+		assert.NotEqual(t, 0, byID[busybox.ID].ExitCode)
+		assert.True(t, byID[busybox.ID].Failed())
+
+		// The command is part of the history of the environments
+		env := user.GetEnvironment(alpine.ID)
+		assert.Equal(t, "cat /etc/os-release | head -1; cat fixed.txt", env.State.History[len(env.State.History)-1].Command)
+	})
+}
@@ -0,0 +1,159 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIncrementalExport verifies successive updates only touching a few files keep the worktree in sync
+func TestIncrementalExport(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "incremental_export", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		env := user.CreateEnvironment("Incremental Export", "Testing incremental exports")
+
+		user.FileWrite(env.ID, "keep.txt", "unchanged", "Add file to keep")
+		user.FileWrite(env.ID, "dir/modified.txt", "v1", "Add file to modify")
+		user.FileWrite(env.ID, "dir/removed.txt", "gone soon", "Add file to remove")
+
+		user.FileWrite(env.ID, "dir/modified.txt", "v2", "Modify file")
+		user.FileDelete(env.ID, "dir/removed.txt", "Remove file")
+
+		// Removing a file leaves the other files of its directory alone
+		worktreePath := user.WorktreePath(env.ID)
+		assert.NoFileExists(t, filepath.Join(worktreePath, "dir/removed.txt"))
+		assert.Equal(t, "v2", user.ReadWorktreeFile(env.ID, "dir/modified.txt"))
+
+		user.RunCommand(env.ID, "rm -rf dir && mkdir -p dir/nested && echo v3 > dir/nested/file.txt", "Replace directory")
+
+		assert.Equal(t, "unchanged", user.ReadWorktreeFile(env.ID, "keep.txt"))
+		assert.Equal(t, "v3\n", user.ReadWorktreeFile(env.ID, "dir/nested/file.txt"))
+		assert.NoFileExists(t, filepath.Join(worktreePath, "dir/modified.txt"))
+		assert.NoFileExists(t, filepath.Join(worktreePath, "dir/removed.txt"))
+
+		// Everything that was exported got committed
+		status, err := repository.RunGitCommand(context.Background(), worktreePath, "status", "--porcelain")
+		require.NoError(t, err)
+		assert.Empty(t, status)
+	})
+}
+
+// TestExportOutOfDiskSpace verifies running out of disk space while writing the worktree is reported clearly,
+// and leaves the environment usable
+func TestExportOutOfDiskSpace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "export_out_of_disk_space", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+
+		worktrees := filepath.Join(user.configDir, "worktrees")
+		require.NoError(t, os.MkdirAll(worktrees, 0755))
+		if out, err := exec.Command("mount", "-t", "tmpfs", "-o", "size=4m", "tmpfs", worktrees).CombinedOutput(); err != nil {
+			t.Skipf("Unable to mount a tmpfs, which requires root: %v: %s", err, out)
+		}
+		t.Cleanup(func() {
+			exec.Command("umount", worktrees).Run()
+		})
+
+		env := user.CreateEnvironment("Disk Full", "Testing exports running out of disk space")
+		env = user.GetEnvironment(env.ID)
+		_, err := env.Run(ctx, "head -c 8388608 /dev/urandom > big.bin", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+
+		err = repo.Update(ctx, env, "Write a file larger than the disk")
+		require.ErrorIs(t, err, repository.ErrOutOfDiskSpace)
+		assert.ErrorContains(t, err, "out of disk space writing worktree")
+
+		// The partial export was rolled back
+		status, err := repository.RunGitCommand(ctx, user.WorktreePath(env.ID), "status", "--porcelain")
+		require.NoError(t, err)
+		assert.Empty(t, status)
+		assert.NoFileExists(t, filepath.Join(user.WorktreePath(env.ID), "big.bin"))
+
+		// Once the space is freed, the environment takes changes again
+		_, err = env.Run(ctx, "rm big.bin", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		require.NoError(t, repo.Update(ctx, env, "Remove the large file"))
+		user.FileWrite(env.ID, "small.txt", "fits\n", "Write a small file")
+		assert.Equal(t, "fits\n", user.ReadWorktreeFile(env.ID, "small.txt"))
+	})
+}
+
+// BenchmarkFileWrite measures propagating a single file write to the worktree.
+// Only the changed file is exported, so the time per write should barely depend on the repository size.
+func BenchmarkFileWrite(b *testing.B) {
+	if testing.Short() {
+		b.Skip("Skipping integration benchmark")
+	}
+	daggerOnce.Do(func() {
+		testDaggerClient, daggerErr = connectDagger()
+	})
+	if daggerErr != nil {
+		b.Skipf("Skipping benchmark - Dagger not available: %v", daggerErr)
+	}
+
+	for _, files := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("files=%d", files), func(b *testing.B) {
+			ctx := context.Background()
+			repoDir, configDir := b.TempDir(), b.TempDir()
+
+			for i := range files {
+				path := filepath.Join(repoDir, "src", fmt.Sprintf("dir%d", i%50), fmt.Sprintf("file%d.js", i))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					b.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(fmt.Sprintf("// File %d\nconsole.log('test');\n", i)), 0644); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for _, args := range [][]string{
+				{"init"},
+				{"config", "user.email", "test@example.com"},
+				{"config", "user.name", "Test User"},
+				{"config", "commit.gpgsign", "false"},
+				{"add", "."},
+				{"commit", "-m", "Large project"},
+			} {
+				if _, err := repository.RunGitCommand(ctx, repoDir, args...); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			repo, err := repository.OpenWithBasePath(ctx, repoDir, configDir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			env, err := repo.Create(ctx, testDaggerClient, "Benchmark", "Benchmark file writes", repository.CreateOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() {
+				repo.Delete(context.Background(), env.ID)
+			})
+
+			b.ResetTimer()
+			for i := range b.N {
+				if err := env.FileWrite(ctx, "Write file", "bench.txt", fmt.Sprintf("iteration %d\n", i), 0); err != nil {
+					b.Fatal(err)
+				}
+				if err := repo.Update(ctx, env, "Write file"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
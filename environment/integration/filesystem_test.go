@@ -0,0 +1,91 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileWriteMode verifies files can be written with explicit permissions that survive the worktree round-trip
+func TestFileWriteMode(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "file_write_mode", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("File Mode", "Testing file modes")
+
+		env = user.GetEnvironment(env.ID)
+		require.NoError(t, env.FileWrite(ctx, "Add script", "run.sh", "#!/bin/sh\necho script-ran\n", 0755))
+		require.NoError(t, repo.Update(ctx, env, "Add script"))
+		user.FileWrite(env.ID, "notes.txt", "not executable", "Add notes")
+
+		// The script is executable in the container
+		output := user.RunCommand(env.ID, "./run.sh && stat -c %a run.sh notes.txt", "Run script")
+		assert.Contains(t, output, "script-ran")
+		assert.Contains(t, output, "755\n644")
+
+		// And the mode is preserved in the worktree and its history
+		info, err := os.Stat(filepath.Join(user.WorktreePath(env.ID), "run.sh"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+		files, err := repository.RunGitCommand(ctx, user.WorktreePath(env.ID), "ls-files", "-s", "run.sh")
+		require.NoError(t, err)
+		assert.Contains(t, files, "100755")
+	})
+}
+
+// TestFilesWriteSingleCommit verifies writing several files at once produces a single commit
+func TestFilesWriteSingleCommit(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "files_write_single_commit", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Batch Write", "Testing batch writes")
+		worktreePath := user.WorktreePath(env.ID)
+		commitCount := func() int {
+			out, err := repository.RunGitCommand(ctx, worktreePath, "rev-list", "--count", "HEAD")
+			require.NoError(t, err)
+			count, err := strconv.Atoi(strings.TrimSpace(out))
+			require.NoError(t, err)
+			return count
+		}
+		before := commitCount()
+
+		env = user.GetEnvironment(env.ID)
+		var files []environment.File
+		for i := range 5 {
+			files = append(files, environment.File{
+				Path:     fmt.Sprintf("src/file%d.txt", i),
+				Contents: fmt.Sprintf("file %d\n", i),
+			})
+		}
+		files[4].Mode = 0755
+		require.NoError(t, env.FilesWrite(ctx, "Scaffold project", files))
+		require.NoError(t, repo.Update(ctx, env, "Scaffold project"))
+
+		assert.Equal(t, before+1, commitCount())
+
+		for i := range 5 {
+			assert.Equal(t, fmt.Sprintf("file %d\n", i), user.ReadWorktreeFile(env.ID, fmt.Sprintf("src/file%d.txt", i)))
+		}
+		info, err := os.Stat(filepath.Join(worktreePath, "src/file4.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	})
+}
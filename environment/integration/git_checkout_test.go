@@ -0,0 +1,48 @@
+package integration
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGitCheckout verifies commits made inside an environment configured as a git checkout are kept
+func TestGitCheckout(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "git_checkout", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		config := environment.DefaultConfig()
+		config.BaseImage = "alpine:latest"
+		config.SetupCommands = []string{"apk add --no-cache git"}
+		config.GitCheckout = true
+		require.NoError(t, config.Save(user.repoDir))
+		user.GitCommand("add", ".")
+		user.GitCommand("commit", "-m", "Configure git checkout")
+
+		env := user.CreateEnvironment("Git Checkout", "Testing agent commits")
+
+		gitCommit := `git -c user.name=Agent -c user.email=agent@example.com commit -q -m`
+		user.RunCommand(env.ID, `echo one > one.txt && git add one.txt && `+gitCommit+` "Add one"`, "Commit one")
+		user.RunCommand(env.ID, `echo two > two.txt && git add two.txt && `+gitCommit+` "Add two"`, "Commit two")
+
+		log := user.GitCommand("log", "--format=%an %s", "container-use/"+env.ID)
+		assert.True(t, strings.HasPrefix(log, "Agent Add two\nAgent Add one\n"), "agent commits should be kept as-is:\n%s", log)
+
+		// Uncommitted changes are committed on top, and the next agent commit builds on them
+		user.FileWrite(env.ID, "three.txt", "three\n", "Write three")
+		user.RunCommand(env.ID, `echo four > four.txt && git add four.txt && `+gitCommit+` "Add four"`, "Commit four")
+
+		log = user.GitCommand("log", "--format=%s", "container-use/"+env.ID)
+		assert.True(t, strings.HasPrefix(log, "Add four\nWrite three\nAdd two\n"), "unexpected history:\n%s", log)
+		files := user.GitCommand("ls-tree", "--name-only", "container-use/"+env.ID)
+		assert.Contains(t, files, "three.txt")
+		assert.NotContains(t, files, ".git\n")
+	})
+}
@@ -76,7 +76,7 @@ func WithRepository(t *testing.T, name string, setup RepositorySetup, fn func(t
 	// Cleanup
 	t.Cleanup(func() {
 		// Clean up any environments created during the test
-		envs, _ := repo.List(context.Background())
+		envs, _ := repo.List(context.Background(), repository.ListOptions{})
 		for _, env := range envs {
 			repo.Delete(context.Background(), env.ID)
 		}
@@ -158,14 +158,7 @@ func initializeDaggerOnce(t *testing.T) {
 			return
 		}
 
-		ctx := context.Background()
-		client, err := dagger.Connect(ctx)
-		if err != nil {
-			daggerErr = err
-			return
-		}
-
-		testDaggerClient = client
+		testDaggerClient, daggerErr = connectDagger()
 	})
 
 	if daggerErr != nil {
@@ -173,6 +166,10 @@ func initializeDaggerOnce(t *testing.T) {
 	}
 }
 
+func connectDagger() (*dagger.Client, error) {
+	return dagger.Connect(context.Background())
+}
+
 // UserActions provides test helpers that mirror MCP tool behavior exactly
 // These represent what a user would experience when using the MCP tools
 type UserActions struct {
@@ -205,7 +202,7 @@ func (u *UserActions) FileWrite(envID, targetFile, contents, explanation string)
 	env, err := u.repo.Get(u.ctx, u.dag, envID)
 	require.NoError(u.t, err, "Failed to get environment %s", envID)
 
-	err = env.FileWrite(u.ctx, explanation, targetFile, contents)
+	err = env.FileWrite(u.ctx, explanation, targetFile, contents, 0)
 	require.NoError(u.t, err, "FileWrite should succeed")
 
 	err = u.repo.Update(u.ctx, env, explanation)
@@ -217,7 +214,7 @@ func (u *UserActions) RunCommand(envID, command, explanation string) string {
 	env, err := u.repo.Get(u.ctx, u.dag, envID)
 	require.NoError(u.t, err, "Failed to get environment %s", envID)
 
-	output, err := env.Run(u.ctx, command, "/bin/sh", false)
+	output, err := env.Run(u.ctx, command, "/bin/sh", environment.RunOpts{})
 	require.NoError(u.t, err, "Run command should succeed")
 
 	err = u.repo.Update(u.ctx, env, explanation)
@@ -228,7 +225,7 @@ func (u *UserActions) RunCommand(envID, command, explanation string) string {
 
 // CreateEnvironment mirrors environment_create MCP tool behavior
 func (u *UserActions) CreateEnvironment(title, explanation string) *environment.Environment {
-	env, err := u.repo.Create(u.ctx, u.dag, title, explanation)
+	env, err := u.repo.Create(u.ctx, u.dag, title, explanation, repository.CreateOptions{})
 	require.NoError(u.t, err, "Create environment should succeed")
 	return env
 }
@@ -266,7 +263,7 @@ func (u *UserActions) FileRead(envID, targetFile string) string {
 	env, err := u.repo.Get(u.ctx, u.dag, envID)
 	require.NoError(u.t, err, "Failed to get environment %s", envID)
 
-	content, err := env.FileRead(u.ctx, targetFile, true, 0, 0)
+	content, err := env.FileRead(u.ctx, targetFile, true, 0, 0, false)
 	require.NoError(u.t, err, "FileRead should succeed")
 	return content
 }
@@ -276,7 +273,7 @@ func (u *UserActions) FileReadExpectError(envID, targetFile string) {
 	env, err := u.repo.Get(u.ctx, u.dag, envID)
 	require.NoError(u.t, err, "Failed to get environment %s", envID)
 
-	_, err = env.FileRead(u.ctx, targetFile, true, 0, 0)
+	_, err = env.FileRead(u.ctx, targetFile, true, 0, 0, false)
 	assert.Error(u.t, err, "FileRead should fail for %s", targetFile)
 }
 
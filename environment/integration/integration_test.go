@@ -254,6 +254,32 @@ func TestWorktreeUpdatesAreVisibleAfterRebuild(t *testing.T) {
 	})
 }
 
+// TestAdHocInstallsAreLostByRebuild verifies packages installed by commands rather than setup commands are reported
+// as lost when the configuration changes
+func TestAdHocInstallsAreLostByRebuild(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "ad_hoc_installs", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		env := user.CreateEnvironment("Ad-hoc Installs", "Testing ad-hoc installs")
+		user.RunCommand(env.ID, "apk add --no-cache jq", "Install jq")
+
+		env = user.GetEnvironment(env.ID)
+		config := env.State.Config.Copy()
+		config.Env = append(config.Env, "FOO=bar")
+		assert.Equal(t, []string{"apk add --no-cache jq"}, env.UnpersistedInstalls(config))
+		user.UpdateEnvironment(env.ID, env.State.Title, "Add an environment variable", config)
+
+		output := user.RunCommand(env.ID, "which jq || echo missing", "Check jq after rebuild")
+		assert.Contains(t, output, "missing")
+		// Once lost, the install isn't reported again
+		env = user.GetEnvironment(env.ID)
+		assert.Empty(t, env.UnpersistedInstalls(env.State.Config))
+	})
+}
+
 // TestWeirdUserScenarios verifies edge case handling
 func TestWeirdUserScenarios(t *testing.T) {
 	t.Parallel()
@@ -379,20 +405,20 @@ func TestWeirdUserScenarios(t *testing.T) {
 		repo1, err := repository.OpenWithBasePath(ctx, repoDir1, configDir1)
 		require.NoError(t, err)
 
-		env1, err := repo1.Create(ctx, testDaggerClient, "App", "Creating app in repo1")
+		env1, err := repo1.Create(ctx, testDaggerClient, "App", "Creating app in repo1", repository.CreateOptions{})
 		require.NoError(t, err)
 		defer repo1.Delete(ctx, env1.ID)
 
 		// Write file in env1
-		err = env1.FileWrite(ctx, "Add file", "app.js", "console.log('repo1');")
+		err = env1.FileWrite(ctx, "Add file", "app.js", "console.log('repo1');", 0)
 		require.NoError(t, err)
 
 		// Try to use env1 while in repo2 (should fail)
-		_, err = env1.FileRead(ctx, "main.py", true, 0, 0)
+		_, err = env1.FileRead(ctx, "main.py", true, 0, 0, false)
 		assert.Error(t, err, "Should fail to read repo2 files from repo1 environment")
 
 		// The environment is still tied to repo1
-		jsContent, err := env1.FileRead(ctx, "app.js", true, 0, 0)
+		jsContent, err := env1.FileRead(ctx, "app.js", true, 0, 0, false)
 		require.NoError(t, err)
 		assert.Contains(t, jsContent, "repo1", "Environment should still access its original repo")
 	})
@@ -467,6 +493,25 @@ func TestEnvironmentConfigurationPersists(t *testing.T) {
 		})
 	})
 
+	t.Run("BuildArgsExpandInSetupCommands", func(t *testing.T) {
+		WithRepository(t, "build_args", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+			newEnv := user.CreateEnvironment("Test with build args", "Creating environment with build args")
+
+			updatedConfig := newEnv.State.Config.Copy()
+			updatedConfig.BuildArgs = map[string]string{"GREETING": "hello-from-build-arg"}
+			updatedConfig.SetupCommands = []string{"echo ${GREETING} > /build-arg.txt"}
+
+			user.UpdateEnvironment(newEnv.ID, "Test with build args", "Use a build arg", updatedConfig)
+
+			output := user.RunCommand(newEnv.ID, "cat /build-arg.txt", "Check build arg was expanded")
+			assert.Contains(t, output, "hello-from-build-arg")
+
+			// Build args are not runtime environment variables
+			output = user.RunCommand(newEnv.ID, `echo "runtime=${GREETING:-unset}"`, "Check build arg isn't set at runtime")
+			assert.Contains(t, output, "runtime=unset")
+		})
+	})
+
 	t.Run("EnvironmentVariable", func(t *testing.T) {
 		t.Run("Persistence", func(t *testing.T) {
 			WithRepository(t, "envvar_persistence", SetupNodeRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
@@ -31,7 +31,7 @@ func TestRepositoryMerge(t *testing.T) {
 
 		// Merge the environment (without squash)
 		var mergeOutput bytes.Buffer
-		err = repo.Merge(ctx, env.ID, &mergeOutput)
+		err = repo.Merge(ctx, env.ID, &mergeOutput, repository.MergeOptions{})
 		require.NoError(t, err, "Merge should succeed: %s", mergeOutput.String())
 
 		// Verify we're still on the initial branch
@@ -79,7 +79,7 @@ func TestRepositoryApply(t *testing.T) {
 
 		// Apply the environment (squash merge)
 		var applyOutput bytes.Buffer
-		err = repo.Apply(ctx, env.ID, &applyOutput)
+		err = repo.Apply(ctx, env.ID, &applyOutput, repository.MergeOptions{})
 		require.NoError(t, err, "Apply should succeed: %s", applyOutput.String())
 
 		// Verify we're still on the initial branch
@@ -132,9 +132,8 @@ func TestRepositoryMergeNonExistent(t *testing.T) {
 
 		// Try to merge non-existent environment
 		var mergeOutput bytes.Buffer
-		err := repo.Merge(ctx, "non-existent-env", &mergeOutput)
-		assert.Error(t, err, "Merging non-existent environment should fail")
-		assert.Contains(t, err.Error(), "not found")
+		err := repo.Merge(ctx, "non-existent-env", &mergeOutput, repository.MergeOptions{})
+		assert.ErrorIs(t, err, repository.ErrEnvironmentNotFound, "Merging non-existent environment should fail")
 	})
 }
 
@@ -146,9 +145,8 @@ func TestRepositoryApplyNonExistent(t *testing.T) {
 
 		// Try to apply non-existent environment
 		var applyOutput bytes.Buffer
-		err := repo.Apply(ctx, "non-existent-env", &applyOutput)
-		assert.Error(t, err, "Applying non-existent environment should fail")
-		assert.Contains(t, err.Error(), "not found")
+		err := repo.Apply(ctx, "non-existent-env", &applyOutput, repository.MergeOptions{})
+		assert.ErrorIs(t, err, repository.ErrEnvironmentNotFound, "Applying non-existent environment should fail")
 	})
 }
 
@@ -173,7 +171,7 @@ func TestRepositoryMergeWithConflicts(t *testing.T) {
 
 		// Try to merge - this should either succeed with conflict resolution or fail gracefully
 		var mergeOutput bytes.Buffer
-		err = repo.Merge(ctx, env.ID, &mergeOutput)
+		err = repo.Merge(ctx, env.ID, &mergeOutput, repository.MergeOptions{})
 
 		// The merge should fail due to conflict
 		assert.Error(t, err, "Merge should fail due to conflict")
@@ -203,7 +201,7 @@ func TestRepositoryApplyWithConflicts(t *testing.T) {
 
 		// Try to apply - this should fail due to conflict
 		var applyOutput bytes.Buffer
-		err = repo.Apply(ctx, env.ID, &applyOutput)
+		err = repo.Apply(ctx, env.ID, &applyOutput, repository.MergeOptions{})
 
 		// The apply should fail due to conflict
 		assert.Error(t, err, "Apply should fail due to conflict")
@@ -225,7 +223,7 @@ func TestRepositoryMergeCompleted(t *testing.T) {
 
 		// First merge
 		var mergeOutput1 bytes.Buffer
-		err := repo.Merge(ctx, env.ID, &mergeOutput1)
+		err := repo.Merge(ctx, env.ID, &mergeOutput1, repository.MergeOptions{})
 		require.NoError(t, err, "First merge should succeed: %s", mergeOutput1.String())
 
 		// Verify first merge content
@@ -239,7 +237,7 @@ func TestRepositoryMergeCompleted(t *testing.T) {
 
 		// Second merge
 		var mergeOutput2 bytes.Buffer
-		err = repo.Merge(ctx, env.ID, &mergeOutput2)
+		err = repo.Merge(ctx, env.ID, &mergeOutput2, repository.MergeOptions{})
 		require.NoError(t, err, "Second merge should succeed: %s", mergeOutput2.String())
 
 		// Verify second merge content
@@ -0,0 +1,108 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPauseResume verifies pausing an environment from another process stops the services of the process running
+// them, and resuming it brings them back
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "pause_resume", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Pause Resume", "Testing pause and resume")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		user.UpdateEnvironment(env.ID, "Pause Resume", "Use Alpine", config)
+
+		env = user.GetEnvironment(env.ID)
+		svc, err := env.AddService(ctx, "Add web server", &environment.ServiceConfig{
+			Name:         "web",
+			Image:        "busybox:latest",
+			Command:      "mkdir -p /www && echo hello-from-web > /www/index.html && httpd -f -p 8080 -h /www",
+			ExposedPorts: []int{8080},
+		}, environment.AddServiceOpts{})
+		require.NoError(t, err)
+		require.NoError(t, repo.Update(ctx, env, "Add web server"))
+		endpoint := strings.TrimPrefix(svc.Endpoints[8080].HostExternal, "tcp://")
+		require.NoError(t, env.WaitForPort(ctx, "", 8080, 30*time.Second))
+
+		// Pause like the command line does, with a repository and no Dagger client of its own
+		other, err := repository.OpenWithBasePath(ctx, repo.SourcePath(), user.configDir)
+		require.NoError(t, err)
+		require.NoError(t, other.Pause(ctx, env.ID))
+		assert.True(t, serving(endpoint), "pausing only records it, the process running the services stops them")
+
+		// The process running the services, e.g. the MCP server, stops them once it notices
+		require.NoError(t, repo.StopPausedServices(ctx))
+		assert.Eventually(t, func() bool { return !serving(endpoint) }, 30*time.Second, time.Second)
+		assert.NotContains(t, environment.EnvironmentsWithServices(), env.ID)
+
+		// Paused environments refuse commands, and the paused state survives reloading
+		env = user.GetEnvironment(env.ID)
+		assert.True(t, env.State.Paused)
+		_, err = env.Run(ctx, "true", "sh", environment.RunOpts{})
+		assert.ErrorContains(t, err, "paused")
+
+		// Services are started again by the next command once resumed
+		require.NoError(t, other.Resume(ctx, env.ID))
+		env = user.GetEnvironment(env.ID)
+		output, err := env.Run(ctx, "wget -qO- http://web:8080", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "hello-from-web")
+	})
+}
+
+// serving returns whether a service accepts connections on address, through its tunnel: tunnels accept connections
+// whether the service listens or not, and close them right away if it doesn't.
+func serving(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	return n > 0 || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// TestPauseKeepsContainerState verifies a paused environment keeps its container state and resumes where it was
+func TestPauseKeepsContainerState(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "pause_container_state", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Pause Container State", "Testing pause keeps the container state")
+		user.RunCommand(env.ID, "echo in-progress > /tmp/outside-workdir", "Leave state outside the workdir")
+
+		require.NoError(t, repo.Pause(ctx, env.ID))
+		assert.True(t, user.GetEnvironment(env.ID).State.Paused)
+
+		require.NoError(t, repo.Resume(ctx, env.ID))
+		env = user.GetEnvironment(env.ID)
+		assert.False(t, env.State.Paused)
+
+		output, err := env.Run(ctx, "cat /tmp/outside-workdir", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Equal(t, "in-progress\n", output)
+	})
+}
@@ -0,0 +1,37 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPreSourceFiles verifies pre-source files are available to setup commands, which run before the source is mounted
+func TestPreSourceFiles(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "pre_source_files", SetupNodeRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		writeFile(t, user.repoDir, ".npmrc", "registry=https://registry.example.com/\n")
+		config := environment.DefaultConfig()
+		config.BaseImage = "alpine:latest"
+		config.PreSourceFiles = []string{".npmrc"}
+		// Fails unless the .npmrc is there, as the setup of a private registry would
+		config.SetupCommands = []string{"grep -q registry.example.com .npmrc && cp .npmrc /tmp/npmrc-at-setup"}
+		require.NoError(t, config.Save(user.repoDir))
+		user.GitCommand("add", ".")
+		user.GitCommand("commit", "-m", "Configure registry")
+
+		env := user.CreateEnvironment("Pre Source Files", "Testing pre-source files")
+
+		output := user.RunCommand(env.ID, "cat /tmp/npmrc-at-setup", "Check the .npmrc setup saw")
+		assert.Equal(t, "registry=https://registry.example.com/\n", output)
+		// The rest of the source is still mounted after setup
+		assert.Contains(t, user.RunCommand(env.ID, "ls", "List the source"), "package.json")
+	})
+}
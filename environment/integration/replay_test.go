@@ -0,0 +1,39 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReplay verifies an environment's commands can be replayed and divergences are reported
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "replay", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Replay", "Testing replay")
+
+		user.FileWrite(env.ID, "greeting.txt", "hello", "Write greeting")
+		user.RunCommand(env.ID, "cat greeting.txt", "Read greeting")
+		user.RunCommand(env.ID, "echo deterministic > out.txt && cat out.txt", "Write output")
+
+		var out bytes.Buffer
+		require.NoError(t, repo.Replay(ctx, user.dag, env.ID, &out))
+		assert.Contains(t, out.String(), "All 2 commands reproduced")
+
+		// Non-deterministic commands are reported
+		user.RunCommand(env.ID, "cat /proc/sys/kernel/random/uuid", "Random output")
+		out.Reset()
+		err := repo.Replay(ctx, user.dag, env.ID, &out)
+		assert.ErrorContains(t, err, "1 of 3 commands diverged")
+		assert.Contains(t, out.String(), "output differs")
+	})
+}
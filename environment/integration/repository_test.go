@@ -3,10 +3,13 @@ package integration
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/dagger/container-use/environment"
 	"github.com/dagger/container-use/repository"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -65,7 +68,7 @@ func TestRepositoryList(t *testing.T) {
 		env2 := user.CreateEnvironment("Environment 2", "Second test environment")
 
 		// List should return at least 2
-		envs, err := repo.List(ctx)
+		envs, err := repo.List(ctx, repository.ListOptions{})
 		require.NoError(t, err)
 		assert.GreaterOrEqual(t, len(envs), 2)
 
@@ -168,6 +171,44 @@ func TestRepositoryLog(t *testing.T) {
 	})
 }
 
+// TestRepositoryHistory tests retrieving the commit history of an environment as structured data
+func TestRepositoryHistory(t *testing.T) {
+	t.Parallel()
+	WithRepository(t, "repository-history", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+
+		env := user.CreateEnvironment("Test History", "Testing repository history")
+		user.FileWrite(env.ID, "file1.txt", "initial content", "Initial commit")
+		user.FileWrite(env.ID, "file1.txt", "updated content", "Update file")
+		user.FileWrite(env.ID, "file2.txt", "new file", "Add second file")
+
+		history, err := repo.History(ctx, env.ID)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, len(history), 3)
+
+		// Most recent first, matching the commits of the environment branch
+		for i, expected := range []struct{ subject, notes string }{
+			{"Add second file", "Write file2.txt"},
+			{"Update file", "Write file1.txt"},
+			{"Initial commit", "Write file1.txt"},
+		} {
+			commit := history[i]
+			assert.Equal(t, expected.subject, commit.Subject)
+			assert.Contains(t, commit.Notes, expected.notes)
+			assert.NotEmpty(t, commit.Author)
+			assert.False(t, commit.Timestamp.IsZero())
+
+			hash, err := repository.RunGitCommand(ctx, repo.SourcePath(), "rev-parse", fmt.Sprintf("container-use/%s~%d", env.ID, i))
+			require.NoError(t, err)
+			assert.Equal(t, strings.TrimSpace(hash), commit.Hash)
+		}
+		assert.False(t, history[0].Timestamp.Before(history[2].Timestamp))
+
+		_, err = repo.History(ctx, "non-existent-env")
+		assert.Error(t, err)
+	})
+}
+
 // TestRepositoryDiff tests retrieving changes between commits
 func TestRepositoryDiff(t *testing.T) {
 	t.Parallel()
@@ -197,3 +238,56 @@ func TestRepositoryDiff(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+// TestRepositoryCreateWithoutCommits tests creating an environment in a repository that has no commits yet
+func TestRepositoryCreateWithoutCommits(t *testing.T) {
+	t.Parallel()
+	WithRepository(t, "repository-create-without-commits", nil, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		env := user.CreateEnvironment("Test Create Without Commits", "Testing repository create without commits")
+		assert.NotEmpty(t, env.ID)
+
+		user.FileWrite(env.ID, "main.go", "package main\n", "Write the first file")
+		assert.Equal(t, "package main\n", user.ReadWorktreeFile(env.ID, "main.go"))
+
+		// The source repository still has no commits
+		empty, err := repo.IsEmpty(context.Background())
+		require.NoError(t, err)
+		assert.True(t, empty)
+	})
+}
+
+// TestRepositoryWithTransaction verifies the updates made within a transaction are saved as a single commit
+func TestRepositoryWithTransaction(t *testing.T) {
+	t.Parallel()
+	WithRepository(t, "repository-with-transaction", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		created := user.CreateEnvironment("Test Transaction", "Testing repository transactions")
+		env := user.GetEnvironment(created.ID)
+		commits := func() int {
+			user.GitCommand("fetch", "container-use", env.ID)
+			count, err := strconv.Atoi(strings.TrimSpace(user.GitCommand("rev-list", "--count", "container-use/"+env.ID)))
+			require.NoError(t, err)
+			return count
+		}
+		before := commits()
+
+		err := repo.WithTransaction(ctx, func() error {
+			if err := env.FileWrite(ctx, "Write a", "a.txt", "a\n", 0); err != nil {
+				return err
+			}
+			if err := repo.Update(ctx, env, "Write a"); err != nil {
+				return err
+			}
+			if _, err := env.Run(ctx, "echo b > b.txt", "sh", environment.RunOpts{}); err != nil {
+				return err
+			}
+			return repo.Update(ctx, env, "Write b")
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, "a\n", user.ReadWorktreeFile(env.ID, "a.txt"))
+		assert.Equal(t, "b\n", user.ReadWorktreeFile(env.ID, "b.txt"))
+		assert.Equal(t, before+1, commits())
+		assert.Contains(t, user.GitCommand("log", "-1", "--format=%B", "container-use/"+env.ID), "- Write a\n- Write b")
+	})
+}
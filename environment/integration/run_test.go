@@ -0,0 +1,332 @@
+package integration
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRunInheritsHostEnv verifies host environment variables are visible to a single command
+// without being persisted in the environment
+func TestRunInheritsHostEnv(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	const token = "rotating-token-1234"
+	t.Setenv("CU_TEST_HOST_TOKEN", token)
+
+	WithRepository(t, "inherit_host_env", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Host Env", "Testing host env inheritance")
+
+		env = user.GetEnvironment(env.ID)
+		output, err := env.Run(ctx, `[ "$CU_TEST_HOST_TOKEN" = "`+token+`" ] && echo visible`, "sh", environment.RunOpts{InheritHostEnv: []string{"CU_TEST_HOST_TOKEN"}})
+		require.NoError(t, err)
+		assert.Contains(t, output, "visible", "host env var should be visible to the command")
+		require.NoError(t, repo.Update(ctx, env, "Use host token"))
+
+		// The variable doesn't leak into subsequent commands
+		output = user.RunCommand(env.ID, `echo "token=${CU_TEST_HOST_TOKEN:-unset}"`, "Check token is gone")
+		assert.Contains(t, output, "token=unset")
+
+		// Nor is its value stored in the environment state
+		state, err := repository.RunGitCommand(ctx, user.WorktreePath(env.ID), "notes", "--ref", "cu/state", "show")
+		require.NoError(t, err)
+		assert.NotContains(t, state, token)
+
+		// Unset host variables are rejected
+		_, err = env.Run(ctx, "true", "sh", environment.RunOpts{InheritHostEnv: []string{"CU_TEST_UNSET_HOST_VAR"}})
+		assert.Error(t, err)
+	})
+}
+
+// TestRunAsUser verifies a command can run as another user without changing the environment's default user
+func TestRunAsUser(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "run_as_user", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Run As User", "Testing per-command user")
+
+		output, err := env.Run(ctx, "id -un", "sh", environment.RunOpts{User: "nobody"})
+		require.NoError(t, err)
+		assert.Contains(t, output, "nobody")
+		require.NoError(t, repo.Update(ctx, env, "Run as nobody"))
+
+		// Subsequent commands run as the default user again
+		output = user.RunCommand(env.ID, "id -un", "Check default user")
+		assert.Contains(t, output, "root")
+
+		_, err = env.Run(ctx, "true", "sh", environment.RunOpts{User: "no-such-user"})
+		assert.ErrorContains(t, err, "does not exist")
+	})
+}
+
+// TestVerifyCommand verifies the configured verify command reports changes that break it
+func TestVerifyCommand(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "verify_command", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Verify", "Testing verify command")
+
+		result, err := env.Verify(ctx)
+		require.NoError(t, err)
+		assert.Nil(t, result, "verify command is opt-in")
+
+		config := env.State.Config.Copy()
+		config.VerifyCommand = `grep -q '^valid$' status.txt`
+		user.UpdateEnvironment(env.ID, "Verify", "Add verify command", config)
+		user.FileWrite(env.ID, "status.txt", "valid\n", "Write valid status")
+
+		env = user.GetEnvironment(env.ID)
+		result, err = env.Verify(ctx)
+		require.NoError(t, err)
+		assert.True(t, result.Passed())
+
+		// A write that breaks the verify command is reported
+		user.FileWrite(env.ID, "status.txt", "broken\n", "Break status")
+		env = user.GetEnvironment(env.ID)
+		result, err = env.Verify(ctx)
+		require.NoError(t, err)
+		assert.False(t, result.Passed())
+		assert.Equal(t, 1, result.ExitCode)
+	})
+}
+
+// TestRunAsConfiguredUser verifies commands run as the configured user and the files it gets are owned by it
+func TestRunAsConfiguredUser(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "run_as_configured_user", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Run As Configured User", "Testing run_as_user")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		config.RunAsUser = "guest"
+		config.SetupCommands = []string{"whoami > /tmp/setup-user"}
+		user.UpdateEnvironment(env.ID, "Run As Configured User", "Run as guest", config)
+
+		output := user.RunCommand(env.ID, "whoami", "Check user")
+		assert.Equal(t, "guest", strings.TrimSpace(output))
+		output = user.RunCommand(env.ID, "cat /tmp/setup-user", "Check setup user")
+		assert.Equal(t, "guest", strings.TrimSpace(output))
+
+		// Source files, written files and files created by commands are owned by the user
+		user.FileWrite(env.ID, "written.txt", "hello\n", "Write file")
+		output = user.RunCommand(env.ID, "touch created.txt && stat -c %U README.md written.txt created.txt", "Check owners")
+		assert.Equal(t, "guest\nguest\nguest", strings.TrimSpace(output))
+
+		// The per-command user still takes precedence
+		env = user.GetEnvironment(env.ID)
+		output, err := env.Run(ctx, "whoami", "sh", environment.RunOpts{User: "root"})
+		require.NoError(t, err)
+		assert.Equal(t, "root", strings.TrimSpace(output))
+
+		// Users missing from the base image are reported
+		config = config.Copy()
+		config.RunAsUser = "no-such-user"
+		err = env.UpdateConfig(ctx, config)
+		assert.ErrorContains(t, err, "user no-such-user does not exist")
+	})
+}
+
+// TestConfiguredEntrypoint verifies commands run with use_entrypoint go through the configured entrypoint
+func TestConfiguredEntrypoint(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "configured_entrypoint", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Configured Entrypoint", "Testing entrypoint")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		config.Entrypoint = []string{"env", "ENTRYPOINT_RAN=yes"}
+		user.UpdateEnvironment(env.ID, "Configured Entrypoint", "Set entrypoint", config)
+
+		env = user.GetEnvironment(env.ID)
+		output, err := env.Run(ctx, "echo ran:$ENTRYPOINT_RAN", "sh", environment.RunOpts{UseEntrypoint: true})
+		require.NoError(t, err)
+		assert.Equal(t, "ran:yes", strings.TrimSpace(output))
+
+		// Commands don't go through the entrypoint unless asked to
+		output, err = env.Run(ctx, "echo ran:$ENTRYPOINT_RAN", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Equal(t, "ran:", strings.TrimSpace(output))
+	})
+}
+
+// TestRunCached verifies a cached read-only command isn't run again, nor creates a new revision,
+// until the environment changes
+func TestRunCached(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "run_cached", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Run Cached", "Testing cached commands")
+		// The output differs on every actual run
+		const command = "cat README.md && cat /proc/sys/kernel/random/uuid"
+		opts := environment.RunOpts{Cache: true}
+
+		first, err := env.Run(ctx, command, "sh", opts)
+		require.NoError(t, err)
+		require.NoError(t, repo.Update(ctx, env, "Read README"))
+		container := env.State.Container
+		history := len(env.State.History)
+		state, err := repository.RunGitCommand(ctx, user.WorktreePath(env.ID), "notes", "--ref", "cu/state", "show")
+		require.NoError(t, err)
+
+		env = user.GetEnvironment(env.ID)
+		cached, ok := env.CachedOutput(command, "sh", opts)
+		require.True(t, ok)
+		assert.Equal(t, first, cached)
+		second, err := env.Run(ctx, command, "sh", opts)
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+		assert.Equal(t, container, env.State.Container)
+		assert.Len(t, env.State.History, history)
+		newState, err := repository.RunGitCommand(ctx, user.WorktreePath(env.ID), "notes", "--ref", "cu/state", "show")
+		require.NoError(t, err)
+		assert.Equal(t, state, newState)
+
+		// Changing the environment invalidates the cached output
+		user.FileWrite(env.ID, "README.md", "# Changed\n", "Change README")
+		env = user.GetEnvironment(env.ID)
+		_, ok = env.CachedOutput(command, "sh", opts)
+		assert.False(t, ok)
+		third, err := env.Run(ctx, command, "sh", opts)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(third, "# Changed\n"))
+	})
+}
+
+// TestRunCaptureFiles verifies the files listed in RunOpts.CaptureFiles are returned along with the output
+func TestRunCaptureFiles(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "run_capture_files", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Run Capture Files", "Testing captured files")
+
+		output, err := env.Run(ctx, "echo generating && echo 'coverage: 80%' > coverage.txt", "sh", environment.RunOpts{
+			CaptureFiles: []string{"coverage.txt", "missing.txt"},
+		})
+		require.NoError(t, err)
+		assert.Contains(t, output, "generating\n")
+		assert.Contains(t, output, "--- captured file /workdir/coverage.txt ---\ncoverage: 80%\n")
+		assert.Contains(t, output, "--- captured file /workdir/missing.txt ---\n[not captured")
+
+		_, err = env.Run(ctx, "true", "sh", environment.RunOpts{CaptureFiles: []string{"../etc/passwd"}})
+		assert.Error(t, err)
+	})
+}
+
+// TestRunMasksSecrets verifies secret values echoed by commands are neither returned nor stored in the notes
+func TestRunMasksSecrets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	const secret = "super-secret-api-key"
+	t.Setenv("CU_TEST_MASKED_SECRET", secret)
+
+	WithRepository(t, "run_masks_secrets", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Masked Secrets", "Testing secret masking")
+
+		config := env.State.Config.Copy()
+		config.Secrets = []string{"API_KEY=env://CU_TEST_MASKED_SECRET"}
+		user.UpdateEnvironment(env.ID, "Masked Secrets", "Add API key", config)
+
+		env = user.GetEnvironment(env.ID)
+		output, err := env.Run(ctx, `echo "key=$API_KEY" && echo "key=$API_KEY" >&2`, "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Equal(t, "key=***\n\nstderr: key=***\n", output)
+		require.NoError(t, repo.Update(ctx, env, "Echo API key"))
+
+		log, err := repository.RunGitCommand(ctx, user.WorktreePath(env.ID), "notes", "--ref", "cu/log", "show")
+		require.NoError(t, err)
+		assert.Contains(t, log, "key=***")
+		assert.NotContains(t, log, secret)
+
+		// Output of background commands failing to start is masked too
+		_, err = env.RunBackground(ctx, `echo "key=$API_KEY" && exit 1`, "sh", nil, environment.RunOpts{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "key=***")
+		assert.NotContains(t, err.Error(), secret)
+	})
+}
+
+// TestCheckSecrets verifies secret references are resolved to report the ones that fail
+func TestCheckSecrets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+	initializeDaggerOnce(t)
+
+	t.Setenv("CU_TEST_CHECKED_SECRET", "resolvable")
+
+	config := environment.DefaultConfig()
+	config.Secrets = []string{
+		"RESOLVABLE=env://CU_TEST_CHECKED_SECRET",
+		"MISSING=env://CU_TEST_MISSING_SECRET",
+	}
+	failed := config.CheckSecrets(context.Background(), testDaggerClient)
+	assert.Len(t, failed, 1)
+	assert.Contains(t, failed, "MISSING")
+}
+
+// TestRunInterrupted verifies a command canceled while it runs leaves the environment as it was before it
+func TestRunInterrupted(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "run_interrupted", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		env := user.CreateEnvironment("Interrupted", "Testing interrupted commands")
+		env = user.GetEnvironment(env.ID)
+		container := env.State.Container
+		history := len(env.State.History)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(3*time.Second, cancel)
+		_, err := env.Run(ctx, "touch started && sleep 60 && touch finished", "sh", environment.RunOpts{})
+		require.ErrorIs(t, err, environment.ErrCommandInterrupted)
+		require.ErrorIs(t, err, context.Canceled)
+
+		assert.Equal(t, container, env.State.Container, "the container state must not change")
+		assert.Len(t, env.State.History, history)
+		assert.Empty(t, env.Notes.String())
+
+		// Not even the changes the command made before it was interrupted are kept
+		output, err := env.Run(context.Background(), "ls started finished 2>&1 || true", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "started: No such file or directory")
+	})
+}
@@ -0,0 +1,50 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSavepoint verifies restoring a savepoint reverts the files changed since, in the container and the worktree
+func TestSavepoint(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "savepoint", SetupPythonRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+
+		env := user.CreateEnvironment("Savepoint", "Test savepoints")
+		user.FileWrite(env.ID, "app.py", "print('before')\n", "Write the app")
+		require.NoError(t, repo.Savepoint(ctx, user.dag, env.ID, "before refactor"))
+
+		user.FileWrite(env.ID, "app.py", "print('after')\n", "Refactor the app")
+		user.FileWrite(env.ID, "helpers.py", "def helper(): pass\n", "Add helpers")
+		user.RunCommand(env.ID, "echo installed > /tmp/tool", "Install a tool")
+
+		err := repo.RestoreTag(ctx, user.dag, env.ID, "unknown")
+		assert.ErrorIs(t, err, environment.ErrSavepointNotFound)
+
+		require.NoError(t, repo.RestoreTag(ctx, user.dag, env.ID, "before refactor"))
+		assert.Equal(t, "print('before')\n", user.FileRead(env.ID, "app.py"))
+		user.FileReadExpectError(env.ID, "helpers.py")
+		assert.Equal(t, "print('before')\n", user.ReadWorktreeFile(env.ID, "app.py"))
+		assert.NotContains(t, user.RunCommand(env.ID, "ls /tmp", "List temporary files"), "tool")
+
+		// The work done since the savepoint stays in the history
+		log := user.GitCommand("log", "--format=%s", "container-use/"+env.ID)
+		assert.Contains(t, log, "Restore savepoint before refactor")
+		assert.Contains(t, log, "Refactor the app")
+
+		savepoints, err := repo.Savepoints(ctx, env.ID)
+		require.NoError(t, err)
+		require.Len(t, savepoints, 1)
+		assert.Equal(t, "before refactor", savepoints[0].Name)
+	})
+}
@@ -0,0 +1,210 @@
+package integration
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServiceReachableByName verifies foreground and background commands can reach services by name
+func TestServiceReachableByName(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "service_reachable_by_name", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Service Binding", "Testing service bindings")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		user.UpdateEnvironment(env.ID, "Service Binding", "Use Alpine", config)
+
+		env = user.GetEnvironment(env.ID)
+		_, err := env.AddService(ctx, "Add web server", &environment.ServiceConfig{
+			Name:         "web",
+			Image:        "busybox:latest",
+			Command:      "mkdir -p /www && echo hello-from-web > /www/index.html && httpd -f -p 8080 -h /www",
+			ExposedPorts: []int{8080},
+		}, environment.AddServiceOpts{})
+		require.NoError(t, err)
+
+		output, err := env.Run(ctx, "wget -qO- http://web:8080", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "hello-from-web")
+
+		// Background commands see the service too: this one serves what it fetched from it
+		endpoints, err := env.RunBackground(ctx, "mkdir -p /proxy && wget -qO /proxy/index.html http://web:8080 && httpd -f -p 9090 -h /proxy", "sh", []int{9090}, environment.RunOpts{})
+		require.NoError(t, err)
+		require.Contains(t, endpoints, 9090)
+		proxy := strings.Replace(endpoints[9090].EnvironmentInternal, "tcp://", "http://", 1)
+
+		output, err = env.Run(ctx, "wget -qO- "+proxy, "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "hello-from-web")
+	})
+}
+
+// TestConfiguredServiceStartedAfterLoad verifies the services declared in the configuration are started again once
+// an environment is loaded, not only when it's built, when they're needed
+func TestConfiguredServiceStartedAfterLoad(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "configured_service_running_after_load", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Configured Service", "Testing configured services")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		config.Services = environment.ServiceConfigs{{
+			Name:         "web",
+			Image:        "busybox:latest",
+			Command:      "mkdir -p /www && echo hello-from-config > /www/index.html && httpd -f -p 8080 -h /www",
+			ExposedPorts: []int{8080},
+		}}
+		user.UpdateEnvironment(env.ID, "Configured Service", "Declare a web server", config)
+
+		// Loading doesn't start services, so operations that don't need them don't wait for them
+		env, err := repo.Get(ctx, user.dag, env.ID)
+		require.NoError(t, err)
+		assert.Empty(t, env.Services)
+
+		require.NoError(t, env.StartServices(ctx))
+		require.Len(t, env.Services, 1)
+		assert.Equal(t, "web", env.Services[0].Config.Name)
+
+		output, err := env.Run(ctx, "wget -qO- http://web:8080", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "hello-from-config")
+
+		// Loading the environment again reuses the running service
+		reloaded, err := repo.Get(ctx, user.dag, env.ID)
+		require.NoError(t, err)
+		require.NoError(t, reloaded.StartServices(ctx))
+		require.Len(t, reloaded.Services, 1)
+		assert.Same(t, env.Services[0], reloaded.Services[0])
+	})
+}
+
+// TestAddedServiceReconstructedOnLoad verifies services added to an environment are part of it, with their endpoints,
+// once it's loaded again, and are restarted when their configuration changes
+func TestAddedServiceReconstructedOnLoad(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "added_service_reconstructed_on_load", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Added Service", "Testing added services")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		user.UpdateEnvironment(env.ID, "Added Service", "Use Alpine", config)
+
+		env = user.GetEnvironment(env.ID)
+		added, err := env.AddService(ctx, "Add web server", &environment.ServiceConfig{
+			Name:         "web",
+			Image:        "busybox:latest",
+			Command:      "mkdir -p /www && echo v1 > /www/index.html && httpd -f -p 8080 -h /www",
+			ExposedPorts: []int{8080},
+		}, environment.AddServiceOpts{})
+		require.NoError(t, err)
+		require.NoError(t, repo.Update(ctx, env, "Add web server"))
+
+		env = user.GetEnvironment(env.ID)
+		require.NoError(t, env.StartServices(ctx))
+		require.Len(t, env.Services, 1)
+		service := env.Services[0]
+		assert.Equal(t, "web", service.Config.Name)
+		require.Contains(t, service.Endpoints, 8080)
+		assert.Equal(t, "tcp://web:8080", service.Endpoints[8080].EnvironmentInternal)
+		assert.Equal(t, added.Endpoints[8080].HostExternal, service.Endpoints[8080].HostExternal)
+
+		// Changing the configuration of the service restarts it
+		config = env.State.Config.Copy()
+		config.Services[0].Command = "mkdir -p /www && echo v2 > /www/index.html && httpd -f -p 8080 -h /www"
+		user.UpdateEnvironment(env.ID, "Added Service", "Serve v2", config)
+
+		env = user.GetEnvironment(env.ID)
+		output, err := env.Run(ctx, "wget -qO- http://web:8080", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "v2")
+		require.Len(t, env.Services, 1)
+	})
+}
+
+// TestServiceInjectedEnv verifies services can point the environment at them with environment variables
+func TestServiceInjectedEnv(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "service_injected_env", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Injected Env", "Testing service environment variables")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		config.Env.Set("WEB_HOST", "already-set")
+		user.UpdateEnvironment(env.ID, "Injected Env", "Use Alpine", config)
+
+		env = user.GetEnvironment(env.ID)
+		service, err := env.AddService(ctx, "Add web server", &environment.ServiceConfig{
+			Name:         "web",
+			Image:        "busybox:latest",
+			Command:      "mkdir -p /www && echo hello-from-env > /www/index.html && httpd -f -p 8080 -h /www",
+			ExposedPorts: []int{8080},
+		}, environment.AddServiceOpts{InjectEnv: true})
+		require.NoError(t, err)
+		assert.Equal(t, environment.KVList{"WEB_PORT=8080", "WEB_URL=http://web:8080"}, service.InjectedEnv)
+
+		output, err := env.Run(ctx, `wget -qO- "$WEB_URL" && echo "$WEB_HOST"`, "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "hello-from-env")
+		assert.Contains(t, output, "already-set")
+
+		// The variables are part of the configuration, so they're kept when the environment is rebuilt
+		assert.Equal(t, "http://web:8080", env.State.Config.Env.Get("WEB_URL"))
+	})
+}
+
+// TestBackgroundFilesReadableFromSharedDir verifies a foreground command reads the files a running background
+// command wrote to the shared directory, and that they aren't committed
+func TestBackgroundFilesReadableFromSharedDir(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "background_shared_dir", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		env := user.CreateEnvironment("Shared Dir", "Testing the shared directory")
+
+		config := env.State.Config.Copy()
+		config.BaseImage = "alpine:latest"
+		user.UpdateEnvironment(env.ID, "Shared Dir", "Use Alpine", config)
+
+		// The server is only reported as started once it listens, after it wrote the file
+		env = user.GetEnvironment(env.ID)
+		_, err := env.RunBackground(ctx, "echo written-by-server > "+environment.SharedDir+"/server.log && httpd -f -p 8080", "sh", []int{8080}, environment.RunOpts{})
+		require.NoError(t, err)
+
+		output, err := env.Run(ctx, "cat "+environment.SharedDir+"/server.log", "sh", environment.RunOpts{})
+		require.NoError(t, err)
+		assert.Contains(t, output, "written-by-server")
+
+		_, err = env.FileRead(ctx, environment.SharedDir+"/server.log", true, 0, 0, false)
+		assert.Error(t, err, "the shared directory must not be part of the environment's state")
+	})
+}
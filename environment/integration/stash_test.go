@@ -0,0 +1,34 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dagger/container-use/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCreateFromStash verifies an environment can be created with the changes of a git stash
+func TestCreateFromStash(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	WithRepository(t, "create_from_stash", SetupEmptyRepo, func(t *testing.T, repo *repository.Repository, user *UserActions) {
+		ctx := context.Background()
+		user.WriteSourceFile("README.md", "# Stashed Project\n")
+		user.WriteSourceFile("notes.txt", "work in progress\n")
+		user.GitCommand("stash", "push", "--include-untracked", "-m", "wip readme")
+
+		env, err := repo.Create(ctx, testDaggerClient, "From Stash", "Continue stashed work", repository.CreateOptions{
+			Stash: "wip readme",
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, "# Stashed Project\n", user.FileRead(env.ID, "README.md"))
+		assert.Equal(t, "work in progress\n", user.FileRead(env.ID, "notes.txt"))
+		assert.Equal(t, "work in progress\n", user.ReadWorktreeFile(env.ID, "notes.txt"))
+	})
+}
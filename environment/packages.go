@@ -0,0 +1,37 @@
+package environment
+
+import (
+	"regexp"
+	"slices"
+)
+
+// packageInstallRegExp matches commands installing system or global packages: the changes they make to the
+// container are outside of the workdir, so they're only kept until the environment is rebuilt.
+var packageInstallRegExp = regexp.MustCompile(`(?:^|[;&|(]|\bsudo)\s*(?:` +
+	`(?:apt-get|apt|yum|dnf|microdnf|zypper)\s+(?:-\S+\s+)*install|` +
+	`apk\s+(?:-\S+\s+)*add|` +
+	`pacman\s+(?:-\S+\s+)*-S\w*|` +
+	`brew\s+install|` +
+	`(?:pip3?|python3?\s+-m\s+pip|gem|cargo|go)\s+install|` +
+	`(?:npm\s+(?:install|i)|yarn\s+global\s+add|pnpm\s+add)\s+(?:\S+\s+)*(?:-g|--global)\b)`)
+
+// isPackageInstall reports whether the command looks like it installs system or global packages.
+func isPackageInstall(command string) bool {
+	return packageInstallRegExp.MatchString(command)
+}
+
+// UnpersistedInstalls returns the commands that installed packages since the environment was last built,
+// and that aren't part of the setup or install commands of config: what they installed is lost when the
+// environment is rebuilt with config.
+func (env *Environment) UnpersistedInstalls(config *EnvironmentConfig) []string {
+	var commands []string
+	for _, record := range env.State.History[min(env.State.HistoryAtBuild, len(env.State.History)):] {
+		if record.ExitCode != 0 || !isPackageInstall(record.Command) ||
+			slices.Contains(config.SetupCommands, record.Command) || slices.Contains(config.InstallCommands, record.Command) ||
+			slices.Contains(commands, record.Command) {
+			continue
+		}
+		commands = append(commands, record.Command)
+	}
+	return commands
+}
@@ -0,0 +1,53 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPackageInstall(t *testing.T) {
+	for _, command := range []string{
+		"apt-get install -y curl",
+		"apt-get update && apt-get -y install jq",
+		"sudo apt install ripgrep",
+		"apk add --no-cache git",
+		"pip install requests",
+		"python3 -m pip install -r requirements.txt",
+		"npm install -g typescript",
+		"go install golang.org/x/tools/gopls@latest",
+		"cd /tmp; cargo install ripgrep",
+	} {
+		assert.True(t, isPackageInstall(command), command)
+	}
+	for _, command := range []string{
+		"npm install",
+		"go test ./...",
+		"apt-get update",
+		"cat install.sh",
+		"echo 'apk' add",
+	} {
+		assert.False(t, isPackageInstall(command), command)
+	}
+}
+
+func TestUnpersistedInstalls(t *testing.T) {
+	env := &Environment{EnvironmentInfo: &EnvironmentInfo{State: &State{History: []*CommandRecord{
+		{Command: "apk add curl"},
+		{Command: "go test ./..."},
+		{Command: "apk add jq"},
+		{Command: "apk add nonexistent", ExitCode: 1},
+		{Command: "pip install requests"},
+		{Command: "apk add jq"},
+	}}}}
+
+	assert.Equal(t, []string{"apk add curl", "apk add jq", "pip install requests"}, env.UnpersistedInstalls(&EnvironmentConfig{}))
+	// Commands part of the configuration are run again by the rebuild
+	assert.Equal(t, []string{"apk add curl", "apk add jq"}, env.UnpersistedInstalls(&EnvironmentConfig{
+		InstallCommands: []string{"pip install requests"},
+	}))
+
+	// Commands run before the last build were already lost
+	env.State.HistoryAtBuild = 3
+	assert.Equal(t, []string{"pip install requests", "apk add jq"}, env.UnpersistedInstalls(&EnvironmentConfig{}))
+}
@@ -0,0 +1,88 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ErrCommandDenied is returned for commands the command policy of the environment doesn't allow.
+var ErrCommandDenied = errors.New("command denied by the command policy")
+
+// CommandPolicy restricts the commands agents can run in an environment, as a guardrail for semi-trusted agents.
+// Patterns are regular expressions matched anywhere in the command, e.g. `curl.*\|\s*(ba)?sh` or `rm\s+-rf\s+/(\s|$)`.
+// The zero value allows every command.
+type CommandPolicy struct {
+	// Allow, if not empty, only allows the commands matching one of its patterns.
+	Allow []string `json:"allow,omitempty"`
+	// Deny denies the commands matching one of its patterns, even if they're allowed.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Check returns an error wrapping ErrCommandDenied if the policy doesn't allow command.
+// A nil policy allows every command.
+func (p *CommandPolicy) Check(command string) error {
+	if p == nil {
+		return nil
+	}
+	for _, pattern := range p.Deny {
+		re, err := compilePolicyPattern(pattern)
+		if err != nil {
+			return err
+		}
+		if re.MatchString(command) {
+			return fmt.Errorf("%w: %q matches the denied pattern %q", ErrCommandDenied, command, pattern)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, pattern := range p.Allow {
+		re, err := compilePolicyPattern(pattern)
+		if err != nil {
+			return err
+		}
+		if re.MatchString(command) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q doesn't match any allowed pattern", ErrCommandDenied, command)
+}
+
+// Empty reports whether the policy allows every command.
+func (p *CommandPolicy) Empty() bool {
+	return p == nil || (len(p.Allow) == 0 && len(p.Deny) == 0)
+}
+
+// Validate makes sure the patterns of the policy are valid regular expressions.
+func (p *CommandPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, pattern := range slices.Concat(p.Allow, p.Deny) {
+		if _, err := compilePolicyPattern(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compilePolicyPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command_policy pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+// checkCommandPolicy makes sure the command policy of the environment allows command. Denied commands are
+// recorded in the notes, so attempts to get around the policy show up in the log.
+func (env *Environment) checkCommandPolicy(command string) error {
+	err := env.State.Config.CommandPolicy.Check(command)
+	if errors.Is(err, ErrCommandDenied) {
+		env.Notes.Add("$ %s\ndenied: %s", strings.TrimSpace(command), err)
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+var (
+	// daggerAttempts bounds how many times an operation failing with a transient Dagger error is attempted.
+	daggerAttempts = 4
+	// daggerRetryBackoff is the delay before the first retry, doubled after each attempt.
+	daggerRetryBackoff = 500 * time.Millisecond
+)
+
+// transientErrors are the messages of errors the Dagger engine returns when it's overloaded
+// or loses track of resources under concurrent use. The operation itself can succeed if retried.
+var transientErrors = []string{
+	"code = unavailable",
+	"code = resourceexhausted",
+	"engine is busy",
+	// BuildKit losing the lease of a ref, not any message mentioning "lease" such as "please login"
+	"lease does not exist",
+	"failed to get lease",
+	"resource temporarily unavailable",
+	"connection reset by peer",
+	"transport is closing",
+	"too many requests",
+}
+
+// isTransientError reports whether err is a transient failure of the Dagger engine,
+// rather than a failure of the operation itself such as a command exiting with an error.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, transient := range transientErrors {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient calls fn until it succeeds or fails with an error that isn't transient,
+// backing off between attempts. It gives up after daggerAttempts attempts.
+func retryTransient[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	backoff := daggerRetryBackoff
+	for attempt := 1; ; attempt++ {
+		result, err := fn()
+		if !isTransientError(err) {
+			return result, err
+		}
+		if attempt == daggerAttempts {
+			return result, fmt.Errorf("the Dagger engine is busy, giving up after %d attempts (try again later): %w", attempt, err)
+		}
+
+		slog.Warn("Transient Dagger error, retrying", "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
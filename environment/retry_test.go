@@ -0,0 +1,72 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryTransient(t *testing.T) {
+	daggerRetryBackoff = time.Millisecond
+	t.Cleanup(func() { daggerRetryBackoff = 500 * time.Millisecond })
+
+	ctx := context.Background()
+	transient := errors.New("rpc error: code = Unavailable desc = engine is busy")
+
+	t.Run("eventually_succeeds", func(t *testing.T) {
+		attempts := 0
+		result, err := retryTransient(ctx, func() (int, error) {
+			attempts++
+			if attempts < 3 {
+				return 0, transient
+			}
+			return 42, nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 42, result)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("lost_leases", func(t *testing.T) {
+		for _, lost := range []error{
+			errors.New(`lease "buildkit/123": not found: lease does not exist`),
+			errors.New("failed to get lease: context deadline exceeded"),
+		} {
+			assert.True(t, isTransientError(lost), "%v", lost)
+		}
+	})
+
+	t.Run("gives_up", func(t *testing.T) {
+		attempts := 0
+		_, err := retryTransient(ctx, func() (int, error) {
+			attempts++
+			return 0, transient
+		})
+		assert.ErrorIs(t, err, transient)
+		assert.ErrorContains(t, err, "Dagger engine is busy")
+		assert.Equal(t, daggerAttempts, attempts)
+	})
+
+	t.Run("non_retryable_errors_pass_through", func(t *testing.T) {
+		for _, nonRetryable := range []error{
+			&dagger.ExecError{ExitCode: 1, Stderr: "failed to get lease"},
+			errors.New("image not found"),
+			errors.New("pull access denied for private/image, please login"),
+			errors.New("failed to release the layer"),
+			context.Canceled,
+		} {
+			attempts := 0
+			_, err := retryTransient(ctx, func() (int, error) {
+				attempts++
+				return 0, nonRetryable
+			})
+			assert.Equal(t, nonRetryable, err)
+			assert.Equal(t, 1, attempts, "%v", nonRetryable)
+		}
+	})
+}
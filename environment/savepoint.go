@@ -0,0 +1,69 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// ErrSavepointNotFound is returned when restoring a savepoint the environment doesn't have.
+var ErrSavepointNotFound = errors.New("savepoint not found")
+
+// Savepoint is a named state of an environment it can be restored to, e.g. "before refactor". Unlike checkpoints,
+// savepoints aren't published: they reference the container state in the Dagger engine, like the environment does.
+type Savepoint struct {
+	Name      string    `json:"name"`
+	Container string    `json:"container"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// History and HistoryAtBuild are the lengths of the history of the environment when the savepoint was created,
+	// so the commands run since, whose changes the savepoint doesn't have, aren't replayed after restoring it.
+	History        int `json:"history,omitempty"`
+	HistoryAtBuild int `json:"history_at_build,omitempty"`
+}
+
+// Tag records the current state of the environment as a savepoint named name.
+func (env *Environment) Tag(name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("savepoint name must not be empty")
+	}
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if slices.ContainsFunc(env.State.Savepoints, func(s *Savepoint) bool { return s.Name == name }) {
+		return fmt.Errorf("savepoint %q already exists", name)
+	}
+	env.State.Savepoints = append(env.State.Savepoints, &Savepoint{
+		Name:           name,
+		Container:      env.State.Container,
+		CreatedAt:      time.Now(),
+		History:        len(env.State.History),
+		HistoryAtBuild: env.State.HistoryAtBuild,
+	})
+	env.Notes.Add("Create savepoint %s", name)
+	return nil
+}
+
+// RestoreTag brings the environment back to the state recorded by the savepoint named name. The savepoint is kept,
+// as are the more recent ones, so it can be restored again.
+func (env *Environment) RestoreTag(ctx context.Context, name string) error {
+	i := slices.IndexFunc(env.State.Savepoints, func(s *Savepoint) bool { return s.Name == name })
+	if i < 0 {
+		return fmt.Errorf("%w: %q", ErrSavepointNotFound, name)
+	}
+	savepoint := env.State.Savepoints[i]
+
+	if err := env.apply(ctx, env.dag.LoadContainerFromID(dagger.ContainerID(savepoint.Container))); err != nil {
+		return fmt.Errorf("failed to restore savepoint %q: %w", name, err)
+	}
+	env.State.History = env.State.History[:min(savepoint.History, len(env.State.History))]
+	env.State.HistoryAtBuild = savepoint.HistoryAtBuild
+	env.Notes.Add("Restore savepoint %s", name)
+	return nil
+}
@@ -0,0 +1,35 @@
+package environment
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTag(t *testing.T) {
+	env := &Environment{EnvironmentInfo: &EnvironmentInfo{State: &State{
+		Container:      "container-1",
+		History:        []*CommandRecord{{Command: "go build"}, {Command: "go test"}},
+		HistoryAtBuild: 1,
+	}}}
+
+	require.NoError(t, env.Tag(" before refactor "))
+	require.Len(t, env.State.Savepoints, 1)
+	savepoint := env.State.Savepoints[0]
+	assert.Equal(t, "before refactor", savepoint.Name)
+	assert.Equal(t, "container-1", savepoint.Container)
+	assert.Equal(t, 2, savepoint.History)
+	assert.Equal(t, 1, savepoint.HistoryAtBuild)
+	assert.False(t, savepoint.CreatedAt.IsZero())
+	assert.Equal(t, "Create savepoint before refactor", env.Notes.Pop())
+
+	assert.ErrorContains(t, env.Tag("before refactor"), "already exists")
+	assert.ErrorContains(t, env.Tag("  "), "must not be empty")
+	assert.Len(t, env.State.Savepoints, 1)
+
+	err := env.RestoreTag(context.Background(), "unknown")
+	assert.ErrorIs(t, err, ErrSavepointNotFound)
+	assert.Equal(t, "container-1", env.State.Container)
+}
@@ -0,0 +1,173 @@
+package environment
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// secretMask replaces the values of secrets in command outputs.
+	secretMask = "***"
+	// minMaskedSecretLength is the length under which secret values aren't masked:
+	// masking every occurrence of such short values would garble unrelated output.
+	minMaskedSecretLength = 4
+)
+
+// secretValues caches the resolved values of secret references, so secret providers aren't queried for every command.
+// Like commandOutputs, it's global because environments are loaded again for every operation.
+// env:// references are never cached, they are read from the host environment instead.
+var secretValues = &secretCache{values: map[string]string{}}
+
+type secretCache struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// resolve returns the value of the secret reference, resolving it with Dagger the first time.
+func (c *secretCache) resolve(ctx context.Context, env *Environment, ref string) (string, error) {
+	if name, ok := strings.CutPrefix(ref, "env://"); ok {
+		return os.Getenv(name), nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if value, ok := c.values[ref]; ok {
+		return value, nil
+	}
+	value, err := resolveSecret(ctx, env.dag, ref)
+	if err != nil {
+		return "", err
+	}
+	c.values[ref] = value
+	return value, nil
+}
+
+// set caches the value of the secret reference, e.g. after it was resolved again.
+func (c *secretCache) set(ref, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[ref] = value
+}
+
+// secretMasker returns a replacer masking the values of the secrets a command run with opts has access to:
+// the environment's secrets and the host environment variables it inherits.
+// Secrets that can't be resolved are logged and left unmasked rather than failing the command.
+func (env *Environment) secretMasker(ctx context.Context, opts RunOpts) *strings.Replacer {
+	var values []string
+	for _, secret := range env.State.Config.Secrets {
+		name, ref, found := strings.Cut(secret, "=")
+		if !found {
+			continue
+		}
+		value, err := secretValues.resolve(ctx, env, ref)
+		if err != nil {
+			slog.Warn("unable to resolve secret to mask it in command output", "environment", env.ID, "secret", name, "error", err)
+			continue
+		}
+		values = append(values, value)
+	}
+	for _, name := range opts.InheritHostEnv {
+		values = append(values, os.Getenv(name))
+	}
+	return newSecretMasker(values)
+}
+
+// newSecretMasker returns a replacer masking values, longest first so a secret containing another is masked whole.
+// Surrounding whitespace, such as the trailing newline of secrets read from files, isn't part of the masked value.
+func newSecretMasker(values []string) *strings.Replacer {
+	values = slices.SortedFunc(slices.Values(values), func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+	var oldnew []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) < minMaskedSecretLength {
+			continue
+		}
+		oldnew = append(oldnew, value, secretMask)
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// resolveSecret returns the value of a secret reference, resolved the way secrets are when set in containers.
+func resolveSecret(ctx context.Context, dag *dagger.Client, ref string) (string, error) {
+	return dag.Secret(ref).Plaintext(ctx)
+}
+
+// CheckSecrets resolves every secret of the configuration and returns the errors of those that can't be resolved,
+// by secret name. Resolved values are discarded, and never cached: the point is to catch references that stopped
+// resolving, such as a rotated 1Password item or an unset host variable.
+func (config *EnvironmentConfig) CheckSecrets(ctx context.Context, dag *dagger.Client) map[string]error {
+	failed := map[string]error{}
+	for _, secret := range config.Secrets {
+		name, ref, found := strings.Cut(secret, "=")
+		if !found {
+			failed[secret] = fmt.Errorf("invalid secret: %s", secret)
+			continue
+		}
+		if _, err := resolveSecret(ctx, dag, ref); err != nil {
+			failed[name] = err
+		}
+	}
+	return failed
+}
+
+// refreshableSecretSchemes are the secret providers that can be queried again for the current value of a secret.
+var refreshableSecretSchemes = []string{"env://", "op://"}
+
+// refreshedSecrets returns the references of the environment's secrets resolved again for every command, by name.
+func (config *EnvironmentConfig) refreshedSecrets() (map[string]string, error) {
+	refs := map[string]string{}
+	for _, name := range config.RefreshSecrets {
+		ref := config.Secrets.Get(name)
+		if ref == "" {
+			return nil, fmt.Errorf("invalid refresh_secrets: secret %s is not set", name)
+		}
+		if !slices.ContainsFunc(refreshableSecretSchemes, func(scheme string) bool { return strings.HasPrefix(ref, scheme) }) {
+			return nil, fmt.Errorf("invalid refresh_secrets: secret %s can't be refreshed, only %s secrets can", name, strings.Join(refreshableSecretSchemes, " and "))
+		}
+		refs[name] = ref
+	}
+	return refs, nil
+}
+
+// containerWithRefreshedSecrets sets the secrets the environment resolves for every command to their current value.
+// Their values are also cached for secretMasker, so the command output is masked with the values it saw.
+func (env *Environment) containerWithRefreshedSecrets(ctx context.Context, container *dagger.Container) (*dagger.Container, error) {
+	refs, err := env.State.Config.refreshedSecrets()
+	if err != nil {
+		return nil, err
+	}
+	for name, ref := range refs {
+		// A unique cache key makes Dagger look the secret up again instead of reusing the value of the session
+		secret := env.dag.Secret(ref, dagger.SecretOpts{CacheKey: fmt.Sprintf("%s@%d", ref, time.Now().UnixNano())})
+		if !strings.HasPrefix(ref, "env://") {
+			value, err := secret.Plaintext(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to refresh secret %s: %w", name, err)
+			}
+			secretValues.set(ref, value)
+		}
+		container = container.WithSecretVariable(name, secret)
+	}
+	return container, nil
+}
+
+// containerWithoutRefreshedSecrets removes the secrets resolved for every command, so their values aren't kept
+// in the environment's state.
+func (env *Environment) containerWithoutRefreshedSecrets(container *dagger.Container) *dagger.Container {
+	for _, name := range env.State.Config.RefreshSecrets {
+		container = container.WithoutSecretVariable(name)
+	}
+	return container
+}
@@ -0,0 +1,46 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretMasker(t *testing.T) {
+	masker := newSecretMasker([]string{"token-1234", "token-1234-extended", "abc", "password\n", ""})
+
+	assert.Equal(t, "key=*** and ***", masker.Replace("key=token-1234 and token-1234-extended"))
+	assert.Equal(t, "pass=***\n", masker.Replace("pass=password\n"))
+	// Values too short to be masked safely are left alone
+	assert.Equal(t, "abc", masker.Replace("abc"))
+	assert.Equal(t, "nothing to mask", newSecretMasker(nil).Replace("nothing to mask"))
+}
+
+func TestRefreshedSecrets(t *testing.T) {
+	config := DefaultConfig()
+	config.Secrets.Set("GITHUB_TOKEN", "op://vault/github/token")
+	config.Secrets.Set("AWS_SESSION_TOKEN", "env://AWS_SESSION_TOKEN")
+	config.Secrets.Set("API_KEY", "file:///run/secrets/api-key")
+
+	refs, err := config.refreshedSecrets()
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+
+	config.RefreshSecrets = []string{"GITHUB_TOKEN", "AWS_SESSION_TOKEN"}
+	refs, err = config.refreshedSecrets()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"GITHUB_TOKEN":      "op://vault/github/token",
+		"AWS_SESSION_TOKEN": "env://AWS_SESSION_TOKEN",
+	}, refs)
+
+	// Only providers that can be queried again are refreshed
+	config.RefreshSecrets = []string{"API_KEY"}
+	_, err = config.refreshedSecrets()
+	assert.ErrorContains(t, err, "secret API_KEY can't be refreshed")
+
+	config.RefreshSecrets = []string{"MISSING"}
+	_, err = config.refreshedSecrets()
+	assert.ErrorContains(t, err, "secret MISSING is not set")
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
 	"time"
 
 	"dagger.io/dagger"
@@ -11,11 +15,17 @@ import (
 
 var (
 	serviceStartTimeout = 30 * time.Second
+	// portProbeInterval is the time between attempts of WaitForPort to connect to a port
+	portProbeInterval = 250 * time.Millisecond
+	// portProbeGracePeriod is how long a connection must stay open for the port to be considered ready
+	portProbeGracePeriod = 200 * time.Millisecond
 )
 
 type Service struct {
 	Config    *ServiceConfig   `json:"config"`
 	Endpoints EndpointMappings `json:"endpoints"`
+	// InjectedEnv are the variables pointing at the service set in the environment when it was added
+	InjectedEnv KVList `json:"injected_env,omitempty"`
 
 	svc *dagger.Service
 }
@@ -27,19 +37,13 @@ type EndpointMapping struct {
 
 type EndpointMappings map[int]*EndpointMapping
 
-func (env *Environment) startServices(ctx context.Context) ([]*Service, error) {
-	services := []*Service{}
-	for _, cfg := range env.State.Config.Services {
-		service, err := env.startService(ctx, cfg)
-		if err != nil {
+func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*Service, error) {
+	// Agents can add services, their commands are subject to the policy like the commands they run
+	if cfg.Command != "" {
+		if err := env.checkCommandPolicy(cfg.Command); err != nil {
 			return nil, err
 		}
-		services = append(services, service)
 	}
-	return services, nil
-}
-
-func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*Service, error) {
 	container := env.dag.Container().From(cfg.Image)
 	container, err := containerWithEnvAndSecrets(env.dag, container, cfg.Env, cfg.Secrets)
 	if err != nil {
@@ -81,6 +85,8 @@ func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*
 		return nil, err
 	}
 
+	idleServices.track(env.ID, env.State.Config.IdleTimeout(), svc)
+
 	endpoints := EndpointMappings{}
 	for _, port := range cfg.ExposedPorts {
 		endpoint := &EndpointMapping{
@@ -101,6 +107,7 @@ func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*
 		if err != nil {
 			return nil, err
 		}
+		idleServices.track(env.ID, env.State.Config.IdleTimeout(), tunnel)
 
 		externalEndpoint, err := tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{
 			Scheme: "tcp",
@@ -111,14 +118,77 @@ func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*
 		endpoint.HostExternal = externalEndpoint
 	}
 
-	return &Service{
+	idleServices.trackEndpoints(env.ID, endpoints)
+
+	service := &Service{
 		Config:    cfg,
 		Endpoints: endpoints,
 		svc:       svc,
-	}, nil
+	}
+	idleServices.trackConfigured(env.ID, service)
+	return service, nil
+}
+
+// StartServices makes sure the services of the configuration are running. Loading an environment doesn't start them,
+// so operations that don't need them, such as reading files, don't wait for them: commands start them when they run,
+// and operations that need them otherwise, e.g. to report their endpoints, call StartServices.
+func (env *Environment) StartServices(ctx context.Context) error {
+	return env.ensureServices(ctx)
+}
+
+// ensureServices makes sure the services of the configuration are running: environments are loaded again for every
+// operation, possibly by another process, and the services of idle environments are stopped. The services still
+// running are reused, unless their configuration changed, the others are started again. Running services no longer
+// in the configuration are stopped.
+func (env *Environment) ensureServices(ctx context.Context) error {
+	if env.State.Paused {
+		// Paused by another process, the services this one still runs are stopped
+		env.Services = nil
+		return StopServices(ctx, env.ID)
+	}
+	running := idleServices.configured(env.ID)
+	for name, service := range running {
+		if cfg := env.State.Config.Services.Get(name); cfg == nil || !cfg.Equal(service.Config) {
+			if _, err := service.svc.Stop(ctx); err != nil {
+				slog.Warn("Failed to stop outdated service", "environment.id", env.ID, "service", name, "err", err)
+			}
+			idleServices.untrackConfigured(env.ID, name)
+			delete(running, name)
+		}
+	}
+
+	services := make([]*Service, 0, len(env.State.Config.Services))
+	for _, cfg := range env.State.Config.Services {
+		service, ok := running[cfg.Name]
+		if !ok {
+			var err error
+			if service, err = env.startService(ctx, cfg); err != nil {
+				return fmt.Errorf("failed to start service %s: %w", cfg.Name, err)
+			}
+		}
+		services = append(services, service)
+	}
+	env.Services = services
+	return nil
+}
+
+// withServiceBindings binds the running services of the environment to container, so they can be
+// reached by name from every command regardless of how the container state was obtained.
+func (env *Environment) withServiceBindings(container *dagger.Container) *dagger.Container {
+	for _, service := range env.Services {
+		container = container.WithServiceBinding(service.Config.Name, service.svc)
+	}
+	return container
+}
+
+// AddServiceOpts configures how AddService adds a service to the environment.
+type AddServiceOpts struct {
+	// InjectEnv sets the variables pointing at the service in the environment (see ServiceConfig.EnvVariables),
+	// except those already set.
+	InjectEnv bool
 }
 
-func (env *Environment) AddService(ctx context.Context, explanation string, cfg *ServiceConfig) (*Service, error) {
+func (env *Environment) AddService(ctx context.Context, explanation string, cfg *ServiceConfig, opts AddServiceOpts) (*Service, error) {
 	if env.State.Config.Services.Get(cfg.Name) != nil {
 		return nil, fmt.Errorf("service %s already exists", cfg.Name)
 	}
@@ -130,11 +200,112 @@ func (env *Environment) AddService(ctx context.Context, explanation string, cfg
 	env.Services = append(env.Services, svc)
 
 	state := env.container().WithServiceBinding(cfg.Name, svc.svc)
+	if opts.InjectEnv {
+		vars := cfg.EnvVariables()
+		for _, key := range vars.Keys() {
+			if slices.Contains(env.State.Config.Env.Keys(), key) {
+				continue
+			}
+			value := vars.Get(key)
+			env.State.Config.Env.Set(key, value)
+			svc.InjectedEnv.Set(key, value)
+			state = state.WithEnvVariable(key, value)
+		}
+	}
 	if err := env.apply(ctx, state); err != nil {
 		return nil, err
 	}
 
 	env.Notes.Add("Add service %s\n%s\n\n", cfg.Name, explanation)
+	if len(svc.InjectedEnv) > 0 {
+		env.Notes.Add("Set %s\n\n", strings.Join(svc.InjectedEnv, " "))
+	}
 
 	return svc, nil
 }
+
+// StopServices stops the services this process runs for the environment, e.g. once it's paused: services belong to
+// the process that started them, usually the MCP server of the agent, which may not be the one pausing the environment.
+// They're started again by the next command that needs them.
+func StopServices(ctx context.Context, id string) error {
+	var errs []error
+	for _, svc := range idleServices.remove(id) {
+		if _, err := svc.Stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to stop the services of environment %s: %w", id, err)
+	}
+	return nil
+}
+
+// EnvironmentsWithServices returns the IDs of the environments this process runs services for.
+func EnvironmentsWithServices() []string {
+	return idleServices.ids()
+}
+
+// WaitForPort blocks until a service of the environment, started in the background or from the configuration,
+// accepts TCP connections on port, or timeout elapses. If host isn't empty, it's the service reached at host within
+// the environment, e.g. the name of a configured service; otherwise port must be exposed by a single service.
+func (env *Environment) WaitForPort(ctx context.Context, host string, port int, timeout time.Duration) error {
+	if err := env.ensureServices(ctx); err != nil {
+		return err
+	}
+	endpoints := idleServices.endpoints(env.ID, host, port)
+	switch {
+	case len(endpoints) == 0 && host != "":
+		return fmt.Errorf("no running service of environment %s is reached at %s:%d", env.ID, host, port)
+	case len(endpoints) == 0:
+		return fmt.Errorf("no running service of environment %s exposes port %d: start one with a background command exposing it", env.ID, port)
+	case len(endpoints) > 1:
+		var internal []string
+		for _, endpoint := range endpoints {
+			internal = append(internal, endpoint.EnvironmentInternal)
+		}
+		return fmt.Errorf("several services of environment %s expose port %d (%s): choose one by its endpoint", env.ID, port, strings.Join(internal, ", "))
+	}
+	endpoint := endpoints[0]
+	address := strings.TrimPrefix(endpoint.HostExternal, "tcp://")
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(portProbeInterval)
+	defer ticker.Stop()
+	for {
+		if probePort(ctx, address) {
+			idleServices.touch(env.ID, env.State.Config.IdleTimeout())
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("port %d is not ready after %s", port, timeout)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// probePort returns whether the service behind address is ready. Ports are reached through a tunnel
+// that accepts connections whether the service listens or not, and closes them right away if it doesn't:
+// the service is only considered ready if the connection stays open for a moment, or the service sends data.
+func probePort(ctx context.Context, address string) bool {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(portProbeGracePeriod)); err != nil {
+		return false
+	}
+	n, err := conn.Read(make([]byte, 1))
+	if n > 0 {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,75 @@
+package environment
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// wellKnownSchemes are the URL schemes of the services usually listening on a port.
+var wellKnownSchemes = map[int]string{
+	80:    "http",
+	443:   "https",
+	3000:  "http",
+	3306:  "mysql",
+	5432:  "postgres",
+	5672:  "amqp",
+	6379:  "redis",
+	8000:  "http",
+	8080:  "http",
+	9200:  "http",
+	11211: "memcached",
+	27017: "mongodb",
+}
+
+// conventionalURLVariables are the variables libraries and frameworks commonly read the URL of a service from, by scheme.
+var conventionalURLVariables = map[string]string{
+	"amqp":     "AMQP_URL",
+	"mongodb":  "MONGODB_URI",
+	"mysql":    "DATABASE_URL",
+	"postgres": "DATABASE_URL",
+	"redis":    "REDIS_URL",
+}
+
+// ServiceEnvPrefix returns the prefix of the variables pointing at a service: its name in upper case,
+// characters other than letters and digits replaced with underscores, e.g. MY_DB for my-db.
+func ServiceEnvPrefix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, name)
+}
+
+// EnvVariables returns the variables pointing commands of the environment at the service, e.g. for a service my-db
+// exposing port 5432:
+//
+//	MY_DB_HOST=my-db
+//	MY_DB_PORT=5432
+//	MY_DB_URL=postgres://my-db:5432
+//	DATABASE_URL=postgres://my-db:5432
+//
+// The port and URL are those of the first exposed port, the scheme of the URL guessed from the port, tcp if unknown.
+// The conventional variable of the scheme, such as DATABASE_URL or REDIS_URL, is included if there's one.
+func (cfg *ServiceConfig) EnvVariables() KVList {
+	prefix := ServiceEnvPrefix(cfg.Name)
+	vars := KVList{}
+	vars.Set(prefix+"_HOST", cfg.Name)
+	if len(cfg.ExposedPorts) == 0 {
+		return vars
+	}
+
+	port := cfg.ExposedPorts[0]
+	scheme, ok := wellKnownSchemes[port]
+	if !ok {
+		scheme = "tcp"
+	}
+	url := fmt.Sprintf("%s://%s:%d", scheme, cfg.Name, port)
+	vars.Set(prefix+"_PORT", fmt.Sprint(port))
+	vars.Set(prefix+"_URL", url)
+	if name, ok := conventionalURLVariables[scheme]; ok {
+		vars.Set(name, url)
+	}
+	return vars
+}
@@ -0,0 +1,31 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceConfig_EnvVariables(t *testing.T) {
+	assert.Equal(t, KVList{
+		"MY_DB_HOST=my-db",
+		"MY_DB_PORT=5432",
+		"MY_DB_URL=postgres://my-db:5432",
+		"DATABASE_URL=postgres://my-db:5432",
+	}, (&ServiceConfig{Name: "my-db", ExposedPorts: []int{5432}}).EnvVariables())
+
+	// The first port is used, and unknown ports are plain TCP
+	assert.Equal(t, KVList{
+		"QUEUE_HOST=queue",
+		"QUEUE_PORT=4222",
+		"QUEUE_URL=tcp://queue:4222",
+	}, (&ServiceConfig{Name: "queue", ExposedPorts: []int{4222, 8222}}).EnvVariables())
+
+	assert.Equal(t, KVList{"WORKER_HOST=worker"}, (&ServiceConfig{Name: "worker"}).EnvVariables())
+}
+
+func TestServiceEnvPrefix(t *testing.T) {
+	assert.Equal(t, "MY_DB", ServiceEnvPrefix("my-db"))
+	assert.Equal(t, "CACHE_2", ServiceEnvPrefix("cache.2"))
+	assert.Equal(t, "REDIS", ServiceEnvPrefix("redis"))
+}
@@ -0,0 +1,106 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listen starts a TCP listener handling connections with handle, and returns its port.
+func listen(t *testing.T, handle func(net.Conn)) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestProbePort(t *testing.T) {
+	ctx := context.Background()
+
+	// A service keeping the connection open, or greeting the client, is ready
+	silent := listen(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+	assert.True(t, probePort(ctx, fmt.Sprintf("127.0.0.1:%d", silent)))
+	greeting := listen(t, func(conn net.Conn) {
+		fmt.Fprintln(conn, "220 ready")
+		conn.Close()
+	})
+	assert.True(t, probePort(ctx, fmt.Sprintf("127.0.0.1:%d", greeting)))
+
+	// A tunnel with nothing behind it closes connections right away
+	closing := listen(t, func(conn net.Conn) { conn.Close() })
+	assert.False(t, probePort(ctx, fmt.Sprintf("127.0.0.1:%d", closing)))
+}
+
+func TestWaitForPort(t *testing.T) {
+	ctx := context.Background()
+	env := &Environment{EnvironmentInfo: &EnvironmentInfo{ID: "wait-for-port-env", State: &State{Config: DefaultConfig()}}}
+	t.Cleanup(func() {
+		idleServices.mu.Lock()
+		delete(idleServices.envs, env.ID)
+		idleServices.mu.Unlock()
+	})
+
+	err := env.WaitForPort(ctx, "", 8080, time.Second)
+	assert.ErrorContains(t, err, "no running service of environment wait-for-port-env exposes port 8080")
+
+	// The service only becomes ready after a while
+	var ready atomic.Bool
+	port := listen(t, func(conn net.Conn) {
+		if !ready.Load() {
+			conn.Close()
+			return
+		}
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+	idleServices.track(env.ID, 0, &dagger.Service{})
+	idleServices.trackEndpoints(env.ID, EndpointMappings{8080: {
+		EnvironmentInternal: "tcp://web:8080",
+		HostExternal:        fmt.Sprintf("tcp://127.0.0.1:%d", port),
+	}})
+
+	time.AfterFunc(500*time.Millisecond, func() { ready.Store(true) })
+	start := time.Now()
+	require.NoError(t, env.WaitForPort(ctx, "", 8080, 5*time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+
+	// Until the timeout elapses
+	ready.Store(false)
+	err = env.WaitForPort(ctx, "", 8080, 500*time.Millisecond)
+	assert.ErrorContains(t, err, "port 8080 is not ready after 500ms")
+
+	// Services exposing the same port are told apart by their host within the environment
+	ready.Store(true)
+	closing := listen(t, func(conn net.Conn) { conn.Close() })
+	idleServices.trackEndpoints(env.ID, EndpointMappings{8080: {
+		EnvironmentInternal: "tcp://api:8080",
+		HostExternal:        fmt.Sprintf("tcp://127.0.0.1:%d", closing),
+	}})
+	err = env.WaitForPort(ctx, "", 8080, time.Second)
+	assert.ErrorContains(t, err, "several services of environment wait-for-port-env expose port 8080 (tcp://api:8080, tcp://web:8080)")
+	require.NoError(t, env.WaitForPort(ctx, "web", 8080, 5*time.Second))
+	err = env.WaitForPort(ctx, "api", 8080, 500*time.Millisecond)
+	assert.ErrorContains(t, err, "port 8080 is not ready after 500ms")
+	err = env.WaitForPort(ctx, "db", 8080, time.Second)
+	assert.ErrorContains(t, err, "no running service of environment wait-for-port-env is reached at db:8080")
+}
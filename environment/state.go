@@ -1,6 +1,7 @@
 package environment
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -13,6 +14,47 @@ type State struct {
 	Config    *EnvironmentConfig `json:"config,omitempty"`
 	Container string             `json:"container,omitempty"`
 	Title     string             `json:"title,omitempty"`
+	Paused    bool               `json:"paused,omitempty"`
+
+	// FromImage is the image the environment was created from, used as is rather than built from the base image
+	// and the source. Rebuilds start from it too.
+	FromImage string `json:"from_image,omitempty"`
+	// Checkpoint is the content-addressed reference of the image the environment was last checkpointed to.
+	Checkpoint string `json:"checkpoint,omitempty"`
+
+	// History records the commands run in the environment so its work can be replayed.
+	History []*CommandRecord `json:"history,omitempty"`
+	// HistoryAtBuild is the length of History when the container was last rebuilt from the configuration:
+	// the changes of the commands run since are lost by the next rebuild, unless they're in the workdir.
+	HistoryAtBuild int `json:"history_at_build,omitempty"`
+
+	// Savepoints are the named states the environment can be restored to, from the oldest to the most recent.
+	Savepoints []*Savepoint `json:"savepoints,omitempty"`
+
+	// PendingChanges are the explanations of the operations whose changes are left uncommitted in the worktree,
+	// with the per-session commit granularity. They make up the message of the commit flushing them.
+	PendingChanges []string `json:"pending_changes,omitempty"`
+}
+
+// CommandRecord describes a command run in an environment and its outcome.
+type CommandRecord struct {
+	Command        string   `json:"command"`
+	Shell          string   `json:"shell,omitempty"`
+	User           string   `json:"user,omitempty"`
+	UseEntrypoint  bool     `json:"use_entrypoint,omitempty"`
+	InheritHostEnv []string `json:"inherit_host_env,omitempty"`
+
+	ExitCode     int    `json:"exit_code"`
+	OutputDigest string `json:"output_digest"`
+
+	// Source is the commit of the environment's source the command ran on.
+	// It is filled in when the environment is saved to the repository.
+	Source string `json:"source,omitempty"`
+}
+
+// OutputDigest returns the digest recorded for the output of a command.
+func OutputDigest(output string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(output)))
 }
 
 func (s *State) Marshal() ([]byte, error) {
@@ -0,0 +1,160 @@
+package mcpserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// buildLimiter bounds the number of environment builds that can run at the
+// same time. A nil limiter doesn't limit anything.
+type buildLimiter struct {
+	slots chan struct{}
+}
+
+func newBuildLimiter(max int) *buildLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &buildLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire blocks until a build slot is available or ctx is done.
+// onWait is invoked once if the caller has to queue behind other builds.
+func (l *buildLimiter) acquire(ctx context.Context, onWait func()) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	if onWait != nil {
+		onWait()
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *buildLimiter) release() {
+	<-l.slots
+}
+
+// buildLimiters bounds the number of concurrent environment builds of each repository, for one server.
+type buildLimiters struct {
+	max int
+
+	mu     sync.Mutex
+	byRepo map[string]*buildLimiter
+}
+
+func newBuildLimiters(max int) *buildLimiters {
+	return &buildLimiters{max: max, byRepo: map[string]*buildLimiter{}}
+}
+
+// forRepo returns the limiter shared by every build of the given repository.
+func (b *buildLimiters) forRepo(repo string) *buildLimiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if l, ok := b.byRepo[repo]; ok {
+		return l
+	}
+	l := newBuildLimiter(b.max)
+	b.byRepo[repo] = l
+	return l
+}
+
+type buildLimitersKey struct{}
+
+// acquireBuildSlot waits for the repository to have room for another build under the limits of the server,
+// reporting the time spent in the queue through progress notifications.
+func acquireBuildSlot(ctx context.Context, request mcp.CallToolRequest, repo string) (func(), error) {
+	limiters, ok := ctx.Value(buildLimitersKey{}).(*buildLimiters)
+	if !ok {
+		return func() {}, nil
+	}
+	queuedAt := time.Time{}
+	release, err := limiters.forRepo(repo).acquire(ctx, func() {
+		queuedAt = time.Now()
+		slog.Info("Waiting for a build slot", "repository", repo, "max-concurrent-builds", limiters.max)
+		notifyProgress(ctx, request, 0, fmt.Sprintf("Waiting for other environment builds to finish (limit: %d concurrent builds)", limiters.max))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gave up waiting for a build slot: %w", err)
+	}
+	if !queuedAt.IsZero() {
+		waited := time.Since(queuedAt).Round(time.Second)
+		slog.Info("Acquired build slot", "repository", repo, "waited", waited)
+		notifyProgress(ctx, request, 1, fmt.Sprintf("Starting environment build after waiting %s", waited))
+	}
+	return release, nil
+}
+
+// notifyProgress sends a progress notification if the client asked for them.
+func notifyProgress(ctx context.Context, request mcp.CallToolRequest, progress int, message string) {
+	if request.Params.Meta == nil || request.Params.Meta.ProgressToken == nil {
+		return
+	}
+	srv := server.ServerFromContext(ctx)
+	if srv == nil {
+		return
+	}
+	if err := srv.SendNotificationToClient(ctx, "notifications/progress", map[string]any{
+		"progressToken": request.Params.Meta.ProgressToken,
+		"progress":      progress,
+		"message":       message,
+	}); err != nil {
+		slog.Warn("Failed to send progress notification", "err", err)
+	}
+}
+
+// withBuildProgress returns a context in which environment builds report their setup and install commands,
+// and the output of each once it exits, through progress notifications.
+func withBuildProgress(ctx context.Context, request mcp.CallToolRequest) context.Context {
+	// The progress of queuing for a build slot goes up to 1
+	return environment.WithBuildLog(ctx, &progressWriter{
+		progress: 1,
+		send: func(progress int, message string) {
+			slog.Info("Build output", "line", message)
+			notifyProgress(ctx, request, progress, message)
+		},
+	})
+}
+
+// progressWriter sends what's written to it line by line, with increasing progress.
+type progressWriter struct {
+	progress int
+	send     func(progress int, message string)
+	partial  []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.partial[:i])
+		w.partial = w.partial[i+1:]
+		w.progress++
+		w.send(w.progress, line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,129 @@
+package mcpserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildLimiterSerializesBuilds(t *testing.T) {
+	limiter := newBuildLimiter(1)
+	ctx := context.Background()
+
+	var running, maxRunning, waited atomic.Int32
+	build := func() {
+		release, err := limiter.acquire(ctx, func() { waited.Add(1) })
+		require.NoError(t, err)
+		defer release()
+
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		running.Add(-1)
+	}
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			build()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxRunning.Load(), "builds should not overlap")
+	assert.Equal(t, int32(1), waited.Load(), "second build should have been queued")
+}
+
+func TestBuildLimiterCanceledWhileQueued(t *testing.T) {
+	limiter := newBuildLimiter(1)
+
+	release, err := limiter.acquire(context.Background(), nil)
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestBuildLimiterUnlimited(t *testing.T) {
+	limiter := newBuildLimiter(0)
+	assert.Nil(t, limiter)
+
+	for range 3 {
+		release, err := limiter.acquire(context.Background(), func() { t.Fatal("unlimited builds should never wait") })
+		require.NoError(t, err)
+		defer release()
+	}
+}
+
+func TestAcquireBuildSlotWaitsForRelease(t *testing.T) {
+	ctx := context.WithValue(context.Background(), buildLimitersKey{}, newBuildLimiters(1))
+
+	release, err := acquireBuildSlot(ctx, mcp.CallToolRequest{}, "/repo")
+	require.NoError(t, err)
+
+	acquired := make(chan func())
+	go func() {
+		release, err := acquireBuildSlot(ctx, mcp.CallToolRequest{}, "/repo")
+		assert.NoError(t, err)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the second build should wait for the first to release its slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Builds of other repositories, and of other servers, aren't limited by it
+	other, err := acquireBuildSlot(ctx, mcp.CallToolRequest{}, "/other-repo")
+	require.NoError(t, err)
+	other()
+	otherServer := context.WithValue(context.Background(), buildLimitersKey{}, newBuildLimiters(1))
+	other, err = acquireBuildSlot(otherServer, mcp.CallToolRequest{}, "/repo")
+	require.NoError(t, err)
+	other()
+
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second build should start once the first released its slot")
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var progress []int
+	var lines []string
+	w := &progressWriter{progress: 1, send: func(p int, message string) {
+		progress = append(progress, p)
+		lines = append(lines, message)
+	}}
+
+	// Lines split across writes are sent whole, once complete
+	for _, chunk := range []string{"$ apt-get install -y git\n", "Reading package", " lists...\nDone\n", "Setting up git"} {
+		_, err := w.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"$ apt-get install -y git", "Reading package lists...", "Done"}, lines)
+	assert.Equal(t, []int{2, 3, 4}, progress)
+
+	_, err := w.Write([]byte(" (2.43.0)\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "Setting up git (2.43.0)", lines[len(lines)-1])
+}
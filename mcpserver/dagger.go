@@ -0,0 +1,61 @@
+package mcpserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// DaggerConnector connects to the Dagger engine.
+type DaggerConnector func(ctx context.Context) (*dagger.Client, error)
+
+// lazyDagger connects to the Dagger engine the first time a tool needs it, so the tools only using git
+// work without an engine running. A failed connection is attempted again by the next tool needing it,
+// e.g. once the engine is started.
+type lazyDagger struct {
+	// ctx outlives tool calls: the connection is shared by all of them
+	ctx     context.Context
+	connect DaggerConnector
+
+	mu     sync.Mutex
+	client *dagger.Client
+}
+
+func newLazyDagger(ctx context.Context, connect DaggerConnector) *lazyDagger {
+	return &lazyDagger{ctx: ctx, connect: connect}
+}
+
+func (l *lazyDagger) get() (*dagger.Client, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client != nil {
+		return l.client, nil
+	}
+	client, err := l.connect(l.ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.client = client
+	return client, nil
+}
+
+// close closes the connection, if it was ever made.
+func (l *lazyDagger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client != nil {
+		l.client.Close()
+		l.client = nil
+	}
+}
+
+// daggerClient returns the Dagger client of the server, connecting to the engine if it's the first tool needing it.
+func daggerClient(ctx context.Context) (*dagger.Client, error) {
+	dag, ok := ctx.Value(daggerClientKey{}).(*lazyDagger)
+	if !ok {
+		return nil, fmt.Errorf("dagger client not found in context")
+	}
+	return dag.get()
+}
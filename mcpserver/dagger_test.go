@@ -0,0 +1,28 @@
+package mcpserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"dagger.io/dagger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazyDaggerRetriesFailedConnections(t *testing.T) {
+	attempts := 0
+	dag := newLazyDagger(context.Background(), func(context.Context) (*dagger.Client, error) {
+		attempts++
+		return nil, errors.New("engine not running")
+	})
+	assert.Equal(t, 0, attempts, "must not connect before a tool needs it")
+
+	ctx := context.WithValue(context.Background(), daggerClientKey{}, dag)
+	for range 2 {
+		_, err := daggerClient(ctx)
+		require.ErrorContains(t, err, "engine not running")
+	}
+	assert.Equal(t, 2, attempts)
+	dag.close()
+}
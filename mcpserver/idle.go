@@ -0,0 +1,53 @@
+package mcpserver
+
+import (
+	"sync"
+	"time"
+)
+
+// idleTimer calls onIdle once no tool call has been running for the timeout.
+// A nil idleTimer does nothing, so tools can always report their activity.
+type idleTimer struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	running int
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	return &idleTimer{
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, onIdle),
+	}
+}
+
+// callStarted pauses the timer for the duration of a tool call, however long it takes.
+func (t *idleTimer) callStarted() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running++
+	t.timer.Stop()
+}
+
+// callFinished restarts the timer once no tool call is running anymore.
+func (t *idleTimer) callFinished() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	if t.running == 0 {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.timer.Stop()
+}
@@ -0,0 +1,60 @@
+package mcpserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleTimer(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	t.Run("cancels_when_idle", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		timer := newIdleTimer(timeout, cancel)
+		defer timer.stop()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * timeout):
+			t.Fatal("server context wasn't canceled after the idle timeout")
+		}
+	})
+
+	t.Run("tool_calls_keep_it_alive", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		timer := newIdleTimer(timeout, cancel)
+		defer timer.stop()
+
+		// A long-running call isn't interrupted
+		timer.callStarted()
+		time.Sleep(2 * timeout)
+		assert.NoError(t, ctx.Err())
+		timer.callFinished()
+
+		// Calls in quick succession keep resetting the timer
+		for range 4 {
+			time.Sleep(timeout / 2)
+			timer.callStarted()
+			timer.callFinished()
+		}
+		assert.NoError(t, ctx.Err())
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * timeout):
+			t.Fatal("server context wasn't canceled after the idle timeout")
+		}
+	})
+
+	t.Run("nil_timer_does_nothing", func(t *testing.T) {
+		var timer *idleTimer
+		timer.callStarted()
+		timer.callFinished()
+		timer.stop()
+	})
+}
@@ -0,0 +1,31 @@
+package mcpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// ErrReadOnly is returned by the tools changing environments that are read-only.
+var ErrReadOnly = errors.New("environment is read-only")
+
+// readOnlySessionKey marks the tool calls of a server whose session makes every environment read-only,
+// whatever its configuration.
+type readOnlySessionKey struct{}
+
+// isReadOnly reports whether the tools must leave env unchanged: files can be read and listed, and commands run
+// with their changes discarded, but nothing else.
+func isReadOnly(ctx context.Context, env *environment.EnvironmentInfo) bool {
+	readOnlySession, _ := ctx.Value(readOnlySessionKey{}).(bool)
+	return readOnlySession || env.State.Config.ReadOnly
+}
+
+// checkWritable refuses the operation, such as writing files, if env is read-only.
+func checkWritable(ctx context.Context, env *environment.EnvironmentInfo, operation string) error {
+	if !isReadOnly(ctx, env) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not allowed. Files can only be read and listed, and commands run without their changes being kept", ErrReadOnly, operation)
+}
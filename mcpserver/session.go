@@ -0,0 +1,140 @@
+package mcpserver
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/metrics"
+	"github.com/dagger/container-use/repository"
+)
+
+// sessionKey holds the environments used by the server in the context of its tools.
+type sessionKey struct{}
+
+// session tracks the environments a server used.
+type session struct {
+	// used are the environments used since the server started, counted by metrics.EnvironmentsUsed.
+	used *environmentSet
+	// deferred are the environments used during the session that defer their commits
+	// (per-session commit granularity), so their changes are committed when the session ends.
+	deferred *environmentTracker
+}
+
+func newSession() *session {
+	return &session{
+		used:     &environmentSet{keys: map[string]bool{}, repos: map[string]*repository.Repository{}},
+		deferred: &environmentTracker{envs: map[string]trackedEnvironment{}},
+	}
+}
+
+// trackEnvironment records that the server of the tool called with ctx used env.
+func trackEnvironment(ctx context.Context, repo *repository.Repository, env *environment.Environment) {
+	session, ok := ctx.Value(sessionKey{}).(*session)
+	if !ok {
+		return
+	}
+	session.deferred.track(repo, env)
+	session.used.add(repo, env)
+}
+
+// renameTrackedEnvironment keeps tracking an environment of the server of the tool called with ctx after its ID changed.
+func renameTrackedEnvironment(ctx context.Context, repo *repository.Repository, id, newID string) {
+	session, ok := ctx.Value(sessionKey{}).(*session)
+	if !ok {
+		return
+	}
+	session.deferred.rename(repo, id, newID)
+}
+
+type environmentSet struct {
+	mu    sync.Mutex
+	keys  map[string]bool
+	repos map[string]*repository.Repository
+}
+
+func (s *environmentSet) add(repo *repository.Repository, env *environment.Environment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := repo.SourcePath() + "/" + env.ID
+	if !s.keys[key] {
+		s.keys[key] = true
+		metrics.EnvironmentsUsed.Inc("")
+	}
+	s.repos[repo.SourcePath()] = repo
+}
+
+// repositories returns the repositories of the environments used since the server started.
+func (s *environmentSet) repositories() []*repository.Repository {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Collect(maps.Values(s.repos))
+}
+
+// stopPausedServices stops the services the server runs for the environments it used once they're paused, usually
+// by the user from the command line, checking every interval until ctx is done.
+func stopPausedServices(ctx context.Context, used *environmentSet, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, repo := range used.repositories() {
+				if err := repo.StopPausedServices(ctx); err != nil {
+					slog.Warn("Failed to stop the services of paused environments", "repo", repo.SourcePath(), "err", err)
+				}
+			}
+		}
+	}
+}
+
+type trackedEnvironment struct {
+	repo *repository.Repository
+	id   string
+}
+
+type environmentTracker struct {
+	mu   sync.Mutex
+	envs map[string]trackedEnvironment
+}
+
+func (t *environmentTracker) track(repo *repository.Repository, env *environment.Environment) {
+	if env.State.Config.CommitGranularity != environment.CommitPerSession {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.envs[repo.SourcePath()+"/"+env.ID] = trackedEnvironment{repo: repo, id: env.ID}
+}
+
+// rename keeps tracking an environment after its ID changed.
+func (t *environmentTracker) rename(repo *repository.Repository, id, newID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := repo.SourcePath() + "/" + id
+	if _, ok := t.envs[key]; !ok {
+		return
+	}
+	delete(t.envs, key)
+	t.envs[repo.SourcePath()+"/"+newID] = trackedEnvironment{repo: repo, id: newID}
+}
+
+// flush commits the deferred changes of all tracked environments.
+func (t *environmentTracker) flush(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, tracked := range t.envs {
+		if err := tracked.repo.Flush(ctx, tracked.id); err != nil {
+			slog.Error("Failed to commit session changes", "environment.id", tracked.id, "repo", tracked.repo.SourcePath(), "err", err)
+			continue
+		}
+		delete(t.envs, key)
+	}
+}
@@ -0,0 +1,208 @@
+package mcpserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// methodNotificationCancelled is sent by clients to cancel a request, e.g. when the user interrupts a tool call.
+const methodNotificationCancelled = "notifications/cancelled"
+
+// errCancelledByClient is the cause of the cancellation of the context of tool calls the client cancelled.
+var errCancelledByClient = errors.New("cancelled by the client")
+
+// stdioTransport serves an MCP server on stdio like server.StdioServer, except that tool calls run in the background,
+// one at a time in the order they're received: server.StdioServer handles messages one after the other, so it would
+// only read the cancellation of a tool call once the call is over. The context of a tool call the client cancels is
+// canceled, and no response is sent for it, as the client ignores it.
+type stdioTransport struct {
+	server *server.MCPServer
+
+	mu sync.Mutex
+	// calls cancel the context of the running and queued tool calls, by request ID
+	calls map[string]context.CancelCauseFunc
+}
+
+func newStdioTransport(s *server.MCPServer) *stdioTransport {
+	t := &stdioTransport{
+		server: s,
+		calls:  map[string]context.CancelCauseFunc{},
+	}
+	s.AddNotificationHandler(methodNotificationCancelled, t.handleCancelled)
+	return t
+}
+
+// requestKey identifies a request by its ID, a number or a string.
+func requestKey(id any) string {
+	key, _ := json.Marshal(id)
+	return string(key)
+}
+
+func (t *stdioTransport) handleCancelled(ctx context.Context, notification mcp.JSONRPCNotification) {
+	id, ok := notification.Params.AdditionalFields["requestId"]
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	cancel, ok := t.calls[requestKey(id)]
+	t.mu.Unlock()
+	if !ok {
+		// The call is over already
+		return
+	}
+	slog.Info("Tool call cancelled by the client", "id", id, "reason", notification.Params.AdditionalFields["reason"])
+	cancel(errCancelledByClient)
+}
+
+// Listen serves the MCP server with the messages read from stdin, until stdin is closed or ctx is done. It returns
+// once the tool calls received are over.
+func (t *stdioTransport) Listen(ctx context.Context, stdin io.Reader, stdout io.Writer) error {
+	session := &stdioSession{notifications: make(chan mcp.JSONRPCNotification, 100)}
+	if err := t.server.RegisterSession(ctx, session); err != nil {
+		return fmt.Errorf("register session: %w", err)
+	}
+	defer t.server.UnregisterSession(ctx, session.SessionID())
+	ctx = t.server.WithContext(ctx, session)
+
+	out := &messageWriter{w: stdout}
+	go func() {
+		for {
+			select {
+			case notification := <-session.notifications:
+				if err := out.write(notification); err != nil {
+					slog.Error("Failed to write notification", "err", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	lines := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(stdin)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Each tool call waits for the previous one to be over
+	previousCall := make(chan struct{})
+	close(previousCall)
+	defer func() { <-previousCall }()
+
+	for {
+		var line []byte
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case line = <-lines:
+		}
+
+		var request struct {
+			ID     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		if err := json.Unmarshal(line, &request); err != nil || request.ID == nil || request.Method != string(mcp.MethodToolsCall) {
+			// Invalid messages are reported by the server
+			if response := t.server.HandleMessage(ctx, line); response != nil {
+				if err := out.write(response); err != nil {
+					return fmt.Errorf("failed to write response: %w", err)
+				}
+			}
+			continue
+		}
+
+		key := requestKey(request.ID)
+		callCtx, cancel := context.WithCancelCause(ctx)
+		t.mu.Lock()
+		t.calls[key] = cancel
+		t.mu.Unlock()
+
+		wait, done := previousCall, make(chan struct{})
+		previousCall = done
+		go func() {
+			defer close(done)
+			<-wait
+			response := t.server.HandleMessage(callCtx, line)
+
+			t.mu.Lock()
+			delete(t.calls, key)
+			t.mu.Unlock()
+			cancelled := errors.Is(context.Cause(callCtx), errCancelledByClient)
+			cancel(nil)
+			if cancelled || response == nil {
+				return
+			}
+			if err := out.write(response); err != nil {
+				slog.Error("Failed to write response", "err", err)
+			}
+		}()
+	}
+}
+
+// messageWriter writes JSON-RPC messages, one per line, from concurrent tool calls.
+type messageWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *messageWriter) write(message mcp.JSONRPCMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = fmt.Fprintf(w.w, "%s\n", data)
+	return err
+}
+
+// stdioSession is the single client session of the stdio transport.
+type stdioSession struct {
+	notifications chan mcp.JSONRPCNotification
+	initialized   atomic.Bool
+}
+
+var _ server.ClientSession = (*stdioSession)(nil)
+
+func (s *stdioSession) SessionID() string {
+	return "stdio"
+}
+
+func (s *stdioSession) NotificationChannel() chan<- mcp.JSONRPCNotification {
+	return s.notifications
+}
+
+func (s *stdioSession) Initialize() {
+	s.initialized.Store(true)
+}
+
+func (s *stdioSession) Initialized() bool {
+	return s.initialized.Load()
+}
@@ -0,0 +1,83 @@
+package mcpserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdioTransportCancelsToolCalls(t *testing.T) {
+	s := server.NewMCPServer("test", "1.0.0")
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	s.AddTool(mcp.NewTool("block"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return mcp.NewToolResultText("interrupted"), nil
+	})
+	s.AddTool(mcp.NewTool("echo"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText("echo"), nil
+	})
+
+	stdin, clientOut := io.Pipe()
+	clientIn, stdout := io.Pipe()
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- newStdioTransport(s).Listen(context.Background(), stdin, stdout)
+	}()
+	send := func(message string) {
+		t.Helper()
+		_, err := fmt.Fprintln(clientOut, message)
+		require.NoError(t, err)
+	}
+	responses := bufio.NewScanner(clientIn)
+	receive := func() map[string]any {
+		t.Helper()
+		require.True(t, responses.Scan(), "no response")
+		var response map[string]any
+		require.NoError(t, json.Unmarshal(responses.Bytes(), &response))
+		return response
+	}
+
+	send(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"block"}}`)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tool call didn't start")
+	}
+
+	// Messages are handled while the tool call runs, the cancellation included
+	send(`{"jsonrpc":"2.0","id":2,"method":"ping"}`)
+	assert.EqualValues(t, 2, receive()["id"])
+	send(`{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":1,"reason":"interrupted by the user"}}`)
+	select {
+	case err := <-stopped:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context of the cancelled tool call wasn't canceled")
+	}
+
+	// Cancelled tool calls get no response, the next ones do
+	send(`{"jsonrpc":"2.0","id":"next","method":"tools/call","params":{"name":"echo"}}`)
+	response := receive()
+	assert.Equal(t, "next", response["id"])
+	assert.Contains(t, fmt.Sprint(response["result"]), "echo")
+
+	require.NoError(t, clientOut.Close())
+	select {
+	case err := <-listenErr:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transport didn't stop once stdin was closed")
+	}
+}
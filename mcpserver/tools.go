@@ -6,14 +6,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/metrics"
 	"github.com/dagger/container-use/repository"
 	"github.com/dagger/container-use/rules"
 	"github.com/mark3labs/mcp-go/mcp"
@@ -43,48 +48,120 @@ func openEnvironment(ctx context.Context, request mcp.CallToolRequest) (*reposit
 	if err != nil {
 		return nil, nil, err
 	}
-	dag, ok := ctx.Value(daggerClientKey{}).(*dagger.Client)
-	if !ok {
-		return nil, nil, fmt.Errorf("dagger client not found in context")
+	dag, err := daggerClient(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
 	env, err := repo.Get(ctx, dag, envID)
 	if err != nil {
+		if errors.Is(err, repository.ErrEnvironmentNotFound) {
+			return nil, nil, fmt.Errorf("unable to get environment: %w. Use environment_list to find existing environments or environment_create to create a new one", err)
+		}
 		return nil, nil, fmt.Errorf("unable to get environment: %w", err)
 	}
+	trackEnvironment(ctx, repo, env)
 	return repo, env, nil
 }
 
+// serviceReapInterval is how often environments are checked for idle services, and for services to stop
+// because the environment was paused.
+const serviceReapInterval = 30 * time.Second
+
 type Tool struct {
 	Definition mcp.Tool
 	Handler    server.ToolHandlerFunc
 }
 
-func RunStdioServer(ctx context.Context, dag *dagger.Client) error {
+// ServerOptions configures the behavior of the MCP server.
+type ServerOptions struct {
+	// MaxConcurrentBuilds limits how many environment builds can run at the
+	// same time for a given repository. Zero means unlimited.
+	MaxConcurrentBuilds int
+	// IdleTimeout shuts the server down when no tool is called for this long,
+	// e.g. because the agent that started it is gone. Zero means never.
+	IdleTimeout time.Duration
+	// MetricsAddr is the address to serve metrics on at /metrics, in the Prometheus format. Empty means not served.
+	MetricsAddr string
+	// ReadOnly makes every environment read-only for the session, e.g. for code review agents.
+	ReadOnly bool
+}
+
+// RunStdioServer serves the tools on stdio. The server only connects to the Dagger engine with connect once a tool
+// needs it, so the tools only using git work without an engine running.
+func RunStdioServer(ctx context.Context, connect DaggerConnector, opts ServerOptions) error {
+	builds := newBuildLimiters(opts.MaxConcurrentBuilds)
+	session := newSession()
+	dag := newLazyDagger(ctx, connect)
+	defer dag.close()
+
 	s := server.NewMCPServer(
 		"Dagger",
 		"1.0.0",
 		server.WithInstructions(rules.AgentRules),
 	)
 
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, os.Kill, syscall.SIGTERM)
+	defer cancel()
+
+	// activity shuts the server down once it's left idle, if configured with an idle timeout
+	var activity *idleTimer
+	if opts.IdleTimeout > 0 {
+		activity = newIdleTimer(opts.IdleTimeout, func() {
+			slog.Info("No tool called recently, shutting down", "idle-timeout", opts.IdleTimeout)
+			cancel()
+		})
+		defer activity.stop()
+	}
+
 	for _, t := range tools {
-		s.AddTool(t.Definition, wrapToolWithClient(t, dag).Handler)
+		s.AddTool(t.Definition, wrapToolWithClient(t, dag, builds, session, activity, opts.ReadOnly).Handler)
 	}
 
 	slog.Info("starting server")
 
-	stdioSrv := server.NewStdioServer(s)
-	stdioSrv.SetErrorLogger(log.Default()) // this should re-use our `slog` handler
+	stdioSrv := newStdioTransport(s)
 
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, os.Kill, syscall.SIGTERM)
-	defer cancel()
+	if opts.MetricsAddr != "" {
+		stop, err := serveMetrics(opts.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	go environment.ReapIdleServices(ctx, serviceReapInterval)
+	go stopPausedServices(ctx, session.used, serviceReapInterval)
 
 	err := stdioSrv.Listen(ctx, os.Stdin, os.Stdout)
+	// The session is over, commit the changes environments deferred until then
+	session.deferred.flush(context.WithoutCancel(ctx))
+	if err := repository.FlushNotes(context.WithoutCancel(ctx)); err != nil {
+		slog.Error("Failed to propagate git notes", "err", err)
+	}
 	if err != nil && !errors.Is(err, context.Canceled) {
 		return err
 	}
 	return nil
 }
 
+// serveMetrics serves the metrics on addr in the background, until the returned function is called.
+func serveMetrics(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "addr", addr, "err", err)
+		}
+	}()
+	slog.Info("serving metrics", "addr", listener.Addr().String())
+	return func() { srv.Close() }, nil
+}
+
 var tools = []*Tool{}
 
 func Tools() []*Tool {
@@ -102,11 +179,15 @@ func wrapTool(tool *Tool) *Tool {
 		Definition: tool.Definition,
 		Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 			slog.Info("Tool called", "tool", tool.Definition.Name)
+			start := time.Now()
 			defer func() {
+				metrics.ToolDuration.Observe(tool.Definition.Name, time.Since(start).Seconds())
 				slog.Info("Tool finished", "tool", tool.Definition.Name)
 			}()
+			metrics.ToolCalls.Inc(tool.Definition.Name)
 			response, err := tool.Handler(ctx, request)
 			if err != nil {
+				metrics.ToolErrors.Inc(tool.Definition.Name)
 				return mcp.NewToolResultError(err.Error()), nil
 			}
 			return response, nil
@@ -115,11 +196,16 @@ func wrapTool(tool *Tool) *Tool {
 }
 
 // keeping this modular for now. we could move tool registration to RunStdioServer and collapse the 2 wrapTool functions.
-func wrapToolWithClient(tool *Tool, dag *dagger.Client) *Tool {
+func wrapToolWithClient(tool *Tool, dag *lazyDagger, builds *buildLimiters, session *session, activity *idleTimer, readOnly bool) *Tool {
 	return &Tool{
 		Definition: tool.Definition,
 		Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			activity.callStarted()
+			defer activity.callFinished()
 			ctx = context.WithValue(ctx, daggerClientKey{}, dag)
+			ctx = context.WithValue(ctx, buildLimitersKey{}, builds)
+			ctx = context.WithValue(ctx, sessionKey{}, session)
+			ctx = context.WithValue(ctx, readOnlySessionKey{}, readOnly)
 			return tool.Handler(ctx, request)
 		},
 	}
@@ -130,34 +216,55 @@ func init() {
 		EnvironmentOpenTool,
 		EnvironmentCreateTool,
 		EnvironmentUpdateMetadataTool,
+		EnvironmentRenameTool,
+		EnvironmentCommentTool,
 		EnvironmentConfigTool,
+		EnvironmentGetConfigTool,
+		EnvironmentDiffTool,
+		EnvironmentChangedFilesTool,
 
 		EnvironmentRunCmdTool,
+		EnvironmentWaitTool,
 
 		EnvironmentFileReadTool,
 		EnvironmentFileListTool,
 		EnvironmentFileWriteTool,
+		EnvironmentFileWriteBatchTool,
 		EnvironmentFileDeleteTool,
 
 		EnvironmentAddServiceTool,
 
+		EnvironmentFlushTool,
 		EnvironmentCheckpointTool,
 	)
 }
 
+// EnvironmentResponseSchemaVersion is the version of the JSON format of EnvironmentResponse. It's incremented whenever
+// a field is removed, renamed or changes meaning, not when fields are added: integrators should ignore unknown fields,
+// and can tell responses without schema_version, from before it was introduced, by its zero value.
+const EnvironmentResponseSchemaVersion = 1
+
+// EnvironmentResponse describes an environment in the responses of the tools creating, opening or changing environments.
 type EnvironmentResponse struct {
-	ID              string                         `json:"id"`
-	Title           string                         `json:"title"`
-	Config          *environment.EnvironmentConfig `json:"config"`
-	RemoteRef       string                         `json:"remote_ref"`
-	CheckoutCommand string                         `json:"checkout_command_to_share_with_user"`
-	LogCommand      string                         `json:"log_command_to_share_with_user"`
-	DiffCommand     string                         `json:"diff_command_to_share_with_user"`
-	Services        []*environment.Service         `json:"services,omitempty"`
+	// SchemaVersion is EnvironmentResponseSchemaVersion
+	SchemaVersion int    `json:"schema_version"`
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	// Config is the configuration of the environment
+	Config *environment.EnvironmentConfig `json:"config"`
+	// RemoteRef is the branch of the environment in the source repository
+	RemoteRef       string `json:"remote_ref"`
+	CheckoutCommand string `json:"checkout_command_to_share_with_user"`
+	LogCommand      string `json:"log_command_to_share_with_user"`
+	DiffCommand     string `json:"diff_command_to_share_with_user"`
+	// Services are the running services of the environment, with their endpoints
+	Services    []*environment.Service `json:"services,omitempty"`
+	Attachments []string               `json:"attachments,omitempty"`
 }
 
 func environmentResponseFromEnvInfo(envInfo *environment.EnvironmentInfo) *EnvironmentResponse {
 	return &EnvironmentResponse{
+		SchemaVersion:   EnvironmentResponseSchemaVersion,
 		ID:              envInfo.ID,
 		Title:           envInfo.State.Title,
 		Config:          envInfo.State.Config,
@@ -207,17 +314,60 @@ func EnvironmentInfoToCallResult(envInfo *environment.EnvironmentInfo) (*mcp.Cal
 	return mcp.NewToolResultText(out), nil
 }
 
+// idleTimeoutNotice warns the agent that background commands will be stopped if the environment is left idle.
+func idleTimeoutNotice(env *environment.Environment) string {
+	timeout := env.State.Config.IdleTimeout()
+	if timeout == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n\nBackground commands are stopped after %s without any command run in this environment. Start them again if you need them after that.", timeout)
+}
+
+// verificationReport runs the environment's verify command, if any, and describes the outcome for the agent.
+func verificationReport(ctx context.Context, env *environment.Environment) string {
+	result, err := env.Verify(ctx)
+	if err != nil {
+		return fmt.Sprintf("\n\nVERIFICATION ERROR: unable to run the verify command: %s", err)
+	}
+	return formatVerifyResult(result)
+}
+
+func formatVerifyResult(result *environment.VerifyResult) string {
+	if result == nil {
+		return ""
+	}
+	if result.Passed() {
+		return fmt.Sprintf("\n\nVERIFICATION PASSED: `%s`", result.Command)
+	}
+	return fmt.Sprintf("\n\nVERIFICATION FAILED: `%s` exited with %d. Your last change most likely broke it, you MUST fix it before moving on.\n%s",
+		result.Command, result.ExitCode, result.Output)
+}
+
 var EnvironmentOpenTool = &Tool{
 	Definition: newEnvironmentTool(
 		"environment_open",
-		"Opens an existing environment. Return format is same as environment_create.",
+		"Opens an existing environment. Return format is same as environment_create, with the names of the files the user attached to the environment for context, if any.",
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		_, env, err := openEnvironment(ctx, request)
+		repo, env, err := openEnvironment(ctx, request)
 		if err != nil {
 			return nil, err
 		}
-		return EnvironmentToCallResult(env)
+		// Commands start the services anyway, start them now to report their endpoints.
+		// Commands report why they can't.
+		if err := env.StartServices(ctx); err != nil {
+			slog.Warn("Failed to start the services of the environment", "environment.id", env.ID, "err", err)
+		}
+		resp := environmentResponseFromEnv(env)
+		resp.Attachments, err = repo.Attachments(ctx, env.ID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list attachments: %w", err)
+		}
+		out, err := json.Marshal(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal response: %w", err)
+		}
+		return mcp.NewToolResultText(string(out)), nil
 	},
 }
 
@@ -228,8 +378,16 @@ var EnvironmentCreateTool = &Tool{
 The environment is the result of a the setups commands on top of the base image.
 Environment configuration is managed by the user via cu config commands.`,
 		mcp.WithString("title",
-			mcp.Description("Short description of the work that is happening in this environment."),
-			mcp.Required(),
+			mcp.Description("Short description of the work that is happening in this environment. Defaults to the subject of the last commit of the repository, which the environment starts from."),
+		),
+		mcp.WithString("stash",
+			mcp.Description("Git stash entry of the source repository to apply in the new environment, as a reference such as stash@{0} or a part of its message. Use it when the user wants to continue work they stashed."),
+		),
+		mcp.WithBoolean("include_uncommitted",
+			mcp.Description("Apply the uncommitted changes of the source repository, untracked files included, in the new environment. By default, the environment is created from the last committed state only."),
+		),
+		mcp.WithString("from_image",
+			mcp.Description("Image to use as the container of the new environment, e.g. the checkpoint of another environment to continue its work, instead of building it from the base image and the repository. Its workdir is taken as the source of the environment, setup and install commands aren't run. Can't be combined with stash or include_uncommitted."),
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -237,34 +395,62 @@ Environment configuration is managed by the user via cu config commands.`,
 		if err != nil {
 			return nil, err
 		}
-		title, err := request.RequireString("title")
+		dag, err := daggerClient(ctx)
 		if err != nil {
 			return nil, err
 		}
 
-		dag, ok := ctx.Value(daggerClientKey{}).(*dagger.Client)
-		if !ok {
-			return nil, fmt.Errorf("dagger client not found in context")
+		release, err := acquireBuildSlot(ctx, request, repo.SourcePath())
+		if err != nil {
+			return nil, err
 		}
+		defer release()
 
-		env, err := repo.Create(ctx, dag, title, request.GetString("explanation", ""))
+		env, err := repo.Create(withBuildProgress(ctx, request), dag, request.GetString("title", ""), request.GetString("explanation", ""), repository.CreateOptions{
+			Stash:              request.GetString("stash", ""),
+			IncludeUncommitted: request.GetBool("include_uncommitted", false),
+			FromImage:          request.GetString("from_image", ""),
+		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to create environment: %w", err)
 		}
+		trackEnvironment(ctx, repo, env)
 
 		out, err := marshalEnvironment(env)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal environment: %w", err)
 		}
 
-		dirty, status, err := repo.IsDirty(ctx)
+		if fromImage := request.GetString("from_image", ""); fromImage != "" {
+			return mcp.NewToolResultText(fmt.Sprintf(`%s
+
+NOTE: The source of this environment is the workdir of %s, not the repository: the first commit of the environment records how it differs from the last commit of the repository, so files missing from the image show up as deleted.`, out, fromImage)), nil
+		}
+
+		empty, err := repo.IsEmpty(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("unable to check if environment is dirty: %w", err)
+			return nil, fmt.Errorf("unable to check if the repository has commits: %w", err)
 		}
+		if empty {
+			included := "None of the files of the repository are included in this environment: to include them, ask for the environment to be created again with include_uncommitted."
+			if request.GetBool("include_uncommitted", false) {
+				included = "The files of the repository are included in this environment on top of that commit."
+			}
+			return mcp.NewToolResultText(fmt.Sprintf(`%s
 
-		if !dirty {
+NOTE: You MUST inform the user that the repository %s has no commits yet, so the environment was created from an empty initial commit. %s Merging the environment will make that initial commit the first commit of the repository.`, out, request.GetString("environment_source", ""), included)), nil
+		}
+
+		if request.GetBool("include_uncommitted", false) {
+			return mcp.NewToolResultText(out), nil
+		}
+		status, err := repo.IsDirty(ctx)
+		if err == nil {
 			return mcp.NewToolResultText(out), nil
 		}
+		if !errors.Is(err, repository.ErrDirtyRepo) {
+			return nil, fmt.Errorf("unable to check if environment is dirty: %w", err)
+		}
 
 		return mcp.NewToolResultText(fmt.Sprintf(`%s
 
@@ -273,7 +459,7 @@ CRITICAL: You MUST inform the user that the repository %s has uncommitted change
 Uncommitted changes detected:
 %s
 
-You MUST tell the user: To include these changes in the environment, they need to commit them first using git commands outside the environment.`, out, request.GetString("environment_source", ""), status)), nil
+You MUST tell the user: To include these changes in the environment, they need to commit them first using git commands outside the environment, or ask for the environment to be created again with include_uncommitted.`, out, request.GetString("environment_source", ""), status)), nil
 	},
 }
 
@@ -290,6 +476,9 @@ var EnvironmentUpdateMetadataTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
+		if err := checkWritable(ctx, env.EnvironmentInfo, "updating its metadata"); err != nil {
+			return nil, err
+		}
 
 		// Update title if provided
 		if title := request.GetString("title", ""); title != "" {
@@ -308,6 +497,90 @@ var EnvironmentUpdateMetadataTool = &Tool{
 	},
 }
 
+var EnvironmentRenameTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_rename",
+		"Give the environment a meaningful ID once its work is understood (e.g. `fix-login-redirect`). Its branch is renamed accordingly: use the returned commands from now on.",
+		mcp.WithString("new_id",
+			mcp.Description("The new ID of the environment: letters, digits, '.', '_' and '-'. It must not be the ID of another environment."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, err := openRepository(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		newID, err := request.RequireString("new_id")
+		if err != nil {
+			return nil, err
+		}
+		envInfo, err := repo.Info(ctx, envID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get environment: %w", err)
+		}
+		if err := checkWritable(ctx, envInfo, "renaming it"); err != nil {
+			return nil, err
+		}
+
+		if err := repo.Rename(ctx, envID, newID); err != nil {
+			if errors.Is(err, repository.ErrEnvironmentExists) {
+				return nil, fmt.Errorf("unable to rename environment: %w. Choose another ID", err)
+			}
+			return nil, fmt.Errorf("unable to rename environment: %w", err)
+		}
+		renameTrackedEnvironment(ctx, repo, envID, newID)
+
+		envInfo, err = repo.Info(ctx, newID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get environment: %w", err)
+		}
+		return EnvironmentInfoToCallResult(envInfo)
+	},
+}
+
+var EnvironmentCommentTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_comment",
+		"Add a comment to the environment's thread, shared with the user and other agents working on it: record decisions, open questions and TODOs that aren't obvious from the code. Returns the whole thread.",
+		mcp.WithString("text",
+			mcp.Description("The comment."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, err := openRepository(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+		text, err := request.RequireString("text")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := repo.AddComment(ctx, envID, "agent", text); err != nil {
+			return nil, fmt.Errorf("unable to add comment: %w", err)
+		}
+		comments, err := repo.Comments(ctx, envID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get comments: %w", err)
+		}
+		out, err := json.Marshal(comments)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
 var EnvironmentConfigTool = &Tool{
 	Definition: newEnvironmentTool(
 		"environment_config",
@@ -326,19 +599,49 @@ var EnvironmentConfigTool = &Tool{
 					"description": "Commands that should be executed on top of the base image to set up the environment. Similar to `RUN` instructions in Dockerfiles.",
 					"items":       map[string]any{"type": "string"},
 				},
+				"pre_source_files": map[string]any{
+					"type":        "array",
+					"description": "Files of the repository (e.g. `.npmrc`), relative to its root, that setup commands need: they are copied to the workdir before the setup commands run, while the rest of the source is only available after.",
+					"items":       map[string]any{"type": "string"},
+				},
+				"ignore_patterns": map[string]any{
+					"type":        "array",
+					"description": "Gitignore-style patterns (e.g. `node_modules/`, `*.pyc`) of files not to commit, such as installed dependencies the repository's .gitignore doesn't cover.",
+					"items":       map[string]any{"type": "string"},
+				},
+				"cache_dirs": map[string]any{
+					"type":        "array",
+					"description": "Directories (e.g. `/root/.cache/go-build`, `/usr/local/cargo/registry`), absolute or relative to the workdir, mounted as cache volumes when commands run: their contents persist from one command to the next, without being committed. Use them for build and package caches.",
+					"items":       map[string]any{"type": "string"},
+				},
 				"envs": map[string]any{
 					"type":        "array",
 					"description": "The environment variables to set (e.g. `[\"FOO=bar\", \"BAZ=qux\"]`).",
 					"items":       map[string]any{"type": "string"},
 				},
+				"run_as_user": map[string]any{
+					"type":        "string",
+					"description": "User (name, uid, name:group or uid:gid) that setup commands, install commands and commands run as, instead of root. It must exist in the base image.",
+				},
+				"build_args": map[string]any{
+					"type":                 "object",
+					"description":          "Build-time variables substituted into setup commands as `${NAME}` (e.g. `{\"NODE_VERSION\": \"20\"}`). Similar to `ARG` instructions in Dockerfiles, they are not set at runtime.",
+					"additionalProperties": map[string]any{"type": "string"},
+				},
 			}),
 		),
+		mcp.WithString("validate_command",
+			mcp.Description("Command run in the environment once it's rebuilt, to check the configuration works (e.g. `go version && go build ./...`). Its output is returned with the result, saving a separate environment_run_cmd."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		repo, env, err := openEnvironment(ctx, request)
 		if err != nil {
 			return nil, err
 		}
+		if err := checkWritable(ctx, env.EnvironmentInfo, "changing its configuration"); err != nil {
+			return nil, err
+		}
 
 		updatedConfig := env.State.Config.Copy()
 
@@ -358,6 +661,27 @@ var EnvironmentConfigTool = &Tool{
 			}
 		}
 
+		if preSourceFiles, ok := newConfig["pre_source_files"].([]any); ok {
+			updatedConfig.PreSourceFiles = make([]string, len(preSourceFiles))
+			for i, file := range preSourceFiles {
+				updatedConfig.PreSourceFiles[i] = file.(string)
+			}
+		}
+
+		if ignorePatterns, ok := newConfig["ignore_patterns"].([]any); ok {
+			updatedConfig.IgnorePatterns = make([]string, len(ignorePatterns))
+			for i, pattern := range ignorePatterns {
+				updatedConfig.IgnorePatterns[i] = pattern.(string)
+			}
+		}
+
+		if cacheDirs, ok := newConfig["cache_dirs"].([]any); ok {
+			updatedConfig.CacheDirs = make([]string, len(cacheDirs))
+			for i, dir := range cacheDirs {
+				updatedConfig.CacheDirs[i] = dir.(string)
+			}
+		}
+
 		if envs, ok := newConfig["envs"].([]any); ok {
 			updatedConfig.Env = make([]string, len(envs))
 			for i, env := range envs {
@@ -365,12 +689,49 @@ var EnvironmentConfigTool = &Tool{
 			}
 		}
 
-		if err := env.UpdateConfig(ctx, updatedConfig); err != nil {
-			return nil, fmt.Errorf("unable to update the environment: %w", err)
+		if runAsUser, ok := newConfig["run_as_user"].(string); ok {
+			updatedConfig.RunAsUser = runAsUser
 		}
 
-		if err := repo.Update(ctx, env, request.GetString("explanation", "")); err != nil {
-			return nil, fmt.Errorf("failed to update repository: %w", err)
+		if buildArgs, ok := newConfig["build_args"].(map[string]any); ok {
+			updatedConfig.BuildArgs = make(map[string]string, len(buildArgs))
+			for name, value := range buildArgs {
+				updatedConfig.BuildArgs[name] = fmt.Sprint(value)
+			}
+		}
+
+		release, err := acquireBuildSlot(ctx, request, repo.SourcePath())
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		changes := environment.DiffConfig(env.State.Config, updatedConfig)
+		lostInstalls := env.UnpersistedInstalls(updatedConfig)
+
+		// Rebuilding and validating are saved together, with a single export of the environment
+		validateCommand := request.GetString("validate_command", "")
+		var validateOutput string
+		var validateExitCode int
+		var validateErr error
+		err = repo.WithTransaction(ctx, func() error {
+			if err := env.UpdateConfig(withBuildProgress(ctx, request), updatedConfig); err != nil {
+				return fmt.Errorf("unable to update the environment: %w", err)
+			}
+			if err := repo.Update(ctx, env, request.GetString("explanation", "")); err != nil {
+				return fmt.Errorf("failed to update repository: %w", err)
+			}
+			if validateCommand == "" {
+				return nil
+			}
+			validateOutput, validateErr = env.Run(ctx, validateCommand, "sh", environment.RunOpts{})
+			if validateErr == nil {
+				validateExitCode = env.State.History[len(env.State.History)-1].ExitCode
+			}
+			return repo.Update(ctx, env, request.GetString("explanation", ""))
+		})
+		if err != nil {
+			return nil, err
 		}
 
 		out, err := marshalEnvironment(env)
@@ -378,28 +739,200 @@ var EnvironmentConfigTool = &Tool{
 			return nil, fmt.Errorf("failed to marshal environment: %w", err)
 		}
 
+		changesOut, err := json.Marshal(map[string]any{"changes": changes})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal config changes: %w", err)
+		}
+		summary := "The following configuration changes were applied, explain them to the user:"
+		if changes.Empty() {
+			summary = "The configuration was unchanged, the environment was only rebuilt:"
+		}
+
 		message := fmt.Sprintf(`SUCCESS: Configuration successfully applied. Environment has been restarted, all previous commands have been lost.
 IMPORTANT: The configuration changes are LOCAL to this environment.
 TELL THE USER: To make these changes persistent, they will have to run "cu config import %s"
 
 %s
-`, env.ID, out)
+%s
+
+%s
+`, env.ID, summary, changesOut, out)
+		if validateCommand != "" {
+			if validateErr != nil {
+				message += fmt.Sprintf("\nVALIDATION ERROR: unable to run `%s`: %s\n", validateCommand, validateErr)
+			} else {
+				message += fmt.Sprintf("\nOutput of `%s` (exit code %d):\n%s\n", validateCommand, validateExitCode, validateOutput)
+			}
+		}
+		if len(lostInstalls) > 0 {
+			message += fmt.Sprintf(`
+WARNING: The packages installed by these commands were lost by the rebuild, since they aren't part of the setup commands:
+- %s
+If they're still needed, add these commands to setup_commands with environment_config, rather than running them again.
+`, strings.Join(lostInstalls, "\n- "))
+		}
 
 		return mcp.NewToolResultText(message), nil
 	},
 }
 
+var EnvironmentGetConfigTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_get_config",
+		"Get the current configuration of an environment, such as base image, setup commands and environment variables. "+
+			"Secret values are never returned, only their names. Use environment_config to change the configuration.",
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, err := openRepository(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+
+		envInfo, err := repo.Info(ctx, envID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get environment: %w", err)
+		}
+
+		out, err := json.Marshal(maskSecrets(envInfo.State.Config))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal config: %w", err)
+		}
+		return mcp.NewToolResultText(string(out)), nil
+	},
+}
+
+// maxDiffSize is the size of the diff returned by environment_diff at once, the rest being fetched with an offset.
+const maxDiffSize = 64 * 1024 // 64KB
+
+var EnvironmentDiffTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_diff",
+		"Get the unified diff of all the changes made in an environment, to present them to the user for review. "+
+			"Large diffs are returned in parts: call the tool again with the offset given at the end of the output to get the rest.",
+		mcp.WithString("path",
+			mcp.Description("Only show the changes to this file or directory, relative to the repository root."),
+		),
+		mcp.WithNumber("offset",
+			mcp.Description("Byte offset in the diff to start from, to get the part following a truncated output. Defaults to 0."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, err := openRepository(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+
+		var paths []string
+		if path := request.GetString("path", ""); path != "" {
+			paths = append(paths, path)
+		}
+		var diff strings.Builder
+		if err := repo.Diff(ctx, envID, &diff, paths...); err != nil {
+			return nil, fmt.Errorf("unable to get the diff of the environment: %w", err)
+		}
+		if diff.Len() == 0 {
+			return mcp.NewToolResultText("No changes."), nil
+		}
+
+		out := diff.String()
+		offset := request.GetInt("offset", 0)
+		if offset < 0 || offset >= len(out) {
+			return nil, fmt.Errorf("offset %d is out of the diff, which is %d bytes", offset, len(out))
+		}
+		part := out[offset:]
+		if len(part) <= maxDiffSize {
+			return mcp.NewToolResultText(part), nil
+		}
+		part = part[:maxDiffSize]
+		// Cut at the end of a line, unless a single line doesn't fit
+		if i := strings.LastIndexByte(part, '\n'); i >= 0 {
+			part = part[:i+1]
+		}
+		next := offset + len(part)
+		return mcp.NewToolResultText(fmt.Sprintf("%s\n[diff truncated at byte %d of %d; call environment_diff with offset %d to get the rest]", part, next, len(out), next)), nil
+	},
+}
+
+var EnvironmentChangedFilesTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_changed_files",
+		"List the files changed in an environment, relative to the repository root, without their diff. "+
+			"Use it to summarize the work concisely or to get an overview before environment_diff.",
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, err := openRepository(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		envID, err := request.RequireString("environment_id")
+		if err != nil {
+			return nil, err
+		}
+
+		files, err := repo.ChangedFiles(ctx, envID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list the changed files of the environment: %w", err)
+		}
+		if len(files) == 0 {
+			return mcp.NewToolResultText("No changes."), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("%d changed files:\n%s", len(files), strings.Join(files, "\n"))), nil
+	},
+}
+
+// maskSecrets returns a copy of config with secrets reduced to their names,
+// so secret references don't leak to the agent.
+func maskSecrets(config *environment.EnvironmentConfig) *environment.EnvironmentConfig {
+	masked := config.Copy()
+	masked.Secrets = masked.Secrets.Keys()
+	for _, svc := range masked.Services {
+		svc.Secrets = environment.KVList(svc.Secrets).Keys()
+	}
+	return masked
+}
+
 var EnvironmentListTool = &Tool{
 	Definition: newRepositoryTool(
 		"environment_list",
-		"List available environments",
+		"List available environments, most recently updated first.",
+		mcp.WithNumber("limit",
+			mcp.Description("Maximum number of environments to return. Defaults to all environments."),
+		),
+		mcp.WithNumber("offset",
+			mcp.Description("Number of environments to skip, for paging through results."),
+		),
+		mcp.WithString("filter",
+			mcp.Description("Only return environments whose title contains this text (case insensitive)."),
+		),
+		mcp.WithString("since",
+			mcp.Description("Only return environments updated since this time: a duration (e.g. 24h), an RFC 3339 timestamp or a date (YYYY-MM-DD)."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		repo, err := openRepository(ctx, request)
 		if err != nil {
 			return nil, err
 		}
-		envInfos, err := repo.List(ctx)
+		opts := repository.ListOptions{
+			Limit:         request.GetInt("limit", 0),
+			Offset:        request.GetInt("offset", 0),
+			TitleContains: request.GetString("filter", ""),
+		}
+		if since := request.GetString("since", ""); since != "" {
+			opts.UpdatedSince, err = repository.ParseUpdatedSince(since)
+			if err != nil {
+				return nil, err
+			}
+		}
+		envInfos, err := repo.List(ctx, opts)
 		if err != nil {
 			return nil, fmt.Errorf("invalid source: %w", err)
 		}
@@ -441,6 +974,20 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 			mcp.Description("Ports to expose. Only works with background environments. For each port, returns the environment_internal (for use inside environments) and host_external (for use by the user) addresses."),
 			mcp.Items(map[string]any{"type": "number"}),
 		),
+		mcp.WithArray("inherit_host_env",
+			mcp.Description("Names of environment variables from the user's machine to pass to the command (e.g. `[\"GH_TOKEN\"]`). Their current values are only visible to this command and are never saved in the environment."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithString("user",
+			mcp.Description("Run the command as this user (name, uid, name:group or uid:gid) instead of the environment's default user, e.g. to test permission-sensitive code. Files created or modified by the command will be owned by this user."),
+		),
+		mcp.WithBoolean("cache",
+			mcp.Description("Set ONLY for read-only commands (e.g. `ls`, `cat config.json`): changes they make to the container are discarded, and running the same command again while the environment is unchanged returns the previous output without running it. Not supported for background commands."),
+		),
+		mcp.WithArray("capture_files",
+			mcp.Description("Paths of files the command creates or modifies (e.g. a test report or a coverage file), relative to the workdir or absolute. Their contents after the command ran are returned along with its output, saving a separate read. Binary files aren't captured and large ones are truncated. Not supported for background commands."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		repo, env, err := openEnvironment(ctx, request)
@@ -450,6 +997,13 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 
 		command := request.GetString("command", "")
 		shell := request.GetString("shell", "sh")
+		opts := environment.RunOpts{
+			UseEntrypoint:  request.GetBool("use_entrypoint", false),
+			InheritHostEnv: request.GetStringSlice("inherit_host_env", []string{}),
+			User:           request.GetString("user", ""),
+			Cache:          request.GetBool("cache", false),
+			CaptureFiles:   request.GetStringSlice("capture_files", []string{}),
+		}
 
 		updateRepo := func() error {
 			if err := repo.Update(ctx, env, request.GetString("explanation", "")); err != nil {
@@ -460,13 +1014,16 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 
 		background := request.GetBool("background", false)
 		if background {
+			if err := checkWritable(ctx, env.EnvironmentInfo, "running commands in the background"); err != nil {
+				return nil, err
+			}
 			ports := []int{}
 			if portList, ok := request.GetArguments()["ports"].([]any); ok {
 				for _, port := range portList {
 					ports = append(ports, int(port.(float64)))
 				}
 			}
-			endpoints, runErr := env.RunBackground(ctx, command, shell, ports, request.GetBool("use_entrypoint", false))
+			endpoints, runErr := env.RunBackground(ctx, command, shell, ports, opts)
 			// We want to update the repository even if the command failed.
 			if err := updateRepo(); err != nil {
 				return nil, err
@@ -483,23 +1040,101 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 			return mcp.NewToolResultText(fmt.Sprintf(`Command started in the background in NEW container. Endpoints are %s
 
 To access from the user's machine: use host_external. To access from other commands in this environment: use environment_internal.
+To wait until a port accepts connections, use environment_wait rather than sleep.
 
 Any changes to the container workdir (%s) WILL NOT be committed to container-use/%s
 
-Background commands are unaffected by filesystem and any other kind of changes. You need to start a new command for changes to take effect.`,
-				string(out), env.State.Config.Workdir, env.ID)), nil
+Background commands are unaffected by filesystem and any other kind of changes. You need to start a new command for changes to take effect.
+The only files shared with other commands are the ones in %s: write there what you'll need to inspect from foreground commands (e.g. logs). They're never committed.%s`,
+				string(out), env.State.Config.Workdir, env.ID, environment.SharedDir, idleTimeoutNotice(env))), nil
 		}
 
-		stdout, runErr := env.Run(ctx, command, shell, request.GetBool("use_entrypoint", false))
+		// Commands of read-only environments still run, their changes discarded as for read-only commands,
+		// and nothing is recorded: the environment's history and notes are left as they are
+		readOnly := isReadOnly(ctx, env.EnvironmentInfo)
+		if readOnly {
+			opts.Cache = true
+		}
+		if output, ok := env.CachedOutput(command, shell, opts); ok {
+			return mcp.NewToolResultText(fmt.Sprintf("%s\n\nThis is the output of an identical command run earlier: it wasn't run again since the environment hasn't changed.", output)), nil
+		}
+
+		stdout, runErr := env.Run(ctx, command, shell, opts)
+		// An interrupted command left nothing to save
+		if errors.Is(runErr, environment.ErrCommandInterrupted) {
+			return nil, runErr
+		}
 		// We want to update the repository even if the command failed.
-		if err := updateRepo(); err != nil {
-			return nil, err
+		if !readOnly {
+			if err := updateRepo(); err != nil {
+				return nil, err
+			}
 		}
 		if runErr != nil {
 			return nil, fmt.Errorf("failed to run command: %w", runErr)
 		}
 
-		return mcp.NewToolResultText(fmt.Sprintf("%s\n\nAny changes to the container workdir (%s) have been committed and pushed to container-use/ remote", stdout, env.State.Config.Workdir)), nil
+		if opts.Cache {
+			return mcp.NewToolResultText(fmt.Sprintf("%s\n\nThe command was run as read-only: any changes it made to the container have been discarded.", stdout)), nil
+		}
+
+		installNotice := ""
+		if slices.Contains(env.UnpersistedInstalls(env.State.Config), command) {
+			installNotice = "\n\nNOTE: This command installed packages outside of the workdir: they will be lost when the environment is rebuilt after a configuration change. If the environment needs them, add this command to setup_commands with environment_config."
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("%s\n\nAny changes to the container workdir (%s) have been committed and pushed to container-use/ remote%s%s", stdout, env.State.Config.Workdir, verificationReport(ctx, env), installNotice)), nil
+	},
+}
+
+// defaultWaitTimeout is how long environment_wait waits for a port by default.
+const defaultWaitTimeout = 30 * time.Second
+
+var EnvironmentWaitTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_wait",
+		"Wait until a port of a command started in the background (or of a service) accepts connections. Use this instead of `sleep` after starting a server, before sending it requests.",
+		mcp.WithNumber("port",
+			mcp.Description("The port to wait for, as exposed with the `ports` of the background command. When several commands or services expose it, use endpoint instead."),
+		),
+		mcp.WithString("endpoint",
+			mcp.Description("The environment_internal endpoint to wait for (e.g. `tcp://abc123:8080`), instead of port."),
+		),
+		mcp.WithNumber("timeout",
+			mcp.Description(fmt.Sprintf("How long to wait, in seconds (default: %d).", int(defaultWaitTimeout.Seconds()))),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		_, env, err := openEnvironment(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		port := request.GetInt("port", 0)
+		host := ""
+		if endpoint := request.GetString("endpoint", ""); endpoint != "" {
+			var portString string
+			host, portString, err = net.SplitHostPort(strings.TrimPrefix(endpoint, "tcp://"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+			}
+			if port, err = strconv.Atoi(portString); err != nil {
+				return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+			}
+		}
+		if port <= 0 {
+			return nil, errors.New("either port or endpoint must be set")
+		}
+		timeout := defaultWaitTimeout
+		if seconds := request.GetFloat("timeout", 0); seconds > 0 {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+
+		start := time.Now()
+		if err := env.WaitForPort(ctx, host, port, timeout); err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Port %d is ready (waited %s).", port, time.Since(start).Round(10*time.Millisecond))), nil
 	},
 }
 
@@ -512,7 +1147,7 @@ var EnvironmentFileReadTool = &Tool{
 			mcp.Required(),
 		),
 		mcp.WithBoolean("should_read_entire_file",
-			mcp.Description("Whether to read the entire file. Defaults to false."),
+			mcp.Description("Whether to read the entire file. Large files are truncated (at 256KB by default), read the rest with a line range. Defaults to false."),
 		),
 		mcp.WithNumber("start_line_one_indexed_inclusive",
 			mcp.Description("The one-indexed line number to start reading from (inclusive)."),
@@ -520,6 +1155,9 @@ var EnvironmentFileReadTool = &Tool{
 		mcp.WithNumber("end_line_one_indexed_inclusive",
 			mcp.Description("The one-indexed line number to end reading at (inclusive)."),
 		),
+		mcp.WithBoolean("with_line_numbers",
+			mcp.Description("Prefix each line with its line number, under a header such as \"lines 40-60 of 523\". Useful to locate the lines to edit. Defaults to false."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		_, env, err := openEnvironment(ctx, request)
@@ -534,8 +1172,9 @@ var EnvironmentFileReadTool = &Tool{
 		shouldReadEntireFile := request.GetBool("should_read_entire_file", false)
 		startLineOneIndexedInclusive := request.GetInt("start_line_one_indexed_inclusive", 0)
 		endLineOneIndexedInclusive := request.GetInt("end_line_one_indexed_inclusive", 0)
+		withLineNumbers := request.GetBool("with_line_numbers", false)
 
-		fileContents, err := env.FileRead(ctx, targetFile, shouldReadEntireFile, startLineOneIndexedInclusive, endLineOneIndexedInclusive)
+		fileContents, err := env.FileRead(ctx, targetFile, shouldReadEntireFile, startLineOneIndexedInclusive, endLineOneIndexedInclusive, withLineNumbers)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read file: %w", err)
 		}
@@ -585,12 +1224,18 @@ var EnvironmentFileWriteTool = &Tool{
 			mcp.Description("Full text content of the file you want to write."),
 			mcp.Required(),
 		),
+		mcp.WithString("mode",
+			mcp.Description("Permissions of the file as an octal string (default: 0644). Use 0755 for executable scripts."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		repo, env, err := openEnvironment(ctx, request)
 		if err != nil {
 			return nil, err
 		}
+		if err := checkWritable(ctx, env.EnvironmentInfo, "writing files"); err != nil {
+			return nil, err
+		}
 
 		targetFile, err := request.RequireString("target_file")
 		if err != nil {
@@ -601,7 +1246,12 @@ var EnvironmentFileWriteTool = &Tool{
 			return nil, err
 		}
 
-		if err := env.FileWrite(ctx, request.GetString("explanation", ""), targetFile, contents); err != nil {
+		mode, err := parseFileMode(request.GetString("mode", ""))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.FileWrite(ctx, request.GetString("explanation", ""), targetFile, contents, mode); err != nil {
 			return nil, fmt.Errorf("failed to write file: %w", err)
 		}
 
@@ -609,10 +1259,106 @@ var EnvironmentFileWriteTool = &Tool{
 			return nil, fmt.Errorf("unable to update the environment: %w", err)
 		}
 
-		return mcp.NewToolResultText(fmt.Sprintf("file %s written successfully and committed to container-use/ remote", targetFile)), nil
+		return mcp.NewToolResultText(fmt.Sprintf("file %s written successfully and committed to container-use/ remote%s", targetFile, verificationReport(ctx, env))), nil
 	},
 }
 
+var EnvironmentFileWriteBatchTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_file_write_batch",
+		"Write several files at once, committed together as a single change. Prefer this over multiple environment_file_write calls when creating or updating many files, e.g. when scaffolding a project.",
+		mcp.WithArray("files",
+			mcp.Description("Files to write."),
+			mcp.Required(),
+			mcp.Items(map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"path": map[string]any{
+						"type":        "string",
+						"description": "Path of the file to write, absolute or relative to the workdir.",
+					},
+					"contents": map[string]any{
+						"type":        "string",
+						"description": "Full text content of the file.",
+					},
+					"mode": map[string]any{
+						"type":        "string",
+						"description": "Permissions of the file as an octal string (default: 0644). Use 0755 for executable scripts.",
+					},
+				},
+				"required": []string{"path", "contents"},
+			}),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, env, err := openEnvironment(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkWritable(ctx, env.EnvironmentInfo, "writing files"); err != nil {
+			return nil, err
+		}
+
+		files, err := parseFiles(request.GetArguments()["files"])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.FilesWrite(ctx, request.GetString("explanation", ""), files); err != nil {
+			return nil, fmt.Errorf("failed to write files: %w", err)
+		}
+
+		if err := repo.Update(ctx, env, request.GetString("explanation", "")); err != nil {
+			return nil, fmt.Errorf("unable to update the environment: %w", err)
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("%d files written successfully and committed to container-use/ remote%s", len(files), verificationReport(ctx, env))), nil
+	},
+}
+
+// parseFiles parses the files argument of environment_file_write_batch.
+func parseFiles(arg any) ([]environment.File, error) {
+	items, ok := arg.([]any)
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("files must be a non-empty array")
+	}
+	files := make([]environment.File, 0, len(items))
+	for i, item := range items {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("files[%d] must be an object", i)
+		}
+		path, ok := obj["path"].(string)
+		if !ok || path == "" {
+			return nil, fmt.Errorf("files[%d].path must be a non-empty string", i)
+		}
+		contents, ok := obj["contents"].(string)
+		if !ok {
+			return nil, fmt.Errorf("files[%d].contents must be a string", i)
+		}
+		modeArg, _ := obj["mode"].(string)
+		mode, err := parseFileMode(modeArg)
+		if err != nil {
+			return nil, fmt.Errorf("files[%d]: %w", i, err)
+		}
+		files = append(files, environment.File{Path: path, Contents: contents, Mode: mode})
+	}
+	return files, nil
+}
+
+// parseFileMode parses an octal permission string such as "0755". An empty string means the default mode.
+// "0000" is refused: a zero mode means the default mode to the environment, so it couldn't be honored.
+func parseFileMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return environment.DefaultFileMode, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm == 0 || perm > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q: must be an octal permission between 0001 and 0777 (e.g. 0755)", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
 var EnvironmentFileDeleteTool = &Tool{
 	Definition: newEnvironmentTool(
 		"environment_file_delete",
@@ -627,6 +1373,9 @@ var EnvironmentFileDeleteTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
+		if err := checkWritable(ctx, env.EnvironmentInfo, "deleting files"); err != nil {
+			return nil, err
+		}
 
 		targetFile, err := request.RequireString("target_file")
 		if err != nil {
@@ -641,7 +1390,24 @@ var EnvironmentFileDeleteTool = &Tool{
 			return nil, fmt.Errorf("failed to update env: %w", err)
 		}
 
-		return mcp.NewToolResultText(fmt.Sprintf("file %s deleted successfully and committed to container-use/ remote", targetFile)), nil
+		return mcp.NewToolResultText(fmt.Sprintf("file %s deleted successfully and committed to container-use/ remote%s", targetFile, verificationReport(ctx, env))), nil
+	},
+}
+
+var EnvironmentFlushTool = &Tool{
+	Definition: newEnvironmentTool(
+		"environment_flush",
+		"Commits the changes made in the environment since the last commit. Only needed when the environment is configured to commit once per session rather than after each operation, to record a meaningful milestone. Pending changes are committed automatically when the session ends.",
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, env, err := openEnvironment(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		if err := repo.Flush(ctx, env.ID); err != nil {
+			return nil, fmt.Errorf("failed to commit environment changes: %w", err)
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Changes of environment %s committed.", env.ID)), nil
 	},
 }
 
@@ -655,7 +1421,7 @@ var EnvironmentCheckpointTool = &Tool{
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		_, env, err := openEnvironment(ctx, request)
+		repo, env, err := openEnvironment(ctx, request)
 		if err != nil {
 			return nil, err
 		}
@@ -663,11 +1429,17 @@ var EnvironmentCheckpointTool = &Tool{
 		if err != nil {
 			return nil, err
 		}
+		if err := checkWritable(ctx, env.EnvironmentInfo, "checkpointing it"); err != nil {
+			return nil, err
+		}
 
 		endpoint, err := env.Checkpoint(ctx, destination)
 		if err != nil {
 			return nil, fmt.Errorf("failed to checkpoint environment: %w", err)
 		}
+		if err := repo.Update(ctx, env, request.GetString("explanation", "")); err != nil {
+			return nil, fmt.Errorf("failed to update repository: %w", err)
+		}
 		return mcp.NewToolResultText(fmt.Sprintf("Checkpoint pushed to %q. You MUST use the full content addressed (@sha256:...) reference in `docker` commands. The entrypoint is set to `sh`, keep that in mind when giving commands to the container.", endpoint)), nil
 	},
 }
@@ -707,12 +1479,20 @@ Supported schemas are:
 `),
 			mcp.Items(map[string]any{"type": "string"}),
 		),
+		mcp.WithBoolean("inject_env",
+			mcp.Description(`Set environment variables pointing at the service in the environment, so code finds it without manual wiring.
+For a service named my-db exposing port 5432, they are MY_DB_HOST=my-db, MY_DB_PORT=5432, MY_DB_URL=postgres://my-db:5432,
+and the variable commonly used for this kind of service, here DATABASE_URL. Variables already set are left as is.`),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		repo, env, err := openEnvironment(ctx, request)
 		if err != nil {
 			return nil, err
 		}
+		if err := checkWritable(ctx, env.EnvironmentInfo, "adding services"); err != nil {
+			return nil, err
+		}
 		serviceName, err := request.RequireString("name")
 		if err != nil {
 			return nil, err
@@ -739,6 +1519,8 @@ Supported schemas are:
 			ExposedPorts: ports,
 			Env:          envs,
 			Secrets:      secrets,
+		}, environment.AddServiceOpts{
+			InjectEnv: request.GetBool("inject_env", false),
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to add service: %w", err)
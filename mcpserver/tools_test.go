@@ -0,0 +1,339 @@
+package mcpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/repository"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatVerifyResult(t *testing.T) {
+	assert.Empty(t, formatVerifyResult(nil), "nothing is reported without a verify command")
+
+	passed := formatVerifyResult(&environment.VerifyResult{Command: "go build ./...", ExitCode: 0})
+	assert.Contains(t, passed, "VERIFICATION PASSED")
+
+	failed := formatVerifyResult(&environment.VerifyResult{Command: "go build ./...", ExitCode: 1, Output: "main.go:3:1: syntax error"})
+	assert.Contains(t, failed, "VERIFICATION FAILED")
+	assert.Contains(t, failed, "exited with 1")
+	assert.Contains(t, failed, "main.go:3:1: syntax error")
+}
+
+func TestParseFileMode(t *testing.T) {
+	mode, err := parseFileMode("")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), mode)
+
+	mode, err = parseFileMode("0755")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), mode)
+
+	mode, err = parseFileMode("600")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), mode)
+
+	for _, invalid := range []string{"rwxr-xr-x", "0800", "01777", "-1", "0000", "0"} {
+		_, err := parseFileMode(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseFiles(t *testing.T) {
+	files, err := parseFiles([]any{
+		map[string]any{"path": "main.go", "contents": "package main\n"},
+		map[string]any{"path": "run.sh", "contents": "#!/bin/sh\n", "mode": "0755"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []environment.File{
+		{Path: "main.go", Contents: "package main\n", Mode: 0644},
+		{Path: "run.sh", Contents: "#!/bin/sh\n", Mode: 0755},
+	}, files)
+
+	for _, invalid := range []any{
+		nil,
+		[]any{},
+		[]any{"main.go"},
+		[]any{map[string]any{"contents": "x"}},
+		[]any{map[string]any{"path": "main.go"}},
+		[]any{map[string]any{"path": "main.go", "contents": "x", "mode": "rwx"}},
+	} {
+		_, err := parseFiles(invalid)
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+// runGit runs git in dir, failing the test if it fails, and returns its trimmed output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := repository.RunGitCommand(context.Background(), dir, args...)
+	require.NoError(t, err)
+	return strings.TrimSpace(out)
+}
+
+// newToolTestRepo returns the path and the repository of a new source repo with an environment per entry of states,
+// keyed by ID, each with a commit of its own carrying its state. The container-use data is kept out of the real home
+// directory.
+func newToolTestRepo(t *testing.T, states map[string]string) (string, *repository.Repository) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	homedir.Reset()
+	t.Cleanup(homedir.Reset)
+
+	repoDir := t.TempDir()
+	runGit(t, repoDir, "init")
+	runGit(t, repoDir, "config", "user.email", "test@example.com")
+	runGit(t, repoDir, "config", "user.name", "Test User")
+	runGit(t, repoDir, "config", "commit.gpgsign", "false")
+	runGit(t, repoDir, "commit", "--allow-empty", "-m", "Initial commit")
+	repo, err := repository.Open(context.Background(), repoDir)
+	require.NoError(t, err)
+
+	for id, state := range states {
+		worktreePath, err := repo.WorktreePath(id)
+		require.NoError(t, err)
+		runGit(t, repoDir, "push", "container-use", "HEAD:refs/heads/"+id)
+		runGit(t, runGit(t, repoDir, "remote", "get-url", "container-use"), "worktree", "add", worktreePath, id)
+		runGit(t, worktreePath, "config", "user.email", "test@example.com")
+		runGit(t, worktreePath, "config", "user.name", "Test User")
+		runGit(t, worktreePath, "commit", "--allow-empty", "-m", "Work of "+id)
+		runGit(t, worktreePath, "notes", "--ref", "cu/state", "add", "-m", state)
+		runGit(t, repoDir, "fetch", "container-use", id)
+	}
+	return repoDir, repo
+}
+
+func TestEnvironmentGetConfigTool(t *testing.T) {
+	ctx := context.Background()
+	state, err := json.Marshal(&environment.State{
+		Title: "Config test",
+		Config: &environment.EnvironmentConfig{
+			BaseImage: "golang:1.24",
+			Env:       environment.KVList{"GOFLAGS=-mod=mod"},
+			Secrets:   environment.KVList{"API_KEY=op://vault/item/field"},
+			Services: environment.ServiceConfigs{
+				{Name: "db", Secrets: []string{"DB_PASSWORD=env://DB_PASSWORD"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	repoDir, _ := newToolTestRepo(t, map[string]string{"test-env": string(state)})
+
+	request := mcp.CallToolRequest{}
+	request.Params.Arguments = map[string]any{
+		"environment_source": repoDir,
+		"environment_id":     "test-env",
+	}
+	result, err := EnvironmentGetConfigTool.Handler(ctx, request)
+	require.NoError(t, err)
+	require.Len(t, result.Content, 1)
+	text := result.Content[0].(mcp.TextContent).Text
+
+	var config environment.EnvironmentConfig
+	require.NoError(t, json.Unmarshal([]byte(text), &config))
+	assert.Equal(t, "golang:1.24", config.BaseImage)
+	assert.Equal(t, environment.KVList{"GOFLAGS=-mod=mod"}, config.Env)
+	assert.Equal(t, environment.KVList{"API_KEY"}, config.Secrets)
+	assert.Equal(t, []string{"DB_PASSWORD"}, config.Services[0].Secrets)
+	assert.NotContains(t, text, "op://vault")
+	assert.NotContains(t, text, "env://DB_PASSWORD")
+}
+
+func TestEnvironmentDiffTool(t *testing.T) {
+	ctx := context.Background()
+	repoDir, repo := newToolTestRepo(t, map[string]string{"test-env": `{"title": "Diff test"}`})
+
+	// The environment's work, committed in its worktree along with its state
+	worktreePath, err := repo.WorktreePath("test-env")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(worktreePath, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(worktreePath, "large.txt"), []byte(strings.Repeat("a line of a large file\n", 5000)), 0644))
+	runGit(t, worktreePath, "add", ".")
+	runGit(t, worktreePath, "commit", "-m", "Add main")
+	runGit(t, worktreePath, "notes", "--ref", "cu/state", "add", "-m", `{"title": "Diff test"}`)
+	runGit(t, repoDir, "fetch", "container-use", "test-env")
+
+	diff := func(args map[string]any) string {
+		t.Helper()
+		request := mcp.CallToolRequest{}
+		request.Params.Arguments = map[string]any{
+			"environment_source": repoDir,
+			"environment_id":     "test-env",
+		}
+		maps.Copy(request.Params.Arguments.(map[string]any), args)
+		result, err := EnvironmentDiffTool.Handler(ctx, request)
+		require.NoError(t, err)
+		require.Len(t, result.Content, 1)
+		return result.Content[0].(mcp.TextContent).Text
+	}
+
+	text := diff(map[string]any{"path": "main.go"})
+	assert.Contains(t, text, "+func main() {}")
+	assert.NotContains(t, text, "large.txt")
+
+	// The full diff is too large, and returned in parts
+	text = diff(nil)
+	assert.Contains(t, text, "+a line of a large file\n")
+	assert.Contains(t, text, "[diff truncated at byte")
+	var offset, total int
+	_, err = fmt.Sscanf(text[strings.LastIndex(text, "[diff truncated"):], "[diff truncated at byte %d of %d", &offset, &total)
+	require.NoError(t, err)
+	rest := diff(map[string]any{"offset": offset})
+	assert.NotContains(t, rest, "[diff truncated")
+	assert.True(t, strings.HasSuffix(rest, "+func main() {}\n"))
+	assert.Equal(t, total, offset+len(rest))
+}
+
+func TestEnvironmentRenameTool(t *testing.T) {
+	ctx := context.Background()
+	repoDir, repo := newToolTestRepo(t, map[string]string{
+		"test-env":  `{"title": "Work of test-env"}`,
+		"other-env": `{"title": "Work of other-env"}`,
+	})
+
+	rename := func(id, newID string) (*mcp.CallToolResult, error) {
+		request := mcp.CallToolRequest{}
+		request.Params.Arguments = map[string]any{
+			"environment_source": repoDir,
+			"environment_id":     id,
+			"new_id":             newID,
+		}
+		return EnvironmentRenameTool.Handler(ctx, request)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		result, err := rename("test-env", "fix-login-redirect")
+		require.NoError(t, err)
+		var resp EnvironmentResponse
+		require.NoError(t, json.Unmarshal([]byte(result.Content[0].(mcp.TextContent).Text), &resp))
+		assert.Equal(t, "fix-login-redirect", resp.ID)
+		assert.Equal(t, "Work of test-env", resp.Title)
+		assert.Equal(t, "container-use checkout fix-login-redirect", resp.CheckoutCommand)
+		assert.Equal(t, "container-use log fix-login-redirect", resp.LogCommand)
+		assert.Equal(t, "container-use diff fix-login-redirect", resp.DiffCommand)
+
+		// The work moved along with the ID
+		worktreePath, err := repo.WorktreePath("fix-login-redirect")
+		require.NoError(t, err)
+		assert.Equal(t, "Work of test-env", runGit(t, worktreePath, "log", "-1", "--format=%s"))
+		assert.Equal(t, "Work of test-env", runGit(t, repoDir, "log", "-1", "--format=%s", "container-use/fix-login-redirect"))
+		_, err = repo.Info(ctx, "test-env")
+		assert.ErrorIs(t, err, repository.ErrEnvironmentNotFound)
+	})
+
+	t.Run("collision", func(t *testing.T) {
+		_, err := rename("fix-login-redirect", "other-env")
+		require.ErrorIs(t, err, repository.ErrEnvironmentExists)
+		assert.Contains(t, err.Error(), "Choose another ID")
+
+		// Neither environment was touched
+		envInfo, err := repo.Info(ctx, "fix-login-redirect")
+		require.NoError(t, err)
+		assert.Equal(t, "Work of test-env", envInfo.State.Title)
+		envInfo, err = repo.Info(ctx, "other-env")
+		require.NoError(t, err)
+		assert.Equal(t, "Work of other-env", envInfo.State.Title)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := rename("fix-login-redirect", "fix login")
+		assert.ErrorContains(t, err, `invalid environment ID "fix login"`)
+	})
+}
+
+func TestEnvironmentResponseSchema(t *testing.T) {
+	envInfo := &environment.EnvironmentInfo{
+		ID:    "fancy-mallard",
+		State: &environment.State{Title: "Fix the login redirect", Config: environment.DefaultConfig()},
+	}
+	resp := environmentResponseFromEnvInfo(envInfo)
+
+	data, err := json.Marshal(resp)
+	require.NoError(t, err)
+
+	// Integrators rely on the version and the field names of the response
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(data, &fields))
+	assert.EqualValues(t, 1, fields["schema_version"], "changing the response format must bump EnvironmentResponseSchemaVersion")
+	for _, field := range []string{"id", "title", "config", "remote_ref", "checkout_command_to_share_with_user", "log_command_to_share_with_user", "diff_command_to_share_with_user"} {
+		assert.Contains(t, fields, field)
+	}
+
+	var roundTripped EnvironmentResponse
+	require.NoError(t, json.Unmarshal(data, &roundTripped))
+	assert.Equal(t, resp, &roundTripped)
+
+	// Responses from before the schema was versioned are still parsed, with the zero version
+	var legacy EnvironmentResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"id": "fancy-mallard", "title": "Fix the login redirect"}`), &legacy))
+	assert.Equal(t, 0, legacy.SchemaVersion)
+	assert.Equal(t, "fancy-mallard", legacy.ID)
+}
+
+func TestReadOnlyEnvironments(t *testing.T) {
+	ctx := context.Background()
+	repoDir, repo := newToolTestRepo(t, map[string]string{
+		"review-env":   `{"title": "Review", "config": {"read_only": true, "command_policy": {"deny": ["^curl"]}}}`,
+		"writable-env": `{"title": "Writable"}`,
+	})
+
+	// The refusals don't need a container
+	ctx = context.WithValue(ctx, daggerClientKey{}, newLazyDagger(ctx, func(context.Context) (*dagger.Client, error) {
+		return nil, nil
+	}))
+	call := func(tool *Tool, id string, args map[string]any) error {
+		request := mcp.CallToolRequest{}
+		request.Params.Arguments = map[string]any{
+			"environment_source": repoDir,
+			"environment_id":     id,
+			"explanation":        "Test read-only environments",
+		}
+		maps.Copy(request.Params.Arguments.(map[string]any), args)
+		_, err := tool.Handler(ctx, request)
+		return err
+	}
+	mutations := map[*Tool]map[string]any{
+		EnvironmentFileWriteTool:      {"target_file": "main.go", "contents": "package main\n"},
+		EnvironmentFileWriteBatchTool: {"files": []any{map[string]any{"path": "main.go", "contents": "package main\n"}}},
+		EnvironmentFileDeleteTool:     {"target_file": "main.go"},
+		EnvironmentConfigTool:         {"config": map[string]any{"base_image": "alpine:latest"}},
+		EnvironmentAddServiceTool:     {"name": "db", "image": "postgres:16"},
+		EnvironmentRunCmdTool:         {"command": "python -m http.server", "background": true},
+		EnvironmentRenameTool:         {"new_id": "renamed-env"},
+		EnvironmentUpdateMetadataTool: {"title": "Rewritten"},
+		EnvironmentCheckpointTool:     {"destination": "registry.example.com/review:latest"},
+	}
+
+	for tool, args := range mutations {
+		err := call(tool, "review-env", args)
+		assert.ErrorIs(t, err, ErrReadOnly, tool.Definition.Name)
+	}
+
+	// Commands run in the foreground, here denied before reaching a container, leave no trace in the notes
+	worktreePath, err := repo.WorktreePath("review-env")
+	require.NoError(t, err)
+	notes := func() string {
+		return runGit(t, worktreePath, "for-each-ref", "--format=%(refname) %(objectname)", "refs/notes/cu/state", "refs/notes/cu/log")
+	}
+	before := notes()
+	err = call(EnvironmentRunCmdTool, "review-env", map[string]any{"command": "curl https://example.com"})
+	assert.ErrorIs(t, err, environment.ErrCommandDenied)
+	assert.Equal(t, before, notes())
+
+	ctx = context.WithValue(ctx, readOnlySessionKey{}, true)
+	for tool, args := range mutations {
+		err := call(tool, "writable-env", args)
+		assert.ErrorIs(t, err, ErrReadOnly, tool.Definition.Name)
+	}
+}
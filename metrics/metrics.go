@@ -0,0 +1,232 @@
+// Package metrics records the activity of container-use, such as tool calls and the duration of builds,
+// and exposes it in the Prometheus text format for operators running shared servers.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ToolCalls counts tool calls, by tool.
+	ToolCalls = newCounter("container_use_tool_calls_total", "Tool calls, by tool.", "tool")
+	// ToolErrors counts tool calls that returned an error, by tool.
+	ToolErrors = newCounter("container_use_tool_errors_total", "Tool calls that returned an error, by tool.", "tool")
+	// ToolDuration observes the duration of tool calls, by tool.
+	ToolDuration = newHistogram("container_use_tool_duration_seconds", "Duration of tool calls, by tool.", "tool")
+	// OperationErrors counts failed internal operations, by operation.
+	OperationErrors = newCounter("container_use_operation_errors_total", "Internal operations that failed, by operation.", "operation")
+	// OperationDuration observes the duration of internal operations, by operation: building environments,
+	// running commands and propagating changes to worktrees.
+	OperationDuration = newHistogram("container_use_operation_duration_seconds", "Duration of internal operations, by operation.", "operation")
+	// EnvironmentsUsed counts the environments used since the server started.
+	EnvironmentsUsed = newCounter("container_use_environments_used_total", "Environments used since the server started.", "")
+)
+
+// durationBuckets are the upper bounds of the duration histograms, in seconds: from quick file operations
+// to builds installing toolchains.
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// metric is a metric family, written along with its help and type.
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+var (
+	registry   []metric
+	registryMu sync.Mutex
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// Track records the duration of operation until the returned function is called, and a failure of operation
+// if *errp is then non-nil. It's meant to be deferred by functions with a named error result:
+//
+//	defer metrics.Track("build", &rerr)()
+func Track(operation string, errp *error) func() {
+	start := time.Now()
+	return func() {
+		OperationDuration.Observe(operation, time.Since(start).Seconds())
+		if errp != nil && *errp != nil {
+			OperationErrors.Inc(operation)
+		}
+	}
+}
+
+// Write writes all metrics in the Prometheus text exposition format, sorted by name.
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	metrics := slices.Clone(registry)
+	registryMu.Unlock()
+
+	slices.SortFunc(metrics, func(a, b metric) int { return strings.Compare(a.name(), b.name()) })
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics, to be scraped at /metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Counter is a count that only goes up, by label value.
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+// newCounter returns a counter by values of label, or a single counter if label is empty.
+func newCounter(name, help, label string) *Counter {
+	c := &Counter{family: family{metricName: name, help: help, label: label}, values: map[string]float64{}}
+	if label == "" {
+		// Exposed as 0 from the start rather than once first incremented
+		c.values[""] = 0
+	}
+	register(c)
+	return c
+}
+
+// Inc increments the counter of the label value.
+func (c *Counter) Inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value]++
+}
+
+// Value returns the counter of the label value.
+func (c *Counter) Value(value string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.header(w, "counter"); err != nil {
+		return err
+	}
+	for _, value := range slices.Sorted(maps.Keys(c.values)) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labels(value, ""), formatFloat(c.values[value])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations in durationBuckets, by label value.
+type Histogram struct {
+	family
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// buckets counts the observations of each bucket, not cumulated
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(name, help, label string) *Histogram {
+	h := &Histogram{family: family{metricName: name, help: help, label: label}, values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+// Observe records an observation for the label value.
+func (h *Histogram) Observe(value string, observation float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[value]
+	if !ok {
+		v = &histogramValue{buckets: make([]uint64, len(durationBuckets))}
+		h.values[value] = v
+	}
+	if i, _ := slices.BinarySearch(durationBuckets, observation); i < len(durationBuckets) {
+		v.buckets[i]++
+	}
+	v.count++
+	v.sum += observation
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.header(w, "histogram"); err != nil {
+		return err
+	}
+	for _, value := range slices.Sorted(maps.Keys(h.values)) {
+		v := h.values[value]
+		var cumulated uint64
+		for i, bound := range durationBuckets {
+			cumulated += v.buckets[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labels(value, formatFloat(bound)), cumulated); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.metricName, h.labels(value, "+Inf"), v.count,
+			h.metricName, h.labels(value, ""), formatFloat(v.sum),
+			h.metricName, h.labels(value, ""), v.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// family holds what every metric has: its name, its help, and the name of the label its values are by, if any.
+type family struct {
+	mu         sync.Mutex
+	metricName string
+	help       string
+	label      string
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) header(w io.Writer, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, f.help, f.metricName, kind)
+	return err
+}
+
+// labels returns the labels of a sample with the given label value, and histogram bucket bound if any.
+func (f *family) labels(value, bound string) string {
+	var labels []string
+	if f.label != "" {
+		labels = append(labels, fmt.Sprintf("%s=%s", f.label, strconv.Quote(value)))
+	}
+	if bound != "" {
+		labels = append(labels, fmt.Sprintf("le=%q", bound))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	c := newCounter("test_calls_total", "Test calls.", "tool")
+	c.Inc("environment_run_cmd")
+	c.Inc("environment_run_cmd")
+	c.Inc("environment_create")
+
+	var out strings.Builder
+	require.NoError(t, c.write(&out))
+	assert.Equal(t, `# HELP test_calls_total Test calls.
+# TYPE test_calls_total counter
+test_calls_total{tool="environment_create"} 1
+test_calls_total{tool="environment_run_cmd"} 2
+`, out.String())
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_duration_seconds", "Test durations.", "operation")
+	h.Observe("build", 0.05)
+	h.Observe("build", 3)
+	h.Observe("build", 1000)
+
+	var out strings.Builder
+	require.NoError(t, h.write(&out))
+	// Buckets are cumulative and inclusive of their bound
+	assert.Contains(t, out.String(), "# TYPE test_duration_seconds histogram\n")
+	assert.Contains(t, out.String(), `test_duration_seconds_bucket{operation="build",le="0.05"} 1`+"\n")
+	assert.Contains(t, out.String(), `test_duration_seconds_bucket{operation="build",le="2.5"} 1`+"\n")
+	assert.Contains(t, out.String(), `test_duration_seconds_bucket{operation="build",le="5"} 2`+"\n")
+	assert.Contains(t, out.String(), `test_duration_seconds_bucket{operation="build",le="600"} 2`+"\n")
+	assert.Contains(t, out.String(), `test_duration_seconds_bucket{operation="build",le="+Inf"} 3`+"\n")
+	assert.Contains(t, out.String(), `test_duration_seconds_sum{operation="build"} 1003.05`+"\n")
+	assert.Contains(t, out.String(), `test_duration_seconds_count{operation="build"} 3`+"\n")
+}
+
+func TestTrack(t *testing.T) {
+	succeed := func() (rerr error) {
+		defer Track("test_succeed", &rerr)()
+		return nil
+	}
+	fail := func() (rerr error) {
+		defer Track("test_fail", &rerr)()
+		return errors.New("failed")
+	}
+	require.NoError(t, succeed())
+	require.Error(t, fail())
+
+	assert.Zero(t, OperationErrors.Value("test_succeed"))
+	assert.Equal(t, 1.0, OperationErrors.Value("test_fail"))
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	assert.Contains(t, body, `container_use_operation_duration_seconds_count{operation="test_succeed"} 1`)
+	assert.Contains(t, body, `container_use_operation_duration_seconds_count{operation="test_fail"} 1`)
+	assert.Contains(t, body, "# TYPE container_use_environments_used_total counter\ncontainer_use_environments_used_total 0\n")
+}
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Attachments are files giving context about an environment, such as design docs or screenshots.
+// They are stored alongside the worktrees rather than in them, so they are never committed.
+
+// attachmentsPath returns the directory holding the attachments of an environment.
+func (r *Repository) attachmentsPath(id string) (string, error) {
+	return homedir.Expand(path.Join(r.basePath, "attachments", id))
+}
+
+// Attach copies the file at src to the attachments of the environment and returns its name.
+// An existing attachment with the same name is replaced.
+func (r *Repository) Attach(ctx context.Context, id, src string) (string, error) {
+	if err := r.exists(ctx, id); err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", src)
+	}
+
+	dir, err := r.attachmentsPath(id)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create attachments directory: %w", err)
+	}
+
+	name := filepath.Base(src)
+	if err := copyFile(src, filepath.Join(dir, name), info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("failed to attach %s: %w", src, err)
+	}
+	return name, nil
+}
+
+// Attachments returns the names of the files attached to the environment, sorted by name.
+func (r *Repository) Attachments(ctx context.Context, id string) ([]string, error) {
+	if err := r.exists(ctx, id); err != nil {
+		return nil, err
+	}
+	dir, err := r.attachmentsPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (r *Repository) deleteAttachments(id string) error {
+	dir, err := r.attachmentsPath(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
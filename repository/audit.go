@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// ConfigDeviation is an environment whose configuration deviates from a baseline.
+type ConfigDeviation struct {
+	*environment.EnvironmentInfo
+	Changes *environment.ConfigChanges
+}
+
+// Audit returns the environments whose configuration deviates from baseline, most recently updated first.
+func (r *Repository) Audit(ctx context.Context, baseline *environment.Baseline) ([]*ConfigDeviation, error) {
+	envs, err := r.List(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var deviations []*ConfigDeviation
+	for _, envInfo := range envs {
+		if changes := baseline.Audit(envInfo.State.Config); changes != nil {
+			deviations = append(deviations, &ConfigDeviation{EnvironmentInfo: envInfo, Changes: changes})
+		}
+	}
+	return deviations, nil
+}
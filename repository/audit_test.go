@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+
+	for id, state := range map[string]string{
+		"conforming": `{"title": "Conforming", "config": {"base_image": "python:3.11", "workdir": "/app", "setup_commands": ["pip install uv"]}}`,
+		"deviating":  `{"title": "Deviating", "config": {"base_image": "python:3.12", "workdir": "/app", "setup_commands": ["pip install uv", "apt-get install -y curl"]}}`,
+	} {
+		worktreePath, err := repo.initializeWorktree(ctx, id)
+		require.NoError(t, err)
+		for _, args := range [][]string{
+			{"config", "user.email", "test@example.com"},
+			{"config", "user.name", "Test User"},
+			{"commit", "--allow-empty", "-m", "Create " + id},
+			{"notes", "--ref", gitNotesStateRef, "add", "-m", state},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+	}
+
+	// The baseline doesn't set the workdir, which isn't audited
+	baselineFile := filepath.Join(t.TempDir(), "baseline.json")
+	require.NoError(t, os.WriteFile(baselineFile, []byte(`{"base_image": "python:3.11", "setup_commands": ["pip install uv"]}`), 0644))
+	baseline, err := environment.LoadBaseline(baselineFile)
+	require.NoError(t, err)
+
+	deviations, err := repo.Audit(ctx, baseline)
+	require.NoError(t, err)
+	require.Len(t, deviations, 1)
+	assert.Equal(t, "deviating", deviations[0].ID)
+	require.NotNil(t, deviations[0].Changes.BaseImage)
+	assert.Equal(t, "python:3.11", deviations[0].Changes.BaseImage.From)
+	assert.Equal(t, "python:3.12", deviations[0].Changes.BaseImage.To)
+	require.NotNil(t, deviations[0].Changes.SetupCommands)
+	assert.Equal(t, []string{"apt-get install -y curl"}, deviations[0].Changes.SetupCommands.Added)
+	assert.Nil(t, deviations[0].Changes.Workdir)
+}
@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// gitNotesCommentsRef is the git notes ref holding the comments of environments.
+const gitNotesCommentsRef = "cu/comments"
+
+// Comment is a remark left on an environment by a user or an agent, such as a decision or a TODO.
+type Comment struct {
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AddComment appends a comment to the thread of the environment.
+func (r *Repository) AddComment(ctx context.Context, id, author, text string) error {
+	if err := r.exists(ctx, id); err != nil {
+		return err
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.New("comment must not be empty")
+	}
+
+	anchor, err := r.commentsAnchor(ctx, id, true)
+	if err != nil {
+		return err
+	}
+	// Each comment is a line of JSON, so comments spanning several lines don't get mixed up
+	data, err := json.Marshal(Comment{Author: author, Text: text, Timestamp: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if _, err := RunGitCommand(ctx, r.forkRepoPath, "notes", "--ref", gitNotesCommentsRef, "append", "-m", string(data), anchor); err != nil {
+		return fmt.Errorf("failed to add comment: %w", err)
+	}
+	return r.propagateGitNotes(ctx, gitNotesCommentsRef)
+}
+
+// Comments returns the comments of the environment, from the oldest to the most recent.
+func (r *Repository) Comments(ctx context.Context, id string) ([]Comment, error) {
+	if err := r.exists(ctx, id); err != nil {
+		return nil, err
+	}
+
+	anchor, err := r.commentsAnchor(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := RunGitCommand(ctx, r.forkRepoPath, "notes", "--ref", gitNotesCommentsRef, "show", anchor)
+	if err != nil {
+		if strings.Contains(err.Error(), "no note found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var comments []Comment
+	for line := range strings.SplitSeq(notes, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var comment Comment
+		if err := json.Unmarshal([]byte(line), &comment); err != nil {
+			return nil, fmt.Errorf("invalid comment of environment %s: %w", id, err)
+		}
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
+
+// moveComments moves the comments of an environment to its new ID.
+func (r *Repository) moveComments(ctx context.Context, id, newID string) error {
+	anchor, err := r.commentsAnchor(ctx, id, false)
+	if err != nil {
+		return err
+	}
+	newAnchor, err := r.commentsAnchor(ctx, newID, true)
+	if err != nil {
+		return err
+	}
+	// Without comments, there's nothing to move
+	if _, err := RunGitCommand(ctx, r.forkRepoPath, "notes", "--ref", gitNotesCommentsRef, "list", anchor); err != nil {
+		return nil
+	}
+	if _, err := RunGitCommand(ctx, r.forkRepoPath, "notes", "--ref", gitNotesCommentsRef, "copy", anchor, newAnchor); err != nil {
+		return err
+	}
+	return r.deleteComments(ctx, id)
+}
+
+// deleteComments deletes the comments of an environment, so an environment later created with the same ID
+// doesn't inherit them.
+func (r *Repository) deleteComments(ctx context.Context, id string) error {
+	anchor, err := r.commentsAnchor(ctx, id, false)
+	if err != nil {
+		return err
+	}
+	// Without comments, there's nothing to delete
+	if _, err := RunGitCommand(ctx, r.forkRepoPath, "notes", "--ref", gitNotesCommentsRef, "list", anchor); err != nil {
+		return nil
+	}
+	if _, err := RunGitCommand(ctx, r.forkRepoPath, "notes", "--ref", gitNotesCommentsRef, "remove", anchor); err != nil {
+		return err
+	}
+	return r.propagateGitNotes(ctx, gitNotesCommentsRef)
+}
+
+// commentsAnchor returns the object the comments of an environment are attached to. Notes are attached to
+// objects, and the commits of an environment change as it's worked on and merged: instead, comments are
+// attached to a blob naming the environment, written to the fork with write.
+func (r *Repository) commentsAnchor(ctx context.Context, id string, write bool) (string, error) {
+	f, err := os.CreateTemp("", "cu-comments-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = fmt.Fprintf(f, "container-use environment %s\n", id)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"hash-object"}
+	if write {
+		args = append(args, "-w")
+	}
+	anchor, err := RunGitCommand(ctx, r.forkRepoPath, append(args, f.Name())...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(anchor), nil
+}
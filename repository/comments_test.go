@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComments(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+	} {
+		_, err := RunGitCommand(ctx, repo.forkRepoPath, args...)
+		require.NoError(t, err)
+	}
+	_, err = repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+
+	comments, err := repo.Comments(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Empty(t, comments)
+
+	require.NoError(t, repo.AddComment(ctx, "test-env", "Alice", "Keep the v1 API\nuntil mobile migrates"))
+	require.NoError(t, repo.AddComment(ctx, "test-env", "agent", "TODO: remove the feature flag"))
+	assert.Error(t, repo.AddComment(ctx, "test-env", "agent", " "))
+	assert.ErrorIs(t, repo.AddComment(ctx, "missing-env", "agent", "Hello"), ErrEnvironmentNotFound)
+
+	comments, err = repo.Comments(ctx, "test-env")
+	require.NoError(t, err)
+	require.Len(t, comments, 2)
+	assert.Equal(t, "Alice", comments[0].Author)
+	assert.Equal(t, "Keep the v1 API\nuntil mobile migrates", comments[0].Text)
+	assert.Equal(t, "agent", comments[1].Author)
+	assert.Equal(t, "TODO: remove the feature flag", comments[1].Text)
+	assert.False(t, comments[1].Timestamp.Before(comments[0].Timestamp))
+
+	// The comments are propagated to the source repository
+	_, err = RunGitCommand(ctx, repoDir, "rev-parse", "--verify", "refs/notes/"+gitNotesCommentsRef)
+	require.NoError(t, err)
+
+	// Comments follow the environment when it's renamed, and go away with it
+	require.NoError(t, repo.Rename(ctx, "test-env", "renamed-env"))
+	comments, err = repo.Comments(ctx, "renamed-env")
+	require.NoError(t, err)
+	assert.Len(t, comments, 2)
+
+	require.NoError(t, repo.Delete(ctx, "renamed-env"))
+	_, err = repo.initializeWorktree(ctx, "renamed-env")
+	require.NoError(t, err)
+	comments, err = repo.Comments(ctx, "renamed-env")
+	require.NoError(t, err)
+	assert.Empty(t, comments)
+}
@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// BaseImageChange is a commit of the repository that changed the base image of its environment configuration.
+type BaseImageChange struct {
+	CommitInfo
+	// From is the base image before the commit, empty if the commit added the configuration.
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// BaseImageHistory returns the commits of the current branch that changed the base image in the committed
+// environment configuration, from the most recent to the oldest.
+// A configuration without a base image, or removed, uses the default one.
+func (r *Repository) BaseImageHistory(ctx context.Context) ([]BaseImageChange, error) {
+	configFile := environment.ConfigPath("")
+	// Fields are separated by NUL and commits by RS, neither can appear in subjects
+	output, err := RunGitCommand(ctx, r.userRepoPath, "log", "--reverse",
+		"--format=%H%x00%s%x00%an%x00%ae%x00%aI%x1e",
+		"--", configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []BaseImageChange
+	var current string
+	for record := range strings.SplitSeq(output, "\x1e") {
+		record = strings.TrimPrefix(record, "\n")
+		if record == "" {
+			continue
+		}
+		fields := strings.SplitN(record, "\x00", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected git log output: %q", record)
+		}
+		timestamp, err := time.Parse(time.RFC3339, fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of commit %s: %w", fields[0], err)
+		}
+
+		baseImage, err := r.committedBaseImage(ctx, fields[0], configFile)
+		if err != nil {
+			return nil, err
+		}
+		if baseImage == current {
+			continue
+		}
+		changes = append(changes, BaseImageChange{
+			CommitInfo: CommitInfo{
+				Hash:        fields[0],
+				Subject:     fields[1],
+				Author:      fields[2],
+				AuthorEmail: fields[3],
+				Timestamp:   timestamp,
+			},
+			From: current,
+			To:   baseImage,
+		})
+		current = baseImage
+	}
+
+	// Most recent first, like History
+	slices.Reverse(changes)
+	return changes, nil
+}
+
+// committedBaseImage returns the base image set by the configuration file as of commit.
+func (r *Repository) committedBaseImage(ctx context.Context, commit, configFile string) (string, error) {
+	defaultBaseImage := environment.DefaultConfig().BaseImage
+	data, err := RunGitCommand(ctx, r.userRepoPath, "show", fmt.Sprintf("%s:%s", commit, configFile))
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist in") || strings.Contains(err.Error(), "exists on disk, but not in") {
+			// The commit removed the configuration
+			return defaultBaseImage, nil
+		}
+		return "", err
+	}
+	var config struct {
+		BaseImage string `json:"base_image"`
+	}
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return "", fmt.Errorf("invalid configuration in commit %s: %w", commit, err)
+	}
+	if config.BaseImage == "" {
+		return defaultBaseImage, nil
+	}
+	return config.BaseImage, nil
+}
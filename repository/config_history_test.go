@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseImageHistory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	git := func(args ...string) {
+		_, err := RunGitCommand(ctx, dir, args...)
+		require.NoError(t, err)
+	}
+	git("init")
+	git("config", "user.email", "test@example.com")
+	git("config", "user.name", "Test User")
+	git("config", "commit.gpgsign", "false")
+	git("commit", "--allow-empty", "-m", "Initial commit")
+	commitConfig := func(config, message string) {
+		writeFile(t, dir, ".container-use/environment.json", config)
+		git("add", ".")
+		git("commit", "-m", message)
+	}
+
+	repo := &Repository{userRepoPath: dir}
+	changes, err := repo.BaseImageHistory(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	commitConfig(`{"base_image": "node:16"}`, "Add environment configuration")
+	commitConfig(`{"base_image": "node:16", "setup_commands": ["npm ci"]}`, "Install dependencies")
+	commitConfig(`{"base_image": "node:18", "setup_commands": ["npm ci"]}`, "Switch to node 18 for fetch")
+	writeFile(t, dir, "main.js", "console.log('hi')\n")
+	git("add", ".")
+	git("commit", "-m", "Unrelated change")
+	commitConfig(`{"setup_commands": ["npm ci"]}`, "Use the default image")
+
+	changes, err = repo.BaseImageHistory(ctx)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, "Use the default image", changes[0].Subject)
+	assert.Equal(t, "node:18", changes[0].From)
+	assert.Equal(t, "ubuntu:24.04", changes[0].To)
+	assert.Equal(t, "Switch to node 18 for fetch", changes[1].Subject)
+	assert.Equal(t, "node:16", changes[1].From)
+	assert.Equal(t, "node:18", changes[1].To)
+	assert.Equal(t, "Add environment configuration", changes[2].Subject)
+	assert.Empty(t, changes[2].From)
+	assert.Equal(t, "node:16", changes[2].To)
+	assert.Equal(t, "Test User", changes[2].Author)
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Project is a kind of project found in a source tree, with the environment setup it needs.
+type Project struct {
+	// Name is the language or framework of the project, e.g. "Go".
+	Name string
+	// Marker is the file, at the root of the source tree, the project was detected from.
+	Marker string
+
+	BaseImage       string
+	SetupCommands   []string
+	InstallCommands []string
+}
+
+// projectRule detects a kind of project from its marker file, and other files refining it, e.g. lockfiles.
+type projectRule struct {
+	Project
+	// also are files which must exist along with the marker for the rule to apply.
+	also []string
+}
+
+// projectRules are checked in order: for each language, only the first matching rule is used, so the most specific
+// rules come first.
+var projectRules = []projectRule{
+	{Project: Project{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", SetupCommands: []string{"corepack enable"}, InstallCommands: []string{"pnpm install --frozen-lockfile"}}, also: []string{"pnpm-lock.yaml"}},
+	{Project: Project{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", SetupCommands: []string{"corepack enable"}, InstallCommands: []string{"yarn install --immutable"}}, also: []string{"yarn.lock"}},
+	{Project: Project{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", InstallCommands: []string{"npm ci"}}, also: []string{"package-lock.json"}},
+	{Project: Project{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", InstallCommands: []string{"npm install"}}},
+
+	{Project: Project{Name: "Python", Marker: "pyproject.toml", BaseImage: "python:3.12", SetupCommands: []string{"pip install uv"}, InstallCommands: []string{"uv sync"}}, also: []string{"uv.lock"}},
+	{Project: Project{Name: "Python", Marker: "pyproject.toml", BaseImage: "python:3.12", SetupCommands: []string{"pip install poetry"}, InstallCommands: []string{"poetry install"}}, also: []string{"poetry.lock"}},
+	{Project: Project{Name: "Python", Marker: "pyproject.toml", BaseImage: "python:3.12", InstallCommands: []string{"pip install -e ."}}},
+	{Project: Project{Name: "Python", Marker: "requirements.txt", BaseImage: "python:3.12", InstallCommands: []string{"pip install -r requirements.txt"}}},
+
+	{Project: Project{Name: "Go", Marker: "go.mod", BaseImage: "golang:1.24", InstallCommands: []string{"go mod download"}}},
+	{Project: Project{Name: "Rust", Marker: "Cargo.toml", BaseImage: "rust:1", InstallCommands: []string{"cargo fetch"}}},
+	{Project: Project{Name: "Ruby", Marker: "Gemfile", BaseImage: "ruby:3.3", InstallCommands: []string{"bundle install"}}},
+	{Project: Project{Name: "PHP", Marker: "composer.json", BaseImage: "composer:2", InstallCommands: []string{"composer install"}}},
+	{Project: Project{Name: "Java", Marker: "pom.xml", BaseImage: "maven:3-eclipse-temurin-21", InstallCommands: []string{"mvn -B dependency:go-offline"}}},
+	{Project: Project{Name: "Java", Marker: "build.gradle.kts", BaseImage: "gradle:8-jdk21", InstallCommands: []string{"gradle dependencies"}}},
+	{Project: Project{Name: "Java", Marker: "build.gradle", BaseImage: "gradle:8-jdk21", InstallCommands: []string{"gradle dependencies"}}},
+}
+
+// DetectProjects returns the kinds of projects found at the root of the source tree in dir, at most one per
+// language, in the order of projectRules. A repository may hold several, e.g. a Go backend and a Node.js frontend.
+func DetectProjects(dir string) []Project {
+	exists := func(file string) bool {
+		_, err := os.Stat(filepath.Join(dir, file))
+		return err == nil
+	}
+
+	var projects []Project
+	detected := map[string]bool{}
+rules:
+	for _, rule := range projectRules {
+		if detected[rule.Name] || !exists(rule.Marker) {
+			continue
+		}
+		for _, file := range rule.also {
+			if !exists(file) {
+				continue rules
+			}
+		}
+		detected[rule.Name] = true
+		project := rule.Project
+		project.SetupCommands = slices.Clone(project.SetupCommands)
+		project.InstallCommands = slices.Clone(project.InstallCommands)
+		projects = append(projects, project)
+	}
+	return projects
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectProjects(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		files    []string
+		expected []Project
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:  "npm lockfile",
+			files: []string{"package.json", "package-lock.json"},
+			expected: []Project{
+				{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", InstallCommands: []string{"npm ci"}},
+			},
+		},
+		{
+			name:  "pnpm lockfile",
+			files: []string{"package.json", "pnpm-lock.yaml"},
+			expected: []Project{
+				{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", SetupCommands: []string{"corepack enable"}, InstallCommands: []string{"pnpm install --frozen-lockfile"}},
+			},
+		},
+		{
+			name:  "package without lockfile",
+			files: []string{"package.json"},
+			expected: []Project{
+				{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", InstallCommands: []string{"npm install"}},
+			},
+		},
+		{
+			name:  "pyproject over requirements",
+			files: []string{"pyproject.toml", "requirements.txt"},
+			expected: []Project{
+				{Name: "Python", Marker: "pyproject.toml", BaseImage: "python:3.12", InstallCommands: []string{"pip install -e ."}},
+			},
+		},
+		{
+			name:  "go backend and node frontend",
+			files: []string{"go.mod", "package.json", "yarn.lock"},
+			expected: []Project{
+				{Name: "Node.js", Marker: "package.json", BaseImage: "node:22", SetupCommands: []string{"corepack enable"}, InstallCommands: []string{"yarn install --immutable"}},
+				{Name: "Go", Marker: "go.mod", BaseImage: "golang:1.24", InstallCommands: []string{"go mod download"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range tc.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, file), nil, 0644))
+			}
+			assert.Equal(t, tc.expected, DetectProjects(dir))
+		})
+	}
+
+	// Suggestions can be changed without affecting the next ones
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), nil, 0644))
+	DetectProjects(dir)[0].InstallCommands[0] = "changed"
+	assert.Equal(t, []string{"go mod download"}, DetectProjects(dir)[0].InstallCommands)
+}
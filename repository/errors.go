@@ -0,0 +1,32 @@
+package repository
+
+import "errors"
+
+// Errors returned by Repository operations. They are wrapped with additional
+// context, so use errors.Is to check for them.
+var (
+	// ErrEnvironmentNotFound is returned when the requested environment doesn't exist.
+	ErrEnvironmentNotFound = errors.New("environment not found")
+
+	// ErrNotInitialized is returned by OpenReadOnly when container-use hasn't set up the repository yet,
+	// i.e. no environment was ever created in it.
+	ErrNotInitialized = errors.New("container-use is not initialized in this repository")
+
+	// ErrEnvironmentExists is returned when an environment can't be given an ID another one already has.
+	ErrEnvironmentExists = errors.New("environment already exists")
+
+	// ErrNoState is returned when an environment has no state recorded in git notes,
+	// for instance because it was never saved.
+	ErrNoState = errors.New("environment has no state")
+
+	// ErrMergeConflict is returned when merging or applying an environment left conflicts
+	// in the source repository that must be resolved by hand.
+	ErrMergeConflict = errors.New("merge conflict")
+
+	// ErrDirtyRepo is returned when the source repository has uncommitted changes.
+	ErrDirtyRepo = errors.New("repository has uncommitted changes")
+
+	// ErrOutOfDiskSpace is returned when writing an environment's files to its worktree failed
+	// because the disk is full or a quota was exceeded. The partial export is rolled back.
+	ErrOutOfDiskSpace = errors.New("out of disk space writing worktree")
+)
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+)
+
+// ExecResult is the result of a command run in an environment by ExecAll.
+type ExecResult struct {
+	EnvironmentID string `json:"environment_id"`
+	ExitCode      int    `json:"exit_code"`
+	Output        string `json:"output"`
+	// Error is why the command couldn't be run in the environment, e.g. it's paused.
+	Error string `json:"error,omitempty"`
+}
+
+// Failed reports whether the command failed to run, or exited with a non-zero code.
+func (r *ExecResult) Failed() bool {
+	return r.Error != "" || r.ExitCode != 0
+}
+
+// ExecAll runs command in every environment matching opts, one after the other, and returns the result of each,
+// in the order of List. Like commands run by agents, the changes of the command are committed to the environments.
+// An environment the command can't run in doesn't stop the others: its result has the error.
+func (r *Repository) ExecAll(ctx context.Context, dag *dagger.Client, opts ListOptions, command, shell string) ([]*ExecResult, error) {
+	envInfos, err := r.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*ExecResult, 0, len(envInfos))
+	for _, envInfo := range envInfos {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		exitCode, output, err := r.exec(ctx, dag, envInfo.ID, command, shell)
+		result := &ExecResult{EnvironmentID: envInfo.ID, ExitCode: exitCode, Output: output}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// exec runs command in the environment and commits its changes, returning its exit code and output.
+func (r *Repository) exec(ctx context.Context, dag *dagger.Client, id, command, shell string) (int, string, error) {
+	env, err := r.Get(ctx, dag, id)
+	if err != nil {
+		return 0, "", err
+	}
+	output, runErr := env.Run(ctx, command, shell, environment.RunOpts{})
+	// The environment is updated even if the command failed, as it's recorded in its history
+	if err := r.Update(ctx, env, "Run "+command); err != nil {
+		return 0, output, fmt.Errorf("failed to update environment: %w", err)
+	}
+	if runErr != nil {
+		return 0, output, runErr
+	}
+	history := env.State.History
+	return history[len(history)-1].ExitCode, output, nil
+}
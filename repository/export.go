@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"dagger.io/dagger"
+)
+
+// exportedWorkdir is the last directory exported to a worktree, and the worktree HEAD once it was committed.
+type exportedWorkdir struct {
+	dir  *dagger.Directory
+	head string
+}
+
+// exportCache remembers what was last exported to each worktree, so the next export
+// only needs to write what changed since rather than the whole workdir.
+type exportCache struct {
+	mu      sync.Mutex
+	entries map[string]exportedWorkdir
+}
+
+var exportedWorkdirs = &exportCache{entries: map[string]exportedWorkdir{}}
+
+// take returns the last export to worktreePath and forgets it, so a failed export is never trusted.
+func (c *exportCache) take(worktreePath string) (exportedWorkdir, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exported, ok := c.entries[worktreePath]
+	delete(c.entries, worktreePath)
+	return exported, ok
+}
+
+func (c *exportCache) set(worktreePath string, exported exportedWorkdir) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[worktreePath] = exported
+}
+
+// advance records that the worktree at oldHead, holding the last export, was committed as newHead.
+func (c *exportCache) advance(worktreePath, oldHead, newHead string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exported, ok := c.entries[worktreePath]; ok && exported.head == oldHead {
+		exported.head = newHead
+		c.entries[worktreePath] = exported
+	}
+}
+
+func (c *exportCache) forget(worktreePath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, worktreePath)
+}
+
+// exportWorkdir writes workdir to worktreePath. If the worktree still holds the previous export,
+// only the paths that changed since are written or removed. Otherwise the worktree is wiped and
+// the whole workdir exported.
+func exportWorkdir(ctx context.Context, workdir *dagger.Directory, worktreePath string) error {
+	if prev, ok := exportedWorkdirs.take(worktreePath); ok {
+		head, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+		// The worktree was changed behind our back, we can't rely on the previous export
+		if err == nil && strings.TrimSpace(head) == prev.head {
+			err := exportChanges(ctx, prev.dir, workdir, worktreePath)
+			if err == nil {
+				return nil
+			}
+			slog.Warn("Incremental export failed, exporting the whole workdir", "worktree", worktreePath, "err", err)
+		}
+	}
+
+	_, err := workdir.Export(ctx, worktreePath, dagger.DirectoryExportOpts{Wipe: true})
+	return err
+}
+
+// exportChanges applies the changes between prev and workdir to worktreePath.
+func exportChanges(ctx context.Context, prev, workdir *dagger.Directory, worktreePath string) error {
+	// Files added or modified since prev
+	changed := prev.Diff(workdir)
+	changedPaths, err := changed.Glob(ctx, "**")
+	if err != nil {
+		return fmt.Errorf("failed to list changed files: %w", err)
+	}
+	// Files of prev that were modified or removed since
+	stalePaths, err := workdir.Diff(prev).Glob(ctx, "**")
+	if err != nil {
+		return fmt.Errorf("failed to list removed files: %w", err)
+	}
+
+	keep := make(map[string]struct{}, len(changedPaths))
+	for _, path := range changedPaths {
+		keep[strings.TrimSuffix(path, "/")] = struct{}{}
+	}
+	// Stale directories may still hold unchanged files, only stale files are removed: directories are only
+	// removed once they're gone from workdir.
+	var staleDirs []string
+	for _, path := range stalePaths {
+		path = strings.TrimSuffix(path, "/")
+		if _, ok := keep[path]; ok {
+			continue
+		}
+		worktreeFile := filepath.Join(worktreePath, filepath.FromSlash(path))
+		info, err := os.Lstat(worktreeFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			staleDirs = append(staleDirs, path)
+			continue
+		}
+		if err := os.Remove(worktreeFile); err != nil {
+			return err
+		}
+	}
+	if err := removeGoneDirs(ctx, workdir, worktreePath, staleDirs); err != nil {
+		return err
+	}
+
+	if len(changedPaths) == 0 {
+		return nil
+	}
+	_, err = changed.Export(ctx, worktreePath)
+	return err
+}
+
+// removeGoneDirs removes the directories of the worktree among dirs that no longer exist in workdir, with their contents.
+func removeGoneDirs(ctx context.Context, workdir *dagger.Directory, worktreePath string, dirs []string) error {
+	// Parents first: the parent of a directory then either exists in workdir, or is gone and was removed already
+	slices.SortFunc(dirs, func(a, b string) int {
+		return strings.Count(a, "/") - strings.Count(b, "/")
+	})
+	entries := map[string][]string{}
+	var gone []string
+	for _, dir := range dirs {
+		if slices.ContainsFunc(gone, func(g string) bool { return strings.HasPrefix(dir, g+"/") }) {
+			continue
+		}
+		parent, name := path.Split(dir)
+		parentEntries, ok := entries[parent]
+		if !ok {
+			parentDir := workdir
+			if parent != "" {
+				parentDir = workdir.Directory(parent)
+			}
+			var err error
+			if parentEntries, err = parentDir.Entries(ctx); err != nil {
+				return fmt.Errorf("failed to list %s: %w", parent, err)
+			}
+			entries[parent] = parentEntries
+		}
+		if slices.Contains(parentEntries, name) || slices.Contains(parentEntries, name+"/") {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(worktreePath, filepath.FromSlash(dir))); err != nil {
+			return err
+		}
+		gone = append(gone, dir)
+	}
+	return nil
+}
+
+// isOutOfDiskSpace reports whether an export failed because the disk is full or a quota was exceeded.
+// Errors coming from Dagger only carry the message of the original error.
+func isOutOfDiskSpace(err error) bool {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, syscall.ENOSPC.Error()) || strings.Contains(msg, syscall.EDQUOT.Error())
+}
+
+// rollbackWorktree restores the worktree to its last commit after a partial export, so it remains consistent with
+// the environment's saved state. The git pointer is written back first, as a wiping export may have removed it.
+// Files not committed yet are exported again along with the next change, since the previous export is forgotten.
+func rollbackWorktree(ctx context.Context, worktreePath, worktreePointer string) error {
+	exportedWorkdirs.forget(worktreePath)
+	if err := os.WriteFile(filepath.Join(worktreePath, ".git"), []byte(worktreePointer), 0644); err != nil {
+		return err
+	}
+	// Clean first, freeing the space taken by the partial export
+	if _, err := RunGitCommand(ctx, worktreePath, "clean", "-fdx"); err != nil {
+		return err
+	}
+	_, err := RunGitCommand(ctx, worktreePath, "reset", "--hard", "HEAD")
+	return err
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsOutOfDiskSpace(t *testing.T) {
+	assert.True(t, isOutOfDiskSpace(fmt.Errorf("export: %w", syscall.ENOSPC)))
+	assert.True(t, isOutOfDiskSpace(&os.PathError{Op: "write", Path: "/worktree/big.bin", Err: syscall.EDQUOT}))
+	// Dagger only passes the message along
+	assert.True(t, isOutOfDiskSpace(errors.New("input: directory.export failed: write /worktree/big.bin: no space left on device")))
+	assert.False(t, isOutOfDiskSpace(errors.New("permission denied")))
+}
+
+func TestRollbackWorktree(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepoWithoutCommits(t)
+	writeFile(t, repoDir, "main.go", "package main\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	pointer, err := os.ReadFile(filepath.Join(worktreePath, ".git"))
+	require.NoError(t, err)
+
+	// A wiping export that ran out of space midway: the git pointer is gone and files are partially written
+	entries, err := os.ReadDir(worktreePath)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NoError(t, os.RemoveAll(filepath.Join(worktreePath, entry.Name())))
+	}
+	writeFile(t, worktreePath, "main.go", "package ma")
+	writeFile(t, worktreePath, "node_modules/big.bin", "partial")
+
+	require.NoError(t, rollbackWorktree(ctx, worktreePath, string(pointer)))
+
+	content, err := os.ReadFile(filepath.Join(worktreePath, "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main\n", string(content))
+	assert.NoDirExists(t, filepath.Join(worktreePath, "node_modules"))
+	status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
+	require.NoError(t, err)
+	assert.Empty(t, status)
+}
@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+	"github.com/mitchellh/go-homedir"
+)
+
+// DaggerGCReport describes what pruning the Dagger engine cache freed, or would free.
+type DaggerGCReport struct {
+	// Environments is the number of environments, across all repositories, whose container state was kept.
+	Environments int
+	// UsedBytes is the disk space used by the Dagger engine cache before pruning.
+	UsedBytes int
+	// ReclaimableBytes is the disk space used by the cache entries no environment references.
+	ReclaimableBytes int
+	// ReclaimedBytes is the disk space actually freed, 0 on a dry run.
+	ReclaimedBytes int
+}
+
+// referencedContainer is the container state of an environment.
+type referencedContainer struct {
+	fork        string
+	environment string
+	container   string
+}
+
+// Prune removes the git metadata left behind by deleted environments: the records of their worktrees in the fork,
+// and their remote-tracking branches in the source repository.
+func (r *Repository) Prune(ctx context.Context) error {
+	if _, err := RunGitCommand(ctx, r.forkRepoPath, "worktree", "prune"); err != nil {
+		return fmt.Errorf("failed to prune worktrees: %w", err)
+	}
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "remote", "prune", containerUseRemote); err != nil {
+		return fmt.Errorf("failed to prune remote-tracking branches: %w", err)
+	}
+	return nil
+}
+
+// PruneDagger removes the entries of the Dagger engine cache that no environment references anymore, such as the
+// container states of deleted environments or earlier states of existing ones. The engine is shared by all
+// repositories, so the environments of every repository are kept, not only this one's.
+//
+// Dagger can't prune given containers: instead, the container state of every environment is loaded so it's held by
+// this session, and everything the engine can release is pruned. With dryRun, nothing is pruned and the report only
+// tells how much space would be reclaimed.
+func (r *Repository) PruneDagger(ctx context.Context, dag *dagger.Client, dryRun bool) (*DaggerGCReport, error) {
+	containers, err := r.referencedContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range containers {
+		// An environment whose state can't be held would lose it, better not prune at all
+		if _, err := dag.LoadContainerFromID(dagger.ContainerID(ref.container)).Sync(ctx); err != nil {
+			return nil, fmt.Errorf("unable to load environment %s of %s, nothing was pruned: %w", ref.environment, ref.fork, err)
+		}
+	}
+
+	environments := map[[2]string]bool{}
+	for _, ref := range containers {
+		environments[[2]string{ref.fork, ref.environment}] = true
+	}
+	report := &DaggerGCReport{Environments: len(environments)}
+	before, err := engineCacheUsage(ctx, dag)
+	if err != nil {
+		return nil, err
+	}
+	report.UsedBytes = before.DiskSpaceBytes
+	for _, entry := range before.Entries {
+		if !entry.ActivelyUsed {
+			report.ReclaimableBytes += entry.DiskSpaceBytes
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	if err := dag.Engine().LocalCache().Prune(ctx); err != nil {
+		return nil, fmt.Errorf("failed to prune the Dagger engine cache: %w", err)
+	}
+	after, err := engineCacheUsage(ctx, dag)
+	if err != nil {
+		return nil, err
+	}
+	report.ReclaimedBytes = max(before.DiskSpaceBytes-after.DiskSpaceBytes, 0)
+	return report, nil
+}
+
+type engineCacheEntrySet struct {
+	DiskSpaceBytes int `json:"diskSpaceBytes"`
+	Entries        []struct {
+		ActivelyUsed   bool `json:"activelyUsed"`
+		DiskSpaceBytes int  `json:"diskSpaceBytes"`
+	} `json:"entries"`
+}
+
+// engineCacheUsage returns the entries of the Dagger engine cache. It's queried directly, as the SDK would
+// otherwise make a request per entry and field.
+func engineCacheUsage(ctx context.Context, dag *dagger.Client) (*engineCacheEntrySet, error) {
+	var data struct {
+		Engine struct {
+			LocalCache struct {
+				EntrySet engineCacheEntrySet `json:"entrySet"`
+			} `json:"localCache"`
+		} `json:"engine"`
+	}
+	err := dag.Do(ctx, &dagger.Request{
+		Query: `{ engine { localCache { entrySet { diskSpaceBytes entries { activelyUsed diskSpaceBytes } } } } }`,
+	}, &dagger.Response{Data: &data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the Dagger engine cache usage: %w", err)
+	}
+	return &data.Engine.LocalCache.EntrySet, nil
+}
+
+// referencedContainers returns the container states of the environments of every repository under the base path.
+func (r *Repository) referencedContainers(ctx context.Context) ([]referencedContainer, error) {
+	reposPath, err := homedir.Expand(r.getRepoPath())
+	if err != nil {
+		return nil, err
+	}
+
+	forks, err := listForks(reposPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []referencedContainer
+	for _, fork := range forks {
+		branches, err := RunGitCommand(ctx, fork, "for-each-ref", "--format=%(refname:short)", "refs/heads/")
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range strings.Fields(branches) {
+			data, err := RunGitCommand(ctx, fork, "notes", "--ref", gitNotesStateRef, "show", "refs/heads/"+branch)
+			if err != nil {
+				if strings.Contains(err.Error(), "no note found") {
+					continue
+				}
+				return nil, err
+			}
+			state := &environment.State{}
+			if err := state.Unmarshal([]byte(data)); err != nil {
+				return nil, fmt.Errorf("environment %s of %s: %w", branch, fork, err)
+			}
+			if state.Container != "" {
+				containers = append(containers, referencedContainer{fork: fork, environment: branch, container: state.Container})
+			}
+			// Savepoints are only restorable as long as their container state is kept
+			for _, savepoint := range state.Savepoints {
+				containers = append(containers, referencedContainer{fork: fork, environment: branch, container: savepoint.Container})
+			}
+		}
+	}
+	return containers, nil
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferencedContainers(t *testing.T) {
+	ctx := context.Background()
+	basePath := t.TempDir()
+
+	// openRepo opens a new repository using the shared base path, with an environment for each state.
+	openRepo := func(t *testing.T, states map[string]string) *Repository {
+		repoDir := initTestRepo(t)
+		repo, err := OpenWithBasePath(ctx, repoDir, basePath)
+		require.NoError(t, err)
+		for id, state := range states {
+			worktreePath, err := repo.initializeWorktree(ctx, id)
+			require.NoError(t, err)
+			for _, args := range [][]string{
+				{"config", "user.email", "test@example.com"},
+				{"config", "user.name", "Test User"},
+				{"commit", "--allow-empty", "-m", "Create " + id},
+			} {
+				_, err := RunGitCommand(ctx, worktreePath, args...)
+				require.NoError(t, err)
+			}
+			if state != "" {
+				_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", state)
+				require.NoError(t, err)
+			}
+		}
+		return repo
+	}
+
+	repo := openRepo(t, map[string]string{
+		"env-a":    `{"container": "container-a"}`,
+		"env-b":    `{"container": "container-b", "savepoints": [{"name": "before refactor", "container": "container-b-saved"}]}`,
+		"no-state": "",
+	})
+	openRepo(t, map[string]string{"env-c": `{"container": "container-c"}`})
+
+	containers, err := repo.referencedContainers(ctx)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, ref := range containers {
+		ids = append(ids, ref.container)
+	}
+	// Environments of every repository sharing the Dagger engine are referenced, not only this one's
+	// Savepoints are kept too, so they can still be restored
+	assert.Equal(t, []string{"container-a", "container-b", "container-b-saved", "container-c"}, slices.Sorted(slices.Values(ids)))
+}
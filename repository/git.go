@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -14,37 +15,126 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
+	"github.com/dagger/container-use/metrics"
+	"github.com/dustin/go-humanize"
 	"github.com/mitchellh/go-homedir"
 )
 
 const (
 	maxFileSizeForTextCheck = 10 * 1024 * 1024 // 10MB
+
+	// defaultLargeFileWarningSize is the size above which committed text files are reported to the user
+	// unless the environment configuration says otherwise.
+	defaultLargeFileWarningSize = 1024 * 1024 // 1MB
 )
 
+// commitLimits bounds what's committed from an environment: the size of text files, and the secrets they may contain.
+type commitLimits struct {
+	warn int64 // files larger than this are committed with a warning (0 to disable)
+	max  int64 // files larger than this are not committed (0 for no limit)
+	// ignore are gitignore-style patterns of the files not to commit, in addition to the repository's .gitignore.
+	ignore []string
+	// secretScan is what happens to files that look like they contain secrets: environment.SecretScanOn leaves them
+	// out of the commit, environment.SecretScanWarn commits them with a warning. They aren't scanned if empty.
+	secretScan string
+}
+
+func commitLimitsFor(config *environment.EnvironmentConfig) commitLimits {
+	limits := commitLimits{
+		warn:       defaultLargeFileWarningSize,
+		max:        config.MaxFileSize,
+		ignore:     config.IgnorePatterns,
+		secretScan: config.SecretScan,
+	}
+	if config.LargeFileWarningSize != 0 {
+		limits.warn = config.LargeFileWarningSize
+	}
+	switch config.SecretScan {
+	case "":
+		limits.secretScan = environment.SecretScanWarn
+	case environment.SecretScanOff:
+		limits.secretScan = ""
+	}
+	return limits
+}
+
 var (
-	urlSchemeRegExp  = regexp.MustCompile(`^[^:]+://`)
-	scpLikeURLRegExp = regexp.MustCompile(`^(?:(?P<user>[^@]+)@)?(?P<host>[^:\s]+):(?:(?P<port>[0-9]{1,5})(?:\/|:))?(?P<path>[^\\].*\/[^\\].*)$`)
+	urlSchemeRegExp = regexp.MustCompile(`^[^:]+://`)
+	// Like git, anything with a colon before any slash is SCP-like: [user@]host:[port/]path.
+	// A port isn't valid SCP syntax, but it's accepted in the wild, e.g. git@host:2222/group/repo.git.
+	scpLikeURLRegExp = regexp.MustCompile(`^(?:(?P<user>[^@/]+)@)?(?P<host>[^:/\s]+):(?:(?P<port>[0-9]{1,5})(?:\/|:))?(?P<path>[^\\].*)$`)
 )
 
+// defaultGitCommandTimeout bounds how long a git command can run, so one that hangs (e.g. on an unresponsive remote)
+// fails instead of blocking container-use forever. It can be changed with CONTAINER_USE_GIT_TIMEOUT
+// (e.g. "10m", or "0" for no timeout).
+const defaultGitCommandTimeout = 5 * time.Minute
+
+func gitCommandTimeout() time.Duration {
+	value, ok := os.LookupEnv("CONTAINER_USE_GIT_TIMEOUT")
+	if !ok {
+		return defaultGitCommandTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		slog.Warn("Invalid CONTAINER_USE_GIT_TIMEOUT, using the default", "value", value, "default", defaultGitCommandTimeout)
+		return defaultGitCommandTimeout
+	}
+	return timeout
+}
+
 // RunGitCommand executes a git command in the specified directory.
 // This is exported for use in tests and other packages that need direct git access.
+// Git never prompts for credentials, failing instead, and commands running longer than the git timeout are killed.
+// When git exits with a non-zero code, its output is returned along with the error wrapping the *exec.ExitError,
+// for the commands that report results through their exit code.
 func RunGitCommand(ctx context.Context, dir string, args ...string) (out string, rerr error) {
+	return runGitCommandWithEnv(ctx, dir, nil, args...)
+}
+
+// runGitCommandWithEnv is RunGitCommand with env added to the environment of git.
+func runGitCommandWithEnv(ctx context.Context, dir string, env []string, args ...string) (out string, rerr error) {
 	slog.Info(fmt.Sprintf("[%s] $ git %s", dir, strings.Join(args, " ")))
+	start := time.Now()
 	defer func() {
 		slog.Info(fmt.Sprintf("[%s] $ git %s (DONE)", dir, strings.Join(args, " ")), "err", rerr)
+		gitTrace.trace(dir, args, time.Since(start), rerr)
 	}()
 
-	cmd := exec.CommandContext(ctx, "git", args...)
+	timeout := gitCommandTimeout()
+	cmdCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(cmdCtx, "git", args...)
 	cmd.Dir = dir
+	// There's no terminal to answer prompts: without this, git waits for credentials forever
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, env...)
+	// Kill the subprocesses git spawns (e.g. remote helpers or ssh) along with it, so they don't linger
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
 
 	output, err := cmd.CombinedOutput()
+	if ctx.Err() == nil && errors.Is(cmdCtx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("git %s timed out after %s (set CONTAINER_USE_GIT_TIMEOUT to allow more time): %w\nOutput: %s",
+			strings.Join(args, " "), timeout, cmdCtx.Err(), string(output))
+	}
 	if err != nil {
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
-			return "", fmt.Errorf("git command failed (exit code %d): %w\nOutput: %s",
+			return string(output), fmt.Errorf("git command failed (exit code %d): %w\nOutput: %s",
 				exitErr.ExitCode(), err, string(output))
 		}
 		return "", fmt.Errorf("git command failed: %w", err)
@@ -55,13 +145,22 @@ func RunGitCommand(ctx context.Context, dir string, args ...string) (out string,
 
 // RunInteractiveGitCommand executes a git command in the specified directory in interactive mode.
 func RunInteractiveGitCommand(ctx context.Context, dir string, w io.Writer, args ...string) (rerr error) {
+	return runInteractiveGitCommand(ctx, dir, nil, w, args...)
+}
+
+// runInteractiveGitCommand is RunInteractiveGitCommand with git reading stdin, e.g. the user's terminal for the
+// editors it launches. Git doesn't read anything when stdin is nil.
+func runInteractiveGitCommand(ctx context.Context, dir string, stdin io.Reader, w io.Writer, args ...string) (rerr error) {
 	slog.Info(fmt.Sprintf("[%s] $ git %s", dir, strings.Join(args, " ")))
+	start := time.Now()
 	defer func() {
 		slog.Info(fmt.Sprintf("[%s] $ git %s (DONE)", dir, strings.Join(args, " ")), "err", rerr)
+		gitTrace.trace(dir, args, time.Since(start), rerr)
 	}()
 
 	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Dir = dir
+	cmd.Stdin = stdin
 	cmd.Stdout = w
 	cmd.Stderr = w
 
@@ -87,12 +186,65 @@ func (r *Repository) WorktreePath(id string) (string, error) {
 	return homedir.Expand(path.Join(r.getWorktreePath(), id))
 }
 
+// repairForkPath re-points everything that still references the fork at its previous location,
+// so environments created before the fork moved keep working.
+func (r *Repository) repairForkPath(ctx context.Context, oldForkPath string) error {
+	slog.Info("Repairing moved fork", "old-fork-repo", oldForkPath, "fork-repo", r.forkRepoPath)
+
+	// Tracking branches configured with the fork path rather than the remote name.
+	// Exit code 1 means there are no branches with a remote, which is fine.
+	branchRemotes, _ := RunGitCommand(ctx, r.userRepoPath, "config", "--get-regexp", `^branch\..*\.remote$`)
+	for line := range strings.SplitSeq(strings.TrimSpace(branchRemotes), "\n") {
+		key, remote, ok := strings.Cut(line, " ")
+		if !ok || remote != oldForkPath {
+			continue
+		}
+		if _, err := RunGitCommand(ctx, r.userRepoPath, "config", key, containerUseRemote); err != nil {
+			return err
+		}
+	}
+
+	// Reconnect the worktrees of this repository with the fork, in both directions.
+	// The worktrees directory is shared between repositories, so only touch the ones pointing at the old fork.
+	worktreesDir, err := homedir.Expand(r.getWorktreePath())
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(worktreesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	oldWorktreesPrefix := fmt.Sprintf("gitdir: %s/worktrees/", oldForkPath)
+	worktrees := []string{}
+	for _, entry := range entries {
+		worktreePath := filepath.Join(worktreesDir, entry.Name())
+		pointer, err := os.ReadFile(filepath.Join(worktreePath, ".git"))
+		if err != nil || !strings.HasPrefix(string(pointer), oldWorktreesPrefix) {
+			continue
+		}
+		worktrees = append(worktrees, worktreePath)
+	}
+	if len(worktrees) > 0 {
+		if _, err := RunGitCommand(ctx, r.forkRepoPath, append([]string{"worktree", "repair"}, worktrees...)...); err != nil {
+			return err
+		}
+	}
+
+	// Refresh the remote-tracking branches, which were fetched from the old location
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "fetch", "--prune", containerUseRemote); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (r *Repository) deleteWorktree(id string) error {
 	worktreePath, err := r.WorktreePath(id)
 	if err != nil {
 		return err
 	}
 	fmt.Printf("Deleting worktree at %s\n", worktreePath)
+	exportedWorkdirs.forget(worktreePath)
 	return os.RemoveAll(worktreePath)
 }
 
@@ -129,13 +281,18 @@ func (r *Repository) initializeWorktree(ctx context.Context, id string) (string,
 
 	slog.Info("Initializing worktree", "repository", r.userRepoPath, "container-id", id)
 
-	currentHead, err := RunGitCommand(ctx, r.userRepoPath, "rev-parse", "HEAD")
+	// The branch of an existing environment whose worktree was removed is checked out as is:
+	// pushing the current HEAD to it would move it, or fail if they diverged.
+	err = r.exists(ctx, id)
+	if errors.Is(err, ErrEnvironmentNotFound) {
+		err = r.createBranch(ctx, id)
+	}
 	if err != nil {
 		return "", err
 	}
-	currentHead = strings.TrimSpace(currentHead)
 
-	_, err = RunGitCommand(ctx, r.userRepoPath, "push", containerUseRemote, fmt.Sprintf("%s:refs/heads/%s", currentHead, id))
+	// A worktree deleted by hand is still registered until pruned, and can't be added again before
+	_, err = RunGitCommand(ctx, r.forkRepoPath, "worktree", "prune")
 	if err != nil {
 		return "", err
 	}
@@ -153,7 +310,90 @@ func (r *Repository) initializeWorktree(ctx context.Context, id string) (string,
 	return worktreePath, nil
 }
 
+// createBranch creates the branch of a new environment in the fork, from the current HEAD of the source repository.
+// The push is leased on the branch not existing, so a branch created concurrently in the meantime, by another
+// agent or by hand, is never overwritten.
+func (r *Repository) createBranch(ctx context.Context, id string) error {
+	currentHead, err := r.sourceHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = RunGitCommand(ctx, r.userRepoPath, "push", "--porcelain", "--force-with-lease=refs/heads/"+id+":",
+		containerUseRemote, fmt.Sprintf("%s:refs/heads/%s", currentHead, id))
+	if err != nil {
+		// With --porcelain, refs the push refused are reported as [rejected]
+		if strings.Contains(err.Error(), "[rejected]") {
+			return fmt.Errorf("%w: branch %s was created in %s while this environment was being created, and was left as is rather than overwritten", ErrEnvironmentExists, id, r.forkRepoPath)
+		}
+		return err
+	}
+	return nil
+}
+
+// IsEmpty reports whether the source repository has no commits yet, e.g. right after git init.
+func (r *Repository) IsEmpty(ctx context.Context) (bool, error) {
+	_, err := RunGitCommand(ctx, r.userRepoPath, "rev-parse", "--verify", "--quiet", "HEAD")
+	if err == nil {
+		return false, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, err
+}
+
+// initialCommitEnv pins the identity and dates of the initial commit of repositories without commits, so that
+// every environment created before the first commit starts from the same commit, and they can all be merged.
+var initialCommitEnv = []string{
+	"GIT_AUTHOR_NAME=container-use",
+	"GIT_AUTHOR_EMAIL=container-use@dagger.io",
+	"GIT_AUTHOR_DATE=@0 +0000",
+	"GIT_COMMITTER_NAME=container-use",
+	"GIT_COMMITTER_EMAIL=container-use@dagger.io",
+	"GIT_COMMITTER_DATE=@0 +0000",
+}
+
+// sourceHead returns the commit of the source repository environments start from: its HEAD, or if it has
+// no commits yet, an empty initial commit, the same for every environment. That commit isn't added to any
+// branch of the source repository, it becomes the first commit of its current branch when an environment is merged.
+func (r *Repository) sourceHead(ctx context.Context) (string, error) {
+	empty, err := r.IsEmpty(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !empty {
+		head, err := RunGitCommand(ctx, r.userRepoPath, "rev-parse", "HEAD")
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(head), nil
+	}
+
+	slog.Info("Source repository has no commits, starting from an empty initial commit", "repository", r.userRepoPath)
+	emptyTree, err := r.emptyTree(ctx)
+	if err != nil {
+		return "", err
+	}
+	commit, err := runGitCommandWithEnv(ctx, r.userRepoPath, initialCommitEnv, "commit-tree", "--no-gpg-sign", emptyTree, "-m", "Initial commit")
+	if err != nil {
+		return "", fmt.Errorf("failed to create an initial commit: %w", err)
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+// emptyTree writes the empty tree to the source repository and returns its hash.
+func (r *Repository) emptyTree(ctx context.Context) (string, error) {
+	tree, err := RunGitCommand(ctx, r.userRepoPath, "hash-object", "-t", "tree", "-w", os.DevNull)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(tree), nil
+}
+
 func (r *Repository) propagateToWorktree(ctx context.Context, env *environment.Environment, explanation string) (rerr error) {
+	defer metrics.Track("propagate_to_worktree", &rerr)()
 	slog.Info("Propagating to worktree...",
 		"environment.id", env.ID,
 		"workdir", env.State.Config.Workdir,
@@ -166,7 +406,8 @@ func (r *Repository) propagateToWorktree(ctx context.Context, env *environment.E
 			"err", rerr)
 	}()
 
-	if err := r.exportEnvironment(ctx, env); err != nil {
+	workdir, err := r.exportEnvironment(ctx, env)
+	if err != nil {
 		return err
 	}
 
@@ -174,47 +415,99 @@ func (r *Repository) propagateToWorktree(ctx context.Context, env *environment.E
 	if err != nil {
 		return fmt.Errorf("failed to get worktree path: %w", err)
 	}
-	if err := r.commitWorktreeChanges(ctx, worktreePath, explanation); err != nil {
-		return fmt.Errorf("failed to commit worktree changes: %w", err)
+
+	var warnings []string
+	var gitDir string
+	if env.State.Config.GitCheckout {
+		gitDir, err = exportGitDir(ctx, env)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(gitDir)
+
+		warning, err := r.fastForwardToEnvironmentCommits(ctx, worktreePath, gitDir)
+		if err != nil {
+			return err
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
 	}
 
-	if err := r.saveState(ctx, env); err != nil {
-		return fmt.Errorf("failed to add notes: %w", err)
+	if env.State.Config.CommitGranularity == environment.CommitPerSession {
+		if err := r.deferWorktreeChanges(ctx, env, worktreePath, explanation); err != nil {
+			return err
+		}
+	} else {
+		commitWarnings, err := r.commitWorktreeChanges(ctx, worktreePath, explanation, commitLimitsFor(env.State.Config))
+		if err != nil {
+			return fmt.Errorf("failed to commit worktree changes: %w", err)
+		}
+		warnings = append(warnings, commitWarnings...)
+	}
+	for _, warning := range warnings {
+		slog.Warn(warning, "environment.id", env.ID)
+		env.Notes.Add("%s", warning)
 	}
 
-	slog.Info("Fetching container-use remote in source repository")
-	if _, err := RunGitCommand(ctx, r.userRepoPath, "fetch", containerUseRemote, env.ID); err != nil {
+	if gitDir != "" {
+		if err := r.syncEnvironmentGitDir(ctx, env, worktreePath, gitDir); err != nil {
+			return err
+		}
+	}
+
+	head, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
 		return err
 	}
+	exportedWorkdirs.set(worktreePath, exportedWorkdir{dir: workdir, head: strings.TrimSpace(head)})
 
-	if err := r.propagateGitNotes(ctx, gitNotesStateRef); err != nil {
+	if err := r.saveState(ctx, env.EnvironmentInfo); err != nil {
+		return fmt.Errorf("failed to add notes: %w", err)
+	}
+
+	return r.publish(ctx, env.EnvironmentInfo)
+}
+
+// publish makes the environment's latest commit and state available in the source repository.
+func (r *Repository) publish(ctx context.Context, env *environment.EnvironmentInfo) error {
+	slog.Info("Fetching container-use remote in source repository")
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "fetch", containerUseRemote, env.ID); err != nil {
 		return err
 	}
 
-	return nil
+	return r.propagateNotes(ctx, env, gitNotesStateRef)
 }
 
-func (r *Repository) exportEnvironment(ctx context.Context, env *environment.Environment) error {
+// exportEnvironment writes the environment's workdir to its worktree and returns the exported directory.
+func (r *Repository) exportEnvironment(ctx context.Context, env *environment.Environment) (*dagger.Directory, error) {
 	worktreePointer := fmt.Sprintf("gitdir: %s/worktrees/%s", r.forkRepoPath, env.ID)
 
 	worktreePath, err := r.WorktreePath(env.ID)
 	if err != nil {
-		return fmt.Errorf("failed to get worktree path: %w", err)
+		return nil, fmt.Errorf("failed to get worktree path: %w", err)
 	}
 
-	_, err = env.Workdir().
-		WithNewFile(".git", worktreePointer).
-		Export(
-			ctx,
-			worktreePath,
-			dagger.DirectoryExportOpts{Wipe: true},
-		)
-	if err != nil {
-		return err
+	workdir := env.Workdir()
+	if env.State.Config.GitCheckout {
+		// The environment's own git directory is reconciled with the worktree separately
+		workdir = workdir.WithoutDirectory(".git")
 	}
+	workdir = workdir.WithNewFile(".git", worktreePointer)
 
-	return nil
+	if err := exportWorkdir(ctx, workdir, worktreePath); err != nil {
+		if !isOutOfDiskSpace(err) {
+			return nil, err
+		}
+		if rollbackErr := rollbackWorktree(ctx, worktreePath, worktreePointer); rollbackErr != nil {
+			slog.Error("Failed to roll back partial export", "worktree", worktreePath, "err", rollbackErr)
+		}
+		return nil, fmt.Errorf("%w %s: %w", ErrOutOfDiskSpace, worktreePath, err)
+	}
+
+	return workdir, nil
 }
+
 func (r *Repository) propagateGitNotes(ctx context.Context, ref string) error {
 	fullRef := fmt.Sprintf("refs/notes/%s", ref)
 	fetch := func() error {
@@ -233,7 +526,79 @@ func (r *Repository) propagateGitNotes(ctx context.Context, ref string) error {
 	return nil
 }
 
-func (r *Repository) saveState(ctx context.Context, env *environment.Environment) error {
+// migrateGitNotes moves notes stored under the legacy refs to their namespaced location.
+// The fork repository belongs to container-use so its legacy notes are always migrated.
+// In the user repository, legacy refs are only removed when they are copies of the fork's
+// notes, leaving notes the user created themselves untouched.
+func (r *Repository) migrateGitNotes(ctx context.Context) error {
+	migrations := []struct{ legacyRef, ref string }{
+		{legacyGitNotesLogRef, gitNotesLogRef},
+		{legacyGitNotesStateRef, gitNotesStateRef},
+	}
+
+	for _, m := range migrations {
+		legacyFullRef := fmt.Sprintf("refs/notes/%s", m.legacyRef)
+		fullRef := fmt.Sprintf("refs/notes/%s", m.ref)
+
+		legacyCommit, err := resolveRef(ctx, r.forkRepoPath, legacyFullRef)
+		if err != nil {
+			return err
+		}
+		if legacyCommit == "" {
+			continue
+		}
+		// Don't clobber notes that were already migrated.
+		commit, err := resolveRef(ctx, r.forkRepoPath, fullRef)
+		if err != nil {
+			return err
+		}
+		if commit != "" {
+			continue
+		}
+
+		slog.Info("Migrating git notes", "repo", r.forkRepoPath, "from", legacyFullRef, "to", fullRef)
+
+		userCommit, err := resolveRef(ctx, r.userRepoPath, legacyFullRef)
+		if err != nil {
+			return err
+		}
+		if userCommit == legacyCommit {
+			if _, err := RunGitCommand(ctx, r.userRepoPath, "update-ref", "-d", legacyFullRef, legacyCommit); err != nil {
+				return err
+			}
+		}
+
+		if _, err := RunGitCommand(ctx, r.forkRepoPath, "update-ref", fullRef, legacyCommit, ""); err != nil {
+			return err
+		}
+		if _, err := RunGitCommand(ctx, r.forkRepoPath, "update-ref", "-d", legacyFullRef, legacyCommit); err != nil {
+			return err
+		}
+
+		if err := r.propagateGitNotes(ctx, m.ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveRef returns the commit a ref points to, or an empty string if the ref doesn't exist.
+func resolveRef(ctx context.Context, repo, ref string) (string, error) {
+	out, err := RunGitCommand(ctx, repo, "for-each-ref", "--format=%(objectname)", ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// saveStateAttempts is how many times saving the state is attempted when the notes change concurrently.
+const saveStateAttempts = 5
+
+// saveState records the state of the environment in its notes. The note is staged in a ref of its own,
+// then swapped in, only if the notes didn't change in the meantime, and read back before returning.
+// Saving is retried if the notes changed concurrently, so the state is either saved whole or not at all.
+func (r *Repository) saveState(ctx context.Context, env *environment.EnvironmentInfo) error {
 	state, err := env.State.Marshal()
 	if err != nil {
 		return err
@@ -243,34 +608,100 @@ func (r *Repository) saveState(ctx context.Context, env *environment.Environment
 		return fmt.Errorf("failed to get worktree path: %w", err)
 	}
 
+	for attempt := 1; ; attempt++ {
+		old, staged, err := r.stageState(ctx, worktreePath, env.ID, state)
+		if err != nil {
+			return err
+		}
+		err = r.commitState(ctx, worktreePath, env.ID, old, staged)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errStateChanged) || attempt == saveStateAttempts {
+			return err
+		}
+		slog.Warn("State notes changed while saving, retrying", "environment.id", env.ID, "attempt", attempt)
+	}
+
+	saved, err := r.loadState(ctx, worktreePath)
+	if err != nil {
+		return fmt.Errorf("failed to read the saved state back: %w", err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(saved), bytes.TrimSpace(state)) {
+		return fmt.Errorf("the saved state doesn't read back as written")
+	}
+	return nil
+}
+
+// errStateChanged is returned by commitState when the state notes changed since the state was staged.
+var errStateChanged = errors.New("state notes changed concurrently")
+
+// stageState adds the state note to the staging ref of the environment, on top of the current state notes.
+// It returns the commit of the state notes it was staged on, empty if there were none yet, and the staged commit.
+// A staging ref left behind by an interrupted save is overwritten.
+func (r *Repository) stageState(ctx context.Context, worktreePath, id string, state []byte) (string, string, error) {
+	stagingRef := fmt.Sprintf("refs/notes/%s/%s", gitNotesStagingRef, id)
+	old, err := resolveRef(ctx, worktreePath, "refs/notes/"+gitNotesStateRef)
+	if err != nil {
+		return "", "", err
+	}
+	if old == "" {
+		_, err = RunGitCommand(ctx, worktreePath, "update-ref", "-d", stagingRef)
+	} else {
+		_, err = RunGitCommand(ctx, worktreePath, "update-ref", stagingRef, old)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
 	f, err := os.CreateTemp(os.TempDir(), ".container-use-git-notes-*")
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 	if _, err := f.Write(state); err != nil {
-		return err
+		return "", "", err
 	}
-
-	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-f", "-F", f.Name())
+	if _, err := RunGitCommand(ctx, worktreePath, "notes", "--ref", stagingRef, "add", "-f", "-F", f.Name()); err != nil {
+		return "", "", err
+	}
+	staged, err := resolveRef(ctx, worktreePath, stagingRef)
 	if err != nil {
+		return "", "", err
+	}
+	return old, staged, nil
+}
+
+// commitState fast-forwards the state notes from old to the staged commit, and removes the staging ref.
+// It fails with errStateChanged if the state notes are no longer at old.
+func (r *Repository) commitState(ctx context.Context, worktreePath, id, old, staged string) error {
+	// update-ref only updates the ref if it still has the expected value, the empty string meaning it must not exist
+	if _, err := RunGitCommand(ctx, worktreePath, "update-ref", "refs/notes/"+gitNotesStateRef, staged, old); err != nil {
+		current, resolveErr := resolveRef(ctx, worktreePath, "refs/notes/"+gitNotesStateRef)
+		if resolveErr == nil && current != old {
+			return fmt.Errorf("%w: %w", errStateChanged, err)
+		}
 		return err
 	}
-	return nil
+	_, err := RunGitCommand(ctx, worktreePath, "update-ref", "-d", fmt.Sprintf("refs/notes/%s/%s", gitNotesStagingRef, id))
+	return err
 }
 
+// loadState returns the serialized state of the environment checked out in worktreePath,
+// or ErrNoState if none was recorded.
 func (r *Repository) loadState(ctx context.Context, worktreePath string) ([]byte, error) {
 	buff, err := RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "show")
 	if err != nil {
 		if strings.Contains(err.Error(), "no note found") {
-			return nil, nil
+			return nil, ErrNoState
 		}
 		return nil, err
 	}
 	return []byte(buff), nil
 }
 
-func (r *Repository) addGitNote(ctx context.Context, env *environment.Environment, note string) error {
+func (r *Repository) addGitNote(ctx context.Context, env *environment.EnvironmentInfo, note string) error {
 	worktreePath, err := r.WorktreePath(env.ID)
 	if err != nil {
 		return fmt.Errorf("failed to get worktree path: %w", err)
@@ -279,13 +710,34 @@ func (r *Repository) addGitNote(ctx context.Context, env *environment.Environmen
 	if err != nil {
 		return err
 	}
-	return r.propagateGitNotes(ctx, gitNotesLogRef)
+	return r.propagateNotes(ctx, env, gitNotesLogRef)
 }
 
 func (r *Repository) currentUserBranch(ctx context.Context) (string, error) {
 	return RunGitCommand(ctx, r.userRepoPath, "branch", "--show-current")
 }
 
+// branchWorktree returns the path of the worktree of the source repository where branch is checked out,
+// or an empty string if it isn't checked out anywhere.
+func (r *Repository) branchWorktree(ctx context.Context, branch string) (string, error) {
+	out, err := RunGitCommand(ctx, r.userRepoPath, "worktree", "list", "--porcelain")
+	if err != nil {
+		return "", err
+	}
+	for worktree := range strings.SplitSeq(strings.TrimSpace(out), "\n\n") {
+		var path string
+		for line := range strings.SplitSeq(worktree, "\n") {
+			if p, ok := strings.CutPrefix(line, "worktree "); ok {
+				path = p
+			}
+			if line == "branch refs/heads/"+branch {
+				return path, nil
+			}
+		}
+	}
+	return "", nil
+}
+
 func (r *Repository) mergeBase(ctx context.Context, env *environment.EnvironmentInfo) (string, error) {
 	currentBranch, err := r.currentUserBranch(ctx)
 	if err != nil {
@@ -312,33 +764,72 @@ func (r *Repository) revisionRange(ctx context.Context, env *environment.Environ
 	return fmt.Sprintf("%s..%s", mergeBase, envGitRef), nil
 }
 
-func (r *Repository) commitWorktreeChanges(ctx context.Context, worktreePath, explanation string) error {
+// commitWorktreeChanges commits the changes in the worktree, returning warnings about files
+// that are unusually large or were left out because of the size limits.
+func (r *Repository) commitWorktreeChanges(ctx context.Context, worktreePath, explanation string, limits commitLimits) ([]string, error) {
 	status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if strings.TrimSpace(status) == "" {
-		return nil
+		return nil, nil
 	}
 
-	if err := r.addNonBinaryFiles(ctx, worktreePath); err != nil {
-		return err
+	warnings, err := r.addNonBinaryFiles(ctx, worktreePath, limits)
+	if err != nil {
+		return nil, err
+	}
+	if limits.secretScan != "" {
+		secretWarnings, err := checkStagedSecrets(ctx, worktreePath, limits.secretScan == environment.SecretScanOn)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, secretWarnings...)
 	}
 
 	_, err = RunGitCommand(ctx, worktreePath, "commit", "--allow-empty", "--allow-empty-message", "-m", explanation)
-	return err
+	return warnings, err
+}
+
+// deferWorktreeChanges leaves the changes in the worktree uncommitted, recording the explanation of the operation
+// that made them for the commit that will eventually flush them.
+func (r *Repository) deferWorktreeChanges(ctx context.Context, env *environment.Environment, worktreePath, explanation string) error {
+	status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(status) == "" || explanation == "" {
+		return nil
+	}
+	env.State.PendingChanges = append(env.State.PendingChanges, explanation)
+	return nil
+}
+
+// pendingChangesMessage returns the message of the commit flushing changes made by several operations.
+func pendingChangesMessage(explanations []string) string {
+	if len(explanations) == 1 {
+		return explanations[0]
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "Session changes\n\n")
+	for _, explanation := range explanations {
+		fmt.Fprintf(&message, "- %s\n", explanation)
+	}
+	return message.String()
 }
 
 // AI slop below!
 // this is just to keep us moving fast because big git repos get hard to work with
 // and our demos like to download large dependencies.
-func (r *Repository) addNonBinaryFiles(ctx context.Context, worktreePath string) error {
+func (r *Repository) addNonBinaryFiles(ctx context.Context, worktreePath string, limits commitLimits) ([]string, error) {
 	statusOutput, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var warnings []string
+
 	for line := range strings.SplitSeq(strings.TrimSpace(statusOutput), "\n") {
 		if line == "" {
 			continue
@@ -354,7 +845,7 @@ func (r *Repository) addNonBinaryFiles(ctx context.Context, worktreePath string)
 			continue
 		}
 
-		if r.shouldSkipFile(fileName) {
+		if r.shouldSkipFile(fileName) || limits.ignores(fileName) {
 			continue
 		}
 
@@ -364,15 +855,24 @@ func (r *Repository) addNonBinaryFiles(ctx context.Context, worktreePath string)
 			if strings.HasSuffix(fileName, "/") {
 				// Untracked directory - traverse and add non-binary files
 				dirName := strings.TrimSuffix(fileName, "/")
-				if err := r.addFilesFromUntrackedDirectory(ctx, worktreePath, dirName); err != nil {
-					return err
+				dirWarnings, err := r.addFilesFromUntrackedDirectory(ctx, worktreePath, dirName, limits)
+				if err != nil {
+					return nil, err
 				}
+				warnings = append(warnings, dirWarnings...)
 			} else if !r.isBinaryFile(worktreePath, fileName) {
-				// Untracked file - add if not binary
+				// Untracked file - add if not binary and within the size limits
+				ok, warning := checkFileSize(worktreePath, fileName, limits)
+				if warning != "" {
+					warnings = append(warnings, warning)
+				}
+				if !ok {
+					continue
+				}
 
 				_, err = RunGitCommand(ctx, worktreePath, "add", fileName)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 		case indexStatus == 'A':
@@ -382,20 +882,28 @@ func (r *Repository) addNonBinaryFiles(ctx context.Context, worktreePath string)
 			// D = deleted files (always stage deletion)
 			_, err = RunGitCommand(ctx, worktreePath, "add", fileName)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		default:
-			// M, R, C and other statuses - add if not binary
+			// M, R, C and other statuses - add if not binary and within the size limits
 			if !r.isBinaryFile(worktreePath, fileName) {
+				ok, warning := checkFileSize(worktreePath, fileName, limits)
+				if warning != "" {
+					warnings = append(warnings, warning)
+				}
+				if !ok {
+					continue
+				}
+
 				_, err = RunGitCommand(ctx, worktreePath, "add", fileName)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 		}
 	}
 
-	return nil
+	return warnings, nil
 }
 
 func (r *Repository) shouldSkipFile(fileName string) bool {
@@ -432,23 +940,77 @@ func (r *Repository) shouldSkipFile(fileName string) bool {
 	return false
 }
 
-func (r *Repository) IsDirty(ctx context.Context) (bool, string, error) {
+// IsDirty checks the source repository for uncommitted changes.
+// If there are any, it returns their porcelain status along with an error wrapping ErrDirtyRepo.
+func (r *Repository) IsDirty(ctx context.Context) (string, error) {
 	status, err := RunGitCommand(ctx, r.userRepoPath, "status", "--porcelain")
 	if err != nil {
-		return false, "", err
+		return "", err
 	}
 
 	if strings.TrimSpace(status) == "" {
-		return false, "", nil
+		return "", nil
 	}
 
-	return true, status, nil
+	return status, fmt.Errorf("%w in %s", ErrDirtyRepo, r.userRepoPath)
+}
+
+// conflictedFiles returns the files left unmerged in the working tree at dir.
+func conflictedFiles(ctx context.Context, dir string) ([]string, error) {
+	out, err := RunGitCommand(ctx, dir, "diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
 }
 
-func (r *Repository) addFilesFromUntrackedDirectory(ctx context.Context, worktreePath, dirName string) error {
+// checkMergeConflict converts a merge that failed in dir into an error wrapping ErrMergeConflict
+// if it left conflicts behind.
+func checkMergeConflict(ctx context.Context, dir, id string, mergeErr error) error {
+	files, err := conflictedFiles(ctx, dir)
+	if err != nil || len(files) == 0 {
+		return mergeErr
+	}
+	return fmt.Errorf("%w in %s while merging environment %q", ErrMergeConflict, strings.Join(files, ", "), id)
+}
+
+// mergeTree merges theirs into ours in memory and returns the resulting tree, along with the files that would conflict.
+// Conflicting files are part of the tree with conflict markers.
+func (r *Repository) mergeTree(ctx context.Context, ours, theirs string) (string, []string, error) {
+	output, err := RunGitCommand(ctx, r.userRepoPath, "merge-tree", "--write-tree", "--name-only", "--no-messages", ours, theirs)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", nil, fmt.Errorf("failed to merge %s into %s: %w", theirs, ours, err)
+		}
+		switch exitErr.ExitCode() {
+		case 1:
+			// The merge has conflicts
+		case 129:
+			// Git before 2.38 doesn't know --write-tree, and prints its usage
+			version, _ := RunGitCommand(ctx, r.userRepoPath, "version")
+			return "", nil, fmt.Errorf("failed to merge %s into %s: merging without a worktree requires git 2.38 or later, found %s",
+				theirs, ours, strings.TrimSpace(version))
+		default:
+			return "", nil, fmt.Errorf("failed to merge %s into %s: %w", theirs, ours, err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	tree, conflicts := lines[0], []string{}
+	for _, file := range lines[1:] {
+		if file != "" && !slices.Contains(conflicts, file) {
+			conflicts = append(conflicts, file)
+		}
+	}
+	return tree, conflicts, nil
+}
+
+func (r *Repository) addFilesFromUntrackedDirectory(ctx context.Context, worktreePath, dirName string, limits commitLimits) ([]string, error) {
 	dirPath := filepath.Join(worktreePath, dirName)
 
-	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+	var warnings []string
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -459,17 +1021,25 @@ func (r *Repository) addFilesFromUntrackedDirectory(ctx context.Context, worktre
 		}
 
 		if info.IsDir() {
-			if r.shouldSkipFile(relPath + "/") {
+			if r.shouldSkipFile(relPath+"/") || limits.ignores(relPath+"/") {
 				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		if r.shouldSkipFile(relPath) {
+		if r.shouldSkipFile(relPath) || limits.ignores(relPath) {
 			return nil
 		}
 
 		if !r.isBinaryFile(worktreePath, relPath) {
+			ok, warning := checkFileSize(worktreePath, relPath, limits)
+			if warning != "" {
+				warnings = append(warnings, warning)
+			}
+			if !ok {
+				return nil
+			}
+
 			_, err = RunGitCommand(ctx, worktreePath, "add", relPath)
 			if err != nil {
 				return err
@@ -478,6 +1048,27 @@ func (r *Repository) addFilesFromUntrackedDirectory(ctx context.Context, worktre
 
 		return nil
 	})
+	return warnings, err
+}
+
+// checkFileSize applies the size limits to a text file about to be committed.
+// It reports whether the file should be committed, along with a warning for the user if any.
+func checkFileSize(worktreePath, fileName string, limits commitLimits) (bool, string) {
+	stat, err := os.Stat(filepath.Join(worktreePath, fileName))
+	if err != nil || stat.IsDir() {
+		return true, ""
+	}
+
+	size := stat.Size()
+	switch {
+	case limits.max > 0 && size > limits.max:
+		return false, fmt.Sprintf("Not committing %s: its size (%s) exceeds the %s limit",
+			fileName, humanize.IBytes(uint64(size)), humanize.IBytes(uint64(limits.max)))
+	case limits.warn > 0 && size > limits.warn:
+		return true, fmt.Sprintf("Committing large file %s (%s); consider adding it to .gitignore if it is generated",
+			fileName, humanize.IBytes(uint64(size)))
+	}
+	return true, ""
 }
 
 func (r *Repository) isBinaryFile(worktreePath, fileName string) bool {
@@ -559,7 +1150,7 @@ func normalizeURL(endpoint string) (string, error) {
 		)
 	}
 
-	return fmt.Sprintf("%s%s", u.Hostname(), strings.TrimSuffix(u.Path, ".git")), nil
+	return normalizedRepoPath(u.Hostname(), u.Path), nil
 }
 
 func normalizeSCPLike(endpoint string) (string, bool) {
@@ -569,7 +1160,15 @@ func normalizeSCPLike(endpoint string) (string, bool) {
 
 	_, host, _, path := findScpLikeComponents(endpoint)
 
-	return fmt.Sprintf("%s/%s", host, strings.TrimSuffix(path, ".git")), true
+	return normalizedRepoPath(host, path), true
+}
+
+// normalizedRepoPath returns the path identifying the repository at path on host, the same for all the URLs
+// of a repository whatever their form: hosts are case insensitive, the port and .git suffix are irrelevant
+// and the path may have leading or trailing slashes. Nested paths, such as GitLab subgroups, are kept.
+func normalizedRepoPath(host, path string) string {
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return fmt.Sprintf("%s/%s", strings.ToLower(host), strings.Trim(path, "/"))
 }
 
 // matchesURLScheme returns true if the given string matches a URL-like
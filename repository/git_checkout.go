@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// Environments configured with GitCheckout have a real git directory in their workdir, so agents
+// can craft their own commits. The functions below reconcile these commits with the worktree.
+
+// exportGitDir exports the git directory of the environment's workdir to a temporary directory.
+// The caller is responsible for removing it.
+func exportGitDir(ctx context.Context, env *environment.Environment) (string, error) {
+	gitDir, err := os.MkdirTemp(os.TempDir(), ".container-use-git-dir-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := env.Workdir().Directory(".git").Export(ctx, gitDir); err != nil {
+		os.RemoveAll(gitDir)
+		return "", fmt.Errorf("failed to export the environment git directory: %w", err)
+	}
+	return gitDir, nil
+}
+
+// fastForwardToEnvironmentCommits moves the worktree branch to the commits made inside the environment.
+// The worktree must already hold the files of the environment's workdir, only the branch and index are updated.
+// If the environment history diverged from the worktree, nothing is done and a warning is returned.
+func (r *Repository) fastForwardToEnvironmentCommits(ctx context.Context, worktreePath, gitDir string) (string, error) {
+	if _, err := RunGitCommand(ctx, worktreePath, "fetch", "--no-tags", gitDir, "HEAD"); err != nil {
+		return "", fmt.Errorf("failed to fetch commits from the environment: %w", err)
+	}
+
+	// Nothing new was committed inside the environment
+	if _, err := RunGitCommand(ctx, worktreePath, "merge-base", "--is-ancestor", "FETCH_HEAD", "HEAD"); err == nil {
+		return "", nil
+	}
+
+	if _, err := RunGitCommand(ctx, worktreePath, "merge-base", "--is-ancestor", "HEAD", "FETCH_HEAD"); err != nil {
+		return "Commits made inside the environment rewrite its existing history and were not kept. Their changes are committed as a single commit instead.", nil
+	}
+
+	if _, err := RunGitCommand(ctx, worktreePath, "reset", "--mixed", "--quiet", "FETCH_HEAD"); err != nil {
+		return "", fmt.Errorf("failed to fast-forward to the environment commits: %w", err)
+	}
+	return "", nil
+}
+
+// syncEnvironmentGitDir moves the environment's git checkout to the worktree HEAD, so commits made
+// inside the environment build on top of the ones container-use made on its behalf.
+func (r *Repository) syncEnvironmentGitDir(ctx context.Context, env *environment.Environment, worktreePath, gitDir string) error {
+	head, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	head = strings.TrimSpace(head)
+	envHead, err := RunGitCommand(ctx, gitDir, "--git-dir", gitDir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(envHead) == head {
+		return nil
+	}
+
+	for _, args := range [][]string{
+		{"fetch", "--no-tags", worktreePath, "HEAD"},
+		{"update-ref", "HEAD", head},
+		// The workdir already matches HEAD, only the index is stale
+		{"read-tree", "HEAD"},
+	} {
+		if _, err := RunGitCommand(ctx, gitDir, append([]string{"--git-dir", gitDir}, args...)...); err != nil {
+			return fmt.Errorf("failed to update the environment git directory: %w", err)
+		}
+	}
+
+	return env.ReplaceGitDir(ctx, gitDir)
+}
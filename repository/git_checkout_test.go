@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastForwardToEnvironmentCommits(t *testing.T) {
+	ctx := context.Background()
+
+	// setup returns a worktree and a clone of it standing in for the environment's git checkout
+	setup := func(t *testing.T) (repo *Repository, worktreePath, checkout string) {
+		repoDir := initTestRepo(t)
+		repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+		require.NoError(t, err)
+		worktreePath, err = repo.initializeWorktree(ctx, "test-env")
+		require.NoError(t, err)
+
+		checkout = filepath.Join(t.TempDir(), "checkout")
+		for _, args := range [][]string{
+			{"clone", "--quiet", worktreePath, checkout},
+			{"-C", checkout, "config", "user.email", "agent@example.com"},
+			{"-C", checkout, "config", "user.name", "Agent"},
+		} {
+			_, err := RunGitCommand(ctx, repoDir, args...)
+			require.NoError(t, err)
+		}
+		return repo, worktreePath, checkout
+	}
+	agentCommit := func(t *testing.T, checkout, worktreePath, name, message string, extraArgs ...string) {
+		writeFile(t, checkout, name, message)
+		// Export the environment's files to the worktree like exportEnvironment does
+		writeFile(t, worktreePath, name, message)
+		_, err := RunGitCommand(ctx, checkout, "add", name)
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, checkout, append([]string{"commit", "-m", message}, extraArgs...)...)
+		require.NoError(t, err)
+	}
+	head := func(t *testing.T, dir string) string {
+		out, err := RunGitCommand(ctx, dir, "rev-parse", "HEAD")
+		require.NoError(t, err)
+		return strings.TrimSpace(out)
+	}
+
+	t.Run("keeps_agent_commits", func(t *testing.T) {
+		repo, worktreePath, checkout := setup(t)
+		agentCommit(t, checkout, worktreePath, "a.txt", "Add a")
+		agentCommit(t, checkout, worktreePath, "b.txt", "Add b")
+
+		warning, err := repo.fastForwardToEnvironmentCommits(ctx, worktreePath, filepath.Join(checkout, ".git"))
+		require.NoError(t, err)
+		assert.Empty(t, warning)
+		assert.Equal(t, head(t, checkout), head(t, worktreePath))
+
+		status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
+		require.NoError(t, err)
+		assert.Empty(t, strings.TrimSpace(status))
+		log, err := RunGitCommand(ctx, worktreePath, "log", "--format=%an %s")
+		require.NoError(t, err)
+		assert.Contains(t, log, "Agent Add b\nAgent Add a\n")
+	})
+
+	t.Run("nothing_committed", func(t *testing.T) {
+		repo, worktreePath, checkout := setup(t)
+		before := head(t, worktreePath)
+
+		warning, err := repo.fastForwardToEnvironmentCommits(ctx, worktreePath, filepath.Join(checkout, ".git"))
+		require.NoError(t, err)
+		assert.Empty(t, warning)
+		assert.Equal(t, before, head(t, worktreePath))
+	})
+
+	t.Run("rewritten_history_is_not_kept", func(t *testing.T) {
+		repo, worktreePath, checkout := setup(t)
+		agentCommit(t, checkout, worktreePath, "a.txt", "Add a")
+		_, err := repo.fastForwardToEnvironmentCommits(ctx, worktreePath, filepath.Join(checkout, ".git"))
+		require.NoError(t, err)
+
+		agentCommit(t, checkout, worktreePath, "a.txt", "Amend a", "--amend")
+		before := head(t, worktreePath)
+		warning, err := repo.fastForwardToEnvironmentCommits(ctx, worktreePath, filepath.Join(checkout, ".git"))
+		require.NoError(t, err)
+		assert.NotEmpty(t, warning)
+		assert.Equal(t, before, head(t, worktreePath))
+		content, err := os.ReadFile(filepath.Join(worktreePath, "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "Amend a", string(content), "the environment's files are left in place to be committed")
+	})
+}
@@ -2,11 +2,18 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/dagger/container-use/environment"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -17,8 +24,11 @@ func TestGitCommandErrors(t *testing.T) {
 	tempDir := t.TempDir()
 
 	// Test invalid command
-	_, err := RunGitCommand(ctx, tempDir, "invalid-command")
+	out, err := RunGitCommand(ctx, tempDir, "invalid-command")
 	assert.Error(t, err, "Should get error for invalid git command")
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr, "Should expose the exit code of git")
+	assert.Contains(t, out, "invalid-command", "Should return what git printed along with the error")
 
 	// Test command in non-existent directory
 	_, err = RunGitCommand(ctx, "/nonexistent", "status")
@@ -101,7 +111,7 @@ func TestSelectiveFileStaging(t *testing.T) {
 			repo := &Repository{}
 
 			// Run the actual staging logic (testing the integration)
-			err = repo.addNonBinaryFiles(ctx, dir)
+			_, err = repo.addNonBinaryFiles(ctx, dir, commitLimits{})
 			require.NoError(t, err, "Staging should not error")
 
 			status, err := RunGitCommand(ctx, dir, "status", "--porcelain")
@@ -149,7 +159,7 @@ func TestCommitWorktreeChanges(t *testing.T) {
 
 		// This verifies that commitWorktreeChanges handles empty directories gracefully
 		// It should return nil (success) when there's nothing to commit
-		err := repo.commitWorktreeChanges(ctx, dir, "Empty dirs")
+		_, err := repo.commitWorktreeChanges(ctx, dir, "Empty dirs", commitLimits{})
 		assert.NoError(t, err, "commitWorktreeChanges should handle empty dirs gracefully")
 	})
 
@@ -157,7 +167,7 @@ func TestCommitWorktreeChanges(t *testing.T) {
 		// Create a file to commit
 		writeFile(t, dir, "test.txt", "hello world")
 
-		err := repo.commitWorktreeChanges(ctx, dir, "Testing commit functionality")
+		_, err := repo.commitWorktreeChanges(ctx, dir, "Testing commit functionality", commitLimits{})
 		require.NoError(t, err)
 
 		// Verify commit was created
@@ -165,6 +175,33 @@ func TestCommitWorktreeChanges(t *testing.T) {
 		require.NoError(t, err)
 		assert.Contains(t, log, "Testing commit functionality")
 	})
+
+	t.Run("warns_about_large_text_files", func(t *testing.T) {
+		writeFile(t, dir, "dump.sql", strings.Repeat("INSERT INTO t VALUES (1);\n", 5*1024*1024/26))
+
+		warnings, err := repo.commitWorktreeChanges(ctx, dir, "Large file", commitLimits{warn: 1024 * 1024})
+		require.NoError(t, err)
+		require.Len(t, warnings, 1)
+		assert.Contains(t, warnings[0], "dump.sql")
+
+		// The file is still committed
+		files, err := RunGitCommand(ctx, dir, "ls-files")
+		require.NoError(t, err)
+		assert.Contains(t, files, "dump.sql")
+	})
+
+	t.Run("skips_text_files_over_the_limit", func(t *testing.T) {
+		writeFile(t, dir, "huge.sql", strings.Repeat("INSERT INTO t VALUES (1);\n", 5*1024*1024/26))
+
+		warnings, err := repo.commitWorktreeChanges(ctx, dir, "Huge file", commitLimits{max: 1024 * 1024})
+		require.NoError(t, err)
+		require.Len(t, warnings, 1)
+		assert.Contains(t, warnings[0], "Not committing huge.sql")
+
+		status, err := RunGitCommand(ctx, dir, "status", "--porcelain")
+		require.NoError(t, err)
+		assert.Contains(t, status, "?? huge.sql")
+	})
 }
 
 // Test helper functions
@@ -176,6 +213,31 @@ func writeFile(t *testing.T, dir, name, content string) {
 	require.NoError(t, err)
 }
 
+// initTestRepo creates a git repository in a temporary directory, with an empty initial commit, and returns its path.
+func initTestRepo(t *testing.T) string {
+	t.Helper()
+	dir := initTestRepoWithoutCommits(t)
+	_, err := RunGitCommand(context.Background(), dir, "commit", "--allow-empty", "-m", "Initial commit")
+	require.NoError(t, err)
+	return dir
+}
+
+// initTestRepoWithoutCommits creates a git repository in a temporary directory, without any commit, and returns its path.
+func initTestRepoWithoutCommits(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init"},
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+		{"config", "commit.gpgsign", "false"},
+	} {
+		_, err := RunGitCommand(context.Background(), dir, args...)
+		require.NoError(t, err)
+	}
+	return dir
+}
+
 func writeBinaryFile(t *testing.T, dir, name string, size int) {
 	t.Helper()
 	path := filepath.Join(dir, name)
@@ -197,3 +259,303 @@ func createDir(t *testing.T, dir, name string) {
 	err := os.MkdirAll(path, 0755)
 	require.NoError(t, err)
 }
+
+// All the URLs of a repository must share a single fork, whatever their form
+func TestNormalizeGitURL(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		urls     []string
+		expected string
+	}{
+		{
+			name: "github",
+			urls: []string{
+				"git@github.com:dagger/container-use.git",
+				"git@github.com:dagger/container-use",
+				"https://github.com/dagger/container-use.git",
+				"https://github.com/dagger/container-use/",
+				"https://user@GitHub.com/dagger/container-use",
+				"ssh://git@github.com/dagger/container-use.git",
+			},
+			expected: "github.com/dagger/container-use",
+		},
+		{
+			name: "gitlab_subgroups",
+			urls: []string{
+				"git@gitlab.com:group/subgroup/repo.git",
+				"https://gitlab.com/group/subgroup/repo.git",
+				"ssh://git@gitlab.com/group/subgroup/repo.git",
+			},
+			expected: "gitlab.com/group/subgroup/repo",
+		},
+		{
+			name: "bitbucket",
+			urls: []string{
+				"git@bitbucket.org:team/repo.git",
+				"https://team@bitbucket.org/team/repo.git",
+			},
+			expected: "bitbucket.org/team/repo",
+		},
+		{
+			name: "ports",
+			urls: []string{
+				"ssh://git@git.example.com:2222/group/subgroup/repo.git",
+				"git@git.example.com:2222/group/subgroup/repo.git",
+				"git@git.example.com:2222:group/subgroup/repo.git",
+				"https://git.example.com:8443/group/subgroup/repo.git",
+			},
+			expected: "git.example.com/group/subgroup/repo",
+		},
+		{
+			name: "single_path_segment",
+			urls: []string{
+				"git@git.example.com:repo.git",
+				"git@git.example.com:2222/repo.git",
+				"ssh://git@git.example.com/repo.git",
+			},
+			expected: "git.example.com/repo",
+		},
+		{
+			name: "absolute_scp_path",
+			urls: []string{
+				"git.example.com:/srv/git/repo.git",
+				"ssh://git.example.com/srv/git/repo.git",
+			},
+			expected: "git.example.com/srv/git/repo",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, url := range tc.urls {
+				normalized, err := normalizeGitURL(url)
+				require.NoError(t, err, url)
+				assert.Equal(t, tc.expected, normalized, url)
+			}
+		})
+	}
+
+	_, err := normalizeGitURL("relative/path")
+	assert.Error(t, err)
+}
+
+// Git commands must fail instead of hanging when a remote asks for credentials or doesn't answer
+func TestGitCommandDoesNotHang(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	t.Run("credentials_prompt", func(t *testing.T) {
+		private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="private"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer private.Close()
+
+		start := time.Now()
+		_, err := RunGitCommand(ctx, dir, "ls-remote", private.URL+"/private/repo.git")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "terminal prompts disabled")
+		assert.Less(t, time.Since(start), 10*time.Second)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Setenv("CONTAINER_USE_GIT_TIMEOUT", "500ms")
+		unresponsive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer unresponsive.Close()
+
+		start := time.Now()
+		_, err := RunGitCommand(ctx, dir, "ls-remote", unresponsive.URL+"/repo.git")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "timed out after 500ms")
+		assert.Less(t, time.Since(start), 10*time.Second)
+	})
+}
+
+func TestSaveState(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+
+	// newEnvironment returns an environment with a commit of its own, for its state note.
+	newEnvironment := func(id string) (*environment.EnvironmentInfo, string) {
+		worktreePath, err := repo.initializeWorktree(ctx, id)
+		require.NoError(t, err)
+		for _, args := range [][]string{
+			{"config", "user.email", "test@example.com"},
+			{"config", "user.name", "Test User"},
+			{"commit", "--allow-empty", "-m", "Create " + id},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+		return &environment.EnvironmentInfo{ID: id, State: &environment.State{Title: id}}, worktreePath
+	}
+	assertState := func(t *testing.T, worktreePath string, expected *environment.State) {
+		data, err := repo.loadState(ctx, worktreePath)
+		require.NoError(t, err)
+		var state environment.State
+		require.NoError(t, state.Unmarshal(data))
+		assert.Equal(t, expected.Title, state.Title)
+	}
+
+	env, worktreePath := newEnvironment("env-a")
+	require.NoError(t, repo.saveState(ctx, env))
+	assertState(t, worktreePath, env.State)
+
+	t.Run("interrupted_save", func(t *testing.T) {
+		// A save interrupted after staging leaves the saved state as it was, and doesn't get in the way of the next one
+		env.State.Title = "Interrupted"
+		state, err := env.State.Marshal()
+		require.NoError(t, err)
+		_, _, err = repo.stageState(ctx, worktreePath, env.ID, state)
+		require.NoError(t, err)
+		assertState(t, worktreePath, &environment.State{Title: "env-a"})
+
+		env.State.Title = "Saved after the interruption"
+		require.NoError(t, repo.saveState(ctx, env))
+		assertState(t, worktreePath, env.State)
+	})
+
+	t.Run("concurrent_save", func(t *testing.T) {
+		// The state of another environment is saved between staging and committing
+		env.State.Title = "Staged before the other save"
+		state, err := env.State.Marshal()
+		require.NoError(t, err)
+		old, staged, err := repo.stageState(ctx, worktreePath, env.ID, state)
+		require.NoError(t, err)
+
+		other, otherWorktreePath := newEnvironment("env-b")
+		require.NoError(t, repo.saveState(ctx, other))
+
+		// Committing the stale staged notes would drop the other environment's state
+		err = repo.commitState(ctx, worktreePath, env.ID, old, staged)
+		require.ErrorIs(t, err, errStateChanged)
+
+		// Saving again, as saveState does when retrying, keeps both
+		env.State.Title = "Saved on retry"
+		require.NoError(t, repo.saveState(ctx, env))
+		assertState(t, worktreePath, env.State)
+		assertState(t, otherWorktreePath, other.State)
+
+		staging, err := RunGitCommand(ctx, worktreePath, "for-each-ref", "refs/notes/"+gitNotesStagingRef)
+		require.NoError(t, err)
+		assert.Empty(t, strings.TrimSpace(staging))
+	})
+}
+
+// Environments can be created in a repository without commits, from an empty initial commit
+func TestInitializeWorktreeWithoutCommits(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepoWithoutCommits(t)
+	writeFile(t, repoDir, "main.go", "package main\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", "main.go")
+	require.NoError(t, err)
+	writeFile(t, repoDir, "README.md", "# Project\n")
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	empty, err := repo.IsEmpty(ctx)
+	require.NoError(t, err)
+	assert.True(t, empty)
+
+	worktreePath, err := repo.initializeWorktree(ctx, "empty-env")
+	require.NoError(t, err)
+	files, err := RunGitCommand(ctx, worktreePath, "ls-tree", "-r", "--name-only", "HEAD")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	subject, err := RunGitCommand(ctx, worktreePath, "log", "--format=%s")
+	require.NoError(t, err)
+	assert.Equal(t, "Initial commit", strings.TrimSpace(subject))
+
+	// The uncommitted files are applied on top of the initial commit
+	for _, args := range [][]string{
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	require.NoError(t, repo.applyUncommittedChanges(ctx, worktreePath, commitLimits{}))
+	files, err = RunGitCommand(ctx, worktreePath, "ls-tree", "-r", "--name-only", "HEAD")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"README.md", "main.go"}, strings.Fields(files))
+
+	// The source repository is left untouched
+	empty, err = repo.IsEmpty(ctx)
+	require.NoError(t, err)
+	assert.True(t, empty)
+}
+
+// Initializing a worktree never moves nor overwrites the branch of an environment
+func TestInitializeWorktreeKeepsExistingBranch(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	branchHead := func(id string) string {
+		out, err := RunGitCommand(ctx, repo.forkRepoPath, "rev-parse", id)
+		require.NoError(t, err)
+		return strings.TrimSpace(out)
+	}
+
+	worktreePath, err := repo.initializeWorktree(ctx, "existing-env")
+	require.NoError(t, err)
+	envHead := branchHead("existing-env")
+
+	// The worktree is removed, and the source repository moves on
+	_, err = RunGitCommand(ctx, repo.forkRepoPath, "worktree", "remove", "--force", worktreePath)
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "--allow-empty", "-m", "More work")
+	require.NoError(t, err)
+
+	_, err = repo.initializeWorktree(ctx, "existing-env")
+	require.NoError(t, err)
+	assert.Equal(t, envHead, branchHead("existing-env"))
+
+	// A branch created concurrently isn't overwritten
+	_, err = RunGitCommand(ctx, repoDir, "push", containerUseRemote, envHead+":refs/heads/concurrent-env")
+	require.NoError(t, err)
+	err = repo.createBranch(ctx, "concurrent-env")
+	require.ErrorIs(t, err, ErrEnvironmentExists)
+	assert.Contains(t, err.Error(), "left as is rather than overwritten")
+	assert.Equal(t, envHead, branchHead("concurrent-env"))
+}
+
+// Environments created before the first commit start from the same initial commit, so they can all be merged
+func TestMergeEnvironmentsWithoutCommits(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepoWithoutCommits(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+
+	for i, id := range []string{"first-env", "second-env"} {
+		// Whenever and by whomever they're created
+		t.Setenv("GIT_AUTHOR_DATE", fmt.Sprintf("2025-01-0%d 12:00:00 +0000", i+1))
+		t.Setenv("GIT_AUTHOR_NAME", id)
+		worktreePath, err := repo.initializeWorktree(ctx, id)
+		require.NoError(t, err)
+		writeFile(t, worktreePath, id+".txt", id+"\n")
+		for _, args := range [][]string{
+			{"config", "user.email", "agent@example.com"},
+			{"config", "user.name", "Agent"},
+			{"add", id + ".txt"},
+			{"commit", "-m", "Add " + id},
+			{"notes", "--ref", gitNotesStateRef, "add", "-m", `{"title":"` + id + `"}`},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+		_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, id)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, repo.Merge(ctx, "first-env", io.Discard, MergeOptions{}))
+	require.NoError(t, repo.Merge(ctx, "second-env", io.Discard, MergeOptions{}))
+	files, err := RunGitCommand(ctx, repoDir, "ls-tree", "-r", "--name-only", "HEAD")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"first-env.txt", "second-env.txt"}, strings.Fields(files))
+	roots, err := RunGitCommand(ctx, repoDir, "rev-list", "--max-parents=0", "HEAD")
+	require.NoError(t, err)
+	assert.Len(t, strings.Fields(roots), 1, "both environments should share the initial commit")
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CommitInfo is a commit of an environment, as returned by History.
+type CommitInfo struct {
+	Hash        string    `json:"hash"`
+	Subject     string    `json:"subject"`
+	Author      string    `json:"author"`
+	AuthorEmail string    `json:"author_email"`
+	Timestamp   time.Time `json:"timestamp"`
+	// Notes is the log note attached to the commit: the operations that led to it.
+	Notes string `json:"notes,omitempty"`
+}
+
+// History returns the commits of the environment that aren't in the current branch, from the most recent to the oldest.
+// It's the structured counterpart of Log, for programmatic consumers.
+func (r *Repository) History(ctx context.Context, id string) ([]CommitInfo, error) {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	revisionRange, err := r.revisionRange(ctx, envInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fields are separated by NUL and commits by RS, neither can appear in subjects or notes
+	output, err := RunGitCommand(ctx, r.userRepoPath, "log",
+		fmt.Sprintf("--notes=%s", gitNotesLogRef),
+		"--format=%H%x00%s%x00%an%x00%ae%x00%aI%x00%N%x1e",
+		revisionRange)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []CommitInfo
+	for record := range strings.SplitSeq(output, "\x1e") {
+		record = strings.TrimPrefix(record, "\n")
+		if record == "" {
+			continue
+		}
+		fields := strings.SplitN(record, "\x00", 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("unexpected git log output: %q", record)
+		}
+		timestamp, err := time.Parse(time.RFC3339, fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of commit %s: %w", fields[0], err)
+		}
+		commits = append(commits, CommitInfo{
+			Hash:        fields[0],
+			Subject:     fields[1],
+			Author:      fields[2],
+			AuthorEmail: fields[3],
+			Timestamp:   timestamp,
+			Notes:       strings.TrimSpace(fields[5]),
+		})
+	}
+	return commits, nil
+}
@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/dagger/container-use/environment"
+	petname "github.com/dustinkirkland/golang-petname"
+)
+
+const (
+	defaultIDWords = 2
+	hexIDBytes     = 4
+
+	// maxIDAttempts bounds how many IDs are generated before giving up on finding an unused one.
+	maxIDAttempts = 10
+)
+
+// idRegExp matches the environment IDs users choose, and ID prefixes.
+var idRegExp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// idGenerator returns a function generating environment IDs as configured.
+// A nil config generates two-word petnames.
+func idGenerator(config *environment.IDConfig) (func() string, error) {
+	if config == nil {
+		config = &environment.IDConfig{}
+	}
+
+	if config.Prefix != "" && !idRegExp.MatchString(config.Prefix) {
+		return nil, fmt.Errorf("invalid ID prefix %q: only letters, digits, '.', '_' and '-' are allowed", config.Prefix)
+	}
+	withPrefix := func(id string) string {
+		if config.Prefix == "" {
+			return id
+		}
+		return config.Prefix + "-" + id
+	}
+
+	switch config.Format {
+	case "", environment.IDFormatPetname:
+		words := config.Words
+		if words == 0 {
+			words = defaultIDWords
+		}
+		if words < 0 {
+			return nil, fmt.Errorf("invalid ID word count %d: must be positive", words)
+		}
+		return func() string {
+			return withPrefix(petname.Generate(words, "-"))
+		}, nil
+	case environment.IDFormatHex:
+		return func() string {
+			b := make([]byte, hexIDBytes)
+			rand.Read(b)
+			return withPrefix(hex.EncodeToString(b))
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid ID format %q: must be %q or %q", config.Format, environment.IDFormatPetname, environment.IDFormatHex)
+	}
+}
+
+// uniqueID generates IDs until one isn't taken, which is retried a bounded number of times.
+func uniqueID(generate func() string, taken func(id string) (bool, error)) (string, error) {
+	for range maxIDAttempts {
+		id := generate()
+		exists, err := taken(id)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate an unused environment ID after %d attempts", maxIDAttempts)
+}
+
+// newEnvironmentID generates the ID of a new environment, making sure it isn't used by an existing one.
+func (r *Repository) newEnvironmentID(ctx context.Context, config *environment.IDConfig) (string, error) {
+	generate, err := idGenerator(config)
+	if err != nil {
+		return "", err
+	}
+	return uniqueID(generate, func(id string) (bool, error) {
+		err := r.exists(ctx, id)
+		if errors.Is(err, ErrEnvironmentNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// validateID checks that id can be used as the ID of an environment, and its branch name.
+func validateID(ctx context.Context, id string) error {
+	if !idRegExp.MatchString(id) {
+		return fmt.Errorf("invalid environment ID %q: only letters, digits, '.', '_' and '-' are allowed", id)
+	}
+	if _, err := RunGitCommand(ctx, ".", "check-ref-format", "--branch", id); err != nil {
+		return fmt.Errorf("invalid environment ID %q: not a valid branch name", id)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDGenerator(t *testing.T) {
+	t.Run("default_is_two_word_petname", func(t *testing.T) {
+		generate, err := idGenerator(nil)
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(generate(), "-"), 2)
+	})
+
+	t.Run("word_count", func(t *testing.T) {
+		generate, err := idGenerator(&environment.IDConfig{Words: 3})
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(generate(), "-"), 3)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		generate, err := idGenerator(&environment.IDConfig{Prefix: "alice"})
+		require.NoError(t, err)
+		id := generate()
+		assert.True(t, strings.HasPrefix(id, "alice-"), id)
+		assert.Len(t, strings.Split(id, "-"), 3)
+	})
+
+	t.Run("hex", func(t *testing.T) {
+		generate, err := idGenerator(&environment.IDConfig{Format: environment.IDFormatHex, Prefix: "ci"})
+		require.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile(`^ci-[0-9a-f]{8}$`), generate())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, config := range []*environment.IDConfig{
+			{Format: "uuid"},
+			{Words: -1},
+			{Prefix: "feature/x"},
+			{Prefix: "-x"},
+		} {
+			_, err := idGenerator(config)
+			assert.Error(t, err, "%+v", config)
+		}
+	})
+}
+
+func TestUniqueID(t *testing.T) {
+	t.Run("retries_on_collision", func(t *testing.T) {
+		ids := []string{"taken-one", "taken-two", "free"}
+		generate := func() string {
+			id := ids[0]
+			ids = ids[1:]
+			return id
+		}
+		id, err := uniqueID(generate, func(id string) (bool, error) {
+			return strings.HasPrefix(id, "taken-"), nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "free", id)
+	})
+
+	t.Run("gives_up", func(t *testing.T) {
+		attempts := 0
+		_, err := uniqueID(func() string { return "taken" }, func(string) (bool, error) {
+			attempts++
+			return true, nil
+		})
+		assert.Error(t, err)
+		assert.Equal(t, maxIDAttempts, attempts)
+	})
+}
+
+func TestNewEnvironmentID(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+
+	id, err := repo.newEnvironmentID(ctx, &environment.IDConfig{Prefix: "env"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(id, "env-"), id)
+}
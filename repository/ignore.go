@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"path"
+	"strings"
+)
+
+// ignores reports whether fileName, relative to the worktree root, matches one of the environment's ignore patterns.
+// Directories end with a slash. Patterns follow a subset of the gitignore syntax:
+//   - a pattern without a slash, like "*.log", matches files and directories with that name at any depth,
+//   - a pattern containing a slash, like "web/tmp", matches that path relative to the root (and what's under it),
+//   - a trailing slash, like "cache/", only matches directories,
+//   - "*", "?" and "[...]" are wildcards within a path segment.
+func (l commitLimits) ignores(fileName string) bool {
+	isDir := strings.HasSuffix(fileName, "/")
+	segments := strings.Split(strings.Trim(fileName, "/"), "/")
+	for _, pattern := range l.ignore {
+		dirOnly := strings.HasSuffix(pattern, "/")
+		pattern = strings.TrimSuffix(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+		for i := range segments {
+			// The last segment of a file can't match a pattern for directories only
+			if dirOnly && i == len(segments)-1 && !isDir {
+				break
+			}
+			var matched bool
+			if strings.Contains(pattern, "/") {
+				matched, _ = path.Match(strings.TrimPrefix(pattern, "/"), strings.Join(segments[:i+1], "/"))
+			} else {
+				matched, _ = path.Match(pattern, segments[i])
+			}
+			if matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnores(t *testing.T) {
+	limits := commitLimits{ignore: []string{"deps/", "*.pyc", "web/tmp", "/vendor/"}}
+	for fileName, expected := range map[string]bool{
+		"deps/":              true,
+		"deps/lib/index.js":  true,
+		"app/deps/":          true,
+		"app/deps/lib.js":    true,
+		"deps":               false, // A file, not a directory
+		"main.pyc":           true,
+		"app/__init__.pyc":   true,
+		"main.py":            false,
+		"web/tmp/upload.txt": true,
+		"app/web/tmp/x.txt":  false, // Patterns with a slash are relative to the root
+		"vendor/":            true,
+		"vendor/lib.go":      true,
+		"src/vendor/lib.go":  false,
+		"README.md":          false,
+	} {
+		assert.Equal(t, expected, limits.ignores(fileName), fileName)
+	}
+}
+
+func TestCommitWorktreeChangesIgnorePatterns(t *testing.T) {
+	ctx := context.Background()
+	dir := initTestRepo(t)
+	// Dependencies installed by the agent, that the repository doesn't ignore
+	writeFile(t, dir, "app/main.go", "package main\n")
+	writeFile(t, dir, "app/third_party/lib/lib.go", "package lib\n")
+	writeFile(t, dir, "third_party/README.md", "# Vendored\n")
+
+	repo := &Repository{}
+	limits := commitLimitsFor(&environment.EnvironmentConfig{IgnorePatterns: []string{"third_party/"}})
+	_, err := repo.commitWorktreeChanges(ctx, dir, "Install dependencies", limits)
+	require.NoError(t, err)
+
+	files, err := RunGitCommand(ctx, dir, "ls-tree", "-r", "--name-only", "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, "app/main.go\n", files)
+}
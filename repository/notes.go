@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// pendingNotes holds the git notes propagations deferred by environments configured with a notes propagation window.
+// Notes are always recorded in the fork right away, only copying them to the source repository is deferred.
+var pendingNotes = &notesPropagation{pending: map[string]*pendingPropagation{}}
+
+type pendingPropagation struct {
+	repo  *Repository
+	ref   string
+	timer *time.Timer
+}
+
+type notesPropagation struct {
+	mu      sync.Mutex
+	pending map[string]*pendingPropagation
+}
+
+// schedule propagates ref once the window elapses. Notes added in the meantime are propagated along,
+// so a ref is propagated at most once per window.
+func (p *notesPropagation) schedule(r *Repository, ref string, window time.Duration) {
+	key := r.userRepoPath + ":" + ref
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pending[key]; ok {
+		return
+	}
+	p.pending[key] = &pendingPropagation{
+		repo:  r,
+		ref:   ref,
+		timer: time.AfterFunc(window, func() { p.propagate(key) }),
+	}
+}
+
+func (p *notesPropagation) propagate(key string) {
+	p.mu.Lock()
+	pending, ok := p.pending[key]
+	delete(p.pending, key)
+	p.mu.Unlock()
+	// Already flushed
+	if !ok {
+		return
+	}
+	if err := pending.repo.propagateGitNotes(context.Background(), pending.ref); err != nil {
+		slog.Error("Failed to propagate git notes", "repo", pending.repo.userRepoPath, "ref", pending.ref, "err", err)
+	}
+}
+
+// flush propagates the pending notes of the source repository at repoPath right away,
+// or those of all repositories if repoPath is empty.
+func (p *notesPropagation) flush(ctx context.Context, repoPath string) error {
+	p.mu.Lock()
+	var flushed []*pendingPropagation
+	for key, pending := range p.pending {
+		if repoPath != "" && pending.repo.userRepoPath != repoPath {
+			continue
+		}
+		pending.timer.Stop()
+		delete(p.pending, key)
+		flushed = append(flushed, pending)
+	}
+	p.mu.Unlock()
+
+	var errs error
+	for _, pending := range flushed {
+		errs = errors.Join(errs, pending.repo.propagateGitNotes(ctx, pending.ref))
+	}
+	return errs
+}
+
+// FlushNotes propagates the git notes whose propagation to their source repository is still pending.
+// It must be called before exiting, otherwise the source repositories miss the latest notes until the next propagation.
+func FlushNotes(ctx context.Context) error {
+	return pendingNotes.flush(ctx, "")
+}
+
+// propagateNotes propagates ref to the source repository, right away unless the environment is configured
+// to coalesce notes propagations.
+func (r *Repository) propagateNotes(ctx context.Context, env *environment.EnvironmentInfo, ref string) error {
+	if window := env.State.Config.NotesWindow(); window > 0 {
+		pendingNotes.schedule(r, ref, window)
+		return nil
+	}
+	return r.propagateGitNotes(ctx, ref)
+}
+
+// flushNotes propagates the notes of the environment whose propagation is pending right away.
+func (r *Repository) flushNotes(ctx context.Context, env *environment.EnvironmentInfo) error {
+	if err := pendingNotes.flush(ctx, r.userRepoPath); err != nil {
+		return err
+	}
+	if env.State.Config.NotesWindow() == 0 {
+		return nil
+	}
+	// The notes may have been added by another process, such as the MCP server, still waiting for the window to elapse
+	for _, ref := range []string{gitNotesLogRef, gitNotesStateRef} {
+		if err := r.propagateGitNotes(ctx, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotesPropagationWindow(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+
+	logRef := "refs/notes/" + gitNotesLogRef
+	propagated := func() bool {
+		forkCommit, err := resolveRef(ctx, repo.forkRepoPath, logRef)
+		require.NoError(t, err)
+		userCommit, err := resolveRef(ctx, repoDir, logRef)
+		require.NoError(t, err)
+		return forkCommit == userCommit
+	}
+
+	// runSession adds notes like a session of 50 operations and returns how many times git fetch ran.
+	runSession := func(t *testing.T, env *environment.EnvironmentInfo) int {
+		trace := filepath.Join(t.TempDir(), "trace")
+		t.Setenv("GIT_TRACE", trace)
+		for i := range 50 {
+			require.NoError(t, repo.addGitNote(ctx, env, fmt.Sprintf("operation %d", i)))
+		}
+		data, err := os.ReadFile(trace)
+		require.NoError(t, err)
+		return strings.Count(string(data), "built-in: git fetch ")
+	}
+
+	newEnv := func(window string) *environment.EnvironmentInfo {
+		config := environment.DefaultConfig()
+		config.NotesPropagationWindow = window
+		return &environment.EnvironmentInfo{
+			ID:    "test-env",
+			State: &environment.State{Config: config},
+		}
+	}
+
+	// By default, every note is propagated right away
+	immediate := runSession(t, newEnv(""))
+	assert.Equal(t, 50, immediate)
+	assert.True(t, propagated())
+
+	t.Run("coalesced", func(t *testing.T) {
+		coalesced := runSession(t, newEnv("1h"))
+		t.Logf("git fetch invocations for 50 operations: %d immediate, %d coalesced", immediate, coalesced)
+		assert.Zero(t, coalesced)
+		assert.False(t, propagated())
+
+		require.NoError(t, FlushNotes(ctx))
+		assert.True(t, propagated())
+	})
+
+	t.Run("window_elapses", func(t *testing.T) {
+		env := newEnv("500ms")
+		require.NoError(t, repo.addGitNote(ctx, env, "first"))
+		require.NoError(t, repo.addGitNote(ctx, env, "second"))
+		assert.False(t, propagated())
+		assert.Eventually(t, propagated, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		// Notes added by another process, whose propagation is pending there, are propagated too
+		require.NoError(t, repo.saveState(ctx, newEnv("1h")))
+		_, err := RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesLogRef, "append", "-m", "from elsewhere")
+		require.NoError(t, err)
+		assert.False(t, propagated())
+
+		require.NoError(t, repo.Flush(ctx, "test-env"))
+		assert.True(t, propagated())
+	})
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+)
+
+// recordHistorySource fills in the source commit of the commands run since the environment was last saved.
+// It must be called before their changes are committed, while the worktree HEAD is still the commit they ran on.
+func (r *Repository) recordHistorySource(ctx context.Context, env *environment.Environment) error {
+	var pending []*environment.CommandRecord
+	for _, record := range env.State.History {
+		if record.Source == "" {
+			pending = append(pending, record)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	worktreePath, err := r.WorktreePath(env.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get worktree path: %w", err)
+	}
+	head, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	for _, record := range pending {
+		record.Source = strings.TrimSpace(head)
+	}
+	return nil
+}
+
+// Replay re-runs the commands recorded in an environment's history, in order, in a fresh throwaway environment
+// built from the same configuration. Before each command, the source is brought to the commit the command originally ran on.
+// The outcome of each command is reported to w, and an error is returned if any of them diverged from the original run.
+func (r *Repository) Replay(ctx context.Context, dag *dagger.Client, id string, w io.Writer) error {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return err
+	}
+	history := envInfo.State.History
+	if len(history) == 0 {
+		return fmt.Errorf("environment %q has no recorded commands to replay", id)
+	}
+
+	sourceDir := func(commit string) *dagger.Directory {
+		return dag.
+			Host().
+			Directory(r.forkRepoPath, dagger.HostDirectoryOpts{NoCache: true}).
+			AsGit().
+			Ref(commit).
+			Tree(dagger.GitRefTreeOpts{DiscardGitDir: true})
+	}
+
+	source := history[0].Source
+	if source == "" {
+		if source, err = r.mergeBase(ctx, envInfo); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(w, "Replaying %d commands from %s\n", len(history), id)
+	replayEnv, err := environment.New(ctx, dag, id+"-replay", "Replay of "+envInfo.State.Title, envInfo.State.Config.Copy(), sourceDir(source))
+	if err != nil {
+		return fmt.Errorf("failed to create replay environment: %w", err)
+	}
+
+	diverged := 0
+	for i, record := range history {
+		if record.Source != "" && record.Source != source {
+			if err := replayEnv.SyncSource(ctx, sourceDir(record.Source)); err != nil {
+				return fmt.Errorf("failed to check out %s: %w", record.Source, err)
+			}
+			source = record.Source
+		}
+
+		shell := record.Shell
+		if shell == "" {
+			shell = "sh"
+		}
+		if _, err := replayEnv.Run(ctx, record.Command, shell, environment.RunOpts{
+			UseEntrypoint:  record.UseEntrypoint,
+			InheritHostEnv: record.InheritHostEnv,
+			User:           record.User,
+		}); err != nil {
+			return fmt.Errorf("failed to replay command %d: %w", i+1, err)
+		}
+		replayed := replayEnv.State.History[len(replayEnv.State.History)-1]
+
+		step := fmt.Sprintf("[%d/%d] $ %s", i+1, len(history), strings.TrimSpace(record.Command))
+		switch {
+		case replayed.ExitCode != record.ExitCode:
+			diverged++
+			fmt.Fprintf(w, "✗ %s\n  exited with %d, originally %d\n", step, replayed.ExitCode, record.ExitCode)
+		case replayed.OutputDigest != record.OutputDigest:
+			diverged++
+			fmt.Fprintf(w, "✗ %s\n  output differs from the original run\n", step)
+		default:
+			fmt.Fprintf(w, "✓ %s\n", step)
+		}
+	}
+
+	if diverged > 0 {
+		return fmt.Errorf("%d of %d commands diverged from the original run", diverged, len(history))
+	}
+	fmt.Fprintf(w, "All %d commands reproduced the original run\n", len(history))
+	return nil
+}
@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// forkSourceConfigKey is the git config key of the fork recording the paths of the source repositories using it.
+// Clones of the same origin share their fork, so there may be several.
+const forkSourceConfigKey = "container-use.source"
+
+// ManagedRepo is a fork container-use keeps on this machine for a source repository.
+type ManagedRepo struct {
+	// Name is the normalized name of the repository, e.g. github.com/dagger/container-use.
+	Name string
+	// ForkPath is the path of the fork.
+	ForkPath string
+	// SourcePaths are the source repositories using the fork, unknown for forks last opened by earlier versions.
+	SourcePaths []string
+	// Environments is the number of environments in the fork.
+	Environments int
+	// SizeBytes is the disk space used by the fork, not counting the worktrees of its environments.
+	SizeBytes int64
+}
+
+// ManagedRepos returns the forks of every repository container-use manages on this machine, sorted by name.
+func ManagedRepos(ctx context.Context) ([]ManagedRepo, error) {
+	return ManagedReposWithBasePath(ctx, cuGlobalConfigPath)
+}
+
+// ManagedReposWithBasePath returns the forks of every repository like ManagedRepos, with a custom base path for
+// container-use data.
+func ManagedReposWithBasePath(ctx context.Context, basePath string) ([]ManagedRepo, error) {
+	reposPath, err := homedir.Expand((&Repository{basePath: basePath}).getRepoPath())
+	if err != nil {
+		return nil, err
+	}
+	forks, err := listForks(reposPath)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]ManagedRepo, 0, len(forks))
+	for _, fork := range forks {
+		name, err := filepath.Rel(reposPath, fork)
+		if err != nil {
+			return nil, err
+		}
+		branches, err := RunGitCommand(ctx, fork, "for-each-ref", "--format=%(refname:short)", "refs/heads/")
+		if err != nil {
+			return nil, err
+		}
+		size, err := diskUsage(fork)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, ManagedRepo{
+			Name:         filepath.ToSlash(name),
+			ForkPath:     fork,
+			SourcePaths:  forkSources(ctx, fork),
+			Environments: len(strings.Fields(branches)),
+			SizeBytes:    size,
+		})
+	}
+	return repos, nil
+}
+
+// listForks returns the forks under reposPath. Forks are bare repositories, nested according to their origin.
+func listForks(reposPath string) ([]string, error) {
+	var forks []string
+	err := filepath.WalkDir(reposPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(path, "HEAD")); err == nil {
+			forks = append(forks, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return forks, nil
+}
+
+// forkSources returns the source repositories recorded in the fork by recordSource.
+func forkSources(ctx context.Context, fork string) []string {
+	// Exit code 1 means none was recorded
+	sources, err := RunGitCommand(ctx, fork, "config", "--get-all", forkSourceConfigKey)
+	if err != nil || strings.TrimSpace(sources) == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(sources), "\n")
+}
+
+// recordSource records the source repository in its fork, so the forks can be traced back to their sources.
+func (r *Repository) recordSource(ctx context.Context) error {
+	if slices.Contains(forkSources(ctx, r.forkRepoPath), r.userRepoPath) {
+		return nil
+	}
+	_, err := RunGitCommand(ctx, r.forkRepoPath, "config", "--add", forkSourceConfigKey, r.userRepoPath)
+	return err
+}
+
+// diskUsage returns the size of the files under dir.
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagedRepos(t *testing.T) {
+	ctx := context.Background()
+	basePath := t.TempDir()
+
+	newRepo := func(origin string) string {
+		dir := initTestRepo(t)
+		if origin != "" {
+			_, err := RunGitCommand(ctx, dir, "remote", "add", "origin", origin)
+			require.NoError(t, err)
+		}
+		return dir
+	}
+
+	localDir := newRepo("")
+	local, err := OpenWithBasePath(ctx, localDir, basePath)
+	require.NoError(t, err)
+	_, err = local.initializeWorktree(ctx, "first-env")
+	require.NoError(t, err)
+	_, err = local.initializeWorktree(ctx, "second-env")
+	require.NoError(t, err)
+
+	remoteDir := newRepo("git@github.com:dagger/container-use.git")
+	_, err = OpenWithBasePath(ctx, remoteDir, basePath)
+	require.NoError(t, err)
+	// Opening a repository again doesn't record it twice
+	_, err = OpenWithBasePath(ctx, remoteDir, basePath)
+	require.NoError(t, err)
+
+	repos, err := ManagedReposWithBasePath(ctx, basePath)
+	require.NoError(t, err)
+	require.Len(t, repos, 2)
+
+	byName := map[string]ManagedRepo{}
+	for _, repo := range repos {
+		byName[repo.Name] = repo
+		assert.Positive(t, repo.SizeBytes, repo.Name)
+	}
+
+	remote, ok := byName["github.com/dagger/container-use"]
+	require.True(t, ok, "repos: %v", repos)
+	assert.Equal(t, filepath.Join(basePath, "repos", "github.com", "dagger", "container-use"), remote.ForkPath)
+	assert.Equal(t, []string{remoteDir}, remote.SourcePaths)
+	assert.Zero(t, remote.Environments)
+
+	localName, err := filepath.Rel(filepath.Join(basePath, "repos"), local.forkRepoPath)
+	require.NoError(t, err)
+	require.Contains(t, byName, filepath.ToSlash(localName))
+	assert.Equal(t, []string{localDir}, byName[filepath.ToSlash(localName)].SourcePaths)
+	assert.Equal(t, 2, byName[filepath.ToSlash(localName)].Environments)
+}
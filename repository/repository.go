@@ -11,10 +11,10 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
-	petname "github.com/dustinkirkland/golang-petname"
 )
 
 const (
@@ -22,14 +22,26 @@ const (
 	cuRepoPath         = cuGlobalConfigPath + "/repos"
 	cuWorktreePath     = cuGlobalConfigPath + "/worktrees"
 	containerUseRemote = "container-use"
-	gitNotesLogRef     = "container-use"
-	gitNotesStateRef   = "container-use-state"
+
+	// Git notes refs holding the operation log and the serialized state of environments.
+	// They are namespaced under refs/notes/cu/ so they don't collide with notes users keep for themselves.
+	gitNotesLogRef   = "cu/log"
+	gitNotesStateRef = "cu/state"
+	// gitNotesStagingRef prefixes the refs where the state of each environment is staged before it's saved.
+	gitNotesStagingRef = "cu/staging"
+
+	// Notes refs used by earlier versions, migrated to the refs above by migrateGitNotes.
+	legacyGitNotesLogRef   = "container-use"
+	legacyGitNotesStateRef = "container-use-state"
 )
 
 type Repository struct {
 	userRepoPath string
 	forkRepoPath string
 	basePath     string // defaults to ~/.config/container-use if empty
+
+	// tx holds the updates deferred while a transaction runs, see WithTransaction
+	tx *transaction
 }
 
 // getRepoPath returns the path for storing repository data
@@ -49,22 +61,25 @@ func Open(ctx context.Context, repo string) (*Repository, error) {
 // OpenWithBasePath opens a repository with a custom base path for container-use data.
 // This is useful for tests that need isolated environments.
 func OpenWithBasePath(ctx context.Context, repo string, basePath string) (*Repository, error) {
-	output, err := RunGitCommand(ctx, repo, "rev-parse", "--show-toplevel")
+	userRepoPath, err := SourceRoot(ctx, repo)
 	if err != nil {
-		// Check for exit code 128 which means not a git repository
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) && exitErr.ExitCode() == 128 {
-			return nil, errors.New("you must be in a git repository to use container-use")
-		}
 		return nil, err
 	}
-	userRepoPath := strings.TrimSpace(output)
 
 	forkRepoPath, err := getContainerUseRemote(ctx, userRepoPath)
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return nil, err
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// The remote may still point at a fork that has since been moved (e.g. the base path changed).
+	// In that case, locate the fork under the current base path and repair the references to the old one.
+	var staleForkPath string
+	if err == nil {
+		if _, statErr := os.Stat(forkRepoPath); os.IsNotExist(statErr) {
+			staleForkPath = forkRepoPath
+			err = os.ErrNotExist
 		}
+	}
+	if err != nil {
 		// Create a temporary repository to get the normalized fork path
 		tempRepo := &Repository{basePath: basePath}
 		forkRepoPath, err = tempRepo.normalizeForkPath(ctx, userRepoPath)
@@ -85,10 +100,70 @@ func OpenWithBasePath(ctx context.Context, repo string, basePath string) (*Repos
 	if err := r.ensureUserRemote(ctx); err != nil {
 		return nil, fmt.Errorf("unable to set container-use remote: %w", err)
 	}
+	if err := r.recordSource(ctx); err != nil {
+		return nil, fmt.Errorf("unable to record the source of the fork: %w", err)
+	}
+	if staleForkPath != "" {
+		if err := r.repairForkPath(ctx, staleForkPath); err != nil {
+			return nil, fmt.Errorf("unable to repair environments after the fork moved from %s: %w", staleForkPath, err)
+		}
+	}
+	if err := r.migrateGitNotes(ctx); err != nil {
+		return nil, fmt.Errorf("unable to migrate git notes: %w", err)
+	}
 
 	return r, nil
 }
 
+// OpenReadOnly opens a repository like Open, but without setting it up: the fork and the container-use remote
+// aren't created, nor repaired or migrated from earlier versions. It's meant for tooling that only reads
+// environments, and fails with ErrNotInitialized if the repository wasn't set up yet.
+func OpenReadOnly(ctx context.Context, repo string) (*Repository, error) {
+	return OpenReadOnlyWithBasePath(ctx, repo, cuGlobalConfigPath)
+}
+
+// OpenReadOnlyWithBasePath opens a repository like OpenReadOnly, with a custom base path for container-use data.
+func OpenReadOnlyWithBasePath(ctx context.Context, repo string, basePath string) (*Repository, error) {
+	userRepoPath, err := SourceRoot(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	forkRepoPath, err := getContainerUseRemote(ctx, userRepoPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotInitialized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(forkRepoPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: the fork %s was moved, run any other container-use command to repair it", ErrNotInitialized, forkRepoPath)
+		}
+		return nil, err
+	}
+
+	return &Repository{
+		userRepoPath: userRepoPath,
+		forkRepoPath: forkRepoPath,
+		basePath:     basePath,
+	}, nil
+}
+
+// SourceRoot returns the root of the git repository containing the path repo.
+func SourceRoot(ctx context.Context, repo string) (string, error) {
+	output, err := RunGitCommand(ctx, repo, "rev-parse", "--show-toplevel")
+	if err != nil {
+		// Check for exit code 128 which means not a git repository
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 128 {
+			return "", errors.New("you must be in a git repository to use container-use")
+		}
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
 func (r *Repository) ensureFork(ctx context.Context) error {
 	// Make sure the fork repo path exists, otherwise create it
 	_, err := os.Stat(r.forkRepoPath)
@@ -135,22 +210,98 @@ func (r *Repository) SourcePath() string {
 func (r *Repository) exists(ctx context.Context, id string) error {
 	if _, err := RunGitCommand(ctx, r.forkRepoPath, "rev-parse", "--verify", id); err != nil {
 		if strings.Contains(err.Error(), "Needed a single revision") {
-			return fmt.Errorf("environment %q not found", id)
+			return fmt.Errorf("%w: %q", ErrEnvironmentNotFound, id)
 		}
 		return err
 	}
 	return nil
 }
 
+// CreateOptions configures the creation of environments.
+type CreateOptions struct {
+	// Stash is a stash entry of the source repository (e.g. stash@{0}, or a part of its message)
+	// whose changes are applied on top of the current HEAD in the new environment.
+	Stash string
+	// IncludeUncommitted applies the uncommitted changes of the source repository, untracked files included,
+	// on top of the current HEAD in the new environment. By default, environments start from the committed state only.
+	IncludeUncommitted bool
+	// FromImage is an image used as the container of the new environment, e.g. a checkpoint of another environment,
+	// instead of building it from the base image and the source. The workdir of the image is the source of the
+	// environment: its differences with the current HEAD make up the first commit of the environment.
+	FromImage string
+}
+
+// defaultTitle returns the title of an environment created without one: the subject of the current HEAD commit of
+// the source repository, which is what the environment starts from, or its ID if the repository has no commits.
+func (r *Repository) defaultTitle(ctx context.Context, id string) (string, error) {
+	empty, err := r.IsEmpty(ctx)
+	if err != nil {
+		return "", err
+	}
+	if empty {
+		return id, nil
+	}
+	subject, err := RunGitCommand(ctx, r.userRepoPath, "log", "-1", "--format=%s", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if subject = strings.TrimSpace(subject); subject != "" {
+		return subject, nil
+	}
+	return id, nil
+}
+
 // Create creates a new environment with the given description and explanation.
+// Without a description, the subject of the current HEAD commit is used, see defaultTitle.
 // Requires a dagger client for container operations during environment initialization.
-func (r *Repository) Create(ctx context.Context, dag *dagger.Client, description, explanation string) (*environment.Environment, error) {
-	id := petname.Generate(2, "-")
+func (r *Repository) Create(ctx context.Context, dag *dagger.Client, description, explanation string, opts CreateOptions) (*environment.Environment, error) {
+	if opts.FromImage != "" && (opts.Stash != "" || opts.IncludeUncommitted) {
+		return nil, errors.New("an environment created from an image takes its source from the image, it can't include a stash or uncommitted changes")
+	}
+
+	config := environment.DefaultConfig()
+	if err := config.Load(r.userRepoPath); err != nil {
+		return nil, err
+	}
+
+	id, err := r.newEnvironmentID(ctx, config.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(description) == "" {
+		if description, err = r.defaultTitle(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
 	worktree, err := r.initializeWorktree(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.Stash != "" {
+		if err := r.applyStash(ctx, worktree, opts.Stash, commitLimitsFor(config)); err != nil {
+			return nil, err
+		}
+	}
+	if opts.IncludeUncommitted {
+		if err := r.applyUncommittedChanges(ctx, worktree, commitLimitsFor(config)); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.FromImage != "" {
+		env, err := environment.NewFromImage(ctx, dag, id, description, config, opts.FromImage)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.propagateToWorktree(ctx, env, explanation); err != nil {
+			return nil, err
+		}
+		return env, nil
+	}
+
 	worktreeHead, err := RunGitCommand(ctx, worktree, "rev-parse", "HEAD")
 	if err != nil {
 		return nil, err
@@ -162,17 +313,12 @@ func (r *Repository) Create(ctx context.Context, dag *dagger.Client, description
 		Directory(r.forkRepoPath, dagger.HostDirectoryOpts{NoCache: true}). // bust cache for each Create call
 		AsGit().
 		Ref(worktreeHead).
-		Tree(dagger.GitRefTreeOpts{DiscardGitDir: true}).
+		Tree(dagger.GitRefTreeOpts{DiscardGitDir: !config.GitCheckout}).
 		Sync(ctx) // don't bust cache when loading from state
 	if err != nil {
 		return nil, fmt.Errorf("failed loading initial source directory: %w", err)
 	}
 
-	config := environment.DefaultConfig()
-	if err := config.Load(r.userRepoPath); err != nil {
-		return nil, err
-	}
-
 	env, err := environment.New(ctx, dag, id, description, config, baseSourceDir)
 	if err != nil {
 		return nil, err
@@ -200,7 +346,7 @@ func (r *Repository) Get(ctx context.Context, dag *dagger.Client, id string) (*e
 
 	state, err := r.loadState(ctx, worktree)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("environment %q: %w", id, err)
 	}
 
 	env, err := environment.Load(ctx, dag, id, state, worktree)
@@ -226,7 +372,7 @@ func (r *Repository) Info(ctx context.Context, id string) (*environment.Environm
 
 	state, err := r.loadState(ctx, worktree)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("environment %q: %w", id, err)
 	}
 
 	envInfo, err := environment.LoadInfo(ctx, id, state, worktree)
@@ -237,10 +383,75 @@ func (r *Repository) Info(ctx context.Context, id string) (*environment.Environm
 	return envInfo, nil
 }
 
-// List returns information about all environments in the repository.
+// ListOptions controls which environments List returns.
+// The zero value returns every environment.
+type ListOptions struct {
+	// Limit is the maximum number of environments to return. 0 means no limit.
+	Limit int
+	// Offset is the number of environments to skip, after filtering and sorting.
+	Offset int
+	// TitleContains only keeps environments whose title contains this string (case insensitive).
+	TitleContains string
+	// UpdatedSince only keeps environments updated at or after this time.
+	UpdatedSince time.Time
+}
+
+// matches reports whether the environment passes the filters of the options.
+func (o ListOptions) matches(envInfo *environment.EnvironmentInfo) bool {
+	if o.TitleContains != "" && !strings.Contains(strings.ToLower(envInfo.State.Title), strings.ToLower(o.TitleContains)) {
+		return false
+	}
+	if !o.UpdatedSince.IsZero() && envInfo.State.UpdatedAt.Before(o.UpdatedSince) {
+		return false
+	}
+	return true
+}
+
+// paginate returns the page of envs selected by Offset and Limit.
+func (o ListOptions) paginate(envs []*environment.EnvironmentInfo) []*environment.EnvironmentInfo {
+	if o.Offset > 0 {
+		if o.Offset >= len(envs) {
+			return []*environment.EnvironmentInfo{}
+		}
+		envs = envs[o.Offset:]
+	}
+	if o.Limit > 0 && o.Limit < len(envs) {
+		envs = envs[:o.Limit]
+	}
+	return envs
+}
+
+// ParseUpdatedSince parses a ListOptions.UpdatedSince value given either as a duration
+// relative to now (e.g. "24h"), an RFC 3339 timestamp or a date (YYYY-MM-DD).
+func ParseUpdatedSince(value string) (time.Time, error) {
+	return parseUpdatedSince(value, time.Now())
+}
+
+func parseUpdatedSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("invalid duration %q: must not be negative", value)
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected a duration (e.g. 24h), an RFC 3339 timestamp or a date (YYYY-MM-DD)", value)
+}
+
+// List returns information about the environments in the repository matching opts.
+// Environments are sorted by most recently updated first, then paginated.
 // Returns EnvironmentInfo slice avoiding dagger client initialization.
 // Use Get() on individual environments when you need full Environment with container operations.
-func (r *Repository) List(ctx context.Context) ([]*environment.EnvironmentInfo, error) {
+func (r *Repository) List(ctx context.Context, opts ListOptions) ([]*environment.EnvironmentInfo, error) {
+	if opts.Limit < 0 || opts.Offset < 0 {
+		return nil, errors.New("limit and offset must not be negative")
+	}
+
 	branches, err := RunGitCommand(ctx, r.forkRepoPath, "branch", "--format", "%(refname:short)")
 	if err != nil {
 		return nil, err
@@ -257,15 +468,19 @@ func (r *Repository) List(ctx context.Context) ([]*environment.EnvironmentInfo,
 			return nil, err
 		}
 		state, err := r.loadState(ctx, worktree)
-		if err != nil || state == nil {
+		if err != nil {
 			continue
 		}
 
-		envInfo, err := r.Info(ctx, branch)
+		// The state is already loaded, no need to go through Info() again.
+		envInfo, err := environment.LoadInfo(ctx, branch, state, worktree)
 		if err != nil {
 			return nil, err
 		}
 
+		if !opts.matches(envInfo) {
+			continue
+		}
 		envs = append(envs, envInfo)
 	}
 
@@ -274,14 +489,14 @@ func (r *Repository) List(ctx context.Context) ([]*environment.EnvironmentInfo,
 		return envs[i].State.UpdatedAt.After(envs[j].State.UpdatedAt)
 	})
 
-	return envs, nil
+	return opts.paginate(envs), nil
 }
 
 // ListDescendantEnvironments returns environments that are descendants of the given commit.
 // This filters environments to only those where the provided commit is an ancestor
 // of the environment's current HEAD. Environments are sorted by most recently updated first.
 func (r *Repository) ListDescendantEnvironments(ctx context.Context, ancestorCommit string) ([]*environment.EnvironmentInfo, error) {
-	allEnvs, err := r.List(ctx)
+	allEnvs, err := r.List(ctx, ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -310,17 +525,136 @@ func (r *Repository) isDescendantOfCommit(ctx context.Context, ancestorCommit, e
 
 // Update saves the provided environment to the repository.
 // Writes configuration and source code changes to the worktree and history + state to git notes.
+// Within WithTransaction, this is deferred until the transaction ends.
 func (r *Repository) Update(ctx context.Context, env *environment.Environment, explanation string) error {
+	if r.tx != nil {
+		r.tx.add(env, explanation)
+		return nil
+	}
+	return r.update(ctx, env, explanation)
+}
+
+func (r *Repository) update(ctx context.Context, env *environment.Environment, explanation string) error {
+	if err := r.recordHistorySource(ctx, env); err != nil {
+		return err
+	}
 	if err := r.propagateToWorktree(ctx, env, explanation); err != nil {
 		return err
 	}
 	if note := env.Notes.Pop(); note != "" {
-		return r.addGitNote(ctx, env, note)
+		return r.addGitNote(ctx, env.EnvironmentInfo, note)
 	}
 
 	return nil
 }
 
+// Pause sets an environment aside without losing its work: its container state is kept as is, and commands are
+// refused until it's resumed. Pausing is only recorded in the state of the environment: its services belong to the
+// process that started them, usually the MCP server of the agent, which stops them once it notices with
+// StopPausedServices.
+func (r *Repository) Pause(ctx context.Context, id string) error {
+	return r.setPaused(ctx, id, true)
+}
+
+// Resume resumes a paused environment. Its services are started again by the next command that needs them.
+func (r *Repository) Resume(ctx context.Context, id string) error {
+	return r.setPaused(ctx, id, false)
+}
+
+func (r *Repository) setPaused(ctx context.Context, id string, paused bool) error {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return err
+	}
+	if envInfo.State.Paused == paused {
+		if paused {
+			return fmt.Errorf("environment %s is already paused", id)
+		}
+		return fmt.Errorf("environment %s is not paused", id)
+	}
+	envInfo.State.Paused = paused
+
+	if err := r.saveState(ctx, envInfo); err != nil {
+		return fmt.Errorf("failed to save environment: %w", err)
+	}
+	if err := r.publish(ctx, envInfo); err != nil {
+		return err
+	}
+	note := "Resume environment"
+	if paused {
+		note = "Pause environment"
+	}
+	return r.addGitNote(ctx, envInfo, note)
+}
+
+// StopPausedServices stops the services this process runs for the environments of the repository that were paused,
+// possibly by another process.
+func (r *Repository) StopPausedServices(ctx context.Context) error {
+	var errs []error
+	for _, id := range environment.EnvironmentsWithServices() {
+		envInfo, err := r.Info(ctx, id)
+		if err != nil {
+			// Not an environment of this repository
+			continue
+		}
+		if !envInfo.State.Paused {
+			continue
+		}
+		if err := environment.StopServices(ctx, id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush commits the changes the environment left uncommitted in its worktree with the per-session commit granularity,
+// and propagates the git notes whose propagation to the source repository is pending.
+// It does nothing if there are no such changes or notes.
+func (r *Repository) Flush(ctx context.Context, id string) error {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return err
+	}
+	worktreePath, err := r.WorktreePath(id)
+	if err != nil {
+		return fmt.Errorf("failed to get worktree path: %w", err)
+	}
+
+	head, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	message := pendingChangesMessage(envInfo.State.PendingChanges)
+	warnings, err := r.commitWorktreeChanges(ctx, worktreePath, message, commitLimitsFor(envInfo.State.Config))
+	if err != nil {
+		return fmt.Errorf("failed to commit worktree changes: %w", err)
+	}
+	newHead, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if newHead == head && len(envInfo.State.PendingChanges) == 0 {
+		return r.flushNotes(ctx, envInfo)
+	}
+	// The worktree still holds the last export, only committed
+	exportedWorkdirs.advance(worktreePath, strings.TrimSpace(head), strings.TrimSpace(newHead))
+
+	envInfo.State.PendingChanges = nil
+	if err := r.saveState(ctx, envInfo); err != nil {
+		return fmt.Errorf("failed to add notes: %w", err)
+	}
+	for _, warning := range warnings {
+		slog.Warn(warning, "environment.id", id)
+		if err := r.addGitNote(ctx, envInfo, warning); err != nil {
+			return err
+		}
+	}
+	if err := r.publish(ctx, envInfo); err != nil {
+		return err
+	}
+	return r.flushNotes(ctx, envInfo)
+}
+
 // Delete removes an environment from the repository.
 func (r *Repository) Delete(ctx context.Context, id string) error {
 	if err := r.exists(ctx, id); err != nil {
@@ -330,12 +664,109 @@ func (r *Repository) Delete(ctx context.Context, id string) error {
 	if err := r.deleteWorktree(id); err != nil {
 		return err
 	}
+	if err := r.deleteAttachments(id); err != nil {
+		return err
+	}
+	if err := r.deleteComments(ctx, id); err != nil {
+		return err
+	}
 	if err := r.deleteLocalRemoteBranch(id); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Rename changes the ID of an environment, and so its branch, worktree and attachments.
+// Local branches of the source repository tracking the environment are updated to track it under its new ID.
+func (r *Repository) Rename(ctx context.Context, id, newID string) error {
+	if err := r.exists(ctx, id); err != nil {
+		return err
+	}
+	if err := validateID(ctx, newID); err != nil {
+		return err
+	}
+	if err := r.exists(ctx, newID); err == nil {
+		return fmt.Errorf("%w: %q", ErrEnvironmentExists, newID)
+	} else if !errors.Is(err, ErrEnvironmentNotFound) {
+		return err
+	}
+
+	if _, err := RunGitCommand(ctx, r.forkRepoPath, "branch", "-m", id, newID); err != nil {
+		return fmt.Errorf("failed to rename branch: %w", err)
+	}
+
+	worktreePath, err := r.WorktreePath(id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(worktreePath); err == nil {
+		newWorktreePath, err := r.WorktreePath(newID)
+		if err != nil {
+			return err
+		}
+		exportedWorkdirs.forget(worktreePath)
+		if _, err := RunGitCommand(ctx, r.forkRepoPath, "worktree", "move", worktreePath, newWorktreePath); err != nil {
+			return fmt.Errorf("failed to move worktree: %w", err)
+		}
+	}
+
+	attachmentsPath, err := r.attachmentsPath(id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(attachmentsPath); err == nil {
+		newAttachmentsPath, err := r.attachmentsPath(newID)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(attachmentsPath, newAttachmentsPath); err != nil {
+			return fmt.Errorf("failed to move attachments: %w", err)
+		}
+	}
+	if err := r.moveComments(ctx, id, newID); err != nil {
+		return fmt.Errorf("failed to move comments: %w", err)
+	}
+
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "fetch", containerUseRemote, newID); err != nil {
+		return err
+	}
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "remote", "prune", containerUseRemote); err != nil {
+		return err
+	}
+	return r.retrackBranches(ctx, id, newID)
+}
+
+// retrackBranches makes the local branches of the source repository tracking the environment's branch track
+// its new name.
+func (r *Repository) retrackBranches(ctx context.Context, id, newID string) error {
+	// Exit code 1 means no branch tracks anything, which is fine.
+	merges, _ := RunGitCommand(ctx, r.userRepoPath, "config", "--get-regexp", `^branch\..*\.merge$`)
+	for line := range strings.SplitSeq(strings.TrimSpace(merges), "\n") {
+		key, merge, ok := strings.Cut(line, " ")
+		if !ok || merge != "refs/heads/"+id {
+			continue
+		}
+		branch := strings.TrimSuffix(strings.TrimPrefix(key, "branch."), ".merge")
+		remote, err := RunGitCommand(ctx, r.userRepoPath, "config", "--get", "branch."+branch+".remote")
+		if err != nil || strings.TrimSpace(remote) != containerUseRemote {
+			continue
+		}
+		if _, err := RunGitCommand(ctx, r.userRepoPath, "config", key, "refs/heads/"+newID); err != nil {
+			return fmt.Errorf("failed to update the upstream of branch %s: %w", branch, err)
+		}
+	}
+	return nil
+}
+
+// EnsureWorktree returns the path of the worktree of the environment, checking it out first if needed, e.g. after
+// it was deleted. Unlike Checkout, the current branch of the source repository is left alone.
+func (r *Repository) EnsureWorktree(ctx context.Context, id string) (string, error) {
+	if err := r.exists(ctx, id); err != nil {
+		return "", err
+	}
+	return r.initializeWorktree(ctx, id)
+}
+
 // Checkout changes the user's current branch to that of the identified environment.
 // It attempts to get the most recent commit from the environment without discarding any user changes.
 func (r *Repository) Checkout(ctx context.Context, id, branch string) (string, error) {
@@ -389,6 +820,44 @@ func (r *Repository) Checkout(ctx context.Context, id, branch string) (string, e
 	return branch, err
 }
 
+// CheckoutWorktree checks the environment out in a new worktree of the source repository at dir, leaving the user's
+// current branch untouched. The worktree is on a new branch tracking the environment if branch isn't empty,
+// detached at the environment's latest commit otherwise. It returns the absolute path of the worktree.
+func (r *Repository) CheckoutWorktree(ctx context.Context, id, dir, branch string) (string, error) {
+	if err := r.exists(ctx, id); err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"worktree", "add"}
+	if branch != "" {
+		args = append(args, "--track", "-b", branch)
+	} else {
+		args = append(args, "--detach")
+	}
+	args = append(args, dir, fmt.Sprintf("%s/%s", containerUseRemote, id))
+	if _, err := RunGitCommand(ctx, r.userRepoPath, args...); err != nil {
+		return "", fmt.Errorf("failed to check out environment %s in %s: %w", id, dir, err)
+	}
+	return dir, nil
+}
+
+// RemoveCheckoutWorktree removes a worktree created by CheckoutWorktree. Like git, it refuses to remove
+// worktrees with uncommitted changes.
+func (r *Repository) RemoveCheckoutWorktree(ctx context.Context, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "worktree", "remove", dir); err != nil {
+		return fmt.Errorf("failed to remove worktree %s: %w", dir, err)
+	}
+	return nil
+}
+
 func (r *Repository) Log(ctx context.Context, id string, patch bool, w io.Writer) error {
 	envInfo, err := r.Info(ctx, id)
 	if err != nil {
@@ -416,7 +885,8 @@ func (r *Repository) Log(ctx context.Context, id string, patch bool, w io.Writer
 	return RunInteractiveGitCommand(ctx, r.userRepoPath, w, logArgs...)
 }
 
-func (r *Repository) Diff(ctx context.Context, id string, w io.Writer) error {
+// Diff writes the changes of the environment since it diverged from the current branch, limited to paths if any.
+func (r *Repository) Diff(ctx context.Context, id string, w io.Writer, paths ...string) error {
 	envInfo, err := r.Info(ctx, id)
 	if err != nil {
 		return err
@@ -432,24 +902,218 @@ func (r *Repository) Diff(ctx context.Context, id string, w io.Writer) error {
 	}
 
 	diffArgs = append(diffArgs, revisionRange)
+	if len(paths) > 0 {
+		diffArgs = append(diffArgs, "--")
+		diffArgs = append(diffArgs, paths...)
+	}
 
 	return RunInteractiveGitCommand(ctx, r.userRepoPath, w, diffArgs...)
 }
 
-func (r *Repository) Merge(ctx context.Context, id string, w io.Writer) error {
+// ChangedFiles returns the files changed in the environment since it diverged from the current branch, as Diff
+// shows them, relative to the repository root.
+func (r *Repository) ChangedFiles(ctx context.Context, id string) ([]string, error) {
 	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	revisionRange, err := r.revisionRange(ctx, envInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// -z keeps unusual file names as is, rather than quoted
+	output, err := RunGitCommand(ctx, r.userRepoPath, "diff", "--name-only", "-z", revisionRange)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changed files: %w", err)
+	}
+
+	var files []string
+	for file := range strings.SplitSeq(output, "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// FormatPatch writes the commits of the environment since it diverged from the current branch to outDir as a
+// series of patches, one per commit, with their original authors, as `git format-patch` does. The patches apply
+// onto the current branch with `git am`. It returns the paths of the patches, in order.
+func (r *Repository) FormatPatch(ctx context.Context, id, outDir string) ([]string, error) {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	revisionRange, err := r.revisionRange(ctx, envInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// git runs in the source repository, not necessarily the current directory
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return nil, err
+	}
+	output, err := RunGitCommand(ctx, r.userRepoPath, "format-patch", "--no-notes", "--output-directory", outDir, revisionRange)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format patches: %w", err)
+	}
+
+	var patches []string
+	for line := range strings.SplitSeq(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			patches = append(patches, line)
+		}
+	}
+	return patches, nil
+}
+
+// MergeOptions holds the settings of Merge and Apply.
+type MergeOptions struct {
+	// TargetBranch is the branch to bring the environment's changes to, instead of the current branch.
+	// It's checked out in a temporary worktree, so the current branch and working tree are left untouched.
+	TargetBranch string
+}
+
+func (r *Repository) Merge(ctx context.Context, id string, w io.Writer, opts MergeOptions) error {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if opts.TargetBranch == "" {
+		empty, err := r.IsEmpty(ctx)
+		if err != nil {
+			return err
+		}
+		if empty {
+			// There's no commit to merge into: the current branch starts from the environment's history,
+			// which git only does by fast-forwarding
+			return r.mergeInto(ctx, envInfo.ID, "", w, "", "merge", "--ff-only", "--autostash", "--", "container-use/"+envInfo.ID)
+		}
+	}
+
+	return r.mergeInto(ctx, envInfo.ID, opts.TargetBranch, w, "", "merge", "--no-ff", "--autostash", "-m", "Merge environment "+envInfo.ID, "--", "container-use/"+envInfo.ID)
+}
+
+// Apply brings the changes of the environment to the current branch as staged changes.
+// Changes applied to another target branch are committed as a single commit instead,
+// since they can't be left staged on a branch that isn't checked out.
+func (r *Repository) Apply(ctx context.Context, id string, w io.Writer, opts MergeOptions) error {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if opts.TargetBranch == "" {
+		empty, err := r.IsEmpty(ctx)
+		if err != nil {
+			return err
+		}
+		if empty {
+			return fmt.Errorf("the repository has no commits yet to apply environment %s onto: merge it instead, or commit first", envInfo.ID)
+		}
+	}
+
+	return r.mergeInto(ctx, envInfo.ID, opts.TargetBranch, w, "Apply environment "+envInfo.ID, "merge", "--autostash", "--squash", "--", "container-use/"+envInfo.ID)
+}
+
+// mergeInto runs the merge command mergeArgs on branch: in the source repository if it's the current branch (or empty),
+// in a temporary worktree otherwise. There, the changes left staged by the merge are committed with commitMessage,
+// and a conflicting merge is discarded rather than left for the user to resolve.
+func (r *Repository) mergeInto(ctx context.Context, id, branch string, w io.Writer, commitMessage string, mergeArgs ...string) error {
+	currentBranch, err := r.currentUserBranch(ctx)
+	if err != nil {
+		return err
+	}
+	if branch == "" || branch == strings.TrimSpace(currentBranch) {
+		if err := RunInteractiveGitCommand(ctx, r.userRepoPath, w, mergeArgs...); err != nil {
+			return checkMergeConflict(ctx, r.userRepoPath, id, err)
+		}
+		return nil
+	}
+
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err != nil {
+		return fmt.Errorf("branch %q doesn't exist", branch)
+	}
+	// A branch checked out in another worktree of the user is merged there, like the current branch,
+	// its work in progress autostashed
+	checkedOut, err := r.branchWorktree(ctx, branch)
+	if err != nil {
+		return err
+	}
+	if checkedOut != "" {
+		if err := RunInteractiveGitCommand(ctx, checkedOut, w, mergeArgs...); err != nil {
+			if err := checkMergeConflict(ctx, checkedOut, id, err); errors.Is(err, ErrMergeConflict) {
+				return fmt.Errorf("%w, in the worktree of %s at %s", err, branch, checkedOut)
+			}
+			return err
+		}
+		return nil
+	}
+	worktreePath, err := os.MkdirTemp("", "container-use-merge-*")
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(worktreePath)
+	// git refuses to check out a branch that is already checked out in another worktree
+	if _, err := RunGitCommand(ctx, r.userRepoPath, "worktree", "add", worktreePath, branch); err != nil {
+		return fmt.Errorf("failed to check out %s: %w", branch, err)
+	}
+	defer func() {
+		if _, err := RunGitCommand(context.WithoutCancel(ctx), r.userRepoPath, "worktree", "remove", "--force", worktreePath); err != nil {
+			slog.Warn("Failed to remove temporary worktree", "path", worktreePath, "err", err)
+		}
+	}()
 
-	return RunInteractiveGitCommand(ctx, r.userRepoPath, w, "merge", "--no-ff", "--autostash", "-m", "Merge environment "+envInfo.ID, "--", "container-use/"+envInfo.ID)
+	if err := RunInteractiveGitCommand(ctx, worktreePath, w, mergeArgs...); err != nil {
+		files, conflictErr := conflictedFiles(ctx, worktreePath)
+		if conflictErr != nil || len(files) == 0 {
+			return err
+		}
+		return fmt.Errorf("%w in %s while merging environment %q into %s, nothing was changed", ErrMergeConflict, strings.Join(files, ", "), id, branch)
+	}
+	if commitMessage == "" {
+		return nil
+	}
+	status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(status) == "" {
+		return nil
+	}
+	if _, err := RunGitCommand(ctx, worktreePath, "commit", "-m", commitMessage); err != nil {
+		return fmt.Errorf("failed to commit changes to %s: %w", branch, err)
+	}
+	return nil
 }
 
-func (r *Repository) Apply(ctx context.Context, id string, w io.Writer) error {
+// PreviewMerge writes the changes merging or applying the environment would bring to the current branch,
+// or to opts.TargetBranch, without touching the index or the working tree. If the merge would conflict,
+// the conflicting files are shown with conflict markers and an error wrapping ErrMergeConflict is returned.
+func (r *Repository) PreviewMerge(ctx context.Context, id string, w io.Writer, opts MergeOptions) error {
 	envInfo, err := r.Info(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	return RunInteractiveGitCommand(ctx, r.userRepoPath, w, "merge", "--autostash", "--squash", "--", "container-use/"+envInfo.ID)
+	target := "HEAD"
+	if opts.TargetBranch != "" {
+		target = "refs/heads/" + opts.TargetBranch
+	}
+	tree, conflicts, err := r.mergeTree(ctx, target, "container-use/"+envInfo.ID)
+	if err != nil {
+		return err
+	}
+	if err := RunInteractiveGitCommand(ctx, r.userRepoPath, w, "diff", target, tree); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w in %s if environment %q was merged", ErrMergeConflict, strings.Join(conflicts, ", "), envInfo.ID)
+	}
+	return nil
 }
@@ -6,7 +6,9 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/dagger/container-use/environment"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -66,3 +68,968 @@ func TestRepositoryOpen(t *testing.T) {
 		assert.Equal(t, repo.forkRepoPath, strings.TrimSpace(remote))
 	})
 }
+
+// TestOpenReadOnly tests that OpenReadOnly doesn't set up the repository
+func TestOpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+	configDir := t.TempDir()
+	repoDir := initTestRepo(t)
+
+	_, err := OpenReadOnlyWithBasePath(ctx, repoDir, configDir)
+	require.ErrorIs(t, err, ErrNotInitialized)
+	assert.NoDirExists(t, filepath.Join(configDir, "repos"))
+	remotes, err := RunGitCommand(ctx, repoDir, "remote")
+	require.NoError(t, err)
+	assert.Empty(t, remotes)
+
+	// Once set up, the repository can be read
+	_, err = OpenWithBasePath(ctx, repoDir, configDir)
+	require.NoError(t, err)
+	repo, err := OpenReadOnlyWithBasePath(ctx, repoDir, configDir)
+	require.NoError(t, err)
+	envs, err := repo.List(ctx, ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, envs)
+}
+
+// TestMigrateGitNotes verifies notes from the legacy refs are moved to their namespaced location
+// without touching notes the user keeps under the same legacy ref name.
+func TestMigrateGitNotes(t *testing.T) {
+	ctx := context.Background()
+	configDir := t.TempDir()
+
+	repoDir := initTestRepo(t)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, configDir)
+	require.NoError(t, err)
+
+	// Simulate notes written by an older version of container-use
+	_, err = RunGitCommand(ctx, repoDir, "push", containerUseRemote, "HEAD:refs/heads/test-env")
+	require.NoError(t, err)
+	forkGit := func(args ...string) string {
+		out, err := RunGitCommand(ctx, repo.forkRepoPath, append([]string{"-c", "user.name=Test User", "-c", "user.email=test@example.com"}, args...)...)
+		require.NoError(t, err)
+		return strings.TrimSpace(out)
+	}
+	forkGit("notes", "--ref", legacyGitNotesLogRef, "add", "-m", "legacy log", "test-env")
+	forkGit("notes", "--ref", legacyGitNotesStateRef, "add", "-m", "legacy state", "test-env")
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "refs/notes/container-use-state:refs/notes/container-use-state")
+	require.NoError(t, err)
+	// The user has notes of their own under the legacy log ref
+	_, err = RunGitCommand(ctx, repoDir, "notes", "--ref", legacyGitNotesLogRef, "add", "-m", "my own note", "HEAD")
+	require.NoError(t, err)
+
+	_, err = OpenWithBasePath(ctx, repoDir, configDir)
+	require.NoError(t, err)
+
+	assert.Equal(t, "legacy log", forkGit("notes", "--ref", gitNotesLogRef, "show", "test-env"))
+	assert.Equal(t, "legacy state", forkGit("notes", "--ref", gitNotesStateRef, "show", "test-env"))
+	for _, ref := range []string{legacyGitNotesLogRef, legacyGitNotesStateRef} {
+		commit, err := resolveRef(ctx, repo.forkRepoPath, "refs/notes/"+ref)
+		require.NoError(t, err)
+		assert.Empty(t, commit, "legacy ref %s should be removed from the fork", ref)
+	}
+
+	userNote, err := RunGitCommand(ctx, repoDir, "notes", "--ref", legacyGitNotesLogRef, "show", "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, "my own note", strings.TrimSpace(userNote))
+
+	commit, err := resolveRef(ctx, repoDir, "refs/notes/"+legacyGitNotesStateRef)
+	require.NoError(t, err)
+	assert.Empty(t, commit, "copy of the legacy state notes should be removed from the user repository")
+	commit, err = resolveRef(ctx, repoDir, "refs/notes/"+gitNotesStateRef)
+	require.NoError(t, err)
+	assert.NotEmpty(t, commit, "migrated state notes should be propagated to the user repository")
+}
+
+// TestOpenRepairsMovedFork verifies environments remain usable after the container-use data directory moved.
+func TestOpenRepairsMovedFork(t *testing.T) {
+	ctx := context.Background()
+	oldBasePath := filepath.Join(t.TempDir(), "old")
+	newBasePath := filepath.Join(t.TempDir(), "new")
+
+	repoDir := initTestRepo(t)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, oldBasePath)
+	require.NoError(t, err)
+	_, err = repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	// A tracking branch set up against the fork path rather than the remote name
+	_, err = RunGitCommand(ctx, repoDir, "branch", "cu-test-env", "container-use/test-env")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "config", "branch.cu-test-env.remote", repo.forkRepoPath)
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "config", "branch.cu-test-env.merge", "refs/heads/test-env")
+	require.NoError(t, err)
+
+	require.NoError(t, os.Rename(oldBasePath, newBasePath))
+
+	repo, err = OpenWithBasePath(ctx, repoDir, newBasePath)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(repo.forkRepoPath, newBasePath), "fork should be located under the new base path")
+
+	remote, err := RunGitCommand(ctx, repoDir, "remote", "get-url", containerUseRemote)
+	require.NoError(t, err)
+	assert.Equal(t, repo.forkRepoPath, strings.TrimSpace(remote))
+
+	trackingRemote, err := RunGitCommand(ctx, repoDir, "config", "branch.cu-test-env.remote")
+	require.NoError(t, err)
+	assert.Equal(t, containerUseRemote, strings.TrimSpace(trackingRemote))
+
+	// The worktree is connected to the fork again
+	worktreePath, err := repo.WorktreePath("test-env")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(worktreePath, newBasePath))
+	for _, args := range [][]string{
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	writeFile(t, worktreePath, "hello.txt", "hello")
+	_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Add hello", commitLimits{})
+	require.NoError(t, err)
+	worktrees, err := RunGitCommand(ctx, repo.forkRepoPath, "worktree", "list")
+	require.NoError(t, err)
+	assert.Contains(t, worktrees, worktreePath)
+	assert.NotContains(t, worktrees, "prunable")
+
+	// And changes are visible from the source repository
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+	require.NoError(t, err)
+	files, err := RunGitCommand(ctx, repoDir, "ls-tree", "--name-only", "container-use/test-env")
+	require.NoError(t, err)
+	assert.Contains(t, files, "hello.txt")
+}
+
+// TestListOptions verifies filtering and pagination of environment listings.
+func TestListOptions(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	newEnv := func(id, title string, updatedAt time.Time) *environment.EnvironmentInfo {
+		return &environment.EnvironmentInfo{
+			ID:    id,
+			State: &environment.State{Title: title, UpdatedAt: updatedAt},
+		}
+	}
+	api := newEnv("api", "Fix API handler", now)
+	docs := newEnv("docs", "Update docs", now.Add(-48*time.Hour))
+
+	t.Run("zero_value_matches_everything", func(t *testing.T) {
+		assert.True(t, ListOptions{}.matches(api))
+		assert.True(t, ListOptions{}.matches(docs))
+	})
+
+	t.Run("title_contains_is_case_insensitive", func(t *testing.T) {
+		opts := ListOptions{TitleContains: "api"}
+		assert.True(t, opts.matches(api))
+		assert.False(t, opts.matches(docs))
+	})
+
+	t.Run("updated_since", func(t *testing.T) {
+		opts := ListOptions{UpdatedSince: now.Add(-24 * time.Hour)}
+		assert.True(t, opts.matches(api))
+		assert.False(t, opts.matches(docs))
+	})
+
+	t.Run("paginate", func(t *testing.T) {
+		envs := []*environment.EnvironmentInfo{
+			newEnv("a", "", now), newEnv("b", "", now), newEnv("c", "", now),
+		}
+		ids := func(envs []*environment.EnvironmentInfo) []string {
+			ids := []string{}
+			for _, env := range envs {
+				ids = append(ids, env.ID)
+			}
+			return ids
+		}
+
+		assert.Equal(t, []string{"a", "b", "c"}, ids(ListOptions{}.paginate(envs)))
+		assert.Equal(t, []string{"a", "b"}, ids(ListOptions{Limit: 2}.paginate(envs)))
+		assert.Equal(t, []string{"b", "c"}, ids(ListOptions{Offset: 1, Limit: 5}.paginate(envs)))
+		assert.Empty(t, ListOptions{Offset: 3}.paginate(envs))
+	})
+}
+
+func TestParseUpdatedSince(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	since, err := parseUpdatedSince("24h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), since)
+
+	since, err = parseUpdatedSince("2025-05-01T10:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC), since)
+
+	since, err = parseUpdatedSince("2025-05-01", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 5, 1, 0, 0, 0, 0, time.Local), since)
+
+	for _, value := range []string{"-1h", "yesterday", ""} {
+		_, err := parseUpdatedSince(value, now)
+		assert.Error(t, err, value)
+	}
+}
+
+// TestErrors verifies repository operations return errors matching the exported sentinels.
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*Repository, string) {
+		repoDir := initTestRepoWithoutCommits(t)
+		writeFile(t, repoDir, "file.txt", "initial\n")
+		_, err := RunGitCommand(ctx, repoDir, "add", ".")
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+		require.NoError(t, err)
+
+		repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+		require.NoError(t, err)
+		return repo, repoDir
+	}
+
+	t.Run("environment_not_found", func(t *testing.T) {
+		repo, _ := setup(t)
+		_, err := repo.Info(ctx, "does-not-exist")
+		assert.ErrorIs(t, err, ErrEnvironmentNotFound)
+	})
+
+	t.Run("no_state", func(t *testing.T) {
+		repo, _ := setup(t)
+		worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+		require.NoError(t, err)
+
+		_, err = repo.loadState(ctx, worktreePath)
+		assert.ErrorIs(t, err, ErrNoState)
+		_, err = repo.Info(ctx, "test-env")
+		assert.ErrorIs(t, err, ErrNoState)
+	})
+
+	t.Run("dirty_repo", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		status, err := repo.IsDirty(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, status)
+
+		writeFile(t, repoDir, "file.txt", "modified\n")
+		status, err = repo.IsDirty(ctx)
+		assert.ErrorIs(t, err, ErrDirtyRepo)
+		assert.Contains(t, status, "file.txt")
+	})
+
+	t.Run("merge_conflict", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+		require.NoError(t, err)
+		for _, args := range [][]string{
+			{"config", "user.email", "test@example.com"},
+			{"config", "user.name", "Test User"},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+		writeFile(t, worktreePath, "file.txt", "from the environment\n")
+		_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Change file", commitLimits{})
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", "{}")
+		require.NoError(t, err)
+
+		_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+		require.NoError(t, err)
+
+		writeFile(t, repoDir, "file.txt", "from the user\n")
+		_, err = RunGitCommand(ctx, repoDir, "commit", "-am", "Change file")
+		require.NoError(t, err)
+
+		var out strings.Builder
+		err = repo.Merge(ctx, "test-env", &out, MergeOptions{})
+		assert.ErrorIs(t, err, ErrMergeConflict)
+		assert.ErrorContains(t, err, "file.txt")
+	})
+}
+
+func TestAttachments(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+
+	attachments, err := repo.Attachments(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Empty(t, attachments)
+
+	srcDir := t.TempDir()
+	writeFile(t, srcDir, "design.md", "# Design\n")
+	writeFile(t, srcDir, "screenshot.png", "png")
+	for _, name := range []string{"screenshot.png", "design.md"} {
+		attached, err := repo.Attach(ctx, "test-env", filepath.Join(srcDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, name, attached)
+	}
+
+	attachments, err = repo.Attachments(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"design.md", "screenshot.png"}, attachments)
+
+	// Attachments are kept out of the worktree
+	assert.NoFileExists(t, filepath.Join(worktreePath, "design.md"))
+
+	_, err = repo.Attach(ctx, "test-env", srcDir)
+	assert.Error(t, err)
+	_, err = repo.Attach(ctx, "does-not-exist", filepath.Join(srcDir, "design.md"))
+	assert.ErrorIs(t, err, ErrEnvironmentNotFound)
+}
+
+func TestPreviewMerge(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*Repository, string) {
+		repoDir := initTestRepoWithoutCommits(t)
+		writeFile(t, repoDir, "file.txt", "initial\n")
+		_, err := RunGitCommand(ctx, repoDir, "add", ".")
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+		require.NoError(t, err)
+
+		repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+		require.NoError(t, err)
+
+		worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+		require.NoError(t, err)
+		for _, args := range [][]string{
+			{"config", "user.email", "test@example.com"},
+			{"config", "user.name", "Test User"},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+		writeFile(t, worktreePath, "file.txt", "from the environment\n")
+		writeFile(t, worktreePath, "new.txt", "new file\n")
+		_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Change files", commitLimits{})
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", "{}")
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+		require.NoError(t, err)
+
+		return repo, repoDir
+	}
+
+	headAndStatus := func(t *testing.T, repoDir string) string {
+		head, err := RunGitCommand(ctx, repoDir, "rev-parse", "HEAD")
+		require.NoError(t, err)
+		status, err := RunGitCommand(ctx, repoDir, "status", "--porcelain")
+		require.NoError(t, err)
+		return head + status
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		before := headAndStatus(t, repoDir)
+
+		var out strings.Builder
+		require.NoError(t, repo.PreviewMerge(ctx, "test-env", &out, MergeOptions{}))
+		assert.Contains(t, out.String(), "-initial")
+		assert.Contains(t, out.String(), "+from the environment")
+		assert.Contains(t, out.String(), "+new file")
+
+		// Nothing changed
+		assert.Equal(t, before, headAndStatus(t, repoDir))
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		writeFile(t, repoDir, "file.txt", "from the user\n")
+		_, err := RunGitCommand(ctx, repoDir, "commit", "-am", "Change file")
+		require.NoError(t, err)
+		before := headAndStatus(t, repoDir)
+
+		var out strings.Builder
+		err = repo.PreviewMerge(ctx, "test-env", &out, MergeOptions{})
+		assert.ErrorIs(t, err, ErrMergeConflict)
+		assert.ErrorContains(t, err, "file.txt")
+		assert.NotContains(t, err.Error(), "new.txt")
+		assert.Contains(t, out.String(), "+<<<<<<<")
+		assert.Contains(t, out.String(), "+new file")
+
+		assert.Equal(t, before, headAndStatus(t, repoDir))
+	})
+}
+
+func TestMergeTargetBranch(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*Repository, string) {
+		repoDir := initTestRepoWithoutCommits(t)
+		writeFile(t, repoDir, "file.txt", "initial\n")
+		_, err := RunGitCommand(ctx, repoDir, "add", ".")
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "branch", "release")
+		require.NoError(t, err)
+
+		repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+		require.NoError(t, err)
+
+		worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+		require.NoError(t, err)
+		for _, args := range [][]string{
+			{"config", "user.email", "test@example.com"},
+			{"config", "user.name", "Test User"},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+		writeFile(t, worktreePath, "file.txt", "from the environment\n")
+		_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Change file", commitLimits{})
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", "{}")
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+		require.NoError(t, err)
+
+		// Work in progress on the current branch must be left alone
+		writeFile(t, repoDir, "wip.txt", "in progress\n")
+		return repo, repoDir
+	}
+
+	// current returns the current branch, HEAD and status of the source repository.
+	current := func(t *testing.T, repoDir string) string {
+		branch, err := RunGitCommand(ctx, repoDir, "branch", "--show-current")
+		require.NoError(t, err)
+		head, err := RunGitCommand(ctx, repoDir, "rev-parse", "HEAD")
+		require.NoError(t, err)
+		status, err := RunGitCommand(ctx, repoDir, "status", "--porcelain")
+		require.NoError(t, err)
+		return branch + head + status
+	}
+	releaseFile := func(t *testing.T, repoDir string) string {
+		content, err := RunGitCommand(ctx, repoDir, "show", "release:file.txt")
+		require.NoError(t, err)
+		return content
+	}
+	assertNoWorktreeLeft := func(t *testing.T, repoDir string) {
+		worktrees, err := RunGitCommand(ctx, repoDir, "worktree", "list", "--porcelain")
+		require.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(worktrees, "worktree "))
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		before := current(t, repoDir)
+
+		var out strings.Builder
+		require.NoError(t, repo.Merge(ctx, "test-env", &out, MergeOptions{TargetBranch: "release"}), out.String())
+
+		assert.Equal(t, before, current(t, repoDir))
+		assert.Equal(t, "from the environment\n", releaseFile(t, repoDir))
+		subject, err := RunGitCommand(ctx, repoDir, "log", "-1", "--format=%s", "release")
+		require.NoError(t, err)
+		assert.Equal(t, "Merge environment test-env", strings.TrimSpace(subject))
+		assertNoWorktreeLeft(t, repoDir)
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		before := current(t, repoDir)
+
+		var out strings.Builder
+		require.NoError(t, repo.Apply(ctx, "test-env", &out, MergeOptions{TargetBranch: "release"}), out.String())
+
+		assert.Equal(t, before, current(t, repoDir))
+		assert.Equal(t, "from the environment\n", releaseFile(t, repoDir))
+		log, err := RunGitCommand(ctx, repoDir, "log", "--format=%s", "release")
+		require.NoError(t, err)
+		assert.Equal(t, "Apply environment test-env\nInitial commit", strings.TrimSpace(log))
+		assertNoWorktreeLeft(t, repoDir)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		// Commit a conflicting change on release without checking it out
+		releaseDir := t.TempDir()
+		_, err := RunGitCommand(ctx, repoDir, "worktree", "add", releaseDir, "release")
+		require.NoError(t, err)
+		writeFile(t, releaseDir, "file.txt", "from the user\n")
+		_, err = RunGitCommand(ctx, releaseDir, "commit", "-am", "Change file")
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "worktree", "remove", releaseDir)
+		require.NoError(t, err)
+		releaseHead, err := RunGitCommand(ctx, repoDir, "rev-parse", "release")
+		require.NoError(t, err)
+		before := current(t, repoDir)
+
+		var out strings.Builder
+		err = repo.Merge(ctx, "test-env", &out, MergeOptions{TargetBranch: "release"})
+		assert.ErrorIs(t, err, ErrMergeConflict)
+		assert.ErrorContains(t, err, "file.txt")
+
+		// The merge is abandoned, nothing changed
+		assert.Equal(t, before, current(t, repoDir))
+		newReleaseHead, err := RunGitCommand(ctx, repoDir, "rev-parse", "release")
+		require.NoError(t, err)
+		assert.Equal(t, releaseHead, newReleaseHead)
+		assertNoWorktreeLeft(t, repoDir)
+	})
+
+	t.Run("checked_out_elsewhere", func(t *testing.T) {
+		repo, repoDir := setup(t)
+		releaseDir := t.TempDir()
+		_, err := RunGitCommand(ctx, repoDir, "worktree", "add", releaseDir, "release")
+		require.NoError(t, err)
+		writeFile(t, releaseDir, "wip.txt", "in progress on release\n")
+		before := current(t, repoDir)
+
+		// The merge happens in the worktree where release is checked out, its work in progress kept
+		var out strings.Builder
+		require.NoError(t, repo.Merge(ctx, "test-env", &out, MergeOptions{TargetBranch: "release"}), out.String())
+
+		assert.Equal(t, before, current(t, repoDir))
+		assert.Equal(t, "from the environment\n", releaseFile(t, repoDir))
+		content, err := os.ReadFile(filepath.Join(releaseDir, "file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "from the environment\n", string(content))
+		content, err = os.ReadFile(filepath.Join(releaseDir, "wip.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "in progress on release\n", string(content))
+	})
+
+	t.Run("missing_branch", func(t *testing.T) {
+		repo, _ := setup(t)
+		var out strings.Builder
+		err := repo.Merge(ctx, "test-env", &out, MergeOptions{TargetBranch: "nonexistent"})
+		assert.ErrorContains(t, err, "doesn't exist")
+	})
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+
+	config := environment.DefaultConfig()
+	config.CommitGranularity = environment.CommitPerSession
+	env := &environment.Environment{
+		EnvironmentInfo: &environment.EnvironmentInfo{
+			ID:    "test-env",
+			State: &environment.State{Config: config},
+		},
+	}
+	commitCount := func() string {
+		count, err := RunGitCommand(ctx, worktreePath, "rev-list", "--count", "HEAD")
+		require.NoError(t, err)
+		return strings.TrimSpace(count)
+	}
+	before := commitCount()
+
+	// Operations leave their changes uncommitted
+	writeFile(t, worktreePath, "a.txt", "a\n")
+	require.NoError(t, repo.deferWorktreeChanges(ctx, env, worktreePath, "Write a"))
+	require.NoError(t, repo.deferWorktreeChanges(ctx, env, worktreePath, ""))
+	writeFile(t, worktreePath, "b.txt", "b\n")
+	require.NoError(t, repo.deferWorktreeChanges(ctx, env, worktreePath, "Write b"))
+	require.NoError(t, repo.saveState(ctx, env.EnvironmentInfo))
+	assert.Equal(t, []string{"Write a", "Write b"}, env.State.PendingChanges)
+	assert.Equal(t, before, commitCount())
+
+	// Flushing commits them all at once
+	require.NoError(t, repo.Flush(ctx, "test-env"))
+	assert.NotEqual(t, before, commitCount())
+	message, err := RunGitCommand(ctx, worktreePath, "log", "-1", "--format=%B")
+	require.NoError(t, err)
+	assert.Equal(t, "Session changes\n\n- Write a\n- Write b", strings.TrimSpace(message))
+	files, err := RunGitCommand(ctx, repoDir, "ls-tree", "--name-only", "container-use/test-env")
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt\nb.txt", strings.TrimSpace(files))
+
+	envInfo, err := repo.Info(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Empty(t, envInfo.State.PendingChanges)
+
+	// Nothing left to flush
+	flushed := commitCount()
+	require.NoError(t, repo.Flush(ctx, "test-env"))
+	assert.Equal(t, flushed, commitCount())
+}
+
+func TestTree(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-b", "main"},
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+		{"config", "commit.gpgsign", "false"},
+		{"commit", "--allow-empty", "-m", "Initial commit"},
+	} {
+		_, err := RunGitCommand(ctx, repoDir, args...)
+		require.NoError(t, err)
+	}
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+
+	// createEnvironment branches an environment off the current commit, with one commit of its own
+	createEnvironment := func(id string) {
+		worktreePath, err := repo.initializeWorktree(ctx, id)
+		require.NoError(t, err)
+		for _, args := range [][]string{
+			{"config", "user.email", "test@example.com"},
+			{"config", "user.name", "Test User"},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+		writeFile(t, worktreePath, id+".txt", id+"\n")
+		_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Work in "+id, commitLimits{})
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", `{"title": "`+id+`"}`)
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, id)
+		require.NoError(t, err)
+	}
+
+	createEnvironment("first-a")
+	createEnvironment("first-b")
+	_, err = RunGitCommand(ctx, repoDir, "commit", "--allow-empty", "-m", "Second commit")
+	require.NoError(t, err)
+	createEnvironment("second")
+	createEnvironment("merged")
+	_, err = RunGitCommand(ctx, repoDir, "merge", "--no-ff", "-m", "Merge", "container-use/merged")
+	require.NoError(t, err)
+
+	tree, err := repo.Tree(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "main", tree.Branch)
+	assert.Empty(t, tree.Unrelated)
+
+	environments := func(base *EnvironmentBase) map[string]bool {
+		merged := map[string]bool{}
+		for _, env := range base.Environments {
+			merged[env.ID] = env.Merged()
+		}
+		return merged
+	}
+	require.Len(t, tree.Bases, 3)
+	// The merged environment is entirely part of the branch, it branches off its own last commit
+	assert.Equal(t, "Work in merged", tree.Bases[0].Subject)
+	assert.Equal(t, 1, tree.Bases[0].Behind)
+	assert.Equal(t, map[string]bool{"merged": true}, environments(tree.Bases[0]))
+	assert.Equal(t, "Second commit", tree.Bases[1].Subject)
+	assert.Equal(t, 2, tree.Bases[1].Behind)
+	assert.Equal(t, map[string]bool{"second": false}, environments(tree.Bases[1]))
+	assert.Equal(t, "Initial commit", tree.Bases[2].Subject)
+	assert.Equal(t, 3, tree.Bases[2].Behind)
+	assert.Equal(t, map[string]bool{"first-a": false, "first-b": false}, environments(tree.Bases[2]))
+	for _, env := range tree.Bases[2].Environments {
+		assert.Equal(t, 1, env.Ahead)
+	}
+}
+
+func TestFormatPatch(t *testing.T) {
+	ctx := context.Background()
+
+	repoDir := initTestRepoWithoutCommits(t)
+	writeFile(t, repoDir, "file.txt", "initial\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "agent@example.com"},
+		{"config", "user.name", "Agent"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	writeFile(t, worktreePath, "file.txt", "from the environment\n")
+	_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Change file", commitLimits{})
+	require.NoError(t, err)
+	writeFile(t, worktreePath, "new.txt", "new file\n")
+	_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Add new file", commitLimits{})
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", "{}")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+	require.NoError(t, err)
+
+	outDir := filepath.Join(t.TempDir(), "patches")
+	patches, err := repo.FormatPatch(ctx, "test-env", outDir)
+	require.NoError(t, err)
+	require.Len(t, patches, 2)
+	assert.Equal(t, filepath.Join(outDir, "0001-Change-file.patch"), patches[0])
+	assert.Equal(t, filepath.Join(outDir, "0002-Add-new-file.patch"), patches[1])
+
+	// The patches apply onto the base, with their authors
+	_, err = RunGitCommand(ctx, repoDir, append([]string{"am"}, patches...)...)
+	require.NoError(t, err)
+	authors, err := RunGitCommand(ctx, repoDir, "log", "-2", "--format=%an <%ae> %s")
+	require.NoError(t, err)
+	assert.Equal(t, "Agent <agent@example.com> Add new file\nAgent <agent@example.com> Change file\n", authors)
+	data, err := os.ReadFile(filepath.Join(repoDir, "new.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "new file\n", string(data))
+}
+
+func TestEnsureWorktree(t *testing.T) {
+	ctx := context.Background()
+
+	repoDir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--initial-branch", "main"},
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+		{"config", "commit.gpgsign", "false"},
+	} {
+		_, err := RunGitCommand(ctx, repoDir, args...)
+		require.NoError(t, err)
+	}
+	writeFile(t, repoDir, "file.txt", "initial\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "agent@example.com"},
+		{"config", "user.name", "Agent"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	writeFile(t, worktreePath, "file.txt", "from the environment\n")
+	_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Change file", commitLimits{})
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", "{}")
+	require.NoError(t, err)
+
+	_, err = repo.EnsureWorktree(ctx, "missing-env")
+	assert.ErrorIs(t, err, ErrEnvironmentNotFound)
+
+	// The worktree is checked out again once deleted
+	require.NoError(t, os.RemoveAll(worktreePath))
+	path, err := repo.EnsureWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Equal(t, worktreePath, path)
+	data, err := os.ReadFile(filepath.Join(path, "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "from the environment\n", string(data))
+
+	// The current branch of the user is left alone
+	branch, err := RunGitCommand(ctx, repoDir, "branch", "--show-current")
+	require.NoError(t, err)
+	assert.Equal(t, "main\n", branch)
+}
+
+func TestCheckoutWorktree(t *testing.T) {
+	ctx := context.Background()
+
+	repoDir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--initial-branch", "main"},
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+		{"config", "commit.gpgsign", "false"},
+	} {
+		_, err := RunGitCommand(ctx, repoDir, args...)
+		require.NoError(t, err)
+	}
+	writeFile(t, repoDir, "file.txt", "initial\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "agent@example.com"},
+		{"config", "user.name", "Agent"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	writeFile(t, worktreePath, "file.txt", "from the environment\n")
+	_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Change file", commitLimits{})
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", "{}")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+	require.NoError(t, err)
+
+	_, err = repo.CheckoutWorktree(ctx, "missing-env", filepath.Join(t.TempDir(), "missing"), "")
+	assert.ErrorIs(t, err, ErrEnvironmentNotFound)
+
+	checkFile := func(dir string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "from the environment\n", string(data))
+	}
+
+	// Detached at the environment's commit by default
+	dir, err := repo.CheckoutWorktree(ctx, "test-env", filepath.Join(t.TempDir(), "review"), "")
+	require.NoError(t, err)
+	checkFile(dir)
+	branch, err := RunGitCommand(ctx, dir, "branch", "--show-current")
+	require.NoError(t, err)
+	assert.Empty(t, strings.TrimSpace(branch))
+
+	// Or on a new branch tracking the environment
+	branchDir, err := repo.CheckoutWorktree(ctx, "test-env", filepath.Join(t.TempDir(), "review"), "review-test-env")
+	require.NoError(t, err)
+	checkFile(branchDir)
+	upstream, err := RunGitCommand(ctx, branchDir, "rev-parse", "--abbrev-ref", "@{upstream}")
+	require.NoError(t, err)
+	assert.Equal(t, containerUseRemote+"/test-env\n", upstream)
+
+	// The current branch of the user is left alone
+	branch, err = RunGitCommand(ctx, repoDir, "branch", "--show-current")
+	require.NoError(t, err)
+	assert.Equal(t, "main\n", branch)
+
+	// Worktrees with changes aren't removed
+	writeFile(t, dir, "file.txt", "reviewed\n")
+	assert.Error(t, repo.RemoveCheckoutWorktree(ctx, dir))
+	_, err = RunGitCommand(ctx, dir, "checkout", "--", "file.txt")
+	require.NoError(t, err)
+
+	for _, dir := range []string{dir, branchDir} {
+		require.NoError(t, repo.RemoveCheckoutWorktree(ctx, dir))
+		assert.NoDirExists(t, dir)
+	}
+	worktrees, err := RunGitCommand(ctx, repoDir, "worktree", "list", "--porcelain")
+	require.NoError(t, err)
+	assert.NotContains(t, worktrees, "review")
+}
+
+func TestPauseResume(t *testing.T) {
+	ctx := context.Background()
+
+	repoDir := initTestRepo(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "agent@example.com"},
+		{"config", "user.name", "Agent"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", `{"title":"Pause test"}`)
+	require.NoError(t, err)
+
+	// Pausing is recorded in the state, without Dagger, and published to the source repository
+	require.NoError(t, repo.Pause(ctx, "test-env"))
+	info, err := repo.Info(ctx, "test-env")
+	require.NoError(t, err)
+	assert.True(t, info.State.Paused)
+	assert.Equal(t, "Pause test", info.State.Title)
+	state, err := RunGitCommand(ctx, repoDir, "notes", "--ref", gitNotesStateRef, "show", containerUseRemote+"/test-env")
+	require.NoError(t, err)
+	assert.Contains(t, state, `"paused": true`)
+	assert.ErrorContains(t, repo.Pause(ctx, "test-env"), "already paused")
+
+	require.NoError(t, repo.Resume(ctx, "test-env"))
+	info, err = repo.Info(ctx, "test-env")
+	require.NoError(t, err)
+	assert.False(t, info.State.Paused)
+	assert.ErrorContains(t, repo.Resume(ctx, "test-env"), "not paused")
+
+	assert.ErrorIs(t, repo.Pause(ctx, "missing-env"), ErrEnvironmentNotFound)
+}
+
+func TestDefaultTitle(t *testing.T) {
+	ctx := context.Background()
+
+	repoDir := initTestRepoWithoutCommits(t)
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+
+	// Without commits, there's no subject to use
+	title, err := repo.defaultTitle(ctx, "fancy-mallard")
+	require.NoError(t, err)
+	assert.Equal(t, "fancy-mallard", title)
+
+	writeFile(t, repoDir, "file.txt", "initial\n")
+	_, err = RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Add the parser\n\nWith a body which isn't part of the title.")
+	require.NoError(t, err)
+
+	title, err = repo.defaultTitle(ctx, "fancy-mallard")
+	require.NoError(t, err)
+	assert.Equal(t, "Add the parser", title)
+}
+
+func TestChangedFiles(t *testing.T) {
+	ctx := context.Background()
+
+	repoDir := initTestRepoWithoutCommits(t)
+	writeFile(t, repoDir, "file.txt", "initial\n")
+	writeFile(t, repoDir, "removed.txt", "removed\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "agent@example.com"},
+		{"config", "user.name", "Agent"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", "{}")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+	require.NoError(t, err)
+
+	files, err := repo.ChangedFiles(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	writeFile(t, worktreePath, "file.txt", "from the environment\n")
+	writeFile(t, worktreePath, "docs/new file.md", "new file\n")
+	require.NoError(t, os.Remove(filepath.Join(worktreePath, "removed.txt")))
+	_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Change files", commitLimits{})
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-f", "-m", "{}")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+	require.NoError(t, err)
+
+	files, err = repo.ChangedFiles(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/new file.md", "file.txt", "removed.txt"}, files)
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+)
+
+// Savepoint records the current state of the environment as a savepoint named name, to restore it later with
+// RestoreTag.
+func (r *Repository) Savepoint(ctx context.Context, dag *dagger.Client, id, name string) error {
+	env, err := r.Get(ctx, dag, id)
+	if err != nil {
+		return err
+	}
+	if err := env.Tag(name); err != nil {
+		return err
+	}
+	if err := r.Update(ctx, env, "Create savepoint "+name); err != nil {
+		return fmt.Errorf("failed to save environment: %w", err)
+	}
+	return nil
+}
+
+// Savepoints returns the savepoints of the environment, from the oldest to the most recent.
+func (r *Repository) Savepoints(ctx context.Context, id string) ([]*environment.Savepoint, error) {
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return envInfo.State.Savepoints, nil
+}
+
+// RestoreTag brings the environment back to the savepoint named name. The files are reverted by a new commit,
+// so the work done since the savepoint stays in the history of the environment.
+func (r *Repository) RestoreTag(ctx context.Context, dag *dagger.Client, id, name string) error {
+	env, err := r.Get(ctx, dag, id)
+	if err != nil {
+		return err
+	}
+	if err := env.RestoreTag(ctx, name); err != nil {
+		return err
+	}
+	if err := r.Update(ctx, env, "Restore savepoint "+name); err != nil {
+		return fmt.Errorf("failed to save environment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// secretPatterns are the patterns of well-known kinds of secrets, by kind.
+var secretPatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{"private key", regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`)},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{"Stripe key", regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{20,}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+}
+
+// secretAssignmentRegExp matches values assigned to names that suggest a secret, e.g. API_KEY="..." or "token": "...".
+// Only such values are checked for entropy: on their own, high-entropy strings are mostly hashes and identifiers.
+var secretAssignmentRegExp = regexp.MustCompile(`(?i)(?:api[_-]?key|secret|token|passw(?:or)?d|credential|auth)[\w.-]*["']?\s*[:=]\s*["']?([A-Za-z0-9+/_=-]{20,})`)
+
+// minSecretEntropy is the Shannon entropy, in bits per character, above which an assigned value mixing letters and
+// digits looks random enough to be a secret rather than a placeholder like "your-api-key-goes-here".
+const minSecretEntropy = 3.5
+
+// findSecrets returns the kinds of secrets line looks like it contains.
+func findSecrets(line string) []string {
+	var kinds []string
+	for _, p := range secretPatterns {
+		if p.pattern.MatchString(line) {
+			kinds = append(kinds, p.kind)
+		}
+	}
+	if len(kinds) > 0 {
+		return kinds
+	}
+	for _, match := range secretAssignmentRegExp.FindAllStringSubmatch(line, -1) {
+		value := match[1]
+		if strings.ContainsAny(value, "0123456789") && strings.ContainsFunc(value, unicode.IsLetter) && entropy(value) >= minSecretEntropy {
+			return []string{"high-entropy value"}
+		}
+	}
+	return nil
+}
+
+// entropy returns the Shannon entropy of s, in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+	var e float64
+	n := float64(len([]rune(s)))
+	for _, count := range counts {
+		p := float64(count) / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// secretFinding is a line added to a file that looks like it contains a secret.
+type secretFinding struct {
+	file string
+	line int
+	kind string
+}
+
+// scanStagedSecrets returns the lines added by the staged changes of the worktree that look like they contain secrets.
+// Only added lines are scanned, so a secret already committed isn't reported again on every commit.
+func scanStagedSecrets(ctx context.Context, worktreePath string) ([]secretFinding, error) {
+	diff, err := RunGitCommand(ctx, worktreePath, "diff", "--cached", "--unified=0", "--no-color", "--no-ext-diff", "--diff-filter=AM")
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []secretFinding
+	var file string
+	var lineNumber int
+	for line := range strings.SplitSeq(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			file = strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/")
+		case strings.HasPrefix(line, "@@ "):
+			// @@ -<old> +<start>[,<count>] @@
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			start, _, _ := strings.Cut(strings.TrimPrefix(fields[2], "+"), ",")
+			lineNumber, _ = strconv.Atoi(start)
+		case strings.HasPrefix(line, "+"):
+			for _, kind := range findSecrets(line[1:]) {
+				findings = append(findings, secretFinding{file: file, line: lineNumber, kind: kind})
+			}
+			lineNumber++
+		}
+	}
+	return findings, nil
+}
+
+// checkStagedSecrets returns warnings about the staged files that look like they contain secrets.
+// With block, those files are unstaged so they aren't committed.
+func checkStagedSecrets(ctx context.Context, worktreePath string, block bool) ([]string, error) {
+	findings, err := scanStagedSecrets(ctx, worktreePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	found := map[string][]string{}
+	for _, f := range findings {
+		if !slices.Contains(files, f.file) {
+			files = append(files, f.file)
+		}
+		found[f.file] = append(found[f.file], fmt.Sprintf("%s at line %d", f.kind, f.line))
+	}
+
+	var warnings []string
+	for _, file := range files {
+		if block {
+			if _, err := RunGitCommand(ctx, worktreePath, "reset", "--quiet", "--", file); err != nil {
+				return nil, err
+			}
+			warnings = append(warnings, fmt.Sprintf("Not committing %s, it looks like it contains a secret (%s): remove the secret from the file, or keep it out of the repository with .gitignore",
+				file, strings.Join(found[file], ", ")))
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("WARNING: committing %s, which looks like it contains a secret (%s): it will stay in the git history, remove it and rewrite the history if it's real",
+			file, strings.Join(found[file], ", ")))
+	}
+	return warnings, nil
+}
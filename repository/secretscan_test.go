@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Fake secrets, assembled so the test file itself doesn't look like it leaks any.
+var (
+	fakeAWSKey     = "AKIA" + "IOSFODNN7EXAMPLE"
+	fakeGitHubPAT  = "ghp" + "_" + strings.Repeat("a1B2c3", 6)
+	fakePrivateKey = "-----BEGIN " + "OPENSSH PRIVATE KEY-----"
+	fakeAPIKey     = "Zx8fQ2mL9pR4tW7vB1nK6cJ3hD5sG0aE"
+)
+
+func TestFindSecrets(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected []string
+	}{
+		{"aws_access_key_id = " + fakeAWSKey, []string{"AWS access key"}},
+		{fakePrivateKey, []string{"private key"}},
+		{`GITHUB_TOKEN: "` + fakeGitHubPAT + `"`, []string{"GitHub token"}},
+		{"API_KEY=" + fakeAPIKey, []string{"high-entropy value"}},
+		{`{"client_secret": "` + fakeAPIKey + `"}`, []string{"high-entropy value"}},
+
+		// Placeholders, references and hashes aren't secrets
+		{"API_KEY=your-api-key-goes-here-now", nil},
+		{"token = os.Getenv(\"TOKEN\")", nil},
+		{`"integrity": "sha512-` + fakeAPIKey + `"`, nil},
+		{"commit " + strings.Repeat("0123456789abcdef", 2), nil},
+		{"func main() {}", nil},
+	} {
+		assert.Equal(t, tc.expected, findSecrets(tc.line), tc.line)
+	}
+}
+
+func TestCommitWorktreeChangesSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) string {
+		dir := initTestRepo(t)
+		writeFile(t, dir, "main.go", "package main\n")
+		writeFile(t, dir, "config/.env", "DEBUG=true\nAWS_ACCESS_KEY_ID="+fakeAWSKey+"\n")
+		return dir
+	}
+	committed := func(t *testing.T, dir string) string {
+		files, err := RunGitCommand(ctx, dir, "ls-tree", "-r", "--name-only", "HEAD")
+		require.NoError(t, err)
+		return files
+	}
+	repo := &Repository{}
+
+	t.Run("warn", func(t *testing.T) {
+		dir := setup(t)
+		warnings, err := repo.commitWorktreeChanges(ctx, dir, "Write files", commitLimitsFor(&environment.EnvironmentConfig{}))
+		require.NoError(t, err)
+		require.Len(t, warnings, 1)
+		assert.Contains(t, warnings[0], "config/.env")
+		assert.Contains(t, warnings[0], "AWS access key at line 2")
+		assert.Contains(t, committed(t, dir), "config/.env")
+	})
+
+	t.Run("on", func(t *testing.T) {
+		dir := setup(t)
+		warnings, err := repo.commitWorktreeChanges(ctx, dir, "Write files", commitLimitsFor(&environment.EnvironmentConfig{SecretScan: environment.SecretScanOn}))
+		require.NoError(t, err)
+		require.Len(t, warnings, 1)
+		assert.Contains(t, warnings[0], "Not committing config/.env")
+		files := committed(t, dir)
+		assert.Contains(t, files, "main.go")
+		assert.NotContains(t, files, "config/.env")
+
+		// Once the secret is removed, the file is committed
+		writeFile(t, dir, "config/.env", "DEBUG=true\n")
+		warnings, err = repo.commitWorktreeChanges(ctx, dir, "Remove secret", commitLimitsFor(&environment.EnvironmentConfig{SecretScan: environment.SecretScanOn}))
+		require.NoError(t, err)
+		assert.Empty(t, warnings)
+		assert.Contains(t, committed(t, dir), "config/.env")
+	})
+
+	t.Run("off", func(t *testing.T) {
+		dir := setup(t)
+		warnings, err := repo.commitWorktreeChanges(ctx, dir, "Write files", commitLimitsFor(&environment.EnvironmentConfig{SecretScan: environment.SecretScanOff}))
+		require.NoError(t, err)
+		assert.Empty(t, warnings)
+		assert.Contains(t, committed(t, dir), "config/.env")
+	})
+}
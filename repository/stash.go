@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// resolveStash returns the stash entry of the source repository (e.g. stash@{0}) designated by stash,
+// either directly or by a part of its message, along with its message.
+func (r *Repository) resolveStash(ctx context.Context, stash string) (string, string, error) {
+	out, err := RunGitCommand(ctx, r.userRepoPath, "stash", "list", "--format=%gd%x00%gs")
+	if err != nil {
+		return "", "", err
+	}
+	for line := range strings.Lines(out) {
+		ref, message, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "\x00")
+		if ref == stash || strings.Contains(message, stash) {
+			return ref, message, nil
+		}
+	}
+	return "", "", fmt.Errorf("no stash entry matching %q", stash)
+}
+
+// applyStash applies a stash entry of the source repository, untracked files included, to the worktree
+// and commits the result.
+func (r *Repository) applyStash(ctx context.Context, worktreePath, stash string, limits commitLimits) error {
+	ref, message, err := r.resolveStash(ctx, stash)
+	if err != nil {
+		return err
+	}
+
+	patch, err := RunGitCommand(ctx, r.userRepoPath, "stash", "show", "--patch", "--binary", "--include-untracked", ref)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", ref, err)
+	}
+	if strings.TrimSpace(patch) == "" {
+		return fmt.Errorf("%s has no changes", ref)
+	}
+
+	if err := applyPatch(ctx, worktreePath, patch); err != nil {
+		return fmt.Errorf("failed to apply %s: %w", ref, err)
+	}
+
+	warnings, err := r.commitWorktreeChanges(ctx, worktreePath, fmt.Sprintf("Apply %s (%s)", ref, message), limits)
+	if err != nil {
+		return fmt.Errorf("failed to commit %s: %w", ref, err)
+	}
+	for _, warning := range warnings {
+		slog.Warn(warning, "stash", ref)
+	}
+	return nil
+}
+
+// applyPatch applies a patch of the source repository to the worktree, falling back to a 3-way merge.
+func applyPatch(ctx context.Context, worktreePath, patch string) error {
+	f, err := os.CreateTemp(os.TempDir(), ".container-use-patch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString(patch); err != nil {
+		return err
+	}
+
+	_, err = RunGitCommand(ctx, worktreePath, "apply", "--3way", f.Name())
+	return err
+}
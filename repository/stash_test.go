@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyStash(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepoWithoutCommits(t)
+	writeFile(t, repoDir, "main.go", "package main\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	// Stash a change to a tracked file and a new file, then another unrelated change on top
+	writeFile(t, repoDir, "main.go", "package main\n\nfunc main() {}\n")
+	writeFile(t, repoDir, "feature.go", "package main\n")
+	_, err = RunGitCommand(ctx, repoDir, "stash", "push", "--include-untracked", "-m", "half-done feature")
+	require.NoError(t, err)
+	writeFile(t, repoDir, "other.go", "package main\n")
+	_, err = RunGitCommand(ctx, repoDir, "stash", "push", "--include-untracked", "-m", "something else")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+
+	ref, message, err := repo.resolveStash(ctx, "stash@{0}")
+	require.NoError(t, err)
+	assert.Equal(t, "stash@{0}", ref)
+	assert.Contains(t, message, "something else")
+
+	ref, _, err = repo.resolveStash(ctx, "half-done")
+	require.NoError(t, err)
+	assert.Equal(t, "stash@{1}", ref)
+
+	_, _, err = repo.resolveStash(ctx, "nonexistent")
+	assert.ErrorContains(t, err, "no stash entry")
+
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test User"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, repo.applyStash(ctx, worktreePath, "half-done", commitLimits{}))
+
+	content, err := os.ReadFile(filepath.Join(worktreePath, "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main\n\nfunc main() {}\n", string(content))
+	assert.FileExists(t, filepath.Join(worktreePath, "feature.go"))
+	assert.NoFileExists(t, filepath.Join(worktreePath, "other.go"))
+
+	// The stashed changes are committed, and the stash itself is left alone
+	status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
+	require.NoError(t, err)
+	assert.Empty(t, status)
+	subject, err := RunGitCommand(ctx, worktreePath, "log", "-1", "--format=%s")
+	require.NoError(t, err)
+	assert.Contains(t, strings.TrimSpace(subject), "Apply stash@{1}")
+	stashes, err := RunGitCommand(ctx, repoDir, "stash", "list")
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(stashes), "\n"), 2)
+}
@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// ErrNothingToTidy is returned by Tidy when the environment has no commits of its own.
+var ErrNothingToTidy = errors.New("no commits to tidy")
+
+// tidyStartRef records the commit an interactive rebase of Tidy started from, until its result is saved.
+// The rebase may stop before the end for the user to finish it by hand, e.g. at an edit, and the state of the
+// environment is then on that commit.
+func tidyStartRef(id string) string {
+	return "refs/container-use/tidy/" + id
+}
+
+// Tidy lets the user rewrite the commits of the environment with an interactive rebase, e.g. squashing the commits
+// of every file write into a few meaningful ones before merging it. The rebase runs in the worktree of the environment,
+// through the user's editor, and covers the commits that aren't on the current branch yet.
+// A rebase that fails or is aborted is undone, leaving the history of the environment as it was. A rebase that stops
+// before the end, e.g. at an edit, is left for the user to finish with git rebase --continue, and its result is saved
+// by the next Tidy.
+func (r *Repository) Tidy(ctx context.Context, id string, w io.Writer) error {
+	worktreePath, err := r.EnsureWorktree(ctx, id)
+	if err != nil {
+		return err
+	}
+	inProgress, err := rebaseInProgress(ctx, worktreePath)
+	if err != nil {
+		return err
+	}
+	if inProgress {
+		return fmt.Errorf("environment %s is being rebased: finish with `git -C %s rebase --continue` (or --abort), then run `container-use tidy %s` again to save its history",
+			id, worktreePath, id)
+	}
+	start, err := resolveRef(ctx, worktreePath, tidyStartRef(id))
+	if err != nil {
+		return err
+	}
+	if start != "" {
+		// The last tidy was finished by hand
+		state, err := RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "show", start)
+		if err != nil {
+			return fmt.Errorf("failed to load the state of environment %s from before tidying it: %w", id, err)
+		}
+		envInfo, err := environment.LoadInfo(ctx, id, []byte(state), worktreePath)
+		if err != nil {
+			return err
+		}
+		return r.saveTidied(ctx, envInfo, worktreePath, start)
+	}
+
+	envInfo, err := r.Info(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(envInfo.State.PendingChanges) > 0 {
+		return fmt.Errorf("environment %s has uncommitted changes, commit them first (container-use flush %s)", id, id)
+	}
+	status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(status) != "" {
+		return fmt.Errorf("the worktree of environment %s has uncommitted changes", id)
+	}
+
+	mergeBase, err := r.mergeBase(ctx, envInfo)
+	if err != nil {
+		return err
+	}
+	head, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	head = strings.TrimSpace(head)
+	if head == mergeBase {
+		return fmt.Errorf("%w: environment %s has nothing the current branch doesn't", ErrNothingToTidy, id)
+	}
+
+	// The log notes of rewritten commits follow them, and are concatenated when commits are squashed.
+	// The state is only meaningful on the last commit, and is saved there again afterwards.
+	// This is configured in the fork rather than for the rebase command only, so that it applies
+	// to the rebases the user finishes by hand too.
+	for _, args := range [][]string{
+		{"config", "notes.rewriteRef", "refs/notes/" + gitNotesLogRef},
+		{"config", "notes.rewriteMode", "concatenate"},
+		{"update-ref", tidyStartRef(id), head},
+	} {
+		if _, err := RunGitCommand(ctx, worktreePath, args...); err != nil {
+			return err
+		}
+	}
+	// The rebase runs the user's editor, in their terminal
+	if err := runInteractiveGitCommand(ctx, worktreePath, os.Stdin, w, "rebase", "--interactive", mergeBase); err != nil {
+		if _, err := RunGitCommand(context.WithoutCancel(ctx), worktreePath, "update-ref", "-d", tidyStartRef(id)); err != nil {
+			return err
+		}
+		// Fails harmlessly when the rebase didn't even start, e.g. with an empty todo list
+		if _, abortErr := RunGitCommand(context.WithoutCancel(ctx), worktreePath, "rebase", "--abort"); abortErr == nil {
+			return fmt.Errorf("tidying environment %s was aborted, its history is unchanged: %w", id, err)
+		}
+		return fmt.Errorf("failed to tidy environment %s, its history is unchanged: %w", id, err)
+	}
+
+	// The rebase stops, successfully, at edit and break commands, for the user to go on by hand:
+	// its history can't be saved before it's over.
+	inProgress, err = rebaseInProgress(ctx, worktreePath)
+	if err != nil {
+		return err
+	}
+	if inProgress {
+		return fmt.Errorf("the rebase of environment %s stopped before the end: finish with `git -C %s rebase --continue` (or --abort), then run `container-use tidy %s` again to save its history",
+			id, worktreePath, id)
+	}
+	return r.saveTidied(ctx, envInfo, worktreePath, head)
+}
+
+// saveTidied saves the state of the environment on its last commit, once the rebase of Tidy that started from
+// the start commit is over.
+func (r *Repository) saveTidied(ctx context.Context, envInfo *environment.EnvironmentInfo, worktreePath, start string) error {
+	newHead, err := RunGitCommand(ctx, worktreePath, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(newHead) != start {
+		// Dropped commits change the files of the worktree, it no longer holds the last export
+		exportedWorkdirs.forget(worktreePath)
+
+		if err := r.saveState(ctx, envInfo); err != nil {
+			return fmt.Errorf("failed to add notes: %w", err)
+		}
+		if err := r.publish(ctx, envInfo); err != nil {
+			return err
+		}
+		if err := r.propagateNotes(ctx, envInfo, gitNotesLogRef); err != nil {
+			return err
+		}
+	}
+	_, err = RunGitCommand(ctx, worktreePath, "update-ref", "-d", tidyStartRef(envInfo.ID))
+	return err
+}
+
+// rebaseInProgress reports whether a rebase was started in the worktree and isn't over.
+func rebaseInProgress(ctx context.Context, worktreePath string) (bool, error) {
+	for _, dir := range []string{"rebase-merge", "rebase-apply"} {
+		path, err := RunGitCommand(ctx, worktreePath, "rev-parse", "--git-path", dir)
+		if err != nil {
+			return false, err
+		}
+		path = strings.TrimSpace(path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(worktreePath, path)
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
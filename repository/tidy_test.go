@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTidy(t *testing.T) {
+	ctx := context.Background()
+
+	repoDir := initTestRepoWithoutCommits(t)
+	writeFile(t, repoDir, "README.md", "# Test\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	worktreePath, err := repo.initializeWorktree(ctx, "test-env")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"config", "user.email", "agent@example.com"},
+		{"config", "user.name", "Agent"},
+		{"config", "commit.gpgsign", "false"},
+	} {
+		_, err := RunGitCommand(ctx, worktreePath, args...)
+		require.NoError(t, err)
+	}
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-m", `{"title":"Tidy test"}`)
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+	require.NoError(t, err)
+
+	err = repo.Tidy(ctx, "test-env", io.Discard)
+	assert.ErrorIs(t, err, ErrNothingToTidy)
+
+	for _, file := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeFile(t, worktreePath, file, file+"\n")
+		_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Write "+file, commitLimits{})
+		require.NoError(t, err)
+		_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesLogRef, "add", "-m", "$ touch "+file)
+		require.NoError(t, err)
+	}
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-f", "-m", `{"title":"Tidy test"}`)
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "fetch", containerUseRemote, "test-env")
+	require.NoError(t, err)
+
+	commits := func() []string {
+		log, err := RunGitCommand(ctx, repoDir, "log", "--format=%s", "HEAD.."+containerUseRemote+"/test-env")
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSpace(log), "\n")
+	}
+
+	// Aborting, here with an editor that fails, leaves the history unchanged
+	t.Setenv("GIT_SEQUENCE_EDITOR", "false")
+	err = repo.Tidy(ctx, "test-env", io.Discard)
+	assert.ErrorContains(t, err, "history is unchanged")
+	assert.Equal(t, []string{"Write c.txt", "Write b.txt", "Write a.txt"}, commits())
+	_, err = RunGitCommand(ctx, worktreePath, "rev-parse", "--verify", "--quiet", "REBASE_HEAD")
+	assert.Error(t, err, "no rebase must be left in progress")
+
+	// Squash all the commits of the environment into the first one
+	t.Setenv("GIT_SEQUENCE_EDITOR", `sed -i -e '2,$s/^pick/fixup/'`)
+	require.NoError(t, repo.Tidy(ctx, "test-env", io.Discard))
+	assert.Equal(t, []string{"Write a.txt"}, commits())
+
+	// The state is on the new last commit, and the log notes of the squashed commits are kept
+	info, err := repo.Info(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Equal(t, "Tidy test", info.State.Title)
+	notes, err := RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesLogRef, "show", "HEAD")
+	require.NoError(t, err)
+	for _, file := range []string{"a.txt", "b.txt", "c.txt"} {
+		assert.Contains(t, notes, "$ touch "+file)
+	}
+
+	// A rebase stopping at an edit is left for the user to finish, and saved by the next tidy
+	writeFile(t, worktreePath, "d.txt", "d.txt\n")
+	_, err = repo.commitWorktreeChanges(ctx, worktreePath, "Write d.txt", commitLimits{})
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesStateRef, "add", "-f", "-m", `{"title":"Tidy test"}`)
+	require.NoError(t, err)
+	t.Setenv("GIT_SEQUENCE_EDITOR", `sed -i -e '1s/^pick/edit/'`)
+	err = repo.Tidy(ctx, "test-env", io.Discard)
+	assert.ErrorContains(t, err, "rebase --continue")
+	err = repo.Tidy(ctx, "test-env", io.Discard)
+	assert.ErrorContains(t, err, "is being rebased")
+	_, err = RunGitCommand(ctx, worktreePath, "commit", "--amend", "-m", "Write a.txt, b.txt and c.txt")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, worktreePath, "rebase", "--continue")
+	require.NoError(t, err)
+	require.NoError(t, repo.Tidy(ctx, "test-env", io.Discard))
+	assert.Equal(t, []string{"Write d.txt", "Write a.txt, b.txt and c.txt"}, commits())
+	info, err = repo.Info(ctx, "test-env")
+	require.NoError(t, err)
+	assert.Equal(t, "Tidy test", info.State.Title)
+	notes, err = RunGitCommand(ctx, worktreePath, "notes", "--ref", gitNotesLogRef, "show", "HEAD~1")
+	require.NoError(t, err)
+	assert.Contains(t, notes, "$ touch a.txt")
+
+	start, err := resolveRef(ctx, worktreePath, tidyStartRef("test-env"))
+	require.NoError(t, err)
+	assert.Empty(t, start, "nothing must be left to save")
+}
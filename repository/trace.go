@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// gitTrace is where the git commands run by container-use are traced, if anywhere. Unlike the logs, the trace
+// is meant to be pasted in bug reports: one line per command, which can be run again as is.
+var gitTrace = &gitTracer{}
+
+type gitTracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func init() {
+	if enabled, _ := strconv.ParseBool(os.Getenv("CONTAINER_USE_TRACE_GIT")); enabled {
+		SetGitTrace(os.Stderr)
+	}
+}
+
+// SetGitTrace traces every git command, and its exit status, to w. A nil w disables tracing.
+// It's also enabled by setting CONTAINER_USE_TRACE_GIT=1, to stderr.
+func SetGitTrace(w io.Writer) {
+	gitTrace.mu.Lock()
+	defer gitTrace.mu.Unlock()
+	gitTrace.w = w
+}
+
+// trace writes a git command run in dir, how long it took and its exit status, e.g.
+//
+//	git -C /path/to/repo log --format=%H -1  # exit 0 (12ms)
+func (t *gitTracer) trace(dir string, args []string, elapsed time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.w == nil {
+		return
+	}
+
+	status := "exit 0"
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		status = fmt.Sprintf("exit %d", exitErr.ExitCode())
+	case err != nil:
+		message, _, _ := strings.Cut(err.Error(), "\n")
+		status = "error: " + message
+	}
+
+	quoted := make([]string, 0, len(args)+3)
+	quoted = append(quoted, "git", "-C", environment.ShellQuote(dir))
+	for _, arg := range args {
+		quoted = append(quoted, environment.ShellQuote(arg))
+	}
+	fmt.Fprintf(t.w, "%s  # %s (%s)\n", strings.Join(quoted, " "), status, elapsed.Round(time.Millisecond))
+}
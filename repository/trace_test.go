@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitTrace(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var trace strings.Builder
+	SetGitTrace(&trace)
+	t.Cleanup(func() { SetGitTrace(nil) })
+
+	_, err := RunGitCommand(ctx, dir, "init")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, dir, "config", "user.name", "Test User")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, dir, "rev-parse", "--verify", "HEAD")
+	require.Error(t, err)
+
+	lines := strings.Split(strings.TrimSpace(trace.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "git -C "+environment.ShellQuote(dir)+" init  # exit 0 ("), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "git -C "+environment.ShellQuote(dir)+" config user.name 'Test User'  # exit 0 ("), lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "git -C "+environment.ShellQuote(dir)+" rev-parse --verify HEAD  # exit 128 ("), lines[2])
+
+	// Once disabled, commands aren't traced anymore
+	SetGitTrace(nil)
+	_, err = RunGitCommand(ctx, dir, "status")
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(trace.String()), "\n"), 3)
+}
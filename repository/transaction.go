@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// transaction holds the updates of environments deferred by WithTransaction.
+type transaction struct {
+	// updates are in the order environments were first updated
+	updates []*deferredUpdate
+}
+
+// deferredUpdate is the pending update of an environment, made once for all the updates of a transaction.
+type deferredUpdate struct {
+	env          *environment.Environment
+	explanations []string
+}
+
+// add records an update of env, merging it with the previous updates of the same environment.
+func (tx *transaction) add(env *environment.Environment, explanation string) {
+	i := slices.IndexFunc(tx.updates, func(u *deferredUpdate) bool { return u.env.ID == env.ID })
+	if i < 0 {
+		tx.updates = append(tx.updates, &deferredUpdate{env: env})
+		i = len(tx.updates) - 1
+	}
+	update := tx.updates[i]
+	// The latest copy of the environment has the latest state
+	update.env = env
+	if explanation != "" && !slices.Contains(update.explanations, explanation) {
+		update.explanations = append(update.explanations, explanation)
+	}
+}
+
+// message returns the explanation of the commit of the update.
+func (u *deferredUpdate) message() string {
+	if len(u.explanations) == 0 {
+		return ""
+	}
+	return pendingChangesMessage(u.explanations)
+}
+
+// WithTransaction runs fn, deferring the updates of environments it makes with Update until it returns: each environment
+// updated is then exported to its worktree, committed and has its notes propagated once, rather than once per update.
+// The updates are made even if fn fails, as they would have been without a transaction. Since the state of environments
+// isn't saved until then, fn must keep working on the environments it has rather than Get them again. Transactions don't nest,
+// a transaction started within another is part of it. A Repository must not be used concurrently during a transaction.
+func (r *Repository) WithTransaction(ctx context.Context, fn func() error) error {
+	if r.tx != nil {
+		return fn()
+	}
+
+	r.tx = &transaction{}
+	err := fn()
+	tx := r.tx
+	r.tx = nil
+
+	errs := []error{err}
+	for _, update := range tx.updates {
+		errs = append(errs, r.update(ctx, update.env, update.message()))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dagger/container-use/environment"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTransactionDefersUpdates(t *testing.T) {
+	ctx := context.Background()
+	repo := &Repository{}
+	newEnv := func(id string) *environment.Environment {
+		return &environment.Environment{EnvironmentInfo: &environment.EnvironmentInfo{ID: id, State: &environment.State{}}}
+	}
+	first, firstAgain, second := newEnv("first"), newEnv("first"), newEnv("second")
+
+	var tx *transaction
+	err := repo.WithTransaction(ctx, func() error {
+		require.NoError(t, repo.Update(ctx, first, "Update config"))
+		require.NoError(t, repo.Update(ctx, second, ""))
+		require.NoError(t, repo.Update(ctx, firstAgain, "Run validation"))
+		require.NoError(t, repo.Update(ctx, firstAgain, "Run validation"))
+		// Nested transactions are part of the outer one
+		require.NoError(t, repo.WithTransaction(ctx, func() error {
+			return repo.Update(ctx, second, "Write file")
+		}))
+
+		tx = repo.tx
+		// Stop before the deferred updates are made, as they need an engine
+		repo.tx = &transaction{}
+		return errors.New("stop")
+	})
+	require.EqualError(t, err, "stop")
+	assert.Nil(t, repo.tx)
+
+	require.Len(t, tx.updates, 2)
+	assert.Same(t, firstAgain, tx.updates[0].env)
+	assert.Equal(t, "Session changes\n\n- Update config\n- Run validation\n", tx.updates[0].message())
+	assert.Same(t, second, tx.updates[1].env)
+	assert.Equal(t, "Write file", tx.updates[1].message())
+}
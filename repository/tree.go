@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// EnvironmentTree describes where environments branched off the current branch.
+type EnvironmentTree struct {
+	// Branch is the current branch, or HEAD if it's detached.
+	Branch string
+	// Bases are the commits environments branched off, from the most recent to the oldest.
+	Bases []*EnvironmentBase
+	// Unrelated are the environments sharing no history with the current branch.
+	Unrelated []*EnvironmentBranch
+}
+
+// EnvironmentBase is a commit of the current branch environments branched off.
+type EnvironmentBase struct {
+	Commit  string
+	Subject string
+	// Behind is the number of commits made on the current branch since this one.
+	Behind int
+	// Environments are sorted by most recently updated first.
+	Environments []*EnvironmentBranch
+}
+
+// EnvironmentBranch is an environment in the tree.
+type EnvironmentBranch struct {
+	*environment.EnvironmentInfo
+	// Ahead is the number of commits of the environment that aren't in the current branch.
+	Ahead int
+}
+
+// Merged reports whether all the commits of the environment are in the current branch.
+func (b *EnvironmentBranch) Merged() bool {
+	return b.Ahead == 0
+}
+
+// Tree groups environments by the commit of the current branch they branched off.
+func (r *Repository) Tree(ctx context.Context) (*EnvironmentTree, error) {
+	branch, err := r.currentUserBranch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tree := &EnvironmentTree{Branch: strings.TrimSpace(branch)}
+	if tree.Branch == "" {
+		tree.Branch = "HEAD"
+	}
+
+	envs, err := r.List(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	bases := map[string]*EnvironmentBase{}
+	for _, envInfo := range envs {
+		mergeBase, err := r.mergeBase(ctx, envInfo)
+		if err != nil {
+			slog.Warn("Failed to find where environment branched off", "environment.id", envInfo.ID, "err", err)
+			// None of its commits are in the current branch
+			ahead, err := r.countCommits(ctx, fmt.Sprintf("%s/%s", containerUseRemote, envInfo.ID))
+			if err != nil {
+				return nil, err
+			}
+			tree.Unrelated = append(tree.Unrelated, &EnvironmentBranch{EnvironmentInfo: envInfo, Ahead: ahead})
+			continue
+		}
+
+		base, ok := bases[mergeBase]
+		if !ok {
+			base, err = r.environmentBase(ctx, tree.Branch, mergeBase)
+			if err != nil {
+				return nil, err
+			}
+			bases[mergeBase] = base
+			tree.Bases = append(tree.Bases, base)
+		}
+
+		ahead, err := r.countCommits(ctx, fmt.Sprintf("%s..%s/%s", mergeBase, containerUseRemote, envInfo.ID))
+		if err != nil {
+			return nil, err
+		}
+		base.Environments = append(base.Environments, &EnvironmentBranch{EnvironmentInfo: envInfo, Ahead: ahead})
+	}
+
+	slices.SortStableFunc(tree.Bases, func(a, b *EnvironmentBase) int {
+		return a.Behind - b.Behind
+	})
+	return tree, nil
+}
+
+func (r *Repository) environmentBase(ctx context.Context, branch, commit string) (*EnvironmentBase, error) {
+	behind, err := r.countCommits(ctx, fmt.Sprintf("%s..%s", commit, branch))
+	if err != nil {
+		return nil, err
+	}
+	subject, err := RunGitCommand(ctx, r.userRepoPath, "log", "-1", "--format=%s", commit)
+	if err != nil {
+		return nil, err
+	}
+	return &EnvironmentBase{
+		Commit:  commit,
+		Subject: strings.TrimSpace(subject),
+		Behind:  behind,
+	}, nil
+}
+
+func (r *Repository) countCommits(ctx context.Context, revisionRange string) (int, error) {
+	count, err := RunGitCommand(ctx, r.userRepoPath, "rev-list", "--count", revisionRange)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(count))
+}
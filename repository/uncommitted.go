@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// applyUncommittedChanges applies the uncommitted changes of the source repository, staged or not, to the worktree
+// and commits the result. Untracked files are copied along, unless they are ignored.
+// It does nothing if the source repository is clean.
+func (r *Repository) applyUncommittedChanges(ctx context.Context, worktreePath string, limits commitLimits) error {
+	// Without commits, the changes are the files added to the index, on top of the empty initial commit
+	base := "HEAD"
+	empty, err := r.IsEmpty(ctx)
+	if err != nil {
+		return err
+	}
+	if empty {
+		if base, err = r.emptyTree(ctx); err != nil {
+			return err
+		}
+	}
+
+	patch, err := RunGitCommand(ctx, r.userRepoPath, "diff", "--binary", base)
+	if err != nil {
+		return fmt.Errorf("failed to read uncommitted changes: %w", err)
+	}
+	if strings.TrimSpace(patch) != "" {
+		if err := applyPatch(ctx, worktreePath, patch); err != nil {
+			return fmt.Errorf("failed to apply uncommitted changes: %w", err)
+		}
+	}
+
+	untracked, err := RunGitCommand(ctx, r.userRepoPath, "ls-files", "-z", "--others", "--exclude-standard")
+	if err != nil {
+		return fmt.Errorf("failed to list untracked files: %w", err)
+	}
+	for file := range strings.SplitSeq(untracked, "\x00") {
+		// Nested repositories are listed as directories, their content isn't part of this repository
+		if file == "" || strings.HasSuffix(file, "/") {
+			continue
+		}
+		if err := copyUntrackedFile(filepath.Join(r.userRepoPath, file), filepath.Join(worktreePath, file)); err != nil {
+			return fmt.Errorf("failed to copy untracked file %s: %w", file, err)
+		}
+	}
+
+	warnings, err := r.commitWorktreeChanges(ctx, worktreePath, "Apply uncommitted changes", limits)
+	if err != nil {
+		return fmt.Errorf("failed to commit uncommitted changes: %w", err)
+	}
+	for _, warning := range warnings {
+		slog.Warn(warning, "source", r.userRepoPath)
+	}
+	return nil
+}
+
+// copyUntrackedFile copies a file, or a symlink as is, preserving its permissions.
+func copyUntrackedFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
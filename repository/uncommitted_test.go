@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyUncommittedChanges(t *testing.T) {
+	ctx := context.Background()
+	repoDir := initTestRepoWithoutCommits(t)
+	writeFile(t, repoDir, "main.go", "package main\n")
+	writeFile(t, repoDir, "README.md", "# Project\n")
+	writeFile(t, repoDir, ".gitignore", "*.log\n")
+	_, err := RunGitCommand(ctx, repoDir, "add", ".")
+	require.NoError(t, err)
+	_, err = RunGitCommand(ctx, repoDir, "commit", "-m", "Initial commit")
+	require.NoError(t, err)
+
+	repo, err := OpenWithBasePath(ctx, repoDir, t.TempDir())
+	require.NoError(t, err)
+	newWorktree := func(id string) string {
+		worktreePath, err := repo.initializeWorktree(ctx, id)
+		require.NoError(t, err)
+		for _, args := range [][]string{
+			{"config", "user.email", "test@example.com"},
+			{"config", "user.name", "Test User"},
+		} {
+			_, err := RunGitCommand(ctx, worktreePath, args...)
+			require.NoError(t, err)
+		}
+		return worktreePath
+	}
+	head := func(dir string) string {
+		out, err := RunGitCommand(ctx, dir, "rev-parse", "HEAD")
+		require.NoError(t, err)
+		return strings.TrimSpace(out)
+	}
+
+	// Nothing to apply in a clean repository
+	clean := newWorktree("clean-env")
+	initial := head(clean)
+	require.NoError(t, repo.applyUncommittedChanges(ctx, clean, commitLimits{}))
+	assert.Equal(t, initial, head(clean))
+
+	// Unstaged, staged and untracked changes, and an ignored file
+	writeFile(t, repoDir, "main.go", "package main\n\nfunc main() {}\n")
+	writeFile(t, repoDir, "README.md", "# Project\n\nWork in progress.\n")
+	_, err = RunGitCommand(ctx, repoDir, "add", "README.md")
+	require.NoError(t, err)
+	writeFile(t, repoDir, "pkg/feature.go", "package pkg\n")
+	writeFile(t, repoDir, "debug.log", "noise\n")
+	sourceStatus, err := RunGitCommand(ctx, repoDir, "status", "--porcelain")
+	require.NoError(t, err)
+
+	worktreePath := newWorktree("dirty-env")
+	require.NoError(t, repo.applyUncommittedChanges(ctx, worktreePath, commitLimits{}))
+
+	for file, expected := range map[string]string{
+		"main.go":        "package main\n\nfunc main() {}\n",
+		"README.md":      "# Project\n\nWork in progress.\n",
+		"pkg/feature.go": "package pkg\n",
+	} {
+		content, err := os.ReadFile(filepath.Join(worktreePath, file))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(content), file)
+	}
+	assert.NoFileExists(t, filepath.Join(worktreePath, "debug.log"))
+
+	// The changes are committed in the environment, and left alone in the source repository
+	status, err := RunGitCommand(ctx, worktreePath, "status", "--porcelain")
+	require.NoError(t, err)
+	assert.Empty(t, status)
+	subject, err := RunGitCommand(ctx, worktreePath, "log", "-1", "--format=%s")
+	require.NoError(t, err)
+	assert.Equal(t, "Apply uncommitted changes", strings.TrimSpace(subject))
+	newSourceStatus, err := RunGitCommand(ctx, repoDir, "status", "--porcelain")
+	require.NoError(t, err)
+	assert.Equal(t, sourceStatus, newSourceStatus)
+}